@@ -0,0 +1,142 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bufio"
+	"maps"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// acronymRe matches acronyms: two or more capitals and digits, starting with
+// a capital, optionally plural, e.g. LLMs or GPT4
+var acronymRe = regexp.MustCompile(`\b([A-Z][A-Z0-9]{1,7})(s)?\b`)
+
+// DefaultAcronyms are expanded on first mention unless replaced
+var DefaultAcronyms = map[string]string{
+	"AI":   "artificial intelligence",
+	"API":  "application programming interface",
+	"ASR":  "automatic speech recognition",
+	"BERT": "bidirectional encoder representations from transformers",
+	"CNN":  "convolutional neural network",
+	"CPU":  "central processing unit",
+	"GAN":  "generative adversarial network",
+	"GPU":  "graphics processing unit",
+	"HTTP": "hypertext transfer protocol",
+	"IoT":  "internet of things",
+	"LLM":  "large language model",
+	"LSTM": "long short-term memory",
+	"ML":   "machine learning",
+	"MLP":  "multilayer perceptron",
+	"NLP":  "natural language processing",
+	"OCR":  "optical character recognition",
+	"RAG":  "retrieval-augmented generation",
+	"RL":   "reinforcement learning",
+	"RLHF": "reinforcement learning from human feedback",
+	"RNN":  "recurrent neural network",
+	"SGD":  "stochastic gradient descent",
+	"SOTA": "state of the art",
+	"SQL":  "structured query language",
+	"STT":  "speech-to-text",
+	"TPU":  "tensor processing unit",
+	"TTS":  "text-to-speech",
+	"VAE":  "variational autoencoder",
+	"ViT":  "vision transformer",
+	"VLM":  "vision language model",
+}
+
+// ParseAcronyms reads acronyms and their expansions, one per line, e.g.
+// "WER=word error rate"; blank lines and lines starting with # are skipped
+func ParseAcronyms(text string) map[string]string {
+	acronyms := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		acronym, expansion, _ := strings.Cut(line, "=")
+		acronyms[strings.TrimSpace(acronym)] = strings.TrimSpace(expansion)
+	}
+	return acronyms
+}
+
+// ExpandAcronyms spells out acronyms on their first mention in a script, e.g.
+// "LLM, or large language model,", using DefaultAcronyms and the user's,
+// which take precedence; an empty expansion leaves an acronym alone. Acronyms
+// already spelled out before their first mention aren't expanded, and those
+// without an expansion are returned, to add to the user's list
+func ExpandAcronyms(script string, user map[string]string) (string, []string) {
+	dictionary := maps.Clone(DefaultAcronyms)
+	maps.Copy(dictionary, user)
+	pattern := acronymPattern(dictionary)
+
+	mentioned := map[string]bool{}
+	unknown := map[string]bool{}
+	var b strings.Builder
+	last := 0
+	for _, loc := range pattern.FindAllStringSubmatchIndex(script, -1) {
+		acronym, plural := script[loc[2]:loc[3]], loc[4] >= 0
+		// speaker labels, e.g. AGENT:, aren't acronyms
+		if mentioned[acronym] || strings.HasPrefix(script[loc[1]:], ":") {
+			continue
+		}
+		mentioned[acronym] = true
+		expansion, ok := dictionary[acronym]
+		if !ok {
+			unknown[acronym] = true
+			continue
+		}
+		if expansion == "" || strings.Contains(strings.ToLower(script[:loc[0]]), strings.ToLower(expansion)) {
+			continue
+		}
+		if plural {
+			expansion += "s"
+		}
+		b.WriteString(script[last:loc[1]])
+		b.WriteString(", or " + expansion)
+		// a comma closes the aside unless punctuation follows
+		if loc[1] == len(script) || !strings.ContainsRune(".,;:!?)\n", rune(script[loc[1]])) {
+			b.WriteString(",")
+		}
+		last = loc[1]
+	}
+	b.WriteString(script[last:])
+	expanded := b.String()
+
+	list := []string{}
+	for acronym := range unknown {
+		list = append(list, acronym)
+	}
+	sort.Strings(list)
+	return expanded, list
+}
+
+// acronymPattern matches capitalized acronyms and the dictionary's, e.g. IoT
+func acronymPattern(dictionary map[string]string) *regexp.Regexp {
+	mixed := []string{}
+	for acronym := range dictionary {
+		if strings.ToUpper(acronym) != acronym {
+			mixed = append(mixed, regexp.QuoteMeta(acronym))
+		}
+	}
+	if len(mixed) == 0 {
+		return acronymRe
+	}
+	sort.Slice(mixed, func(i, j int) bool { return len(mixed[i]) > len(mixed[j]) })
+	return regexp.MustCompile(`\b(` + strings.Join(mixed, "|") + `|[A-Z][A-Z0-9]{1,7})(s)?\b`)
+}
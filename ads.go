@@ -0,0 +1,231 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// where ad segments are placed
+const (
+	AdPreRoll  = "pre"
+	AdMidRoll  = "mid"
+	AdPostRoll = "post"
+)
+
+// DefaultAdVoice reads ad scripts, distinct from the default host and expert
+const DefaultAdVoice = "en-US-Chirp3-HD-Aoede"
+
+// AdSegment is a sponsor or ad read placed in an episode, either recorded
+// audio or a script synthesized in its own voice
+type AdSegment struct {
+	Name     string  `json:"name,omitempty"` // the chapter title, e.g. the sponsor
+	Position string  `json:"position"`       // AdPreRoll, AdMidRoll or AdPostRoll
+	At       float64 `json:"at,omitempty"`   // for mid-rolls, how far through the episode, default 0.5
+	Audio    string  `json:"audio,omitempty"`
+	Script   string  `json:"script,omitempty"`
+	Voice    string  `json:"voice,omitempty"` // for Script, default DefaultAdVoice
+}
+
+func (a AdSegment) withDefaults() AdSegment {
+	if a.Name == "" {
+		a.Name = "Sponsor"
+	}
+	if a.Position == AdMidRoll && a.At == 0 {
+		a.At = 0.5
+	}
+	if a.Script != "" && a.Voice == "" {
+		a.Voice = DefaultAdVoice
+	}
+	return a
+}
+
+// ValidateAds checks ad segments have a position and one of audio or a script
+func ValidateAds(ads []AdSegment) error {
+	for i, a := range ads {
+		switch a.Position {
+		case AdPreRoll, AdMidRoll, AdPostRoll:
+		default:
+			return fmt.Errorf("ad %d: unknown position %q, use pre, mid or post", i+1, a.Position)
+		}
+		if (a.Audio == "") == (a.Script == "") {
+			return fmt.Errorf("ad %d: use one of audio or script", i+1)
+		}
+		if a.At < 0 || a.At > 1 {
+			return fmt.Errorf("ad %d: at is a fraction of the episode, 0 to 1", i+1)
+		}
+	}
+	return nil
+}
+
+// ChaptersFile is where an episode's chapters are written, beside its audio
+func ChaptersFile(audiofile string) string {
+	return strings.TrimSuffix(audiofile, filepath.Ext(audiofile)) + ".chapters.json"
+}
+
+// episodeChapter titles the parts of the episode between ads
+const episodeChapter = "Episode"
+
+// placedAd is an ad's audio and the turn it goes before
+type placedAd struct {
+	name     string
+	file     string
+	before   int
+	duration time.Duration
+}
+
+// InsertAds places ad segments among an episode's wav turns before they're
+// combined, returning the files to combine and the episode's chapters, with
+// each ad as its own. Recorded ads are copied, since combining removes its
+// files, and turns, if given, are moved later by the ads placed before them
+func InsertAds(ctx context.Context, synth Synthesizer, audiofiles []string, ads []AdSegment, turns []TranscriptTurn) ([]string, []Chapter, error) {
+	if len(ads) == 0 || len(audiofiles) == 0 {
+		return audiofiles, nil, nil
+	}
+	if err := ValidateAds(ads); err != nil {
+		return nil, nil, err
+	}
+	for _, f := range audiofiles {
+		if !strings.EqualFold(filepath.Ext(f), "."+FormatWAV) {
+			return nil, nil, fmt.Errorf("ads need wav turns, %s isn't", filepath.Base(f))
+		}
+	}
+	durations, err := AudioDurations(audiofiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	// starts[i] is when turn i starts, starts[len] the episode's end
+	starts := make([]time.Duration, len(durations)+1)
+	for i, d := range durations {
+		starts[i+1] = starts[i] + d
+	}
+
+	base := strings.TrimSuffix(audiofiles[0], filepath.Ext(audiofiles[0]))
+	placed := make([]placedAd, len(ads))
+	for i, a := range ads {
+		a = a.withDefaults()
+		p := placedAd{name: a.Name, file: fmt.Sprintf("%s_ad%d.wav", base, i+1)}
+		if err := writeAd(ctx, synth, a, p.file); err != nil {
+			return nil, nil, fmt.Errorf("ad %d: %w", i+1, err)
+		}
+		d, err := AudioDurations([]string{p.file})
+		if err != nil {
+			return nil, nil, fmt.Errorf("ad %d: %w", i+1, err)
+		}
+		p.duration = d[0]
+		switch a.Position {
+		case AdPostRoll:
+			p.before = len(audiofiles)
+		case AdMidRoll:
+			p.before = nearestStart(starts, time.Duration(a.At*float64(starts[len(starts)-1])))
+		}
+		placed[i] = p
+		log.Printf("ad %q, %s-roll at %s", a.Name, a.Position, starts[p.before].Round(time.Second))
+	}
+
+	var files []string
+	var chapters []Chapter
+	var at time.Duration
+	inEpisode := false
+	for i := 0; i <= len(audiofiles); i++ {
+		for _, p := range placed {
+			if p.before != i {
+				continue
+			}
+			chapters = append(chapters, Chapter{Title: p.name, Start: at, End: at + p.duration})
+			files = append(files, p.file)
+			at += p.duration
+			inEpisode = false
+		}
+		if i == len(audiofiles) {
+			break
+		}
+		if !inEpisode {
+			chapters = append(chapters, Chapter{Title: episodeChapter, Start: at})
+			inEpisode = true
+		}
+		at += durations[i]
+		chapters[len(chapters)-1].End = at
+		files = append(files, audiofiles[i])
+	}
+
+	for i := range turns {
+		var offset time.Duration
+		for _, p := range placed {
+			// turns are timed from the same durations, within rounding
+			if turns[i].Start >= starts[p.before]-time.Millisecond {
+				offset += p.duration
+			}
+		}
+		turns[i].Start += offset
+		turns[i].End += offset
+	}
+	return files, chapters, nil
+}
+
+// nearestStart is the turn starting nearest to t, never the first so a
+// mid-roll follows some of the episode
+func nearestStart(starts []time.Duration, t time.Duration) int {
+	best := 1
+	for i := 1; i < len(starts); i++ {
+		if (starts[i] - t).Abs() < (starts[best] - t).Abs() {
+			best = i
+		}
+	}
+	return min(best, len(starts)-1)
+}
+
+// writeAd writes an ad's audio as wav, a copy of its recording or its
+// script synthesized; combining converts it to the episode's format
+func writeAd(ctx context.Context, synth Synthesizer, a AdSegment, filename string) error {
+	var audio Audio
+	if a.Audio != "" {
+		data, err := os.ReadFile(a.Audio)
+		if err != nil {
+			return err
+		}
+		audio = Audio{Data: data, Format: strings.TrimPrefix(strings.ToLower(filepath.Ext(a.Audio)), ".")}
+	} else {
+		if synth == nil {
+			return errors.New("no synthesizer for the ad script")
+		}
+		var err error
+		if audio, err = synth.Synthesize(ctx, a.Voice, "", a.Script); err != nil {
+			return fmt.Errorf("unable to synthesize: %w", err)
+		}
+	}
+	if audio.Format != FormatWAV {
+		return fmt.Errorf("the ad is %s, the episode is wav", audio.Format)
+	}
+	if _, err := decodeWav(audio.Data); err != nil {
+		return fmt.Errorf("can't decode the ad: %w", err)
+	}
+	return os.WriteFile(filename, audio.Data, 0644)
+}
+
+// ShiftChapters moves chapters later by offset
+func ShiftChapters(chapters []Chapter, offset time.Duration) {
+	for i := range chapters {
+		chapters[i].Start += offset
+		chapters[i].End += offset
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/moutend/go-wav"
+)
+
+// TranscriptWord is a word of a turn and when it's spoken in the episode
+type TranscriptWord struct {
+	Word  string
+	Start time.Duration
+	End   time.Duration
+}
+
+// MarshalJSON writes word times in seconds
+func (w TranscriptWord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Word  string  `json:"word"`
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+	}{w.Word, w.Start.Seconds(), w.End.Seconds()})
+}
+
+// UnmarshalJSON reads word times in seconds
+func (w *TranscriptWord) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Word  string  `json:"word"`
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*w = TranscriptWord{v.Word, seconds(v.Start), seconds(v.End)}
+	return nil
+}
+
+// AlignTranscript times each word of turns, already timed in audiofile, by
+// recognizing the audio with Speech-to-Text and aligning the words it hears
+// with the turns' text; words it misses are timed between their neighbors.
+// The language is the first voice's, or en-US, if empty
+func AlignTranscript(ctx context.Context, projectID, audiofile string, turns []TranscriptTurn, language string) error {
+	if language == "" {
+		language = "en-US"
+		if len(turns) > 0 {
+			if m := voiceLanguageRe.FindStringSubmatch(turns[0].Voice); m != nil {
+				language = m[1]
+			}
+		}
+	}
+	data, err := os.ReadFile(audiofile)
+	if err != nil {
+		return err
+	}
+	var w *wav.File
+	switch strings.ToLower(filepath.Ext(audiofile)) {
+	case ".wav":
+		w = &wav.File{}
+		if err := wav.Unmarshal(data, w); err != nil {
+			return fmt.Errorf("can't read %s: %w", audiofile, err)
+		}
+	case ".mp3":
+	default:
+		return fmt.Errorf("can't align %s files, use wav or mp3", filepath.Ext(audiofile))
+	}
+	start := time.Now()
+	recognized, err := recognizeWords(ctx, projectID, audiofile, data, w, language)
+	if err != nil {
+		return err
+	}
+
+	// each turn's words, and the normalized words of each for alignment
+	type owner struct{ turn, word int }
+	script, owners := []string{}, []owner{}
+	for i := range turns {
+		turns[i].Words = nil
+		for k, word := range strings.Fields(turns[i].Text) {
+			turns[i].Words = append(turns[i].Words, TranscriptWord{Word: word, Start: -1, End: -1})
+			for _, s := range normalizeWords(word) {
+				script, owners = append(script, s), append(owners, owner{i, k})
+			}
+		}
+	}
+	heard := make([]string, len(recognized))
+	for i, r := range recognized {
+		heard[i] = r.text
+	}
+	_, aligned := alignWords(script, heard)
+	found := 0
+	for i, j := range aligned {
+		if j < 0 {
+			continue
+		}
+		word := &turns[owners[i].turn].Words[owners[i].word]
+		if word.Start < 0 {
+			word.Start = recognized[j].start
+			found++
+		}
+		word.End = max(word.End, recognized[j].end)
+	}
+	for i := range turns {
+		interpolateWords(turns[i])
+	}
+	log.Printf("aligned %d of %d words in %s in %s", found, len(script), audiofile, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// interpolateWords times a turn's words that weren't recognized between
+// the recognized words around them, or the turn's start and end, by length
+func interpolateWords(t TranscriptTurn) {
+	words := t.Words
+	for i := 0; i < len(words); {
+		if words[i].Start >= 0 {
+			// words can't run into the next one or out of the turn
+			words[i].Start = max(words[i].Start, t.Start)
+			words[i].End = max(words[i].Start, min(words[i].End, t.End))
+			i++
+			continue
+		}
+		j := i
+		for j < len(words) && words[j].Start < 0 {
+			j++
+		}
+		from, to := t.Start, t.End
+		if i > 0 {
+			from = words[i-1].End
+		}
+		if j < len(words) {
+			to = max(from, min(to, words[j].Start))
+		}
+		chars := 0
+		for _, w := range words[i:j] {
+			chars += utf8.RuneCountInString(w.Word)
+		}
+		at := from
+		for k := i; k < j; k++ {
+			d := time.Duration(float64(to-from) * float64(utf8.RuneCountInString(words[k].Word)) / float64(max(1, chars)))
+			words[k].Start, words[k].End = at, at+d
+			at += d
+		}
+		i = j
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moutend/go-wav"
+)
+
+// CombineWavFiles appends wav files to a single one named for title, which may
+// include a directory, and removes the source files, even if it fails
+func CombineWavFiles(title string, audiolist []string) (string, error) {
+	outputfilename, _, err := MixWavFiles(title, audiolist, 0, AudioFormat{})
+	return outputfilename, err
+}
+
+// CombineAudioFiles combines wav or mp3 files, by their extension
+func CombineAudioFiles(title string, audiolist []string) (string, error) {
+	for _, audiofile := range audiolist {
+		if !strings.EqualFold(filepath.Ext(audiofile), filepath.Ext(audiolist[0])) {
+			return "", fmt.Errorf("can't combine %s with %s audio", filepath.Ext(audiofile), filepath.Ext(audiolist[0]))
+		}
+	}
+	if len(audiolist) > 0 && strings.EqualFold(filepath.Ext(audiolist[0]), "."+FormatMP3) {
+		return CombineMP3Files(title, audiolist)
+	}
+	return CombineWavFiles(title, audiolist)
+}
+
+// CombineMP3Files concatenates mp3 files, without their ID3 tags, to a single
+// one named for title and removes the source files, even if it fails
+func CombineMP3Files(title string, audiolist []string) (string, error) {
+	defer RemoveFiles(audiolist...)
+	if len(audiolist) == 0 {
+		return "", errors.New("no audio files to combine")
+	}
+	var output bytes.Buffer
+	for _, audiofile := range audiolist {
+		audiobytes, err := os.ReadFile(audiofile)
+		if err != nil {
+			return "", fmt.Errorf("can't read %s: %w", audiofile, err)
+		}
+		output.Write(stripID3(audiobytes))
+	}
+	log.Printf("%d mp3 files", len(audiolist))
+
+	outputfilename := fmt.Sprintf("%s_%s.mp3", title, time.Now().Format(timeformat))
+	if err := os.WriteFile(outputfilename, output.Bytes(), 0644); err != nil {
+		return "", err
+	}
+
+	return outputfilename, nil
+}
+
+// RemoveFiles removes temporary files, such as turns, logging those that
+// can't be removed; files already gone, or empty names, are skipped
+func RemoveFiles(files ...string) {
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("os.Remove: %v", err)
+		}
+	}
+}
+
+// stripID3 removes a leading ID3v2 tag and a trailing ID3v1 tag from mp3 data,
+// which players would otherwise find in the middle of concatenated files
+func stripID3(data []byte) []byte {
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		// the tag size is a 28-bit synchsafe integer, after a 10 byte header
+		size := unsynchsafe(data[6:10]) + 10
+		if data[5]&0x10 != 0 { // footer present
+			size += 10
+		}
+		if size > len(data) {
+			size = len(data)
+		}
+		data = data[size:]
+	}
+	if len(data) >= 128 && string(data[len(data)-128:len(data)-125]) == "TAG" {
+		data = data[:len(data)-128]
+	}
+	return data
+}
+
+// normalizeWavs converts wavs with different formats, e.g. from different
+// providers, to 16-bit audio at the highest sample rate and channel count
+func normalizeWavs(wavs []*wav.File) ([]*wav.File, error) {
+	rate, channels, mixed := 0, 0, false
+	for _, w := range wavs {
+		if w.SamplesPerSec() != wavs[0].SamplesPerSec() || w.BitsPerSample() != wavs[0].BitsPerSample() || w.Channels() != wavs[0].Channels() {
+			mixed = true
+		}
+		rate = max(rate, w.SamplesPerSec())
+		channels = max(channels, w.Channels())
+	}
+	if !mixed {
+		return wavs, nil
+	}
+	log.Printf("normalizing wav files to %d Hz, 16 bit, %d channel(s)", rate, channels)
+	normalized := make([]*wav.File, len(wavs))
+	for i, w := range wavs {
+		if w.SamplesPerSec() == rate && w.BitsPerSample() == 16 && w.Channels() == channels {
+			normalized[i] = w
+			continue
+		}
+		var err error
+		if normalized[i], err = convertWav(w, rate, channels); err != nil {
+			return nil, err
+		}
+	}
+	return normalized, nil
+}
+
+// convertWav resamples audio to 16-bit samples at rate, with linear
+// interpolation, and duplicates or averages channels
+func convertWav(w *wav.File, rate, channels int) (*wav.File, error) {
+	if w.BitsPerSample() != 8 && w.BitsPerSample() != 16 && w.BitsPerSample() != 24 && w.BitsPerSample() != 32 {
+		return nil, fmt.Errorf("unsupported %d bit audio", w.BitsPerSample())
+	}
+	// Int32s scales every sample size to 32 bits
+	samples := w.Int32s()
+	inChannels := w.Channels()
+	frames := len(samples) / inChannels
+	frame := func(i, c int) float64 {
+		if inChannels == channels {
+			return float64(samples[i*inChannels+c])
+		}
+		sum := 0.0
+		for ch := 0; ch < inChannels; ch++ {
+			sum += float64(samples[i*inChannels+ch])
+		}
+		return sum / float64(inChannels)
+	}
+
+	out, err := wav.New(rate, 16, channels)
+	if err != nil {
+		return nil, err
+	}
+	outFrames := int(int64(frames) * int64(rate) / int64(w.SamplesPerSec()))
+	data := make([]byte, 0, outFrames*channels*2)
+	step := float64(w.SamplesPerSec()) / float64(rate)
+	for i := 0; i < outFrames; i++ {
+		pos := float64(i) * step
+		j := int(pos)
+		frac := pos - float64(j)
+		for c := 0; c < channels; c++ {
+			v := frame(j, c)
+			if j+1 < frames {
+				v += frac * (frame(j+1, c) - v)
+			}
+			data = binary.LittleEndian.AppendUint16(data, uint16(int16(int32(v)>>16)))
+		}
+	}
+	if _, err := out.Write(data); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// mixPCM16 adds 16-bit little-endian samples from src, scaled by gain, into dst
+func mixPCM16(dst, src []byte, gain float64) {
+	for i := 0; i+1 < len(dst) && i+1 < len(src); i += 2 {
+		a := int16(binary.LittleEndian.Uint16(dst[i:]))
+		b := int16(binary.LittleEndian.Uint16(src[i:]))
+		mixed := float64(a) + gain*float64(b)
+		mixed = math.Max(math.MinInt16, math.Min(math.MaxInt16, mixed))
+		binary.LittleEndian.PutUint16(dst[i:], uint16(int16(mixed)))
+	}
+}
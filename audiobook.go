@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ErrNoFFmpeg is returned when packaging needs ffmpeg and it isn't installed
+var ErrNoFFmpeg = errors.New("ffmpeg not found, install it to create M4B audiobooks and videos")
+
+// AudiobookMetadata is written into an M4B audiobook
+type AudiobookMetadata struct {
+	Title    string
+	Author   string
+	Narrator string
+	Cover    string // optional JPEG or PNG cover image
+}
+
+// PackageM4B encodes wav audio as AAC in an M4B container, with chapters and
+// metadata, for audiobook players; it uses ffmpeg
+func PackageM4B(ctx context.Context, wavfile string, chapters []Chapter, meta AudiobookMetadata, outputfilename string) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return ErrNoFFmpeg
+	}
+
+	metafile, err := os.CreateTemp("", "fabulae-ffmetadata-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(metafile.Name())
+	if _, err := metafile.WriteString(ffmpegMetadata(chapters, meta)); err != nil {
+		metafile.Close()
+		return err
+	}
+	if err := metafile.Close(); err != nil {
+		return err
+	}
+
+	args := []string{"-y", "-loglevel", "error", "-i", wavfile, "-i", metafile.Name()}
+	maps := []string{"-map", "0:a", "-map_metadata", "1", "-map_chapters", "1"}
+	if meta.Cover != "" {
+		args = append(args, "-i", meta.Cover)
+		maps = append(maps, "-map", "2:v", "-c:v", "copy", "-disposition:v", "attached_pic")
+	}
+	args = append(args, maps...)
+	args = append(args, "-c:a", "aac", "-b:a", "64k", "-movflags", "+faststart", "-f", "mp4", outputfilename)
+
+	debugf(DebugRequests, "ffmpeg %s", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	log.Printf("audiobook written to %s, %d chapters", outputfilename, len(chapters))
+	return nil
+}
+
+// ffmpegMetadata creates an ffmpeg metadata file with chapters
+func ffmpegMetadata(chapters []Chapter, meta AudiobookMetadata) string {
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	tag := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, ffmpegEscape(value))
+		}
+	}
+	tag("title", meta.Title)
+	tag("album", meta.Title)
+	tag("artist", meta.Author)
+	tag("album_artist", meta.Author)
+	tag("composer", meta.Narrator) // audiobook players show the composer as the narrator
+	tag("genre", "Audiobook")
+	for _, c := range chapters {
+		b.WriteString("[CHAPTER]\nTIMEBASE=1/1000\n")
+		fmt.Fprintf(&b, "START=%d\nEND=%d\n", c.Start.Milliseconds(), c.End.Milliseconds())
+		tag("title", c.Title)
+	}
+	return b.String()
+}
+
+// ffmpegEscape escapes the characters special to ffmpeg metadata files
+func ffmpegEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n").Replace(s)
+}
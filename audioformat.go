@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sample rates Text-to-Speech can synthesize at
+const (
+	MinSampleRate = 8000
+	MaxSampleRate = 48000
+)
+
+// AudioFormat is the sample rate and channel count episodes are made in,
+// rather than whatever each voice returns; zero fields keep the voices'
+type AudioFormat struct {
+	SampleRate int
+	Channels   int
+}
+
+// Validate checks the sample rate is one Text-to-Speech supports and the
+// audio is mono or stereo
+func (f AudioFormat) Validate() error {
+	if f.SampleRate != 0 && (f.SampleRate < MinSampleRate || f.SampleRate > MaxSampleRate) {
+		return fmt.Errorf("sample rate %d is outside %d to %d Hz", f.SampleRate, MinSampleRate, MaxSampleRate)
+	}
+	if f.Channels < 0 || f.Channels > 2 {
+		return fmt.Errorf("%d channels, use 1 for mono or 2 for stereo", f.Channels)
+	}
+	return nil
+}
+
+// ParseChannels returns the channel count for mono or stereo, or 0 for the
+// voices' own if s is empty
+func ParseChannels(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, nil
+	case "mono":
+		return 1, nil
+	case "stereo":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown channels %q, use mono or stereo", s)
+}
+
+// apply sets p's rate and channels to those of the format that are set, as
+// 16-bit audio if either changes
+func (f AudioFormat) apply(p pcmAudio) pcmAudio {
+	q := p
+	if f.SampleRate != 0 {
+		q.rate = f.SampleRate
+	}
+	if f.Channels != 0 {
+		q.channels = f.Channels
+	}
+	if !q.sameFormat(p) {
+		q.bits = 16
+	}
+	return q
+}
+
+type audioFormatKey struct{}
+
+// WithAudioFormat returns a context whose episodes are made in a format:
+// Cloud TTS voices synthesize at its sample rate, and turns from any
+// provider are streamed together in its rate and channels
+func WithAudioFormat(ctx context.Context, f AudioFormat) context.Context {
+	return context.WithValue(ctx, audioFormatKey{}, f)
+}
+
+// audioFormatOf is the context's format, zero for the voices' own
+func audioFormatOf(ctx context.Context) AudioFormat {
+	f, _ := ctx.Value(audioFormatKey{}).(AudioFormat)
+	return f
+}
+
+// ConvertEpisode rewrites a wav episode in a format, keeping its tags
+func ConvertEpisode(audiofile string, f AudioFormat) error {
+	p, err := readPCM(audiofile)
+	if err != nil {
+		return err
+	}
+	q := f.apply(pcmAudio{rate: p.rate, bits: p.bits, channels: p.channels})
+	if q.sameFormat(p) {
+		return nil
+	}
+	tags, err := ReadTags(audiofile)
+	if err != nil {
+		return err
+	}
+	w, err := readWav16(audiofile, q.rate, q.channels)
+	if err != nil {
+		return err
+	}
+	data := pcmAudio{q.rate, 16, q.channels, w.Bytes()}.encode()
+	if tags != (Tags{}) {
+		if data, err = wavWithInfo(data, tags); err != nil {
+			return err
+		}
+	}
+	log.Printf("%s converted to %d Hz, %d channel(s)", filepath.Base(audiofile), q.rate, q.channels)
+	return os.WriteFile(audiofile, data, 0644)
+}
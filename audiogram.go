@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// default audiogram size, square for social feeds
+const (
+	DefaultAudiogramWidth  = 1080
+	DefaultAudiogramHeight = 1080
+)
+
+// AudiogramOptions configures RenderAudiogram, zero values use the defaults
+type AudiogramOptions struct {
+	Cover    string // still image behind the waveform, JPEG or PNG; default a plain background
+	Captions string // SRT file burned in, e.g. the episode's or ClipTranscript's
+	Width    int    // default DefaultAudiogramWidth
+	Height   int    // default DefaultAudiogramHeight
+}
+
+func (o AudiogramOptions) withDefaults() AudiogramOptions {
+	if o.Width <= 0 {
+		o.Width = DefaultAudiogramWidth
+	}
+	if o.Height <= 0 {
+		o.Height = DefaultAudiogramHeight
+	}
+	// H.264 needs even dimensions
+	o.Width, o.Height = o.Width&^1, o.Height&^1
+	return o
+}
+
+// AudiogramFile is the audiogram rendered for an audio file, e.g.
+// episode.audiogram.mp4
+func AudiogramFile(audiofile string) string {
+	return strings.TrimSuffix(VideoFile(audiofile), ".mp4") + ".audiogram.mp4"
+}
+
+// RenderAudiogram renders audio as an H.264 MP4 for social media: the cover
+// art with the audio's waveform animated over it and the captions burned
+// in; it uses ffmpeg
+func RenderAudiogram(ctx context.Context, audiofile string, opts AudiogramOptions, outputfilename string) error {
+	opts = opts.withDefaults()
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return ErrNoFFmpeg
+	}
+	w, h := opts.Width, opts.Height
+	args := []string{"-y", "-loglevel", "error"}
+	if opts.Cover != "" {
+		args = append(args, "-loop", "1", "-framerate", "25", "-i", opts.Cover)
+	} else {
+		args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("color=c=%s:s=%dx%d:r=25", ffmpegColor(waveformBackground.R, waveformBackground.G, waveformBackground.B), w, h))
+	}
+	args = append(args, "-i", audiofile)
+
+	waved := "[v]"
+	if opts.Captions != "" {
+		waved = "[waved]"
+	}
+	filters := []string{
+		fmt.Sprintf("[0:v]scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,setsar=1[bg]", w, h, w, h),
+		fmt.Sprintf("[1:a]showwaves=s=%dx%d:mode=cline:rate=25:colors=%s[wave]", w, h/4, ffmpegColor(waveformBars.R, waveformBars.G, waveformBars.B)),
+		fmt.Sprintf("[bg][wave]overlay=0:%d%s", h*3/8, waved),
+	}
+	if opts.Captions != "" {
+		// captions below the waveform, sized to the video
+		filters = append(filters, fmt.Sprintf("[waved]subtitles=filename=%s:original_size=%dx%d:force_style='Fontsize=%d,Alignment=2,MarginV=%d,Outline=1'[v]",
+			ffmpegFilterValue(opts.Captions), w, h, max(12, h/30), h/12))
+	}
+	args = append(args, "-filter_complex", strings.Join(filters, ";"),
+		"-map", "[v]", "-map", "1:a",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "192k", "-shortest", "-movflags", "+faststart", outputfilename)
+
+	debugf(DebugRequests, "ffmpeg %s", strings.Join(args, " "))
+	start := time.Now()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	log.Printf("audiogram written to %s in %s", outputfilename, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// ffmpegColor is an ffmpeg color, e.g. 0x1d2333
+func ffmpegColor(r, g, b uint8) string {
+	return fmt.Sprintf("0x%02x%02x%02x", r, g, b)
+}
+
+// ffmpegFilterValue escapes a file name as an ffmpeg filter option value,
+// once for the option and again for the filter graph
+func ffmpegFilterValue(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(s)
+}
+
+// ClipTranscript is a clip's transcript, timed from the start of the clip,
+// for its captions
+func ClipTranscript(turns []TranscriptTurn, clip Clip) []TranscriptTurn {
+	start, end := seconds(clip.Start), seconds(clip.End)
+	t := TranscriptTurn{Speaker: clip.Speaker, Text: clip.Text, End: end - start}
+	if clip.Turn > 0 && clip.Turn <= len(turns) {
+		t.Voice = turns[clip.Turn-1].Voice
+		for _, w := range turns[clip.Turn-1].Words {
+			if w.Start >= start && w.End <= end {
+				t.Words = append(t.Words, TranscriptWord{w.Word, w.Start - start, w.End - start})
+			}
+		}
+		// only a clip's whole words time its captions
+		if len(t.Words) != len(strings.Fields(t.Text)) {
+			t.Words = nil
+		}
+	}
+	return []TranscriptTurn{t}
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAzureFormat is 24kHz 16-bit mono wav, like Cloud Text-to-Speech
+	DefaultAzureFormat = "riff-24khz-16bit-mono-pcm"
+	azureParallelism   = 4
+)
+
+// azureStyles maps turn style directives to Azure speaking styles; other
+// known styles use SSML prosody
+var azureStyles = map[string]string{
+	"excited":    "excited",
+	"happy":      "cheerful",
+	"laughing":   "cheerful",
+	"whispering": "whispering",
+	"calm":       "calm",
+	"sad":        "sad",
+	"serious":    "serious",
+	"surprised":  "excited",
+	"shouting":   "shouting",
+}
+
+// AzureVoice is an Azure neural voice and a speaking style for a speaker
+type AzureVoice struct {
+	Name        string  `json:"name"`                  // e.g. en-US-JennyNeural
+	Style       string  `json:"style,omitempty"`       // default style, e.g. chat or newscast
+	StyleDegree float64 `json:"styledegree,omitempty"` // 0.01 to 2, style intensity
+	Role        string  `json:"role,omitempty"`        // role-play, e.g. YoungAdultFemale
+	Language    string  `json:"language,omitempty"`    // defaults to the name's locale
+}
+
+// Azure synthesizes with Azure AI Speech neural voices, as wav
+type Azure struct {
+	Key          string
+	Region       string // e.g. eastus
+	Endpoint     string // overrides the region's endpoint
+	OutputFormat string
+	// Voices maps voice names used in fabulae to Azure voices; other names
+	// are Azure voice names, optionally with a style, e.g. en-US-JennyNeural:chat
+	Voices      map[string]AzureVoice
+	Concurrency int
+	Client      *http.Client
+}
+
+// NewAzure returns an Azure synthesizer for a Speech resource's key and region
+func NewAzure(key, region string) *Azure {
+	return &Azure{
+		Key:          key,
+		Region:       region,
+		OutputFormat: DefaultAzureFormat,
+		Voices:       map[string]AzureVoice{},
+		Concurrency:  azureParallelism,
+		Client:       &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// newAzureFromEnv configures Azure from AZURE_SPEECH_KEY, AZURE_SPEECH_REGION
+// and the optional AZURE_SPEECH_ENDPOINT, AZURE_SPEECH_VOICES (a JSON object
+// of name to voice) and AZURE_SPEECH_CONCURRENCY
+func newAzureFromEnv() (Synthesizer, error) {
+	key, err := SecretEnv(context.Background(), "AZURE_SPEECH_KEY")
+	if err != nil {
+		return nil, err
+	}
+	region := os.Getenv("AZURE_SPEECH_REGION")
+	endpoint := os.Getenv("AZURE_SPEECH_ENDPOINT")
+	if key == "" || (region == "" && endpoint == "") {
+		return nil, errors.New("AZURE_SPEECH_KEY and AZURE_SPEECH_REGION are required for the azure provider")
+	}
+	a := NewAzure(key, region)
+	a.Endpoint = endpoint
+	if voices := os.Getenv("AZURE_SPEECH_VOICES"); voices != "" {
+		if err := json.Unmarshal([]byte(voices), &a.Voices); err != nil {
+			return nil, fmt.Errorf("invalid AZURE_SPEECH_VOICES: %w", err)
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv("AZURE_SPEECH_CONCURRENCY")); err == nil && n > 0 {
+		a.Concurrency = n
+	}
+	return a, nil
+}
+
+// Parallelism is the number of concurrent requests
+func (a *Azure) Parallelism() int {
+	return a.Concurrency
+}
+
+// voice returns the Azure voice for a name
+func (a *Azure) voice(name string) AzureVoice {
+	if v, ok := a.Voices[name]; ok {
+		return v
+	}
+	voicename, style, _ := strings.Cut(name, ":")
+	return AzureVoice{Name: voicename, Style: style}
+}
+
+// Synthesize returns wav audio; a turn's style directive replaces the
+// speaker's style
+func (a *Azure) Synthesize(ctx context.Context, voice, style, text string) (Audio, error) {
+	ssml := azureSSML(a.voice(voice), style, text)
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.tts.speech.microsoft.com/cognitiveservices/v1", a.Region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(ssml))
+	if err != nil {
+		return Audio{}, err
+	}
+	req.Header.Set("Ocp-Apim-Subscription-Key", a.Key)
+	req.Header.Set("Content-Type", "application/ssml+xml")
+	req.Header.Set("X-Microsoft-OutputFormat", a.OutputFormat)
+	req.Header.Set("User-Agent", "fabulae")
+
+	debugf(DebugRequests, "azure: voice %s, %d characters", voice, len(text))
+	debugf(DebugPayloads, "azure: ssml: %s", ssml)
+	start := time.Now()
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return Audio{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return Audio{}, fmt.Errorf("azure: %s: %s", res.Status, bytes.TrimSpace(detail))
+	}
+	audiobytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return Audio{}, err
+	}
+	debugf(DebugRequests, "azure: voice %s, %d bytes in %s", voice, len(audiobytes), time.Since(start))
+	return Audio{audiobytes, FormatWAV}, nil
+}
+
+// azureSSML creates SSML for a turn, with the Azure style for the turn's
+// style directive or the speaker's style, and prosody for other known styles
+func azureSSML(voice AzureVoice, style, text string) string {
+	expressAs := voice.Style
+	prosodyStyle := ""
+	if s, ok := azureStyles[style]; ok {
+		expressAs = s
+	} else {
+		prosodyStyle = style
+	}
+	content, _ := turnSSML(prosodyStyle, text)
+	if expressAs != "" || voice.Role != "" {
+		attrs := []string{}
+		if expressAs != "" {
+			attrs = append(attrs, fmt.Sprintf("style=%q", escapeSSML(expressAs)))
+		}
+		if voice.StyleDegree > 0 {
+			attrs = append(attrs, fmt.Sprintf(`styledegree="%.2f"`, voice.StyleDegree))
+		}
+		if voice.Role != "" {
+			attrs = append(attrs, fmt.Sprintf("role=%q", escapeSSML(voice.Role)))
+		}
+		content = fmt.Sprintf("<mstts:express-as %s>%s</mstts:express-as>", strings.Join(attrs, " "), content)
+	}
+
+	language := voice.Language
+	if language == "" {
+		// the locale prefix of the voice name, e.g. en-US
+		parts := strings.SplitN(voice.Name, "-", 3)
+		language = "en-US"
+		if len(parts) == 3 {
+			language = parts[0] + "-" + parts[1]
+		}
+	}
+	return fmt.Sprintf(`<speak version="1.0" xmlns="http://www.w3.org/2001/10/synthesis" xmlns:mstts="https://www.w3.org/2001/mstts" xml:lang=%q><voice name=%q>%s</voice></speak>`,
+		escapeSSML(language), escapeSSML(voice.Name), content)
+}
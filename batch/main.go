@@ -0,0 +1,353 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// batch is a Cloud Run Jobs entrypoint that creates podcasts for a list of
+// sources stored in Cloud Storage
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghchinoy/fabulae"
+	"github.com/ghchinoy/fabulae/config"
+)
+
+// exit codes
+const (
+	exitOK          = 0
+	exitSomeFailed  = 1
+	exitConfigError = 2
+)
+
+var (
+	projectID   string
+	location    string
+	modelName   string
+	voice1name  string
+	voice2name  string
+	outputPath  string // bucket/path for generated audio
+	parallelism int
+	taskIndex   int
+	taskCount   int
+)
+
+// result is the outcome for a single source
+type result struct {
+	Source   string `json:"source"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// report is written to Cloud Storage when the task finishes
+type report struct {
+	Sources   string    `json:"sources"`
+	TaskIndex int       `json:"task_index"`
+	TaskCount int       `json:"task_count"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+	Results   []result  `json:"results"`
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	ctx := context.Background()
+
+	sources := os.Getenv("BATCH_SOURCES")
+	if !fabulae.IsGCSURI(sources) {
+		log.Print("missing BATCH_SOURCES, gs:// URI of a file with one source per line")
+		return exitConfigError
+	}
+	// the project, region, bucket and model, from an optional config file,
+	// the environment and flags
+	configPath := flag.String("config", os.Getenv("FABULAE_CONFIG"), "JSON config file with project_id, region, bucket and model, or env FABULAE_CONFIG")
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	settings, err := config.Load(*configPath)
+	if err != nil {
+		log.Printf("config: %v", err)
+		return exitConfigError
+	}
+	settings.Flags(flag.CommandLine)
+	if err := settings.Validate("project", "bucket"); err != nil {
+		log.Print(err)
+		return exitConfigError
+	}
+	projectID, location, outputPath, modelName = settings.ProjectID, settings.Region, settings.Bucket, settings.Model
+	voice1name = envCheck("VOICE1", "en-US-Chirp3-HD-Charon")
+	voice2name = envCheck("VOICE2", "en-US-Chirp3-HD-Kore")
+	if v := os.Getenv("CUSTOM_VOICES"); v != "" {
+		if err := fabulae.RegisterCustomVoicesJSON([]byte(v)); err != nil {
+			log.Print(err)
+			return exitConfigError
+		}
+	}
+	parallelism = envInt("BATCH_PARALLELISM", 2)
+	// set by Cloud Run Jobs, each task processes its share of the sources
+	taskIndex = envInt("CLOUD_RUN_TASK_INDEX", 0)
+	taskCount = envInt("CLOUD_RUN_TASK_COUNT", 1)
+	if parallelism < 1 || taskCount < 1 || taskIndex < 0 || taskIndex >= taskCount {
+		log.Printf("invalid parallelism %d or task %d of %d", parallelism, taskIndex, taskCount)
+		return exitConfigError
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Printf("unable to create storage client: %v", err)
+		return exitConfigError
+	}
+	defer client.Close()
+
+	list, err := readSources(ctx, client, sources)
+	if err != nil {
+		log.Printf("unable to read %s: %v", sources, err)
+		return exitConfigError
+	}
+	mine := []string{}
+	for i, source := range list {
+		if i%taskCount == taskIndex {
+			mine = append(mine, source)
+		}
+	}
+	log.Printf("task %d of %d: %d of %d sources, %d at a time", taskIndex, taskCount, len(mine), len(list), parallelism)
+
+	rep := report{
+		Sources:   sources,
+		TaskIndex: taskIndex,
+		TaskCount: taskCount,
+		Started:   time.Now().UTC(),
+		Results:   make([]result, len(mine)),
+	}
+
+	// bounded parallelism
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, parallelism)
+	for i, source := range mine {
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			rep.Results[i] = process(ctx, client, source)
+		}(i, source)
+	}
+	wg.Wait()
+
+	rep.Finished = time.Now().UTC()
+	for _, r := range rep.Results {
+		if r.Status == "done" {
+			rep.Succeeded++
+		} else {
+			rep.Failed++
+		}
+	}
+	reportURI, err := writeReport(ctx, client, rep)
+	if err != nil {
+		log.Printf("unable to write report: %v", err)
+		return exitSomeFailed
+	}
+	log.Printf("%d succeeded, %d failed, report at %s", rep.Succeeded, rep.Failed, reportURI)
+
+	if rep.Failed > 0 {
+		return exitSomeFailed
+	}
+	return exitOK
+}
+
+// readSources reads a list of sources, one per line; blank lines and lines
+// starting with # are ignored
+func readSources(ctx context.Context, client *storage.Client, uri string) ([]string, error) {
+	bucketName, objectName, _ := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	rc, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	sources := []string{}
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sources = append(sources, line)
+	}
+	return sources, scanner.Err()
+}
+
+// process creates a podcast for one source and uploads it
+func process(ctx context.Context, client *storage.Client, source string) result {
+	start := time.Now()
+	res := result{Source: source, Status: "failed"}
+
+	fail := func(err error) result {
+		log.Printf("%s: %v", source, err)
+		res.Error = err.Error()
+		res.Duration = time.Since(start).Round(time.Second).String()
+		return res
+	}
+
+	if err := fabulae.ValidateSourceURI(source); err != nil {
+		return fail(err)
+	}
+
+	// each source works in its own directory so turn files don't collide
+	dir, err := os.MkdirTemp("", "fabulae-batch-*")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// http(s) documents are retrieved first, gs:// and Drive sources are read in place
+	document := source
+	if _, ok := fabulae.DriveFileID(source); !ok && !fabulae.IsGCSURI(source) {
+		localpdf := filepath.Join(dir, "source.pdf")
+		f, err := os.Create(localpdf)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = fabulae.FetchPDF(ctx, source, f, fabulae.FetchOptions{})
+		f.Close()
+		if err != nil {
+			return fail(err)
+		}
+		document = "file://" + localpdf
+	}
+
+	conversation, err := fabulae.GenerateConversation(ctx, projectID, location, modelName, document, "")
+	if err != nil {
+		return fail(err)
+	}
+
+	name := sourceName(source)
+	audiofiles, err := fabulae.Fabulae(voice1name, voice2name, conversation, filepath.Join(dir, name+".wav"), true, "")
+	if err != nil {
+		return fail(err)
+	}
+	combined, err := fabulae.CombineWavFiles(filepath.Join(dir, "podcast-"+name), audiofiles)
+	if err != nil {
+		return fail(err)
+	}
+
+	uri, err := upload(ctx, client, combined)
+	if err != nil {
+		return fail(err)
+	}
+	log.Printf("%s: %s", source, uri)
+
+	res.Status = "done"
+	res.Output = uri
+	res.Duration = time.Since(start).Round(time.Second).String()
+	return res
+}
+
+// sourceName creates a short file-safe name from a source
+func sourceName(source string) string {
+	base := strings.TrimSuffix(path.Base(strings.Split(source, "?")[0]), ".pdf")
+	base = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return -1
+	}, base)
+	if base == "" {
+		base = "source"
+	}
+	return base
+}
+
+// objectPath returns the bucket and object for name under GCS_AUDIO_BUCKET
+func objectPath(name string) (string, string) {
+	bucketName, prefix, _ := strings.Cut(outputPath, "/")
+	if prefix == "" {
+		return bucketName, name
+	}
+	return bucketName, fmt.Sprintf("%s/%s", strings.TrimSuffix(prefix, "/"), name)
+}
+
+// upload copies a file to the output bucket, returning its gs:// URI
+func upload(ctx context.Context, client *storage.Client, filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	bucketName, objectName := objectPath(filepath.Base(filename))
+	wc := client.Bucket(bucketName).Object(objectName).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if _, err := io.Copy(wc, f); err != nil {
+		wc.Close()
+		return "", fmt.Errorf("io.Copy: %w", err)
+	}
+	if err := wc.Close(); err != nil {
+		return "", fmt.Errorf("Writer.Close: %w", err)
+	}
+	return fmt.Sprintf("gs://%s/%s", bucketName, objectName), nil
+}
+
+// writeReport writes the report next to the generated audio
+func writeReport(ctx context.Context, client *storage.Client, rep report) (string, error) {
+	bucketName, objectName := objectPath(fmt.Sprintf("reports/batch_%s_task%d.json", rep.Started.Format("20060102T150405"), rep.TaskIndex))
+	wc := client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
+	wc.ContentType = "application/json"
+	enc := json.NewEncoder(wc)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		wc.Close()
+		return "", err
+	}
+	if err := wc.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s", bucketName, objectName), nil
+}
+
+// envCheck checks for an environment variable, otherwise returns default
+func envCheck(environmentVariable, defaultVar string) string {
+	if envar, ok := os.LookupEnv(environmentVariable); !ok || envar == "" {
+		return defaultVar
+	} else {
+		return envar
+	}
+}
+
+// envInt returns an integer environment variable, otherwise the default
+func envInt(environmentVariable string, defaultVar int) int {
+	v, err := strconv.Atoi(envCheck(environmentVariable, ""))
+	if err != nil {
+		return defaultVar
+	}
+	return v
+}
@@ -0,0 +1,304 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchmark defaults
+const (
+	DefaultBenchTurns   = 24
+	DefaultBenchRuns    = 3
+	DefaultBenchLatency = 100 * time.Millisecond
+)
+
+// benchRate is the sample rate of FakeSynthesizer's audio, Chirp 3 HD's
+const benchRate = 24000
+
+// benchScript is the fixed script benchmarks synthesize, repeated for as
+// many turns as they ask for
+var benchScript = []string{
+	"Welcome back to the show. Today we're looking at how long it takes to turn a paper into an episode.",
+	"Which sounds simple, until you count the steps: a script, a voice for every turn, and then the mixing.",
+	"Right, and every turn is its own request, so they're synthesized side by side rather than one after another.",
+	"So the slowest turn sets the pace, and the combining can't start until the last one is back?",
+	"Unless the turns are streamed into the episode as they arrive, which is what keeps long episodes off the disk.",
+	"[excited] And then there's mastering, the high-pass, the de-esser and the compressor, over the whole thing.",
+}
+
+// BenchOptions is a benchmark's workload: the fixed script synthesized by a
+// provider, or by FakeSynthesizer, then combined, streamed and mastered
+type BenchOptions struct {
+	Synth       Synthesizer // nil for a FakeSynthesizer with Latency
+	Voice1      string
+	Voice2      string
+	Turns       int           // turns of the script, default DefaultBenchTurns
+	Runs        int           // times each phase runs, default DefaultBenchRuns
+	Parallelism int           // concurrent synthesis requests, 0 for the provider's
+	Latency     time.Duration // FakeSynthesizer's per-request latency
+	Dir         string        // for the turns and episodes, default a temporary folder
+}
+
+func (o BenchOptions) withDefaults() BenchOptions {
+	if o.Synth == nil {
+		o.Synth = FakeSynthesizer{Latency: o.Latency}
+		if o.Voice1 == "" {
+			o.Voice1, o.Voice2 = "fake-1", "fake-2"
+		}
+	}
+	if o.Turns <= 0 {
+		o.Turns = DefaultBenchTurns
+	}
+	if o.Runs <= 0 {
+		o.Runs = DefaultBenchRuns
+	}
+	return o
+}
+
+// BenchReport is how long each phase of a benchmark took
+type BenchReport struct {
+	Turns        int          `json:"turns"`
+	Characters   int          `json:"characters"`
+	AudioSeconds float64      `json:"audio_seconds"`
+	Parallelism  int          `json:"parallelism"`
+	Runs         int          `json:"runs"`
+	Phases       []BenchPhase `json:"phases"`
+	Requests     BenchLatency `json:"requests"` // each synthesis request, over every run
+}
+
+// BenchPhase is a phase's latency over the runs, and its throughput at the
+// median
+type BenchPhase struct {
+	Name       string  `json:"name"`
+	Min        float64 `json:"min_seconds"`
+	Median     float64 `json:"median_seconds"`
+	Max        float64 `json:"max_seconds"`
+	Throughput float64 `json:"throughput"`
+	Unit       string  `json:"unit"` // of the throughput, e.g. turns/s
+}
+
+// BenchLatency is the spread of many latencies
+type BenchLatency struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_seconds"`
+	P95   float64 `json:"p95_seconds"`
+	P99   float64 `json:"p99_seconds"`
+	Max   float64 `json:"max_seconds"`
+}
+
+// FakeSynthesizer speaks any text as a harmonic tone, as long as the text
+// would take to say, after Latency; it stands in for a provider in
+// benchmarks, so they measure fabulae rather than the network
+type FakeSynthesizer struct {
+	Latency time.Duration
+}
+
+// Synthesize returns 16-bit mono wav audio
+func (f FakeSynthesizer) Synthesize(ctx context.Context, voice, style, text string) (Audio, error) {
+	select {
+	case <-time.After(f.Latency):
+	case <-ctx.Done():
+		return Audio{}, ctx.Err()
+	}
+	words := max(1, len(strings.Fields(text)))
+	frames := words * benchRate * 60 / wordsPerMinute
+	// a voice's pitch from its name, with harmonics and a syllable rate
+	// envelope so the audio passes turn checks
+	pitch := 110.0
+	if strings.HasSuffix(voice, "2") {
+		pitch = 196
+	}
+	data := make([]byte, frames*2)
+	for i := 0; i < frames; i++ {
+		t := float64(i) / benchRate
+		v := 0.0
+		for h := 1.0; h <= 4; h++ {
+			v += math.Sin(2*math.Pi*pitch*h*t) / h
+		}
+		v *= 0.25 * (0.6 + 0.4*math.Sin(2*math.Pi*4*t))
+		s := int16(v * math.MaxInt16)
+		data[i*2], data[i*2+1] = byte(s), byte(s>>8)
+	}
+	return Audio{pcmAudio{benchRate, 16, 1, data}.encode(), FormatWAV}, nil
+}
+
+// timedSynthesizer records how long each synthesis request takes
+type timedSynthesizer struct {
+	Synthesizer
+	parallelism int
+	mu          sync.Mutex
+	latencies   []time.Duration
+}
+
+func (t *timedSynthesizer) Synthesize(ctx context.Context, voice, style, text string) (Audio, error) {
+	start := time.Now()
+	audio, err := t.Synthesizer.Synthesize(ctx, voice, style, text)
+	t.mu.Lock()
+	t.latencies = append(t.latencies, time.Since(start))
+	t.mu.Unlock()
+	return audio, err
+}
+
+func (t *timedSynthesizer) Parallelism() int {
+	return t.parallelism
+}
+
+// Bench runs a synthetic workload and reports each phase's latency and
+// throughput: synthesizing the turns, combining them into an episode,
+// streaming them into one as they're synthesized, and mastering it
+func Bench(ctx context.Context, opts BenchOptions) (BenchReport, error) {
+	opts = opts.withDefaults()
+	dir := opts.Dir
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "fabulae-bench"); err != nil {
+			return BenchReport{}, err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	lines := make([]string, opts.Turns)
+	report := BenchReport{Turns: opts.Turns, Runs: opts.Runs}
+	for i := range lines {
+		lines[i] = benchScript[i%len(benchScript)]
+		_, text := parseStyle(lines[i])
+		report.Characters += len(text)
+	}
+	script := strings.Join(lines, "\n")
+
+	synth := &timedSynthesizer{Synthesizer: opts.Synth, parallelism: opts.Parallelism}
+	if synth.parallelism <= 0 {
+		synth.parallelism = defaultSynthesisParallelism
+		if p, ok := opts.Synth.(parallelSynthesizer); ok && p.Parallelism() > 0 {
+			synth.parallelism = p.Parallelism()
+		}
+	}
+	report.Parallelism = synth.parallelism
+
+	var synthesize, combine, stream, master []time.Duration
+	for run := 0; run < opts.Runs; run++ {
+		start := time.Now()
+		files, err := SynthesizeConversation(ctx, synth, opts.Voice1, opts.Voice2, script, filepath.Join(dir, "bench.wav"), "")
+		if err != nil {
+			return report, fmt.Errorf("synthesizing: %w", err)
+		}
+		synthesize = append(synthesize, time.Since(start))
+
+		start = time.Now()
+		episode, _, err := MixWavFiles(filepath.Join(dir, "bench"), files, 0, AudioFormat{})
+		RemoveFiles(files...)
+		if err != nil {
+			return report, fmt.Errorf("combining: %w", err)
+		}
+		combine = append(combine, time.Since(start))
+		if report.AudioSeconds == 0 {
+			if p, err := readPCM(episode); err == nil {
+				report.AudioSeconds = p.duration().Seconds()
+			}
+		}
+
+		start = time.Now()
+		err = MasterEpisode(episode, DefaultMastering)
+		RemoveFiles(episode)
+		if err != nil {
+			return report, fmt.Errorf("mastering: %w", err)
+		}
+		master = append(master, time.Since(start))
+
+		start = time.Now()
+		if _, err := StreamConversation(ctx, synth, opts.Voice1, opts.Voice2, script, filepath.Join(dir, "stream.wav"), "", io.Discard); err != nil {
+			return report, fmt.Errorf("streaming: %w", err)
+		}
+		stream = append(stream, time.Since(start))
+	}
+
+	turns, audio := float64(opts.Turns), report.AudioSeconds
+	report.Phases = []BenchPhase{
+		benchPhase("synthesize", synthesize, turns, "turns/s"),
+		benchPhase("combine", combine, audio, "x realtime"),
+		benchPhase("master", master, audio, "x realtime"),
+		benchPhase("stream", stream, turns, "turns/s"),
+	}
+	report.Requests = benchLatency(synth.latencies)
+	return report, nil
+}
+
+// benchPhase summarizes a phase's runs, with work done per second at the
+// median
+func benchPhase(name string, runs []time.Duration, work float64, unit string) BenchPhase {
+	sorted := slices.Clone(runs)
+	slices.Sort(sorted)
+	p := BenchPhase{
+		Name:   name,
+		Min:    sorted[0].Seconds(),
+		Median: sorted[len(sorted)/2].Seconds(),
+		Max:    sorted[len(sorted)-1].Seconds(),
+		Unit:   unit,
+	}
+	if p.Median > 0 {
+		p.Throughput = work / p.Median
+	}
+	return p
+}
+
+// benchLatency is the spread of latencies, by nearest rank
+func benchLatency(latencies []time.Duration) BenchLatency {
+	if len(latencies) == 0 {
+		return BenchLatency{}
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	rank := func(p float64) float64 {
+		return sorted[max(0, int(math.Ceil(p*float64(len(sorted))))-1)].Seconds()
+	}
+	return BenchLatency{
+		Count: len(sorted),
+		P50:   rank(0.50),
+		P95:   rank(0.95),
+		P99:   rank(0.99),
+		Max:   sorted[len(sorted)-1].Seconds(),
+	}
+}
+
+// CompareBench returns the phases of a report whose median latency is more
+// than tolerance, e.g. 0.2 for 20%, slower than in a baseline
+func CompareBench(baseline, report BenchReport, tolerance float64) ([]string, error) {
+	if baseline.Turns != report.Turns {
+		return nil, errors.New("the baseline has a different number of turns")
+	}
+	var regressions []string
+	for _, p := range report.Phases {
+		for _, b := range baseline.Phases {
+			if b.Name != p.Name || b.Median <= 0 {
+				continue
+			}
+			if change := p.Median/b.Median - 1; change > tolerance {
+				regressions = append(regressions, fmt.Sprintf("%s: %.3fs, %.0f%% slower than %.3fs", p.Name, p.Median, 100*change, b.Median))
+			}
+		}
+	}
+	return regressions, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// charactersPerWord estimates Text-to-Speech characters from words, with
+// spaces and punctuation
+const charactersPerWord = 6
+
+// Budget caps what a job may spend before it starts; zero is no limit
+type Budget struct {
+	DocumentTokens int `json:"document_tokens,omitempty"` // Gemini input tokens, the document and prompt
+	TTSCharacters  int `json:"tts_characters,omitempty"`  // characters sent to Text-to-Speech
+}
+
+// BudgetError is an estimate over budget
+type BudgetError struct {
+	Measure  string `json:"measure"` // document tokens or Text-to-Speech characters
+	Estimate int    `json:"estimate"`
+	Limit    int    `json:"limit"`
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s are %d, over the budget of %d", e.Measure, e.Estimate, e.Limit)
+}
+
+// CheckTokens returns a *BudgetError if tokens are over the document token budget
+func (b Budget) CheckTokens(tokens int) error {
+	if b.DocumentTokens > 0 && tokens > b.DocumentTokens {
+		return &BudgetError{"document tokens", tokens, b.DocumentTokens}
+	}
+	return nil
+}
+
+// CheckCharacters returns a *BudgetError if characters are over the
+// Text-to-Speech character budget
+func (b Budget) CheckCharacters(characters int) error {
+	if b.TTSCharacters > 0 && characters > b.TTSCharacters {
+		return &BudgetError{"Text-to-Speech characters", characters, b.TTSCharacters}
+	}
+	return nil
+}
+
+// Characters estimates the Text-to-Speech characters of the script the
+// prompt asks for
+func (d PromptData) Characters() int {
+	words := d.Words()
+	if d.TargetMinutes <= 0 {
+		words = defaultPodcastTurns * wordsPerPodcastTurn
+	}
+	return words * charactersPerWord
+}
+
+// ScriptCharacters counts the characters of a conversation's turns, without
+// the speaker markers
+func ScriptCharacters(conversation string) int {
+	n := 0
+	for _, turn := range splitTurns(conversation) {
+		n += utf8.RuneCountInString(turn)
+	}
+	return n
+}
+
+// CountTokens counts the Gemini input tokens to generate a conversation from
+// source with prompt
+func CountTokens(ctx context.Context, projectID, location, modelName, source, prompt string) (int, error) {
+	request := fmt.Sprintf("count tokens, model: %s\nsource: %s\nprompt:\n%s", modelName, fixtureSource(source), prompt)
+	data, err := withFixture("gemini-tokens", "txt", []byte(request), request, func() ([]byte, error) {
+		tokens, err := countTokens(ctx, projectID, location, modelName, source, prompt)
+		return []byte(strconv.Itoa(tokens)), err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+func countTokens(ctx context.Context, projectID, location, modelName, source, prompt string) (int, error) {
+	client, err := genaiClient(projectID, location)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create client: %w", err)
+	}
+
+	document, err := documentPart(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+	debugf(DebugRequests, "gemini: count tokens, model %s, source %s", modelName, source)
+	res, err := client.GenerativeModel(modelName).CountTokens(ctx, document, genai.Text(`"\n\n"`), genai.Text(prompt))
+	if err != nil {
+		return 0, fmt.Errorf("unable to count tokens: %w", err)
+	}
+	return int(res.TotalTokens), nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const buzzsproutBaseURL = "https://www.buzzsprout.com"
+
+// Buzzsprout publishes to a Buzzsprout podcast with its API
+type Buzzsprout struct {
+	APIToken  string
+	PodcastID string
+	BaseURL   string
+	Client    *http.Client
+}
+
+// NewBuzzsprout returns a Buzzsprout host for a podcast
+func NewBuzzsprout(apiToken, podcastID string) *Buzzsprout {
+	return &Buzzsprout{
+		APIToken:  apiToken,
+		PodcastID: podcastID,
+		BaseURL:   buzzsproutBaseURL,
+		Client:    podcastHostClient,
+	}
+}
+
+// newBuzzsproutFromEnv configures Buzzsprout from BUZZSPROUT_API_TOKEN and
+// BUZZSPROUT_PODCAST_ID, unless show is set
+func newBuzzsproutFromEnv(show string) (PodcastHost, error) {
+	apiToken, err := SecretEnv(context.Background(), "BUZZSPROUT_API_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if apiToken == "" {
+		return nil, errors.New("BUZZSPROUT_API_TOKEN is required for the buzzsprout host")
+	}
+	if show == "" {
+		show = os.Getenv("BUZZSPROUT_PODCAST_ID")
+	}
+	if show == "" {
+		return nil, errors.New("buzzsprout needs a podcast ID, from BUZZSPROUT_PODCAST_ID")
+	}
+	return NewBuzzsprout(apiToken, show), nil
+}
+
+// writeFile adds a file to a multipart form
+func writeFile(form *multipart.Writer, field, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part, err := form.CreateFormFile(field, filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// PublishEpisode uploads the episode with its artwork as a multipart form;
+// without Publish it has no published_at, leaving it a draft
+func (b *Buzzsprout) PublishEpisode(ctx context.Context, episode PodcastEpisode) (string, error) {
+	body, w := io.Pipe()
+	form := multipart.NewWriter(w)
+	go func() {
+		fields := map[string]string{
+			"title":       episode.Title,
+			"summary":     episode.Summary,
+			"description": episode.Description,
+		}
+		if episode.Publish {
+			fields["published_at"] = time.Now().UTC().Format(time.RFC3339)
+		}
+		if isURL(episode.Artwork) {
+			fields["artwork_url"] = episode.Artwork
+		}
+		for k, v := range fields {
+			if err := form.WriteField(k, v); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		if err := writeFile(form, "audio_file", episode.Audio); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		if episode.Artwork != "" && !isURL(episode.Artwork) {
+			if err := writeFile(form, "artwork_file", episode.Artwork); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.CloseWithError(form.Close())
+	}()
+
+	endpoint := fmt.Sprintf("%s/api/%s/episodes.json", b.BaseURL, url.PathEscape(b.PodcastID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		body.Close()
+		return "", err
+	}
+	req.Header.Set("Authorization", "Token token="+b.APIToken)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	debugf(DebugRequests, "buzzsprout: podcast %s, %s", b.PodcastID, episode.Audio)
+	res, err := b.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("buzzsprout: %s: %s", res.Status, bytes.TrimSpace(detail))
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		return "", err
+	}
+	log.Printf("buzzsprout: episode %d", created.ID)
+	return fmt.Sprintf("%s/%s/%d", b.BaseURL, b.PodcastID, created.ID), nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// castPCMFormat is requested from mp3 providers in a mixed cast, so every
+// turn can be combined as wav
+const castPCMFormat = "pcm_24000"
+
+// VoiceProvider returns the provider prefix of a voice name, e.g. elevenlabs
+// for elevenlabs:Rachel, and the voice name without it; names without a
+// known provider prefix return an empty provider
+func VoiceProvider(name string) (string, string) {
+	provider, voice, ok := strings.Cut(name, ":")
+	if _, known := providers[provider]; ok && known {
+		return provider, voice
+	}
+	return "", name
+}
+
+// Cast synthesizes each voice with its own provider, so speakers in a
+// conversation can come from different providers
+type Cast struct {
+	Default   string // provider for voices without a provider prefix
+	Providers map[string]Synthesizer
+}
+
+// NewCast creates the providers for voices, which may have a provider prefix,
+// e.g. google:en-US-Chirp3-HD-Charon and elevenlabs:Rachel; voices without
+// one use defaultProvider
+func NewCast(defaultProvider string, voicenames ...string) (*Cast, error) {
+	c := &Cast{Default: defaultProvider, Providers: map[string]Synthesizer{}}
+	for _, name := range voicenames {
+		provider := c.provider(name)
+		if _, ok := c.Providers[provider]; ok {
+			continue
+		}
+		synth, err := NewSynthesizer(provider)
+		if err != nil {
+			return nil, err
+		}
+		c.Providers[provider] = synth
+	}
+	if len(c.Providers) > 1 {
+		// mp3 can't be combined with wav, ask for raw audio instead
+		if e, ok := c.Providers["elevenlabs"].(*ElevenLabs); ok {
+			e.OutputFormat = castPCMFormat
+		}
+	}
+	return c, nil
+}
+
+// provider returns the provider for a voice name
+func (c *Cast) provider(name string) string {
+	if provider, _ := VoiceProvider(name); provider != "" {
+		return provider
+	}
+	return c.Default
+}
+
+// Synthesize uses the voice's provider
+func (c *Cast) Synthesize(ctx context.Context, voice, style, text string) (Audio, error) {
+	provider := c.provider(voice)
+	synth, ok := c.Providers[provider]
+	if !ok {
+		return Audio{}, fmt.Errorf("no %s provider for voice %s", provider, voice)
+	}
+	_, name := VoiceProvider(voice)
+	return synth.Synthesize(ctx, name, style, text)
+}
+
+// Parallelism is the lowest of the providers' limits
+func (c *Cast) Parallelism() int {
+	parallelism := defaultSynthesisParallelism
+	for _, synth := range c.Providers {
+		if p, ok := synth.(parallelSynthesizer); ok && p.Parallelism() > 0 && p.Parallelism() < parallelism {
+			parallelism = p.Parallelism()
+		}
+	}
+	return parallelism
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Fingerprint is what an episode is made from, so one already made from the
+// same source, prompt, voices and output settings can be returned rather than
+// generated again
+type Fingerprint struct {
+	SourceSHA256 string   `json:"source_sha256"`           // the document, or the transcript as given
+	PromptSHA256 string   `json:"prompt_sha256,omitempty"` // the prompt and model, for generated scripts
+	Voices       []string `json:"voices"`                  // with providers, e.g. google:en-US-Chirp3-HD-Charon
+	OutputSHA256 string   `json:"output_sha256,omitempty"` // the audio format, mix and files written, see OutputSHA256
+}
+
+// PromptSHA256 hashes a script's prompt with the model it's sent to
+func PromptSHA256(model, prompt string) string {
+	return SHA256([]byte(model + "\n" + prompt))
+}
+
+// OutputSHA256 hashes an episode's output settings, a struct whose fields
+// are omitted when unset, so episodes made with the defaults hash to "" and
+// keep the fingerprints they had before output settings were hashed
+func OutputSHA256(settings any) string {
+	data, _ := json.Marshal(settings)
+	if string(data) == "{}" {
+		return ""
+	}
+	return SHA256(data)
+}
+
+// Key identifies the fingerprint in a catalog
+func (f Fingerprint) Key() string {
+	data, _ := json.Marshal(f)
+	return SHA256(data)
+}
+
+// CatalogEntry is an episode in a catalog
+type CatalogEntry struct {
+	Fingerprint Fingerprint `json:"fingerprint"`
+	Title       string      `json:"title,omitempty"`
+	Audio       string      `json:"audio"`
+	Created     time.Time   `json:"created"`
+}
+
+// Catalog is the episodes generated on this machine, by fingerprint key
+type Catalog struct {
+	Episodes map[string]CatalogEntry `json:"episodes"`
+}
+
+// ReadCatalog reads a catalog file, a missing file is an empty catalog
+func ReadCatalog(filename string) (Catalog, error) {
+	c := Catalog{Episodes: map[string]CatalogEntry{}}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	if c.Episodes == nil {
+		c.Episodes = map[string]CatalogEntry{}
+	}
+	return c, nil
+}
+
+// Find returns the episode made from f, if its audio is still there
+func (c Catalog) Find(f Fingerprint) (CatalogEntry, bool) {
+	e, ok := c.Episodes[f.Key()]
+	if !ok {
+		return e, false
+	}
+	if _, err := os.Stat(e.Audio); err != nil {
+		return e, false
+	}
+	return e, true
+}
+
+// Add adds an episode, replacing any made from the same fingerprint
+func (c *Catalog) Add(e CatalogEntry) {
+	if c.Episodes == nil {
+		c.Episodes = map[string]CatalogEntry{}
+	}
+	c.Episodes[e.Fingerprint.Key()] = e
+}
+
+// WriteCatalog writes a catalog file, creating its directory
+func WriteCatalog(filename string, c Catalog) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	texttospeech "cloud.google.com/go/texttospeech/apiv1"
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/option"
+)
+
+// the Text-to-Speech and Vertex AI clients are opened once and shared by
+// every request, rather than dialed for each; they're opened without a
+// request's context so they outlive it
+var (
+	clientsMu     sync.Mutex
+	sharedTTS     *texttospeech.Client
+	sharedClients = map[string]*genai.Client{} // by project and region
+)
+
+// ttsClient returns the shared Text-to-Speech client, or with opts, e.g. a
+// custom voice's endpoint and credentials, a new one; release closes a new
+// client
+func ttsClient(opts []option.ClientOption) (*texttospeech.Client, func(), error) {
+	if len(opts) > 0 {
+		client, err := texttospeech.NewClient(context.Background(), opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if sharedTTS == nil {
+		client, err := texttospeech.NewClient(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		sharedTTS = client
+	}
+	return sharedTTS, func() {}, nil
+}
+
+// genaiClient returns the shared Vertex AI client for a project and region
+func genaiClient(projectID, location string) (*genai.Client, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	key := projectID + "/" + location
+	if client, ok := sharedClients[key]; ok {
+		return client, nil
+	}
+	client, err := genai.NewClient(context.Background(), projectID, location)
+	if err != nil {
+		return nil, err
+	}
+	sharedClients[key] = client
+	return client, nil
+}
+
+// WarmUp opens the shared Text-to-Speech client and, with a project, the
+// Vertex AI client for it, so the first request doesn't pay for them
+func WarmUp(projectID, location string) error {
+	var errs []error
+	if _, _, err := ttsClient(nil); err != nil {
+		errs = append(errs, fmt.Errorf("text-to-speech: %w", err))
+	}
+	if projectID != "" {
+		if _, err := genaiClient(projectID, location); err != nil {
+			errs = append(errs, fmt.Errorf("vertex ai: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultClipPadding is the audio kept before and after a clip's words
+	DefaultClipPadding = 150 * time.Millisecond
+	// clipFade fades a clip in and out, so it doesn't start or end with a click
+	clipFade = 20 * time.Millisecond
+)
+
+// ClipOptions selects a clip of an episode: a whole turn, or a quote from
+// its transcript
+type ClipOptions struct {
+	Turn    int           // the turn, from 1; with Quote, the turn to find it in
+	Quote   string        // words to find, the first match, ignoring case and punctuation
+	Padding time.Duration // default DefaultClipPadding
+}
+
+func (o ClipOptions) withDefaults() ClipOptions {
+	if o.Padding <= 0 {
+		o.Padding = DefaultClipPadding
+	}
+	return o
+}
+
+// Clip is a quote cut from an episode, timed in the episode
+type Clip struct {
+	File      string  `json:"file"`
+	Turn      int     `json:"turn"`
+	Speaker   string  `json:"speaker"`
+	Text      string  `json:"text"`
+	Start     float64 `json:"start"`
+	End       float64 `json:"end"`
+	Estimated bool    `json:"estimated,omitempty"` // timed by length, the transcript's words weren't aligned
+}
+
+// LoadTranscript reads an episode's JSON transcript, the one listed in its
+// provenance manifest or, without one, the one next to it
+func LoadTranscript(audiofile string) ([]TranscriptTurn, error) {
+	filename := TranscriptFile(audiofile, TranscriptJSON)
+	if data, err := os.ReadFile(ProvenanceManifest(audiofile)); err == nil {
+		var p Provenance
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", ProvenanceManifest(audiofile), err)
+		}
+		for _, t := range p.Transcripts {
+			if strings.HasSuffix(t, ".transcript."+TranscriptJSON) {
+				filename = t
+			}
+		}
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s has no JSON transcript, generate it with -transcript-formats json", audiofile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	turns := []TranscriptTurn{}
+	if err := json.Unmarshal(data, &turns); err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", filename, err)
+	}
+	return turns, nil
+}
+
+// FindClip finds a clip in an episode's transcript, padded and within its
+// turn; a quote is timed by its words, or by its length in the turn if the
+// words weren't aligned
+func FindClip(turns []TranscriptTurn, opts ClipOptions) (Clip, error) {
+	opts = opts.withDefaults()
+	if opts.Turn < 0 || opts.Turn > len(turns) {
+		return Clip{}, fmt.Errorf("no turn %d, the episode has %d", opts.Turn, len(turns))
+	}
+	if opts.Turn == 0 && opts.Quote == "" {
+		return Clip{}, errors.New("a clip needs a turn or a quote")
+	}
+	quote := normalizeWords(opts.Quote)
+	for i, t := range turns {
+		if opts.Turn != 0 && i+1 != opts.Turn {
+			continue
+		}
+		clip := Clip{Turn: i + 1, Speaker: t.Speaker, Text: t.Text, Start: t.Start.Seconds(), End: t.End.Seconds()}
+		if len(quote) == 0 {
+			return clip, nil
+		}
+		words := strings.Fields(t.Text)
+		first, last, ok := findWords(words, quote)
+		if !ok {
+			continue
+		}
+		clip.Text = strings.Join(words[first:last+1], " ")
+		var start, end time.Duration
+		if len(t.Words) == len(words) {
+			start, end = t.Words[first].Start, t.Words[last].End
+		} else {
+			// spread the turn over its characters
+			chars := utf8.RuneCountInString(t.Text)
+			before := utf8.RuneCountInString(strings.Join(words[:first], " "))
+			start = t.Start + time.Duration(float64(t.End-t.Start)*float64(before)/float64(chars))
+			end = start + time.Duration(float64(t.End-t.Start)*float64(utf8.RuneCountInString(clip.Text))/float64(chars))
+			clip.Estimated = true
+		}
+		clip.Start = max(t.Start, start-opts.Padding).Seconds()
+		clip.End = min(t.End, end+opts.Padding).Seconds()
+		return clip, nil
+	}
+	if opts.Turn != 0 {
+		return Clip{}, fmt.Errorf("%q isn't in turn %d", opts.Quote, opts.Turn)
+	}
+	return Clip{}, fmt.Errorf("%q isn't in the transcript", opts.Quote)
+}
+
+// findWords finds quote, normalized words, in a turn's words, returning the
+// first and last of them
+func findWords(words, quote []string) (first, last int, ok bool) {
+	// each normalized word and the turn word it's from
+	normalized, from := []string{}, []int{}
+	for i, w := range words {
+		for _, n := range normalizeWords(w) {
+			normalized, from = append(normalized, n), append(from, i)
+		}
+	}
+	for i := 0; i+len(quote) <= len(normalized); i++ {
+		if slices.Equal(normalized[i:i+len(quote)], quote) {
+			return from[i], from[i+len(quote)-1], true
+		}
+	}
+	return 0, 0, false
+}
+
+// ExtractClip cuts a clip found in a wav episode's transcript into output,
+// a wav file, fading it in and out
+func ExtractClip(audiofile string, turns []TranscriptTurn, opts ClipOptions, output string) (Clip, error) {
+	clip, err := FindClip(turns, opts)
+	if err != nil {
+		return clip, err
+	}
+	p, err := readPCM(audiofile)
+	if err != nil {
+		return clip, fmt.Errorf("clips are cut from wav episodes: %w", err)
+	}
+	frame := func(s float64) int {
+		return min(len(p.data), int(s*float64(p.rate))*p.frameSize())
+	}
+	from, to := frame(clip.Start), frame(clip.End)
+	if to <= from {
+		return clip, fmt.Errorf("clip from %.2fs to %.2fs is outside %s", clip.Start, clip.End, audiofile)
+	}
+	cut := p
+	cut.data = slices.Clone(p.data[from:to])
+	if p.bits == 16 {
+		fade := min(len(cut.data)/2, frame(clipFade.Seconds()))
+		fade -= fade % p.frameSize()
+		silence := make([]byte, fade)
+		crossfadePCM16(silence, cut.data[:fade], p.channels)
+		copy(cut.data, silence)
+		crossfadePCM16(cut.data[len(cut.data)-fade:], make([]byte, fade), p.channels)
+	}
+	if err := os.WriteFile(output, cut.encode(), 0644); err != nil {
+		return clip, err
+	}
+	clip.File = output
+	log.Printf("clip of turn %d, %.2fs to %.2fs, written to %s", clip.Turn, clip.Start, clip.End, output)
+	return clip, nil
+}
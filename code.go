@@ -0,0 +1,105 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// how source code in a document is narrated
+const (
+	// CodeRead reads code as written
+	CodeRead = ""
+	// CodeDescribe describes code in prose instead of reading it
+	CodeDescribe = "describe"
+	// CodeSkip leaves code out
+	CodeSkip = "skip"
+)
+
+var (
+	// fencedCodeRe matches markdown code blocks and their language
+	fencedCodeRe = regexp.MustCompile("(?ms)^[ \t]*(```|~~~)[ \t]*([A-Za-z0-9_+#-]*)[^\n]*\n(.*?)^[ \t]*(```|~~~)[ \t]*$")
+	// codeDefinitionRe matches names defined by code, e.g. def parse or func main
+	codeDefinitionRe = regexp.MustCompile(`\b(?:def|func|function|class|fn|struct|interface|type)\s+(?:\([^)]*\)\s*)?([A-Za-z_]\w*)`)
+)
+
+// codeLanguages are spoken names of code block languages
+var codeLanguages = map[string]string{
+	"py": "Python", "python": "Python", "go": "Go", "golang": "Go", "js": "JavaScript", "javascript": "JavaScript",
+	"ts": "TypeScript", "typescript": "TypeScript", "java": "Java", "c": "C", "cpp": "C++", "c++": "C++", "cs": "C sharp",
+	"csharp": "C sharp", "rs": "Rust", "rust": "Rust", "rb": "Ruby", "ruby": "Ruby", "sh": "shell", "bash": "shell",
+	"shell": "shell", "sql": "SQL", "r": "R", "kotlin": "Kotlin", "swift": "Swift", "json": "JSON", "yaml": "YAML",
+}
+
+// ValidateCodeMode checks a code narration mode
+func ValidateCodeMode(mode string) error {
+	switch mode {
+	case CodeRead, CodeDescribe, CodeSkip:
+		return nil
+	}
+	return fmt.Errorf("unknown code mode %s, use describe or skip", mode)
+}
+
+// NarrateCode replaces fenced code blocks in text, which read literally are
+// symbol soup, with a short description of the code, e.g. "Here's a 12 line
+// Python example that defines parse and main.", or removes them for
+// CodeSkip; CodeRead leaves text unchanged
+func NarrateCode(text, mode string) string {
+	if mode == CodeRead {
+		return text
+	}
+	return fencedCodeRe.ReplaceAllStringFunc(text, func(block string) string {
+		if mode == CodeSkip {
+			return ""
+		}
+		m := fencedCodeRe.FindStringSubmatch(block)
+		return describeCode(m[2], m[3])
+	})
+}
+
+// describeCode describes a code block by its language, length and the names
+// it defines
+func describeCode(language, code string) string {
+	lines := 0
+	for _, line := range strings.Split(code, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines++
+		}
+	}
+	description := "Here's a short code example"
+	if lines > 1 {
+		description = fmt.Sprintf("Here's a %d line code example", lines)
+	}
+	if name, ok := codeLanguages[strings.ToLower(language)]; ok {
+		description = strings.Replace(description, "code example", name+" example", 1)
+	}
+
+	names := []string{}
+	for _, m := range codeDefinitionRe.FindAllStringSubmatch(code, -1) {
+		if len(names) < 3 && !strings.Contains(strings.Join(names, " "), m[1]) {
+			names = append(names, m[1])
+		}
+	}
+	switch len(names) {
+	case 0:
+	case 1:
+		description += " that defines " + names[0]
+	default:
+		description += " that defines " + strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	}
+	return description + "."
+}
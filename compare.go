@@ -0,0 +1,418 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/moutend/go-wav"
+	speech "google.golang.org/api/speech/v1p1beta1"
+)
+
+const (
+	// recognizeRate is the sample rate wav renders are recognized at
+	recognizeRate = 16000
+	// recognizeChunk is the longest audio recognized in one request, to stay
+	// under the inline audio limit
+	recognizeChunk = 3 * time.Minute
+	// minTurnChange is the smallest turn duration change reported, so short
+	// turns don't report regressions for a few milliseconds
+	minTurnChange = 250 * time.Millisecond
+)
+
+// nonWordRe matches what's dropped when comparing words
+var nonWordRe = regexp.MustCompile(`[^\p{L}\p{N}']+`)
+
+// CompareOptions configures CompareRenders, zero values use the defaults
+type CompareOptions struct {
+	Script            string  // the script both renders are from, for turns and word error rate
+	Tags              string  // participant labels to strip from turns, e.g. AGENT,CUSTOMER
+	LanguageCode      string  // e.g. en-US
+	SkipRecognition   bool    // only compare duration and loudness, without Speech-to-Text
+	DurationTolerance float64 // relative duration change reported, e.g. 0.15
+	LoudnessTolerance float64 // loudness change reported, in dB
+	WERTolerance      float64 // word error rate increase reported, e.g. 0.03
+}
+
+func (o CompareOptions) withDefaults() CompareOptions {
+	if o.LanguageCode == "" {
+		o.LanguageCode = "en-US"
+	}
+	if o.DurationTolerance <= 0 {
+		o.DurationTolerance = 0.15
+	}
+	if o.LoudnessTolerance <= 0 {
+		o.LoudnessTolerance = 2
+	}
+	if o.WERTolerance <= 0 {
+		o.WERTolerance = 0.03
+	}
+	return o
+}
+
+// RenderReport measures one render of a script
+type RenderReport struct {
+	File     string       `json:"file"`
+	Seconds  float64      `json:"seconds"`
+	Loudness float64      `json:"loudness_dbfs,omitempty"` // RMS, wav only
+	WER      *float64     `json:"wer,omitempty"`           // against the script
+	Turns    []TurnReport `json:"turns,omitempty"`
+}
+
+// TurnReport measures a turn in a render, found by aligning recognized
+// words with the script
+type TurnReport struct {
+	Turn     int     `json:"turn"` // from 1
+	Found    bool    `json:"found"`
+	Start    float64 `json:"start"`
+	Seconds  float64 `json:"seconds"`
+	Loudness float64 `json:"loudness_dbfs,omitempty"`
+}
+
+// Regression is a change beyond tolerance from the baseline render
+type Regression struct {
+	Turn      int     `json:"turn,omitempty"` // 0 for the whole episode
+	Metric    string  `json:"metric"`         // duration, loudness, wer or turn
+	Baseline  float64 `json:"baseline"`
+	Candidate float64 `json:"candidate"`
+}
+
+func (r Regression) String() string {
+	where := "episode"
+	if r.Turn > 0 {
+		where = fmt.Sprintf("turn %d", r.Turn)
+	}
+	switch r.Metric {
+	case "duration":
+		return fmt.Sprintf("%s duration %.2fs -> %.2fs (%+.0f%%)", where, r.Baseline, r.Candidate, 100*(r.Candidate-r.Baseline)/r.Baseline)
+	case "loudness":
+		return fmt.Sprintf("%s loudness %.1f -> %.1f dBFS", where, r.Baseline, r.Candidate)
+	case "wer":
+		return fmt.Sprintf("%s word error rate %.1f%% -> %.1f%%", where, 100*r.Baseline, 100*r.Candidate)
+	}
+	return fmt.Sprintf("%s not found in the candidate", where)
+}
+
+// Comparison is the result of CompareRenders
+type Comparison struct {
+	Baseline    RenderReport `json:"baseline"`
+	Candidate   RenderReport `json:"candidate"`
+	Regressions []Regression `json:"regressions"`
+}
+
+// CompareRenders compares two renders of the same script, e.g. before and
+// after changing voices or models: duration and loudness, and with the
+// script, word error rate and each turn's duration and loudness, from
+// Speech-to-Text word times
+func CompareRenders(ctx context.Context, projectID, baseline, candidate string, opts CompareOptions) (Comparison, error) {
+	opts = opts.withDefaults()
+	turns := [][]string{}
+	for _, turn := range splitTurns(opts.Script) {
+		_, text := parseStyle(strings.TrimSpace(stripParticipantTags(turn, opts.Tags)))
+		turns = append(turns, normalizeWords(text))
+	}
+
+	var c Comparison
+	var err error
+	if c.Baseline, err = measureRender(ctx, projectID, baseline, turns, opts); err != nil {
+		return c, err
+	}
+	if c.Candidate, err = measureRender(ctx, projectID, candidate, turns, opts); err != nil {
+		return c, err
+	}
+	c.Regressions = regressions(c.Baseline, c.Candidate, opts)
+	return c, nil
+}
+
+// measureRender measures a render's duration, loudness and, if there are
+// turns, its word error rate and turns
+func measureRender(ctx context.Context, projectID, filename string, turns [][]string, opts CompareOptions) (RenderReport, error) {
+	report := RenderReport{File: filename}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return report, err
+	}
+	var w *wav.File
+	var samples []int32
+	var duration time.Duration
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".wav":
+		w = &wav.File{}
+		if err := wav.Unmarshal(data, w); err != nil {
+			return report, fmt.Errorf("can't read %s: %w", filename, err)
+		}
+		duration = bytesDuration(w, len(w.Bytes()))
+		// Int32s scales every sample size to 32 bits
+		samples = w.Int32s()
+		report.Loudness = rmsLoudness(w, samples, 0, duration)
+	case ".mp3":
+		duration = mp3Duration(data)
+	default:
+		return report, fmt.Errorf("can't compare %s files, use wav or mp3", filepath.Ext(filename))
+	}
+	report.Seconds = duration.Seconds()
+	if opts.SkipRecognition || len(turns) == 0 {
+		return report, nil
+	}
+
+	words, err := recognizeWords(ctx, projectID, filename, data, w, opts.LanguageCode)
+	if err != nil {
+		return report, err
+	}
+	script := []string{}
+	for _, turn := range turns {
+		script = append(script, turn...)
+	}
+	recognized := make([]string, len(words))
+	for i, word := range words {
+		recognized[i] = word.text
+	}
+	errs, aligned := alignWords(script, recognized)
+	wer := float64(errs) / float64(max(1, len(script)))
+	report.WER = &wer
+	log.Printf("%s: %s, %d words recognized, word error rate %.1f%%", filename, duration.Round(time.Second), len(words), 100*wer)
+
+	// a turn starts at its first recognized word and ends where the next starts
+	first := 0
+	for i, turn := range turns {
+		t := TurnReport{Turn: i + 1}
+		for _, j := range aligned[first : first+len(turn)] {
+			if j >= 0 {
+				t.Found, t.Start = true, words[j].start.Seconds()
+				break
+			}
+		}
+		first += len(turn)
+		report.Turns = append(report.Turns, t)
+	}
+	end := report.Seconds
+	for i := len(report.Turns) - 1; i >= 0; i-- {
+		t := &report.Turns[i]
+		if !t.Found {
+			continue
+		}
+		t.Seconds = end - t.Start
+		end = t.Start
+		if w != nil {
+			t.Loudness = rmsLoudness(w, samples, secondsDuration(t.Start), secondsDuration(t.Start+t.Seconds))
+		}
+	}
+	return report, nil
+}
+
+// regressions lists changes from baseline to candidate beyond tolerance
+func regressions(baseline, candidate RenderReport, opts CompareOptions) []Regression {
+	found := []Regression{}
+	duration := func(turn int, b, c float64) {
+		change := math.Abs(c - b)
+		if b > 0 && change/b > opts.DurationTolerance && change > minTurnChange.Seconds() {
+			found = append(found, Regression{Turn: turn, Metric: "duration", Baseline: b, Candidate: c})
+		}
+	}
+	loudness := func(turn int, b, c float64) {
+		if b != 0 && c != 0 && math.Abs(c-b) > opts.LoudnessTolerance {
+			found = append(found, Regression{Turn: turn, Metric: "loudness", Baseline: b, Candidate: c})
+		}
+	}
+
+	duration(0, baseline.Seconds, candidate.Seconds)
+	loudness(0, baseline.Loudness, candidate.Loudness)
+	if baseline.WER != nil && candidate.WER != nil && *candidate.WER-*baseline.WER > opts.WERTolerance {
+		found = append(found, Regression{Metric: "wer", Baseline: *baseline.WER, Candidate: *candidate.WER})
+	}
+	for i := 0; i < len(baseline.Turns) && i < len(candidate.Turns); i++ {
+		b, c := baseline.Turns[i], candidate.Turns[i]
+		switch {
+		case b.Found && !c.Found:
+			found = append(found, Regression{Turn: b.Turn, Metric: "turn"})
+		case b.Found && c.Found:
+			duration(b.Turn, b.Seconds, c.Seconds)
+			loudness(b.Turn, b.Loudness, c.Loudness)
+		}
+	}
+	return found
+}
+
+// recognizedWord is a word from Speech-to-Text with its start and end times
+type recognizedWord struct {
+	text       string
+	start, end time.Duration
+}
+
+// recognizeWords recognizes a render's words with their times; wav renders
+// are converted to 16 kHz mono and recognized in chunks, mp3 renders must
+// fit in one request
+func recognizeWords(ctx context.Context, projectID, filename string, data []byte, w *wav.File, language string) ([]recognizedWord, error) {
+	config := &speech.RecognitionConfig{
+		Encoding:              "MP3",
+		LanguageCode:          language,
+		EnableWordTimeOffsets: true,
+	}
+	chunks := [][]byte{data}
+	if w != nil {
+		mono, err := convertWav(w, recognizeRate, 1)
+		if err != nil {
+			return nil, err
+		}
+		config.Encoding, config.SampleRateHertz = "LINEAR16", recognizeRate
+		chunks = nil
+		pcm, size := mono.Bytes(), int(recognizeChunk.Seconds())*recognizeRate*2
+		for len(pcm) > size {
+			chunks = append(chunks, pcm[:size])
+			pcm = pcm[size:]
+		}
+		chunks = append(chunks, pcm)
+	} else if len(data) > maxInlineAudio {
+		return nil, fmt.Errorf("%s is larger than %d MB, compare wav renders or skip recognition", filename, maxInlineAudio>>20)
+	}
+
+	words := []recognizedWord{}
+	for i, chunk := range chunks {
+		offset := time.Duration(i) * recognizeChunk
+		debugf(DebugRequests, "speech: recognizing %s from %s, %d bytes", filename, offset, len(chunk))
+		results, err := recognize(ctx, projectID, &speech.RecognitionAudio{Content: base64.StdEncoding.EncodeToString(chunk)}, config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to recognize %s: %w", filename, err)
+		}
+		for _, result := range results {
+			if len(result.Alternatives) == 0 {
+				continue
+			}
+			for _, info := range result.Alternatives[0].Words {
+				start, _ := time.ParseDuration(info.StartTime)
+				end, _ := time.ParseDuration(info.EndTime)
+				for _, word := range normalizeWords(info.Word) {
+					words = append(words, recognizedWord{word, offset + start, offset + end})
+				}
+			}
+		}
+	}
+	return words, nil
+}
+
+// normalizeWords splits text into lowercase words without punctuation
+func normalizeWords(text string) []string {
+	return strings.Fields(nonWordRe.ReplaceAllString(strings.ToLower(text), " "))
+}
+
+// alignWords aligns recognized words with reference words by edit distance,
+// returning the number of substitutions, deletions and insertions and, for
+// each reference word, the recognized word aligned with it or -1
+func alignWords(reference, recognized []string) (int, []int) {
+	n, m := len(reference), len(recognized)
+	dist := make([][]int, n+1)
+	for i := range dist {
+		dist[i] = make([]int, m+1)
+		dist[i][0] = i
+	}
+	for j := 0; j <= m; j++ {
+		dist[0][j] = j
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			sub := dist[i-1][j-1]
+			if reference[i-1] != recognized[j-1] {
+				sub++
+			}
+			dist[i][j] = min(sub, dist[i-1][j]+1, dist[i][j-1]+1)
+		}
+	}
+
+	aligned := make([]int, n)
+	for i, j := n, m; i > 0; {
+		switch {
+		case j > 0 && dist[i][j] == dist[i-1][j-1]+boolInt(reference[i-1] != recognized[j-1]):
+			aligned[i-1] = j - 1
+			i, j = i-1, j-1
+		case dist[i][j] == dist[i-1][j]+1:
+			aligned[i-1] = -1
+			i--
+		default:
+			j--
+		}
+	}
+	return dist[n][m], aligned
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// rmsLoudness is the RMS level of samples in the format of w from start to
+// end, in dBFS, with silence at -100
+func rmsLoudness(w *wav.File, samples []int32, start, end time.Duration) float64 {
+	perSecond := float64(w.SamplesPerSec() * w.Channels())
+	from := min(len(samples), int(start.Seconds()*perSecond))
+	to := min(len(samples), int(end.Seconds()*perSecond))
+	if to <= from {
+		return 0
+	}
+	sum := 0.0
+	for _, s := range samples[from:to] {
+		v := float64(s) / math.MaxInt32
+		sum += v * v
+	}
+	rms := math.Sqrt(sum / float64(to-from))
+	return 20 * math.Log10(max(rms, 1e-5))
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// mp3 Layer III bitrates in kbit/s and sample rates, by header index
+var (
+	mp3Bitrates         = [2][15]int{{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}, {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}}
+	mp3SampleRates      = [3]int{44100, 48000, 32000}
+	mp3VersionRateScale = map[byte]int{3: 1, 2: 2, 0: 4} // MPEG 1, 2 and 2.5
+)
+
+// mp3Duration adds up the duration of the Layer III frames in mp3 data
+func mp3Duration(data []byte) time.Duration {
+	data = stripID3(data)
+	var seconds float64
+	for pos := 0; pos+4 <= len(data); {
+		h := data[pos : pos+4]
+		version, layer := (h[1]>>3)&3, (h[1]>>1)&3
+		bitrateIndex, rateIndex := int(h[2]>>4), int(h[2]>>2)&3
+		scale, ok := mp3VersionRateScale[version]
+		if h[0] != 0xff || h[1]&0xe0 != 0xe0 || !ok || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+			pos++
+			continue
+		}
+		table, samples := 0, 1152
+		if version != 3 {
+			table, samples = 1, 576
+		}
+		rate := mp3SampleRates[rateIndex] / scale
+		bitrate := mp3Bitrates[table][bitrateIndex] * 1000
+		padding := int(h[2]>>1) & 1
+		seconds += float64(samples) / float64(rate)
+		pos += samples/8*bitrate/rate + padding
+	}
+	return secondsDuration(seconds)
+}
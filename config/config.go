@@ -0,0 +1,190 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config is the Google Cloud settings shared by the fabulae
+// command, the service and batch jobs. Each setting comes from its
+// default, a JSON config file, the environment and flags, later ones
+// taking precedence
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	DefaultRegion = "us-central1"
+	DefaultModel  = "gemini-1.5-pro"
+)
+
+// Config is the project, region, audio bucket and model
+type Config struct {
+	ProjectID string `json:"project_id,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"` // bucket or bucket/prefix, for generated audio
+	Model     string `json:"model,omitempty"`
+
+	sources map[string]string // where each setting came from, by flag name
+}
+
+// setting is a Config field with its flag, environment variable and config
+// file key
+type setting struct {
+	flag, env, key string
+	usage          string
+	value          func(*Config) *string
+}
+
+var settings = []setting{
+	{"project", "PROJECT_ID", "project_id", "Google Cloud project", func(c *Config) *string { return &c.ProjectID }},
+	{"region", "REGION", "region", "Google Cloud region", func(c *Config) *string { return &c.Region }},
+	{"bucket", "GCS_AUDIO_BUCKET", "bucket", "Cloud Storage bucket, or bucket/prefix, for generated audio", func(c *Config) *string { return &c.Bucket }},
+	{"model", "MODEL_NAME", "model", "generative model name", func(c *Config) *string { return &c.Model }},
+}
+
+// Secrets are the environment variables that hold credentials, shown only
+// as set or not by Dump, or as the Secret Manager secret they name
+var Secrets = []string{
+	"PROMPT_ADMIN_TOKEN",
+	"NOTIFY_WEBHOOK_URL",
+	"ELEVENLABS_API_KEY",
+	"AZURE_SPEECH_KEY",
+	"BUZZSPROUT_API_TOKEN",
+	"TRANSISTOR_API_KEY",
+	"FABULAE_SIGNING_KEY",
+}
+
+// projectPattern is a project ID, optionally domain-scoped, e.g. example.com:my-project
+var projectPattern = regexp.MustCompile(`^([a-z0-9.-]+:)?[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+
+// Load reads the config file at path, if there is one, and then the
+// environment over the defaults; a missing file is ignored
+func Load(path string) (*Config, error) {
+	c := &Config{Region: DefaultRegion, Model: DefaultModel, sources: map[string]string{}}
+	for _, s := range settings {
+		if *s.value(c) != "" {
+			c.sources[s.flag] = "default"
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			// the file may have other keys, e.g. the command's voices and shows
+			var file Config
+			if err := json.Unmarshal(data, &file); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			for _, s := range settings {
+				if v := *s.value(&file); v != "" {
+					c.set(s, v, path)
+				}
+			}
+		}
+	}
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			c.set(s, v, "env "+s.env)
+		}
+	}
+	return c, nil
+}
+
+// RegisterFlags adds the named settings' flags to fs, or every setting's,
+// skipping flags fs already has, e.g. a command's own -model
+func RegisterFlags(fs *flag.FlagSet, names ...string) {
+	for _, s := range settings {
+		if len(names) > 0 && !slices.Contains(names, s.flag) || fs.Lookup(s.flag) != nil {
+			continue
+		}
+		// read by Flags once fs is parsed
+		fs.String(s.flag, "", fmt.Sprintf("%s, or env %s", s.usage, s.env))
+	}
+}
+
+// Flags sets the settings from the flags set on fs, after it's parsed
+func (c *Config) Flags(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if f.Name == s.flag {
+				c.set(s, f.Value.String(), "flag -"+s.flag)
+			}
+		}
+	})
+}
+
+// set sets a setting from source, a bucket given as a gs:// URI is
+// trimmed to its name
+func (c *Config) set(s setting, v, source string) {
+	if s.flag == "bucket" {
+		v = strings.TrimSuffix(strings.TrimPrefix(v, "gs://"), "/")
+	}
+	*s.value(c) = v
+	c.sources[s.flag] = source
+}
+
+// Validate checks the settings that are set, and that the required ones,
+// by flag name, e.g. project, are
+func (c *Config) Validate(required ...string) error {
+	var errs []error
+	for _, s := range settings {
+		v := *s.value(c)
+		switch {
+		case v == "":
+			if slices.Contains(required, s.flag) {
+				errs = append(errs, fmt.Errorf("missing %s, set env %s or -%s", s.usage, s.env, s.flag))
+			}
+		case s.flag == "project" && !projectPattern.MatchString(v):
+			errs = append(errs, fmt.Errorf("%s %q from %s isn't a project ID", s.env, v, c.sources[s.flag]))
+		case strings.ContainsAny(v, " \t\n") || s.flag == "region" && strings.Contains(v, "/"):
+			errs = append(errs, fmt.Errorf("invalid %s %q from %s", s.env, v, c.sources[s.flag]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Dump writes the settings and where each came from, and which secrets are
+// set without their values
+func (c *Config) Dump(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, s := range settings {
+		v, source := *s.value(c), c.sources[s.flag]
+		if v == "" {
+			v, source = "-", "not set"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.key, v, source)
+	}
+	for _, name := range Secrets {
+		v := "not set"
+		switch s := os.Getenv(name); {
+		case strings.HasPrefix(s, "projects/") && strings.Contains(s, "/secrets/"):
+			v = "Secret Manager " + s
+		case s != "":
+			v = "set, redacted"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", name, v)
+	}
+	return tw.Flush()
+}
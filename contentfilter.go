@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// content filter modes
+const (
+	FilterBlock   = "block"   // fail on any filtered term
+	FilterBleep   = "bleep"   // bleep filtered terms when spoken
+	FilterRewrite = "rewrite" // replace filtered terms with milder ones
+)
+
+// ErrContentBlocked is returned when a script has filtered terms in block mode
+var ErrContentBlocked = errors.New("script has filtered terms")
+
+// defaultFilterTerms are filtered unless terms are given, with their rewrites
+var defaultFilterTerms = map[string]string{
+	"fuck":     "fudge",
+	"fucking":  "freaking",
+	"shit":     "shoot",
+	"bullshit": "nonsense",
+	"damn":     "darn",
+	"goddamn":  "gosh darn",
+	"hell":     "heck",
+	"ass":      "butt",
+	"asshole":  "jerk",
+	"bitch":    "jerk",
+	"bastard":  "jerk",
+	"crap":     "junk",
+	"piss":     "tick",
+	"pissed":   "ticked",
+}
+
+// ContentFilter finds terms in a script, e.g. profanity, for brand safety
+type ContentFilter struct {
+	Mode string
+	// Terms maps terms, matched as whole words without case, to their
+	// rewrites; an empty rewrite removes the term in rewrite mode
+	Terms map[string]string
+}
+
+// FilterChange is a filtered term in a script
+type FilterChange struct {
+	Line        int    `json:"line"`
+	Term        string `json:"term"`
+	Action      string `json:"action"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// NewContentFilter returns a filter with the built-in terms
+func NewContentFilter(mode string) (*ContentFilter, error) {
+	switch mode {
+	case FilterBlock, FilterBleep, FilterRewrite:
+	default:
+		return nil, fmt.Errorf("unknown content filter mode %s, use block, bleep or rewrite", mode)
+	}
+	terms := map[string]string{}
+	for term, rewrite := range defaultFilterTerms {
+		terms[term] = rewrite
+	}
+	return &ContentFilter{Mode: mode, Terms: terms}, nil
+}
+
+// ParseFilterTerms reads terms, one per line, with an optional rewrite
+// after =, e.g. "darn=drat"; blank lines and lines starting with # are skipped
+func ParseFilterTerms(text string) map[string]string {
+	terms := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		term, rewrite, _ := strings.Cut(line, "=")
+		terms[strings.ToLower(strings.TrimSpace(term))] = strings.TrimSpace(rewrite)
+	}
+	return terms
+}
+
+// Apply filters a script, returning the filtered script and its changes;
+// in block mode, a script with changes returns ErrContentBlocked
+func (f *ContentFilter) Apply(script string) (string, []FilterChange, error) {
+	changes := []FilterChange{}
+	if len(f.Terms) == 0 {
+		return script, changes, nil
+	}
+	re := f.pattern()
+	lines := strings.Split(script, "\n")
+	for i, line := range lines {
+		lines[i] = re.ReplaceAllStringFunc(line, func(match string) string {
+			term := strings.ToLower(match)
+			change := FilterChange{Line: i + 1, Term: term, Action: f.Mode}
+			replacement := match
+			switch f.Mode {
+			case FilterBleep:
+				replacement = bleepMarker
+			case FilterRewrite:
+				replacement = matchCase(f.Terms[term], match)
+				change.Replacement = replacement
+			}
+			changes = append(changes, change)
+			return replacement
+		})
+		if f.Mode == FilterRewrite {
+			// removed terms leave double spaces
+			lines[i] = strings.Join(strings.Fields(lines[i]), " ")
+		}
+	}
+	if f.Mode == FilterBlock && len(changes) > 0 {
+		return script, changes, fmt.Errorf("%w: %d, first %q on line %d", ErrContentBlocked, len(changes), changes[0].Term, changes[0].Line)
+	}
+	return strings.Join(lines, "\n"), changes, nil
+}
+
+// pattern matches any term as a whole word, longest terms first
+func (f *ContentFilter) pattern() *regexp.Regexp {
+	terms := []string{}
+	for term := range f.Terms {
+		terms = append(terms, regexp.QuoteMeta(term))
+	}
+	sort.Slice(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(terms, "|") + `)\b`)
+}
+
+// matchCase capitalizes a replacement like the text it replaces
+func matchCase(replacement, original string) string {
+	if replacement == "" {
+		return ""
+	}
+	if strings.ToUpper(original) == original && len(original) > 1 {
+		return strings.ToUpper(replacement)
+	}
+	if r, _ := utf8.DecodeRuneInString(original); unicode.IsUpper(r) {
+		first, size := utf8.DecodeRuneInString(replacement)
+		return string(unicode.ToUpper(first)) + replacement[size:]
+	}
+	return replacement
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// ContextCaching caches a document with Vertex AI context caching, so
+// generating from it again, e.g. in another style, bills its tokens once
+var ContextCaching = false
+
+// ContextCacheTTL is how long a document's context cache is kept
+var ContextCacheTTL = time.Hour
+
+// ContextCacheFile records the context caches so later runs reuse them, if
+// empty they're reused only in this process
+var ContextCacheFile string
+
+// minCacheTokens is the smallest context Vertex AI caches
+const minCacheTokens = 32768
+
+// contextCache is a document's context cache for a model
+type contextCache struct {
+	Name    string    `json:"name"` // e.g. projects/p/locations/l/cachedContents/123
+	Model   string    `json:"model"`
+	Source  string    `json:"source"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	contextCachesMu sync.Mutex
+	contextCaches   map[string]contextCache // by model and source
+)
+
+// contextCacheKey is a document's key in the context caches, with local
+// files by their content
+func contextCacheKey(modelName, source string) string {
+	return modelName + " " + fixtureSource(source)
+}
+
+// loadContextCaches reads ContextCacheFile the first time it's needed
+func loadContextCaches() {
+	if contextCaches != nil {
+		return
+	}
+	contextCaches = map[string]contextCache{}
+	if ContextCacheFile == "" {
+		return
+	}
+	data, err := os.ReadFile(ContextCacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &contextCaches)
+	}
+	if err != nil {
+		log.Printf("unable to read context caches from %s: %v", ContextCacheFile, err)
+	}
+}
+
+// saveContextCaches writes the unexpired context caches to ContextCacheFile
+func saveContextCaches() {
+	if ContextCacheFile == "" {
+		return
+	}
+	for key, c := range contextCaches {
+		if time.Now().After(c.Expires) {
+			delete(contextCaches, key)
+		}
+	}
+	data, err := json.MarshalIndent(contextCaches, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(ContextCacheFile), 0755); err == nil {
+			err = os.WriteFile(ContextCacheFile, data, 0644)
+		}
+	}
+	if err != nil {
+		log.Printf("unable to write context caches to %s: %v", ContextCacheFile, err)
+	}
+}
+
+// cachedModel is a model with document in its context cache, reusing the
+// cache from an earlier run if it hasn't expired; it's nil, and the
+// document sent with the prompt, if caching is off, the document's under
+// minCacheTokens or the cache can't be created
+func cachedModel(ctx context.Context, client *genai.Client, modelName, source string, document genai.Part, tokens int32) *genai.GenerativeModel {
+	if !ContextCaching {
+		return nil
+	}
+	contextCachesMu.Lock()
+	defer contextCachesMu.Unlock()
+	loadContextCaches()
+
+	key := contextCacheKey(modelName, source)
+	// with a minute to spare, for the generation itself
+	if c, ok := contextCaches[key]; ok && time.Until(c.Expires) > time.Minute {
+		cc, err := client.GetCachedContent(ctx, c.Name)
+		if err == nil {
+			debugf(DebugRequests, "gemini: reusing context cache %s for %s, expires %s", c.Name, source, c.Expires.Format(time.RFC3339))
+			return client.GenerativeModelFromCachedContent(cc)
+		}
+		log.Printf("context cache %s is gone, caching %s again: %v", c.Name, source, err)
+		delete(contextCaches, key)
+	}
+	if tokens < minCacheTokens {
+		log.Printf("not caching %s, %d tokens is under the %d Vertex AI caches", source, tokens, minCacheTokens)
+		return nil
+	}
+
+	cc, err := client.CreateCachedContent(ctx, &genai.CachedContent{
+		Model:      modelName,
+		Contents:   []*genai.Content{{Role: "user", Parts: []genai.Part{document}}},
+		Expiration: genai.ExpireTimeOrTTL{TTL: ContextCacheTTL},
+	})
+	if err != nil {
+		log.Printf("unable to cache %s, sending it with the prompt: %v", source, err)
+		return nil
+	}
+	expires := cc.Expiration.ExpireTime
+	if expires.IsZero() {
+		expires = time.Now().Add(ContextCacheTTL)
+	}
+	contextCaches[key] = contextCache{Name: cc.Name, Model: modelName, Source: source, Expires: expires}
+	saveContextCaches()
+	log.Printf("cached %s as %s until %s", source, cc.Name, expires.Format(time.RFC3339))
+	return client.GenerativeModelFromCachedContent(cc)
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// maxPreviousEpisodes is how many recent episodes a show keeps summaries of
+const maxPreviousEpisodes = 5
+
+// summaryPrompt asks for a summary of an episode's script, to remind the
+// hosts of it in later episodes
+const summaryPrompt = `Summarize this podcast episode in two or three sentences, for the hosts to remember it by in later episodes: the paper or topic, the main points discussed and any opinions or open questions the hosts left off with. Write it in the third person and past tense, e.g. "The hosts discussed ...". Output only the summary.
+
+<Script>
+%s`
+
+// EpisodeSummary is a summary of an earlier episode of a show
+type EpisodeSummary struct {
+	Number  int       `json:"number"`
+	Title   string    `json:"title,omitempty"` // e.g. "Paper Trail, episode 14: AudioLM"
+	Summary string    `json:"summary"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+// SummarizeEpisode summarizes an episode's script with Gemini
+func SummarizeEpisode(ctx context.Context, projectID, location, modelName, script string) (string, error) {
+	request := fmt.Sprintf("summary, model: %s\nscript:\n%s", modelName, script)
+	res, err := withFixture("gemini-summary", "txt", []byte(request), request, func() ([]byte, error) {
+		return summarizeEpisode(ctx, projectID, location, modelName, script)
+	})
+	return strings.TrimSpace(string(res)), err
+}
+
+func summarizeEpisode(ctx context.Context, projectID, location, modelName, script string) ([]byte, error) {
+	client, err := genaiClient(projectID, location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %w", err)
+	}
+
+	model := client.GenerativeModel(modelName)
+	model.SetTemperature(0)
+	model.SafetySettings = safetySettings
+
+	debugf(DebugRequests, "gemini: summary, model %s, %d characters", modelName, len(script))
+	start := time.Now()
+	res, err := model.GenerateContent(ctx, genai.Text(fmt.Sprintf(summaryPrompt, script)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to summarize episode: %w", err)
+	}
+	debugResponse(res, start)
+	if len(res.Candidates) == 0 ||
+		len(res.Candidates[0].Content.Parts) == 0 {
+		return nil, errors.New("empty summary response from model")
+	}
+	return []byte(fmt.Sprintf("%s", res.Candidates[0].Content.Parts[0])), nil
+}
+
+// AddEpisode records a finished episode's summary, keeping the most recent
+// maxPreviousEpisodes in episode order
+func (s *Show) AddEpisode(summary EpisodeSummary) {
+	episodes := []EpisodeSummary{}
+	for _, e := range s.Previous {
+		if e.Number != summary.Number {
+			episodes = append(episodes, e)
+		}
+	}
+	i := len(episodes)
+	for i > 0 && episodes[i-1].Number > summary.Number {
+		i--
+	}
+	episodes = append(episodes[:i], append([]EpisodeSummary{summary}, episodes[i:]...)...)
+	if len(episodes) > maxPreviousEpisodes {
+		episodes = episodes[len(episodes)-maxPreviousEpisodes:]
+	}
+	s.Previous = episodes
+}
+
+// PreviousEpisodes are the summaries of the episodes before number, for
+// the prompt
+func (s Show) PreviousEpisodes(number int) []EpisodeSummary {
+	var previous []EpisodeSummary
+	for _, e := range s.Previous {
+		if number <= 0 || e.Number < number {
+			previous = append(previous, e)
+		}
+	}
+	return previous
+}
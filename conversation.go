@@ -0,0 +1,333 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+//go:embed prompts/*.tpl
+var promptTemplates embed.FS // Embed prompt templates from the prompts directory
+
+// safetySettings are used for all document generation requests
+var safetySettings = []*genai.SafetySetting{
+	{
+		Category:  genai.HarmCategoryHarassment,
+		Threshold: genai.HarmBlockOnlyHigh,
+	},
+	{
+		Category:  genai.HarmCategoryDangerousContent,
+		Threshold: genai.HarmBlockOnlyHigh,
+	},
+}
+
+// DocumentInfo is the controlled generation output for title extraction
+type DocumentInfo struct {
+	Title string `json:"title"`
+}
+
+// promptTemplate parses a prompt template from FABULAE_PROMPTS_DIR, if it's
+// set and has the template, or the embedded prompts, so prompts can be
+// changed without rebuilding
+func promptTemplate(name string) (*template.Template, error) {
+	if dir := os.Getenv("FABULAE_PROMPTS_DIR"); dir != "" {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			debugf(DebugRequests, "prompt %s from %s", name, path)
+			return template.New(name).ParseFiles(path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return template.New(name).ParseFS(promptTemplates, "prompts/"+name)
+}
+
+// defaultPodcastTurns is the length of a podcast without a target length
+const defaultPodcastTurns = 26
+
+// wordsPerPodcastTurn estimates turns for a target length
+const wordsPerPodcastTurn = 45
+
+// PromptData customizes the built-in prompts, zero values keep their defaults
+type PromptData struct {
+	HostNames      []string // the host's and expert's names, unnamed by default
+	ShowName       string
+	TargetMinutes  int
+	Audience       string    // e.g. high school students
+	Tone           string    // e.g. playful
+	Code           string    // how to treat source code, CodeDescribe or CodeSkip
+	SkipReferences bool      // ignore references, footnotes and page headers and footers
+	Personas       []Persona // the host's and expert's characters, see WithPersonas
+	// PreviousEpisodes are the show's earlier episodes, oldest first
+	PreviousEpisodes []EpisodeSummary
+}
+
+// Turns is the number of turns to write, for the target length
+func (d PromptData) Turns() int {
+	if d.TargetMinutes <= 0 {
+		return defaultPodcastTurns
+	}
+	turns := d.Words() / wordsPerPodcastTurn
+	return max(6, turns+turns%2)
+}
+
+// Words is the number of words for the target length
+func (d PromptData) Words() int {
+	return d.TargetMinutes * wordsPerMinute
+}
+
+// PodcastPrompt returns the built-in podcast prompt
+func PodcastPrompt() (string, error) {
+	return PodcastPromptWith(PromptData{})
+}
+
+// PodcastPromptWith returns the built-in podcast prompt customized with data
+func PodcastPromptWith(data PromptData) (string, error) {
+	tmpl, err := promptTemplate("podcast.tpl")
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// PromptNames are the names of the built-in prompts, e.g. podcast
+func PromptNames() []string {
+	names := []string{}
+	files, _ := fs.Glob(promptTemplates, "prompts/*.tpl")
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(path.Base(f), ".tpl"))
+	}
+	return names
+}
+
+// BuiltinPrompt returns a built-in prompt template's text
+func BuiltinPrompt(name string) (string, error) {
+	data, err := promptTemplates.ReadFile("prompts/" + name + ".tpl")
+	if err != nil {
+		return "", fmt.Errorf("unknown prompt %s", name)
+	}
+	return string(data), nil
+}
+
+// RenderPrompt executes prompt template text, e.g. a stored version of a
+// built-in prompt, with data
+func RenderPrompt(name, text string, data PromptData) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// GenerateConversation creates a conversation from a PDF source using the
+// provided prompt; if prompt is empty, the built-in podcast prompt is used.
+// A generation Gemini blocks is a *BlockedError
+func GenerateConversation(ctx context.Context, projectID, location, modelName, source, prompt string) (string, error) {
+	g, err := generateConversationFixture(ctx, projectID, location, modelName, source, prompt, false)
+	return g.Text, err
+}
+
+// generateConversationFixture generates a conversation, with the relaxed
+// safety settings if relaxed, recording or replaying it with fixtures
+func generateConversationFixture(ctx context.Context, projectID, location, modelName, source, prompt string, relaxed bool) (Generation, error) {
+	// use built-in prompt if one isn't supplied
+	if prompt == "" {
+		var err error
+		prompt, err = PodcastPrompt()
+		if err != nil {
+			return Generation{}, fmt.Errorf("unable to load prompt: %w", err)
+		}
+	}
+
+	request := fmt.Sprintf("model: %s\nsource: %s\nprompt:\n%s", modelName, fixtureSource(source), prompt)
+	if relaxed {
+		request = "safety: relaxed\n" + request
+	}
+	// fixtures record the script, a replayed generation has only its text
+	g := Generation{Model: modelName}
+	conversation, err := withFixture("gemini", "txt", []byte(request), request, func() ([]byte, error) {
+		var err error
+		g, err = generateConversation(ctx, projectID, location, modelName, source, prompt, relaxed)
+		return []byte(g.Text), err
+	})
+	g.Text = string(conversation)
+	return g, err
+}
+
+// generateConversation calls Gemini for GenerateConversation
+func generateConversation(ctx context.Context, projectID, location, modelName, source, prompt string, relaxed bool) (Generation, error) {
+	// the shared generative AI client
+	client, err := genaiClient(projectID, location)
+	if err != nil {
+		return Generation{}, fmt.Errorf("unable to create client: %w", err)
+	}
+
+	// set the model name
+	model := client.GenerativeModel(modelName)
+
+	document, err := documentPart(ctx, source)
+	if err != nil {
+		return Generation{}, err
+	}
+
+	// parts for both token count and generation
+	parts := []genai.Part{
+		document,
+		genai.Text(`"\n\n"`),
+		genai.Text(prompt),
+	}
+
+	// count tokens
+	var tokens int32
+	if tr, err := model.CountTokens(ctx, parts...); err == nil {
+		tokens = tr.TotalTokens
+		log.Printf("processing %s tokens ...", strconv.FormatInt(int64(tr.TotalTokens), 10))
+	}
+	// a cached document isn't sent again
+	if cached := cachedModel(ctx, client, modelName, source, document, tokens); cached != nil {
+		model, parts = cached, parts[1:]
+	}
+
+	model.SafetySettings = safetySettings
+	if relaxed {
+		model.SafetySettings = relaxedSafetySettings
+	}
+	structured := structuredScript(modelName)
+	if structured {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = scriptSchema
+		parts = append(parts, genai.Text(structuredInstructions))
+	}
+
+	debugf(DebugRequests, "gemini: generate conversation, model %s, location %s, source %s", modelName, location, source)
+	debugf(DebugPayloads, "gemini: prompt:\n%s", prompt)
+	// a chat, so a script cut off at the output limit can be continued
+	g, err := generate(ctx, model.StartChat(), modelName, structured, parts...)
+	g.Cache = model.CachedContentName
+	return g, err
+}
+
+// debugResponse logs a Gemini response's metadata and, at the payload level, its text
+func debugResponse(res *genai.GenerateContentResponse, start time.Time) {
+	if res.UsageMetadata != nil {
+		debugf(DebugRequests, "gemini: response in %s, tokens prompt %d, candidates %d, total %d",
+			time.Since(start), res.UsageMetadata.PromptTokenCount, res.UsageMetadata.CandidatesTokenCount, res.UsageMetadata.TotalTokenCount)
+	} else {
+		debugf(DebugRequests, "gemini: response in %s", time.Since(start))
+	}
+	for i, c := range res.Candidates {
+		debugf(DebugRequests, "gemini: candidate %d finish reason %s", i, c.FinishReason)
+		if c.Content == nil {
+			continue
+		}
+		for _, p := range c.Content.Parts {
+			debugf(DebugPayloads, "gemini: candidate %d:\n%v", i, p)
+		}
+	}
+}
+
+// GetTitleOfDocument uses Gemini Controlled Generation to output a title
+func GetTitleOfDocument(ctx context.Context, projectID, location, source string) string {
+	// Drive files already have a name
+	if fileID, ok := DriveFileID(source); ok {
+		title, err := driveFileName(ctx, fileID)
+		if err != nil {
+			log.Printf("unable to get Drive file name: %v", err)
+			return ""
+		}
+		return title
+	}
+
+	request := "title, model: gemini-1.5-flash\nsource: " + fixtureSource(source)
+	res, err := withFixture("gemini-title", "json", []byte(request), request, func() ([]byte, error) {
+		return titleOfDocument(ctx, projectID, location, source)
+	})
+	if err != nil {
+		log.Print(err)
+		return ""
+	}
+	var doc DocumentInfo
+	err = json.Unmarshal(res, &doc)
+	if err != nil {
+		log.Printf("couldn't unmarshal: %s: %v", res, err)
+		return ""
+	}
+
+	title := doc.Title
+	if len(doc.Title) > 50 {
+		title = title[:50]
+	}
+	return title
+}
+
+// titleOfDocument asks Gemini for a document's title as JSON
+func titleOfDocument(ctx context.Context, projectID, location, source string) ([]byte, error) {
+	// the shared generative AI client
+	client, err := genaiClient(projectID, location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %w", err)
+	}
+
+	model := client.GenerativeModel("gemini-1.5-flash")
+	model.ResponseMIMEType = "application/json"
+	model.SafetySettings = safetySettings
+
+	document, err := documentPart(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read document: %w", err)
+	}
+
+	parts := []genai.Part{
+		document,
+		genai.Text(`extract the title only from this document, if there isn't a title, provide a short few word title. Make sure it's in this form only:
+{"title": "title of document"}`)}
+
+	debugf(DebugRequests, "gemini: title, model gemini-1.5-flash, source %s", source)
+	start := time.Now()
+	res, err := model.GenerateContent(ctx, parts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate title contents: %w", err)
+	}
+	debugResponse(res, start)
+	if len(res.Candidates) == 0 ||
+		len(res.Candidates[0].Content.Parts) == 0 {
+		return nil, errors.New("empty title response from model")
+	}
+	return []byte(fmt.Sprintf("%s", res.Candidates[0].Content.Parts[0])), nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// DefaultQualityRetries is how many times a script under the minimum score
+// is regenerated, unless set
+const DefaultQualityRetries = 2
+
+// critiquePrompt asks for a script's scores against the source document
+const critiquePrompt = `You are a podcast editor reviewing a script written from the document above. Score the script from 1 to 10 on each of:
+
+coverage: how well it covers the document's key points and contributions
+factuality: how well its claims agree with the document, with nothing invented or misstated
+banter: how natural, engaging and varied the conversation between the two speakers is
+
+Then give feedback for the writer, specific changes that would raise the lowest scores, in a few sentences.
+
+<Script>
+%s
+</Script>`
+
+// ScriptCritique is Gemini's review of a script against its source, each
+// score from 1 to 10
+type ScriptCritique struct {
+	Coverage   int    `json:"coverage"`
+	Factuality int    `json:"factuality"`
+	Banter     int    `json:"banter"`
+	Feedback   string `json:"feedback"`
+}
+
+// Score is the mean of the critique's scores
+func (c ScriptCritique) Score() float64 {
+	return float64(c.Coverage+c.Factuality+c.Banter) / 3
+}
+
+func (c ScriptCritique) String() string {
+	return fmt.Sprintf("%.1f (coverage %d, factuality %d, banter %d)", c.Score(), c.Coverage, c.Factuality, c.Banter)
+}
+
+// critiqueSchema is the controlled generation schema for ScriptCritique
+var critiqueSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"coverage":   {Type: genai.TypeInteger},
+		"factuality": {Type: genai.TypeInteger},
+		"banter":     {Type: genai.TypeInteger},
+		"feedback":   {Type: genai.TypeString},
+	},
+	Required: []string{"coverage", "factuality", "banter", "feedback"},
+}
+
+// CritiqueScript scores a generated script against its source document
+func CritiqueScript(ctx context.Context, projectID, location, modelName, source, script string) (ScriptCritique, error) {
+	var critique ScriptCritique
+	request := fmt.Sprintf("critique, model: %s\nsource: %s\nscript:\n%s", modelName, fixtureSource(source), script)
+	res, err := withFixture("gemini-critique", "json", []byte(request), request, func() ([]byte, error) {
+		return critiqueScript(ctx, projectID, location, modelName, source, script)
+	})
+	if err != nil {
+		return critique, err
+	}
+	if err := json.Unmarshal(res, &critique); err != nil {
+		return critique, fmt.Errorf("couldn't unmarshal critique: %s: %w", res, err)
+	}
+	return critique, nil
+}
+
+// critiqueScript asks Gemini for a script's critique as JSON
+func critiqueScript(ctx context.Context, projectID, location, modelName, source, script string) ([]byte, error) {
+	client, err := genaiClient(projectID, location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %w", err)
+	}
+
+	model := client.GenerativeModel(modelName)
+	model.ResponseMIMEType = "application/json"
+	model.ResponseSchema = critiqueSchema
+	model.SetTemperature(0)
+	model.SafetySettings = safetySettings
+
+	document, err := documentPart(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read document: %w", err)
+	}
+
+	debugf(DebugRequests, "gemini: critique, model %s, source %s", modelName, source)
+	start := time.Now()
+	res, err := model.GenerateContent(ctx, document, genai.Text(fmt.Sprintf(critiquePrompt, script)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to critique script: %w", err)
+	}
+	debugResponse(res, start)
+	if len(res.Candidates) == 0 ||
+		len(res.Candidates[0].Content.Parts) == 0 {
+		return nil, errors.New("empty critique response from model")
+	}
+	return []byte(fmt.Sprintf("%s", res.Candidates[0].Content.Parts[0])), nil
+}
+
+// RevisionPrompt adds a critique's feedback to a prompt, to regenerate a
+// script that scored too low
+func RevisionPrompt(prompt string, critique ScriptCritique) string {
+	return fmt.Sprintf(`%s
+
+<Revision Instructions>
+
+An earlier draft of this conversation was reviewed and scored %s out of 10. Write a new conversation that follows all of the instructions above and addresses this feedback:
+
+%s`, prompt, critique, critique.Feedback)
+}
+
+// QualityOptions are the minimum score for a generated script and how many
+// times to regenerate it with the critique's feedback
+type QualityOptions struct {
+	MinScore   float64 // 1 to 10
+	MaxRetries int     // default DefaultQualityRetries
+	Model      string  // for the critique, default the generation model
+	// Safety is what a blocked generation is retried with
+	Safety SafetyFallback
+}
+
+func (o QualityOptions) withDefaults(modelName string) QualityOptions {
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = DefaultQualityRetries
+	}
+	if o.Model == "" {
+		o.Model = modelName
+	}
+	return o
+}
+
+// GenerateReviewedConversation generates a conversation like
+// GenerateConversation, then critiques it, regenerating with the feedback
+// until it scores opts.MinScore or the retries run out; it returns the best
+// scoring script and its critique
+func GenerateReviewedConversation(ctx context.Context, projectID, location, modelName, source, prompt string, opts QualityOptions) (string, ScriptCritique, error) {
+	opts = opts.withDefaults(modelName)
+	if prompt == "" {
+		var err error
+		if prompt, err = PodcastPrompt(); err != nil {
+			return "", ScriptCritique{}, fmt.Errorf("unable to load prompt: %w", err)
+		}
+	}
+	var best string
+	var bestCritique ScriptCritique
+	next := prompt
+	for attempt := 0; attempt <= opts.MaxRetries; attempt++ {
+		script, err := GenerateConversationWithFallback(ctx, projectID, location, modelName, source, next, opts.Safety)
+		if err != nil {
+			if best != "" {
+				log.Printf("unable to regenerate, keeping the best draft: %v", err)
+				return best, bestCritique, nil
+			}
+			return "", bestCritique, err
+		}
+		critique, err := CritiqueScript(ctx, projectID, location, opts.Model, source, script)
+		if err != nil {
+			// a script without a critique can't be compared to the best draft
+			if best != "" {
+				log.Printf("unable to critique the script, keeping the best draft: %v", err)
+				return best, bestCritique, nil
+			}
+			log.Printf("unable to critique the script, keeping it: %v", err)
+			return script, critique, nil
+		}
+		log.Printf("script scored %s", critique)
+		if best == "" || critique.Score() > bestCritique.Score() {
+			best, bestCritique = script, critique
+		}
+		if critique.Score() >= opts.MinScore {
+			break
+		}
+		if attempt < opts.MaxRetries {
+			log.Printf("under the minimum score %.1f, regenerating: %s", opts.MinScore, critique.Feedback)
+		}
+		next = RevisionPrompt(prompt, critique)
+	}
+	if bestCritique.Score() < opts.MinScore {
+		log.Printf("no draft reached the minimum score %.1f, using the best, %s", opts.MinScore, bestCritique)
+	}
+	return best, bestCritique, nil
+}
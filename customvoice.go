@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	ttspb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+	"google.golang.org/api/option"
+)
+
+// CustomVoice is a Cloud Text-to-Speech custom voice model, e.g. a licensed
+// voice clone, usable as a voice name once registered
+type CustomVoice struct {
+	Model           string `json:"model"`                 // projects/PROJECT/locations/LOCATION/models/MODEL
+	LanguageCode    string `json:"language"`              // e.g. en-US
+	Endpoint        string `json:"endpoint,omitempty"`    // alternate API endpoint, e.g. us-central1-texttospeech.googleapis.com:443
+	CredentialsFile string `json:"credentials,omitempty"` // service account key authorized for the model
+	QuotaProject    string `json:"quota_project,omitempty"`
+	Offline         bool   `json:"offline,omitempty"` // report usage as offline instead of realtime
+}
+
+var (
+	customVoicesMu sync.RWMutex
+	customVoices   = map[string]CustomVoice{}
+)
+
+// RegisterCustomVoice makes a custom voice available by name, for either
+// speaker; a name starting with projects/ is the model itself
+func RegisterCustomVoice(name string, voice CustomVoice) error {
+	if !strings.HasPrefix(voice.Model, "projects/") || !strings.Contains(voice.Model, "/models/") {
+		return fmt.Errorf("custom voice %s: model must be projects/PROJECT/locations/LOCATION/models/MODEL", name)
+	}
+	if voice.LanguageCode == "" {
+		return fmt.Errorf("custom voice %s: language is required", name)
+	}
+	customVoicesMu.Lock()
+	defer customVoicesMu.Unlock()
+	customVoices[name] = voice
+	customVoices[voice.Model] = voice
+	return nil
+}
+
+// RegisterCustomVoicesJSON registers custom voices from a JSON object of
+// voice name to CustomVoice, e.g. the CUSTOM_VOICES environment variable
+func RegisterCustomVoicesJSON(data []byte) error {
+	voices := map[string]CustomVoice{}
+	if err := json.Unmarshal(data, &voices); err != nil {
+		return fmt.Errorf("invalid custom voices: %w", err)
+	}
+	for name, voice := range voices {
+		if err := RegisterCustomVoice(name, voice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsCustomVoice reports whether name is a registered custom voice
+func IsCustomVoice(name string) bool {
+	_, ok := customVoice(name)
+	return ok
+}
+
+// customVoice returns a registered custom voice by name or model
+func customVoice(name string) (CustomVoice, bool) {
+	customVoicesMu.RLock()
+	defer customVoicesMu.RUnlock()
+	voice, ok := customVoices[name]
+	return voice, ok
+}
+
+// selectionParams are the voice selection params for a custom voice
+func (v CustomVoice) selectionParams() *ttspb.VoiceSelectionParams {
+	usage := ttspb.CustomVoiceParams_REALTIME
+	if v.Offline {
+		usage = ttspb.CustomVoiceParams_OFFLINE
+	}
+	return &ttspb.VoiceSelectionParams{
+		LanguageCode: v.LanguageCode,
+		CustomVoice: &ttspb.CustomVoiceParams{
+			Model:         v.Model,
+			ReportedUsage: usage,
+		},
+	}
+}
+
+// clientOptions returns the Text-to-Speech client options for a voice: the
+// endpoint and credentials of custom voices
+func clientOptions(voice *ttspb.VoiceSelectionParams) []option.ClientOption {
+	opts := []option.ClientOption{}
+	if voice == nil || voice.CustomVoice == nil {
+		return opts
+	}
+	custom, ok := customVoice(voice.CustomVoice.Model)
+	if !ok {
+		return opts
+	}
+	if custom.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(custom.Endpoint))
+	}
+	if custom.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(custom.CredentialsFile))
+	}
+	if custom.QuotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(custom.QuotaProject))
+	}
+	return opts
+}
+
+// voiceName is a voice's name for logs, the model for custom voices
+func voiceName(voice *ttspb.VoiceSelectionParams) string {
+	if voice.CustomVoice != nil {
+		return voice.CustomVoice.Model
+	}
+	return voice.Name
+}
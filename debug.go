@@ -0,0 +1,49 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"io"
+	"log"
+)
+
+// debug levels
+const (
+	// DebugOff disables debug logging
+	DebugOff = iota
+	// DebugRequests logs request metadata and timing for Gemini and Text-to-Speech calls
+	DebugRequests
+	// DebugPayloads also logs the prompts, responses and text sent for synthesis
+	DebugPayloads
+)
+
+var (
+	debugLevel  = DebugOff
+	debugLogger = log.New(io.Discard, "", 0)
+)
+
+// SetDebug sends debug logs at or below level to w, e.g. a debug log file
+func SetDebug(w io.Writer, level int) {
+	debugLevel = level
+	debugLogger = log.New(w, "", log.LstdFlags|log.Lmicroseconds)
+}
+
+// debugf logs when the debug level is at least level
+func debugf(level int, format string, v ...any) {
+	if level == DebugOff || debugLevel < level {
+		return
+	}
+	debugLogger.Printf(format, v...)
+}
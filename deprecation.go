@@ -0,0 +1,96 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+
+	ttspb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+)
+
+// journeyReplacements are the Chirp 3 HD voices replacing each Journey
+// voice, which are being retired, in every language
+var journeyReplacements = map[string]string{
+	"D": "Charon",
+	"F": "Kore",
+	"O": "Aoede",
+}
+
+// journeyVoiceRe matches Journey voice names, e.g. en-US-Journey-D
+var journeyVoiceRe = regexp.MustCompile(`^([a-z]{2,3}-[A-Z]{2})-Journey-([A-Z])$`)
+
+// DeprecatedVoice returns the current equivalent of a deprecated Cloud
+// Text-to-Speech voice, e.g. en-US-Chirp3-HD-Charon for en-US-Journey-D
+func DeprecatedVoice(name string) (string, bool) {
+	m := journeyVoiceRe.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	replacement, ok := journeyReplacements[m[2]]
+	if !ok {
+		return "", false
+	}
+	return m[1] + "-Chirp3-HD-" + replacement, true
+}
+
+// VoiceMigration is a voice to replace and what to replace it with
+type VoiceMigration struct {
+	Voice       string `json:"voice"`
+	Replacement string `json:"replacement,omitempty"` // empty if there's no similar voice
+	Reason      string `json:"reason"`                // deprecated or unavailable
+}
+
+// CheckVoices finds Cloud Text-to-Speech voices that are deprecated or no
+// longer available, with a replacement for each; other providers' and
+// custom voices aren't checked
+func CheckVoices(ctx context.Context, names ...string) ([]VoiceMigration, error) {
+	voices, err := ListVoices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	migrations := []VoiceMigration{}
+	seen := map[string]bool{}
+	for _, voice := range names {
+		provider, name := VoiceProvider(voice)
+		if voice == "" || seen[voice] || (provider != "" && provider != "google") || IsCustomVoice(name) {
+			continue
+		}
+		seen[voice] = true
+		migration := VoiceMigration{Voice: voice}
+		if _, ok := DeprecatedVoice(name); ok {
+			migration.Reason = "deprecated"
+		}
+		if !slices.ContainsFunc(voices, func(v *ttspb.Voice) bool { return v.Name == name }) {
+			migration.Reason = "unavailable"
+		}
+		if migration.Reason == "" {
+			continue
+		}
+		migration.Replacement, _ = similarVoice(voices, voice)
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+// String describes the migration
+func (m VoiceMigration) String() string {
+	if m.Replacement == "" {
+		return fmt.Sprintf("%s is %s, no similar voice found", m.Voice, m.Reason)
+	}
+	return fmt.Sprintf("%s is %s, use %s", m.Voice, m.Reason, m.Replacement)
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moutend/go-wav"
+)
+
+// where disclosures are spoken
+const (
+	DisclosureStart = "start"
+	DisclosureEnd   = "end"
+	DisclosureBoth  = "both"
+)
+
+// DefaultDisclosurePause is the silence between a disclosure and the episode
+const DefaultDisclosurePause = 800 * time.Millisecond
+
+// DisclosureOptions configures AddDisclosure, zero values use the defaults
+type DisclosureOptions struct {
+	Text     string // defaults to DisclosureText for Source
+	Source   string // what the episode was generated from, e.g. a document title
+	Voice    string
+	Position string // DisclosureStart, DisclosureEnd or DisclosureBoth
+	Pause    time.Duration
+}
+
+func (o DisclosureOptions) withDefaults() DisclosureOptions {
+	if o.Text == "" {
+		o.Text = DisclosureText(o.Source)
+	}
+	if o.Voice == "" {
+		o.Voice = "en-US-Chirp3-HD-Charon"
+	}
+	if o.Position == "" {
+		o.Position = DisclosureStart
+	}
+	if o.Pause <= 0 {
+		o.Pause = DefaultDisclosurePause
+	}
+	return o
+}
+
+// DisclosureText is the default spoken disclosure for an episode's source
+func DisclosureText(source string) string {
+	if source == "" {
+		return "This episode was generated by AI."
+	}
+	return fmt.Sprintf("This episode was generated by AI from %s.", strings.TrimSuffix(source, "."))
+}
+
+// AddDisclosure speaks an AI-generated disclosure at the start or end of an
+// episode, or both, and notes it in the file's metadata
+func AddDisclosure(ctx context.Context, synth Synthesizer, audiofile string, opts DisclosureOptions) error {
+	opts = opts.withDefaults()
+	switch opts.Position {
+	case DisclosureStart, DisclosureEnd, DisclosureBoth:
+	default:
+		return fmt.Errorf("unknown disclosure position %s, use start, end or both", opts.Position)
+	}
+	episode, err := os.ReadFile(audiofile)
+	if err != nil {
+		return err
+	}
+	disclosure, err := synth.Synthesize(ctx, opts.Voice, "", opts.Text)
+	if err != nil {
+		return fmt.Errorf("unable to synthesize disclosure: %w", err)
+	}
+	atStart := opts.Position == DisclosureStart || opts.Position == DisclosureBoth
+	atEnd := opts.Position == DisclosureEnd || opts.Position == DisclosureBoth
+
+	var output []byte
+	switch strings.ToLower(filepath.Ext(audiofile)) {
+	case "." + FormatWAV:
+		output, err = wavDisclosure(episode, disclosure, atStart, atEnd, opts.Pause)
+	case "." + FormatMP3:
+		if disclosure.Format != FormatMP3 {
+			return fmt.Errorf("the disclosure voice %s doesn't create mp3, use a voice from the episode's provider", opts.Voice)
+		}
+		var b bytes.Buffer
+		if atStart {
+			b.Write(stripID3(disclosure.Data))
+		}
+		b.Write(stripID3(episode))
+		if atEnd {
+			b.Write(stripID3(disclosure.Data))
+		}
+		output = b.Bytes()
+	default:
+		err = fmt.Errorf("can't add a disclosure to %s files", filepath.Ext(audiofile))
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(audiofile, output, 0644); err != nil {
+		return err
+	}
+	log.Printf("disclosure added to %s, %s: %q", audiofile, opts.Position, opts.Text)
+	return WriteTags(audiofile, Tags{
+		Comment:  opts.Text,
+		Software: "fabulae",
+		Created:  time.Now(),
+	})
+}
+
+// wavDisclosure puts disclosure audio, converted to the episode's format,
+// before or after the episode with a pause
+func wavDisclosure(episode []byte, disclosure Audio, atStart, atEnd bool, pause time.Duration) ([]byte, error) {
+	if disclosure.Format != FormatWAV {
+		return nil, fmt.Errorf("the disclosure is %s, the episode is wav", disclosure.Format)
+	}
+	e, d := &wav.File{}, &wav.File{}
+	if err := wav.Unmarshal(episode, e); err != nil {
+		return nil, err
+	}
+	if err := wav.Unmarshal(disclosure.Data, d); err != nil {
+		return nil, err
+	}
+	if d.SamplesPerSec() != e.SamplesPerSec() || d.Channels() != e.Channels() || d.BitsPerSample() != e.BitsPerSample() {
+		if e.BitsPerSample() != 16 {
+			return nil, fmt.Errorf("can't convert the disclosure to %d bit audio", e.BitsPerSample())
+		}
+		var err error
+		if d, err = convertWav(d, e.SamplesPerSec(), e.Channels()); err != nil {
+			return nil, err
+		}
+	}
+	output, err := wav.New(e.SamplesPerSec(), e.BitsPerSample(), e.Channels())
+	if err != nil {
+		return nil, err
+	}
+	if atStart {
+		output.Write(d.Bytes())
+		output.Write(silence(e, pause))
+	}
+	output.Write(e.Bytes())
+	if atEnd {
+		output.Write(silence(e, pause))
+		output.Write(d.Bytes())
+	}
+	return wav.Marshal(output)
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"fmt"
+	"strings"
+)
+
+// speech is synthesized as 24kHz mono wav, Text-to-Speech's default, unless
+// the episode's AudioFormat sets its rate or channels
+const (
+	speechSampleRate = 24000
+	speechChannels   = 1
+)
+
+// speechBytesPerSecond is 16-bit speech in format
+func speechBytesPerSecond(format AudioFormat) float64 {
+	rate, channels := format.SampleRate, format.Channels
+	if rate == 0 {
+		rate = speechSampleRate
+	}
+	if channels == 0 {
+		channels = speechChannels
+	}
+	return float64(rate * channels * 2)
+}
+
+// diskHeadroom covers speech slower than wordsPerMinute, pauses and the
+// files written alongside the episode
+const diskHeadroom = 1.5
+
+// DiskError is a job that needs more disk than it has
+type DiskError struct {
+	Dir   string
+	Need  uint64 // bytes
+	Free  uint64 // bytes, or the quota
+	Quota bool   // Free is a quota, rather than the disk's free space
+}
+
+func (e *DiskError) Error() string {
+	if e.Quota {
+		return fmt.Sprintf("synthesis needs about %d MB of disk, over the quota of %d MB", e.Need>>20, e.Free>>20)
+	}
+	return fmt.Sprintf("synthesis needs about %d MB of disk in %s, %d MB is free", e.Need>>20, e.Dir, e.Free>>20)
+}
+
+// SynthesisDisk estimates the disk synthesizing a conversation in format
+// takes at its peak, from its words: every turn file and the episode
+// combined from them, or when streaming turns into the episode only the
+// episode
+func SynthesisDisk(conversation string, format AudioFormat, streaming bool) uint64 {
+	words := 0
+	for _, turn := range splitTurns(conversation) {
+		words += len(strings.Fields(turn))
+	}
+	seconds := float64(words) / wordsPerMinute * 60
+	episode := uint64(seconds * speechBytesPerSecond(format) * diskHeadroom)
+	if streaming {
+		return episode
+	}
+	return 2 * episode
+}
+
+// CheckDisk returns a *DiskError if need bytes is over quota, if set, or
+// more than dir's disk has free. Free space isn't checked where it can't
+// be read, e.g. on Windows
+func CheckDisk(dir string, need, quota uint64) error {
+	if quota > 0 && need > quota {
+		return &DiskError{Dir: dir, Need: need, Free: quota, Quota: true}
+	}
+	free, err := freeDisk(dir)
+	if err != nil {
+		return nil
+	}
+	if need > free {
+		return &DiskError{Dir: dir, Need: need, Free: free}
+	}
+	return nil
+}
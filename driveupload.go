@@ -0,0 +1,134 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// driveFolderRe matches the folder ID in Drive folder URLs, e.g.
+// https://drive.google.com/drive/folders/<id>, https://drive.google.com/drive/u/0/folders/<id>
+var driveFolderRe = regexp.MustCompile(`/folders/([A-Za-z0-9_-]{20,})`)
+
+var (
+	driveCredentialsMu sync.Mutex
+	driveCredentials   string
+)
+
+// SetDriveCredentials sets the credentials file for Drive uploads, a service
+// account key or authorized user (OAuth) credentials, e.g. from
+// gcloud auth application-default login; empty uses application default credentials
+func SetDriveCredentials(file string) {
+	driveCredentialsMu.Lock()
+	defer driveCredentialsMu.Unlock()
+	driveCredentials = file
+}
+
+// DriveFolderID returns the folder ID for a Drive folder URL or a bare folder ID
+func DriveFolderID(folder string) (string, bool) {
+	if driveIDRe.MatchString(folder) {
+		return folder, true
+	}
+	u, err := url.Parse(folder)
+	if err != nil || u.Host != "drive.google.com" {
+		return "", false
+	}
+	if m := driveFolderRe.FindStringSubmatch(u.Path); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
+
+// DriveFile is a file uploaded to Drive
+type DriveFile struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	Link string `json:"link"`
+}
+
+// driveUploadService creates a Drive client that can write to folders
+// shared with the credentials
+func driveUploadService(ctx context.Context) (*drive.Service, error) {
+	driveCredentialsMu.Lock()
+	file := driveCredentials
+	driveCredentialsMu.Unlock()
+	opts := []option.ClientOption{option.WithScopes(drive.DriveScope)}
+	if file != "" {
+		opts = append(opts, option.WithCredentialsFile(file))
+	}
+	return drive.NewService(ctx, opts...)
+}
+
+// driveMimeType is the content type Drive stores a file as, by extension
+func driveMimeType(filename string) string {
+	switch ext := filepath.Ext(filename); ext {
+	case ".wav":
+		return "audio/wav"
+	case ".md":
+		return "text/markdown"
+	case ".srt":
+		return "application/x-subrip"
+	default:
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+	return "application/octet-stream"
+}
+
+// UploadToDrive uploads files to a Drive folder, which may be in a shared
+// drive, returning each uploaded file's link
+func UploadToDrive(ctx context.Context, folder string, files ...string) ([]DriveFile, error) {
+	folderID, ok := DriveFolderID(folder)
+	if !ok {
+		return nil, fmt.Errorf("invalid Drive folder %q, use a folder ID or URL", folder)
+	}
+	srv, err := driveUploadService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Drive client: %w", err)
+	}
+	uploaded := []DriveFile{}
+	for _, filename := range files {
+		f, err := os.Open(filename)
+		if err != nil {
+			return uploaded, err
+		}
+		mimeType := driveMimeType(filename)
+		created, err := srv.Files.Create(&drive.File{
+			Name:     filepath.Base(filename),
+			MimeType: mimeType,
+			Parents:  []string{folderID},
+		}).Media(f, googleapi.ContentType(mimeType)).SupportsAllDrives(true).Fields("id", "name", "webViewLink").Context(ctx).Do()
+		f.Close()
+		if err != nil {
+			return uploaded, fmt.Errorf("unable to upload %s to Drive folder %s: %w", filename, folderID, err)
+		}
+		log.Printf("uploaded %s to Drive: %s", filename, created.WebViewLink)
+		uploaded = append(uploaded, DriveFile{created.Name, created.Id, created.WebViewLink})
+	}
+	return uploaded, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moutend/go-wav"
+)
+
+const (
+	elevenLabsBaseURL = "https://api.elevenlabs.io"
+	// DefaultElevenLabsModel is the ElevenLabs model used unless set
+	DefaultElevenLabsModel = "eleven_multilingual_v2"
+	// DefaultElevenLabsFormat is the ElevenLabs output format used unless set
+	DefaultElevenLabsFormat = "mp3_44100_128"
+	// elevenLabsParallelism matches the concurrency of the entry-level plans
+	elevenLabsParallelism = 2
+)
+
+// ElevenLabs synthesizes with the ElevenLabs text-to-speech API, as MP3, or
+// as wav with a pcm_ output format
+type ElevenLabs struct {
+	APIKey       string
+	Model        string
+	OutputFormat string
+	// Voices maps voice names used in fabulae to ElevenLabs voice IDs;
+	// names that aren't mapped are used as voice IDs
+	Voices      map[string]string
+	Concurrency int
+	BaseURL     string
+	Client      *http.Client
+}
+
+// NewElevenLabs returns an ElevenLabs synthesizer with the default model and MP3 output
+func NewElevenLabs(apiKey string) *ElevenLabs {
+	return &ElevenLabs{
+		APIKey:       apiKey,
+		Model:        DefaultElevenLabsModel,
+		OutputFormat: DefaultElevenLabsFormat,
+		Voices:       map[string]string{},
+		Concurrency:  elevenLabsParallelism,
+		BaseURL:      elevenLabsBaseURL,
+		Client:       &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// newElevenLabsFromEnv configures ElevenLabs from ELEVENLABS_API_KEY and the
+// optional ELEVENLABS_MODEL, ELEVENLABS_VOICES (a JSON object of name to
+// voice ID) and ELEVENLABS_CONCURRENCY
+func newElevenLabsFromEnv() (Synthesizer, error) {
+	apiKey, err := SecretEnv(context.Background(), "ELEVENLABS_API_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == "" {
+		return nil, errors.New("ELEVENLABS_API_KEY is required for the elevenlabs provider")
+	}
+	e := NewElevenLabs(apiKey)
+	if model := os.Getenv("ELEVENLABS_MODEL"); model != "" {
+		e.Model = model
+	}
+	if voices := os.Getenv("ELEVENLABS_VOICES"); voices != "" {
+		if err := json.Unmarshal([]byte(voices), &e.Voices); err != nil {
+			return nil, fmt.Errorf("invalid ELEVENLABS_VOICES: %w", err)
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv("ELEVENLABS_CONCURRENCY")); err == nil && n > 0 {
+		e.Concurrency = n
+	}
+	return e, nil
+}
+
+// Parallelism is the number of concurrent requests the API key allows
+func (e *ElevenLabs) Parallelism() int {
+	return e.Concurrency
+}
+
+// elevenLabsVoiceSettings are the voice settings for a style
+type elevenLabsVoiceSettings struct {
+	Stability       float64 `json:"stability"`
+	SimilarityBoost float64 `json:"similarity_boost"`
+	Style           float64 `json:"style"`
+	UseSpeakerBoost bool    `json:"use_speaker_boost"`
+}
+
+type elevenLabsRequest struct {
+	Text          string                   `json:"text"`
+	ModelID       string                   `json:"model_id"`
+	VoiceSettings *elevenLabsVoiceSettings `json:"voice_settings,omitempty"`
+}
+
+// Synthesize returns MP3 audio; known styles lower stability and raise style
+// exaggeration, ElevenLabs voices have no explicit styles
+func (e *ElevenLabs) Synthesize(ctx context.Context, voice, style, text string) (Audio, error) {
+	voiceID := voice
+	if id, ok := e.Voices[voice]; ok {
+		voiceID = id
+	}
+	req := elevenLabsRequest{Text: text, ModelID: e.Model}
+	if _, ok := styleProsody[style]; ok {
+		req.VoiceSettings = &elevenLabsVoiceSettings{Stability: 0.3, SimilarityBoost: 0.75, Style: 0.6, UseSpeakerBoost: true}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Audio{}, err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/text-to-speech/%s?output_format=%s", e.BaseURL, url.PathEscape(voiceID), url.QueryEscape(e.OutputFormat))
+	httpreq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Audio{}, err
+	}
+	httpreq.Header.Set("xi-api-key", e.APIKey)
+	httpreq.Header.Set("Content-Type", "application/json")
+	httpreq.Header.Set("Accept", "audio/mpeg")
+
+	debugf(DebugRequests, "elevenlabs: voice %s, model %s, %d characters", voiceID, e.Model, len(text))
+	debugf(DebugPayloads, "elevenlabs: text: %s", text)
+	start := time.Now()
+	res, err := e.Client.Do(httpreq)
+	if err != nil {
+		return Audio{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return Audio{}, fmt.Errorf("elevenlabs: %s: %s", res.Status, bytes.TrimSpace(detail))
+	}
+	audiobytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return Audio{}, err
+	}
+	debugf(DebugRequests, "elevenlabs: voice %s, %d bytes in %s", voiceID, len(audiobytes), time.Since(start))
+	if rate, ok := strings.CutPrefix(e.OutputFormat, "pcm_"); ok {
+		return pcmToWav(audiobytes, rate)
+	}
+	return Audio{audiobytes, FormatMP3}, nil
+}
+
+// pcmToWav wraps raw 16-bit mono audio, e.g. from the pcm_24000 output
+// format, as wav
+func pcmToWav(pcm []byte, rate string) (Audio, error) {
+	samplerate, err := strconv.Atoi(rate)
+	if err != nil {
+		return Audio{}, fmt.Errorf("elevenlabs: unknown pcm sample rate %s", rate)
+	}
+	f, err := wav.New(samplerate, 16, 1)
+	if err != nil {
+		return Audio{}, err
+	}
+	f.Write(pcm)
+	data, err := wav.Marshal(f)
+	return Audio{data, FormatWAV}, err
+}
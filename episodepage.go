@@ -0,0 +1,103 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+)
+
+//go:embed pages/*.html
+var pageTemplates embed.FS
+
+// EpisodePage is what an episode's web page shows
+type EpisodePage struct {
+	Title     string
+	Audio     string // the audio's URL, e.g. its file name next to the page
+	Source    string // the source document, linked if it's http(s)
+	ShowNotes string // paragraphs separated by blank lines
+	Turns     []TranscriptTurn
+	Speakers  []string // the host's and expert's names, default Host and Expert
+	Created   time.Time
+	Duration  time.Duration
+	Analytics template.HTML // added to the page's head, e.g. an analytics script
+}
+
+// EpisodePageFile is the web page for an audio file, e.g. episode.html
+func EpisodePageFile(audiofile string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(audiofile, ".wav"), ".mp3") + ".html"
+}
+
+// RenderEpisodePage renders an episode's web page: a player, the show notes
+// and source, and the transcript with speakers and times to jump to
+func RenderEpisodePage(page EpisodePage) ([]byte, error) {
+	funcs := template.FuncMap{
+		"paragraphs": func(text string) []string {
+			paragraphs := []string{}
+			for _, p := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+				if p = strings.Join(strings.Fields(p), " "); p != "" {
+					paragraphs = append(paragraphs, p)
+				}
+			}
+			return paragraphs
+		},
+		"link": func(source string) bool {
+			return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+		},
+		"speaker": func(speaker string) string {
+			i := 0
+			if speaker == "expert" {
+				i = 1
+			}
+			if i < len(page.Speakers) && page.Speakers[i] != "" {
+				return page.Speakers[i]
+			}
+			return strings.ToUpper(speaker[:1]) + speaker[1:]
+		},
+		"timestamp": func(d time.Duration) string {
+			s := int(d.Seconds())
+			if s >= 3600 {
+				return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+			}
+			return fmt.Sprintf("%d:%02d", s/60, s%60)
+		},
+		"minutes": func(d time.Duration) string {
+			return fmt.Sprintf("%d min", max(1, int(d.Round(time.Minute).Minutes())))
+		},
+	}
+	tmpl, err := template.New("episode.html").Funcs(funcs).ParseFS(pageTemplates, "pages/episode.html")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteEpisodePage writes an episode's web page to filename
+func WriteEpisodePage(filename string, page EpisodePage) error {
+	data, err := RenderEpisodePage(page)
+	if err != nil {
+		return fmt.Errorf("unable to render episode page: %w", err)
+	}
+	return os.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// experimentParallelism is how many variants are generated at once
+const experimentParallelism = 4
+
+// ExperimentVariant is a prompt and model to generate an episode with
+type ExperimentVariant struct {
+	Name   string `json:"name"`
+	Model  string `json:"model"`
+	Prompt string `json:"-"` // empty for the built-in prompt
+}
+
+// ExperimentResult is a variant's script and its measures
+type ExperimentResult struct {
+	Variant ExperimentVariant `json:"variant"`
+	Script  string            `json:"-"`
+	Stats   ScriptStats       `json:"stats"`
+	Seconds float64           `json:"generation_seconds"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// ScriptStats measures a script, for comparing prompts
+type ScriptStats struct {
+	Turns        int     `json:"turns"`
+	Words        int     `json:"words"`
+	Minutes      float64 `json:"estimated_minutes"`
+	WordsPerTurn float64 `json:"words_per_turn"`
+	LongestTurn  int     `json:"longest_turn_words"`
+	FirstSpeaker float64 `json:"first_speaker_share"` // share of words from the first voice
+	Styles       int     `json:"style_directives"`
+}
+
+// AnalyzeScript measures a script's turns and words, without participant
+// labels
+func AnalyzeScript(script, tags string) ScriptStats {
+	var stats ScriptStats
+	first := 0
+	for i, turn := range splitTurns(script) {
+		style, text := parseStyle(strings.TrimSpace(stripParticipantTags(turn, tags)))
+		words := len(strings.Fields(text))
+		stats.Turns++
+		stats.Words += words
+		stats.LongestTurn = max(stats.LongestTurn, words)
+		if i%2 == 0 {
+			first += words
+		}
+		if style != "" {
+			stats.Styles++
+		}
+	}
+	if stats.Turns > 0 {
+		stats.WordsPerTurn = float64(stats.Words) / float64(stats.Turns)
+	}
+	if stats.Words > 0 {
+		stats.FirstSpeaker = float64(first) / float64(stats.Words)
+	}
+	stats.Minutes = float64(stats.Words) / wordsPerMinute
+	return stats
+}
+
+// RunExperiment generates an episode from the same source with each
+// variant's prompt and model; failed variants have an Error
+func RunExperiment(ctx context.Context, projectID, location, source, tags string, variants []ExperimentVariant) []ExperimentResult {
+	results := make([]ExperimentResult, len(variants))
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, experimentParallelism)
+	for i, variant := range variants {
+		wg.Add(1)
+		go func(i int, variant ExperimentVariant) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			result := ExperimentResult{Variant: variant}
+			start := time.Now()
+			script, err := GenerateConversation(ctx, projectID, location, variant.Model, source, variant.Prompt)
+			result.Seconds = time.Since(start).Seconds()
+			if err != nil {
+				result.Error = err.Error()
+				log.Printf("variant %s failed: %v", variant.Name, err)
+			} else {
+				result.Script = script
+				result.Stats = AnalyzeScript(script, tags)
+				log.Printf("variant %s: %d turns, %d words in %.0fs", variant.Name, result.Stats.Turns, result.Stats.Words, result.Seconds)
+			}
+			results[i] = result
+		}(i, variant)
+	}
+	wg.Wait()
+	return results
+}
+
+// ExperimentReport is a Markdown report of results: a table of measures
+// and the scripts' opening turns side by side
+func ExperimentReport(source string, results []ExperimentResult, turns int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Prompt experiment\n\nSource: %s\n\n", source)
+
+	header := "| |"
+	rule := "|---|"
+	for _, r := range results {
+		header += " " + markdownCell(r.Variant.Name) + " |"
+		rule += "---|"
+	}
+	b.WriteString(header + "\n" + rule + "\n")
+	row := func(name string, value func(ExperimentResult) string) {
+		line := "| " + name + " |"
+		for _, r := range results {
+			if r.Error != "" {
+				line += " failed |"
+				continue
+			}
+			line += " " + value(r) + " |"
+		}
+		b.WriteString(line + "\n")
+	}
+	row("model", func(r ExperimentResult) string { return r.Variant.Model })
+	row("turns", func(r ExperimentResult) string { return fmt.Sprint(r.Stats.Turns) })
+	row("words", func(r ExperimentResult) string { return fmt.Sprint(r.Stats.Words) })
+	row("estimated minutes", func(r ExperimentResult) string { return fmt.Sprintf("%.1f", r.Stats.Minutes) })
+	row("words per turn", func(r ExperimentResult) string { return fmt.Sprintf("%.1f", r.Stats.WordsPerTurn) })
+	row("longest turn", func(r ExperimentResult) string { return fmt.Sprint(r.Stats.LongestTurn) })
+	row("first voice share", func(r ExperimentResult) string { return fmt.Sprintf("%.0f%%", 100*r.Stats.FirstSpeaker) })
+	row("style directives", func(r ExperimentResult) string { return fmt.Sprint(r.Stats.Styles) })
+	row("generation seconds", func(r ExperimentResult) string { return fmt.Sprintf("%.0f", r.Seconds) })
+
+	fmt.Fprintf(&b, "\n## First %d turns\n\n%s\n%s\n", turns, header, rule)
+	split := make([][]string, len(results))
+	for i, r := range results {
+		split[i] = splitTurns(r.Script)
+	}
+	for t := 0; t < turns; t++ {
+		line := fmt.Sprintf("| %d |", t+1)
+		for i := range results {
+			cell := ""
+			if t < len(split[i]) {
+				cell = markdownCell(split[i][t])
+			}
+			line += " " + cell + " |"
+		}
+		b.WriteString(line + "\n")
+	}
+
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(&b, "\n%s failed: %s\n", r.Variant.Name, r.Error)
+		}
+	}
+	return b.String()
+}
+
+// markdownCell escapes text for a Markdown table cell
+func markdownCell(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(strings.TrimSpace(text), "|", `\|`), "\n", " ")
+}
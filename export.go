@@ -0,0 +1,172 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OutputProfile is how an episode is exported for a destination: its
+// loudness, channels, sample rate, format and, for telephony, encoding
+type OutputProfile struct {
+	Name       string  `json:"name"`
+	Loudness   float64 `json:"loudness_lufs"`      // integrated loudness target
+	Peak       float64 `json:"peak_dbfs"`          // sample peak ceiling
+	Channels   int     `json:"channels"`           // 1 for mono, 2 for stereo
+	SampleRate int     `json:"sample_rate"`        // Hz
+	Format     string  `json:"format"`             // FormatWAV or FormatMP3
+	Bitrate    int     `json:"bitrate,omitempty"`  // kbps, for mp3
+	Encoding   string  `json:"encoding,omitempty"` // EncodingMulaw or EncodingAlaw wav, default 16-bit PCM
+}
+
+// outputProfiles are the built-in export profiles, by name
+var outputProfiles = map[string]OutputProfile{
+	// podcast apps and directories, e.g. Apple Podcasts and Spotify
+	"podcast": {Loudness: -16, Peak: -1, Channels: 2, SampleRate: 44100, Format: FormatMP3, Bitrate: 128},
+	// voice notes and messages, spoken word in mono
+	"voice-note": {Loudness: -19, Peak: -1, Channels: 1, SampleRate: 44100, Format: FormatMP3, Bitrate: 64},
+	// broadcast, EBU R 128
+	"broadcast": {Loudness: -23, Peak: -1, Channels: 2, SampleRate: 48000, Format: FormatWAV},
+	// IVR and telephony prompts, 8 kHz G.711 in the telephone band
+	"telephony":      {Loudness: -20, Peak: -3, Channels: 1, SampleRate: 8000, Format: FormatWAV, Encoding: EncodingMulaw},
+	"telephony-alaw": {Loudness: -20, Peak: -3, Channels: 1, SampleRate: 8000, Format: FormatWAV, Encoding: EncodingAlaw},
+}
+
+// OutputProfiles returns the built-in export profiles, by name
+func OutputProfiles() []OutputProfile {
+	profiles := []OutputProfile{}
+	for name, p := range outputProfiles {
+		p.Name = name
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// ParseOutputProfiles parses a comma-separated list of export profile
+// names, e.g. podcast,broadcast
+func ParseOutputProfiles(s string) ([]OutputProfile, error) {
+	return LookupOutputProfiles(strings.Split(s, ","))
+}
+
+// LookupOutputProfiles returns the export profiles with names
+func LookupOutputProfiles(names []string) ([]OutputProfile, error) {
+	var profiles []OutputProfile
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, ok := outputProfiles[name]
+		if !ok {
+			names := []string{}
+			for _, p := range OutputProfiles() {
+				names = append(names, p.Name)
+			}
+			return nil, fmt.Errorf("unknown export profile %q, use %s", name, strings.Join(names, ", "))
+		}
+		p.Name = name
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// ExportFile is where an episode's export for a profile is written, e.g.
+// episode.podcast.mp3
+func ExportFile(audiofile string, p OutputProfile) string {
+	return fmt.Sprintf("%s.%s.%s", strings.TrimSuffix(audiofile, filepath.Ext(audiofile)), p.Name, p.Format)
+}
+
+// WriteExports writes a wav episode for each profile, converted to its
+// channels and sample rate and normalized to its loudness; mp3 exports use
+// ffmpeg, and telephony exports are limited to the telephone band and
+// encoded as G.711. Like speed variants, exports keep the episode's title and
+// disclosure but not its provenance
+func WriteExports(ctx context.Context, audiofile string, profiles []OutputProfile) ([]string, error) {
+	if !strings.EqualFold(filepath.Ext(audiofile), "."+FormatWAV) {
+		return nil, fmt.Errorf("exports are made from wav audio, %s isn't", filepath.Base(audiofile))
+	}
+	tags, err := ReadTags(audiofile)
+	if err != nil {
+		return nil, err
+	}
+	tags.Provenance = ""
+
+	var files []string
+	for _, p := range profiles {
+		read := readWav16
+		if p.Encoding != "" {
+			read = readTelephony
+		}
+		episode, err := read(audiofile, p.SampleRate, p.Channels)
+		if err != nil {
+			return files, err
+		}
+		data := episode.Bytes()
+		before, after := normalizeLoudness(data, p.SampleRate, p.Channels, p.Loudness, p.Peak)
+		file := pcmAudio{p.SampleRate, 16, p.Channels, data}.encode()
+		if p.Encoding != "" {
+			if file, err = g711Wav(data, p.SampleRate, p.Channels, p.Encoding); err != nil {
+				return files, err
+			}
+		}
+		if tags != (Tags{}) {
+			if file, err = wavWithInfo(file, tags); err != nil {
+				return files, err
+			}
+		}
+		export := ExportFile(audiofile, p)
+		switch p.Format {
+		case FormatMP3:
+			err = encodeMP3(ctx, file, p.Bitrate, export)
+		default:
+			err = os.WriteFile(export, file, 0644)
+		}
+		if err != nil {
+			return files, err
+		}
+		log.Printf("%s export, %.1f LUFS from %.1f, written to %s", p.Name, after, before, export)
+		files = append(files, export)
+	}
+	return files, nil
+}
+
+// encodeMP3 encodes wav data as an mp3 file at bitrate kbps, with ffmpeg
+func encodeMP3(ctx context.Context, data []byte, bitrate int, outputfilename string) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return ErrNoFFmpeg
+	}
+	args := []string{"-y", "-loglevel", "error", "-f", "wav", "-i", "-",
+		"-c:a", "libmp3lame", "-b:a", strconv.Itoa(bitrate) + "k", "-map_metadata", "0", outputfilename}
+	debugf(DebugRequests, "ffmpeg %s", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
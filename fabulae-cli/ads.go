@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	adsFile         string
+	episodeChapters []fabulae.Chapter // with -ads, timed as the episode is combined
+)
+
+// loadAds reads the -ads file, a JSON list of ad segments with recorded
+// audio relative to the file
+func loadAds() ([]fabulae.AdSegment, error) {
+	if adsFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(adsFile)
+	if err != nil {
+		return nil, err
+	}
+	var ads []fabulae.AdSegment
+	if err := json.Unmarshal(data, &ads); err != nil {
+		return nil, fmt.Errorf("unable to read -ads %s: %w", adsFile, err)
+	}
+	if err := fabulae.ValidateAds(ads); err != nil {
+		return nil, fmt.Errorf("-ads %s: %w", adsFile, err)
+	}
+	for i, a := range ads {
+		if a.Audio != "" && !filepath.IsAbs(a.Audio) {
+			ads[i].Audio = filepath.Join(filepath.Dir(adsFile), a.Audio)
+		}
+	}
+	return ads, nil
+}
+
+// insertAds places the -ads among the synthesized turns, before they're
+// combined, and keeps the episode's chapters
+func insertAds(audiofiles []string) ([]string, error) {
+	ads, err := loadAds()
+	if err != nil || len(ads) == 0 {
+		return audiofiles, err
+	}
+	voices := []string{}
+	for _, a := range ads {
+		if a.Script != "" {
+			voices = append(voices, a.Voice)
+		}
+	}
+	synth, err := fabulae.NewCast(provider, voices...)
+	if err != nil {
+		return nil, err
+	}
+	audiofiles, episodeChapters, err = fabulae.InsertAds(context.Background(), synth, audiofiles, ads, transcriptTurns)
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert ads: %w", err)
+	}
+	log.Printf("%d ads inserted, %d chapters", len(ads), len(episodeChapters))
+	return audiofiles, nil
+}
+
+// alignEpisode moves the transcript's turns and the chapters after any
+// opening disclosure, given the episode's duration before it was added
+func alignEpisode(output string, before time.Duration) {
+	if before == 0 || (len(transcriptTurns) == 0 && len(episodeChapters) == 0) {
+		return
+	}
+	durations, err := fabulae.AudioDurations([]string{output})
+	if err != nil {
+		return
+	}
+	var opening time.Duration
+	switch disclosure {
+	case fabulae.DisclosureStart:
+		opening = durations[0] - before
+	case fabulae.DisclosureBoth:
+		opening = (durations[0] - before) / 2
+	}
+	opening = max(opening, 0)
+	fabulae.ShiftTurns(transcriptTurns, opening)
+	if len(episodeChapters) > 0 {
+		fabulae.ShiftChapters(episodeChapters, opening)
+		// the disclosures belong to the first and last chapters
+		episodeChapters[0].Start = 0
+		episodeChapters[len(episodeChapters)-1].End = durations[0]
+	}
+}
+
+// writeEpisodeChapters writes the chapters next to the episode
+func writeEpisodeChapters(output string) error {
+	if len(episodeChapters) == 0 {
+		return nil
+	}
+	file := fabulae.ChaptersFile(output)
+	if err := fabulae.WriteChapters(file, episodeChapters); err != nil {
+		return fmt.Errorf("unable to write chapters: %w", err)
+	}
+	log.Printf("chapters written to %s", file)
+	return nil
+}
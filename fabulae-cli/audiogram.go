@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	audiogramCover    string
+	audiogramCaptions string
+	audiogramWidth    int
+	audiogramHeight   int
+	audiogramOutput   string
+)
+
+func audiogramCommand() *command {
+	fs := newFlagSet("audiogram", "Render an episode or clip as an audiogram video")
+	fs.StringVar(&audiogramCover, "cover", "", "cover art behind the waveform, JPEG or PNG")
+	fs.StringVar(&audiogramCaptions, "captions", "", "SRT captions to burn in (default the audio's .srt, if there is one), none for no captions")
+	fs.IntVar(&audiogramWidth, "width", fabulae.DefaultAudiogramWidth, "video width")
+	fs.IntVar(&audiogramHeight, "height", fabulae.DefaultAudiogramHeight, "video height")
+	fs.StringVar(&audiogramOutput, "o", "", "MP4 file (default the audio's name, e.g. episode.audiogram.mp4)")
+	debugFlags(fs)
+	return &command{
+		name:        "audiogram",
+		description: "render audio as a waveform video with captions, for social media",
+		flags:       fs,
+		examples: []string{
+			"fabulae audiogram -cover cover.jpg episode.wav",
+			"fabulae audiogram -width 1920 -height 1080 -captions none episode.clip4.wav",
+		},
+		run: runAudiogram,
+	}
+}
+
+func runAudiogram(args []string) error {
+	if len(args) != 1 {
+		return errors.New("audiogram needs one audio file")
+	}
+	audiofile := args[0]
+	captions := audiogramCaptions
+	switch captions {
+	case "":
+		srt := fabulae.TranscriptFile(audiofile, fabulae.TranscriptSRT)
+		if _, err := os.Stat(srt); err == nil {
+			captions = srt
+		}
+	case "none":
+		captions = ""
+	}
+	output := audiogramOutput
+	if output == "" {
+		output = fabulae.AudiogramFile(audiofile)
+	}
+	return fabulae.RenderAudiogram(context.Background(), audiofile, fabulae.AudiogramOptions{
+		Cover:    audiogramCover,
+		Captions: captions,
+		Width:    audiogramWidth,
+		Height:   audiogramHeight,
+	}, output)
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+// benchFake is the -provider that benchmarks without a provider
+const benchFake = "fake"
+
+var (
+	benchProvider    string
+	benchVoice1      string
+	benchVoice2      string
+	benchTurns       int
+	benchRuns        int
+	benchParallelism int
+	benchLatency     time.Duration
+	benchReportFile  string
+	benchBaseline    string
+	benchTolerance   float64
+)
+
+func benchCommand() *command {
+	fs := newFlagSet("bench", "Benchmark synthesizing, combining, streaming and mastering a fixed script")
+	fs.StringVar(&benchProvider, "provider", benchFake, "text-to-speech provider, or fake for generated audio: "+strings.Join(fabulae.Providers(), ", "))
+	fs.StringVar(&benchVoice1, "voice1", "en-US-Chirp3-HD-Charon", "voice 1, for a provider")
+	fs.StringVar(&benchVoice2, "voice2", "en-US-Chirp3-HD-Kore", "voice 2, for a provider")
+	fs.IntVar(&benchTurns, "turns", fabulae.DefaultBenchTurns, "turns in the script")
+	fs.IntVar(&benchRuns, "runs", fabulae.DefaultBenchRuns, "times each phase runs")
+	fs.IntVar(&benchParallelism, "parallelism", 0, "concurrent synthesis requests (default the provider's)")
+	fs.DurationVar(&benchLatency, "latency", fabulae.DefaultBenchLatency, "fake provider's latency per request")
+	fs.StringVar(&benchReportFile, "o", "", "write the report as JSON")
+	fs.StringVar(&benchBaseline, "baseline", "", "a JSON report to compare with, failing on regressions")
+	fs.Float64Var(&benchTolerance, "tolerance", 0.2, "relative slowdown in a phase's median reported against -baseline")
+	debugFlags(fs)
+	return &command{
+		name:        "bench",
+		description: "benchmark the audio pipeline, e.g. before and after a change",
+		flags:       fs,
+		examples: []string{
+			"fabulae bench -o before.json",
+			"fabulae bench -baseline before.json -parallelism 16",
+			"fabulae bench -provider google -turns 12 -runs 1",
+		},
+		run: runBench,
+	}
+}
+
+func runBench(args []string) error {
+	opts := fabulae.BenchOptions{
+		Turns:       benchTurns,
+		Runs:        benchRuns,
+		Parallelism: benchParallelism,
+		Latency:     benchLatency,
+	}
+	if benchProvider != benchFake {
+		synth, err := fabulae.NewSynthesizer(benchProvider)
+		if err != nil {
+			return err
+		}
+		opts.Synth, opts.Voice1, opts.Voice2 = synth, benchVoice1, benchVoice2
+	}
+	var baseline fabulae.BenchReport
+	if benchBaseline != "" {
+		data, err := os.ReadFile(benchBaseline)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			return fmt.Errorf("%s: %w", benchBaseline, err)
+		}
+	}
+
+	report, err := fabulae.Bench(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	if benchReportFile != "" {
+		if err := writeJSON(benchReportFile, report); err != nil {
+			return err
+		}
+		log.Printf("report written to %s", benchReportFile)
+	}
+
+	fmt.Printf("%d turns, %d characters, %.1fs of audio, %d concurrent requests, %d runs\n\n",
+		report.Turns, report.Characters, report.AudioSeconds, report.Parallelism, report.Runs)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tMIN\tMEDIAN\tMAX\tTHROUGHPUT")
+	for _, p := range report.Phases {
+		fmt.Fprintf(tw, "%s\t%.3fs\t%.3fs\t%.3fs\t%.1f %s\n", p.Name, p.Min, p.Median, p.Max, p.Throughput, p.Unit)
+	}
+	tw.Flush()
+	r := report.Requests
+	fmt.Printf("\n%d synthesis requests: p50 %.3fs, p95 %.3fs, p99 %.3fs, max %.3fs\n", r.Count, r.P50, r.P95, r.P99, r.Max)
+
+	if benchBaseline == "" {
+		return nil
+	}
+	regressions, err := fabulae.CompareBench(baseline, report, benchTolerance)
+	if err != nil {
+		return err
+	}
+	if len(regressions) == 0 {
+		fmt.Println("\nno regressions")
+		return nil
+	}
+	fmt.Println("\nregressions:")
+	for _, r := range regressions {
+		fmt.Printf("  %s\n", r)
+	}
+	return fmt.Errorf("%d regressions", len(regressions))
+}
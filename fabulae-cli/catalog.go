@@ -0,0 +1,207 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+// fingerprint is what the episode is made from, once its source is read
+var fingerprint *fabulae.Fingerprint
+
+// catalogFile is the catalog of generated episodes, next to the config file
+func catalogFile() string {
+	if configfile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configfile), "catalog.json")
+}
+
+// withProviders prefixes voices with the -provider unless they name theirs
+func withProviders(voices []string) []string {
+	named := make([]string, len(voices))
+	for i, v := range voices {
+		named[i] = v
+		if p, _ := fabulae.VoiceProvider(v); p == "" {
+			named[i] = provider + ":" + v
+		}
+	}
+	return named
+}
+
+// outputSettings are the flags that change the audio or the files written
+// with it, normalized for the episode's fingerprint; files are by name
+type outputSettings struct {
+	Show              string                `json:"show,omitempty"`
+	SingleRequest     bool                  `json:"single_request,omitempty"` // without -turn-by-turn
+	TranscriptFormats []string              `json:"transcript_formats,omitempty"`
+	WordTimings       bool                  `json:"word_timings,omitempty"`
+	EpisodePage       bool                  `json:"episode_page,omitempty"`
+	ShowNotes         string                `json:"show_notes,omitempty"`
+	Disclosure        string                `json:"disclosure,omitempty"`
+	DisclosureVoice   string                `json:"disclosure_voice,omitempty"`
+	DisclosureText    string                `json:"disclosure_text,omitempty"`
+	Ads               string                `json:"ads,omitempty"`
+	ContentFilter     string                `json:"content_filter,omitempty"`
+	FilterTerms       string                `json:"filter_terms,omitempty"`
+	Redact            string                `json:"redact,omitempty"` // the mode and info types
+	NaturalPacing     bool                  `json:"natural_pacing,omitempty"`
+	SpeakMath         bool                  `json:"speak_math,omitempty"`
+	Verbalize         bool                  `json:"verbalize,omitempty"`
+	ExpandAcronyms    bool                  `json:"expand_acronyms,omitempty"`
+	Acronyms          string                `json:"acronyms,omitempty"`
+	Preprocess        string                `json:"preprocess,omitempty"`
+	InterjectionRate  float64               `json:"interjection_rate,omitempty"`
+	Crossfade         time.Duration         `json:"crossfade,omitempty"`
+	SampleRate        int                   `json:"sample_rate,omitempty"`
+	Channels          int                   `json:"channels,omitempty"`
+	Mastering         *fabulae.Mastering    `json:"mastering,omitempty"`
+	Music             *fabulae.MusicOptions `json:"music,omitempty"`
+	SpeedVariants     []float64             `json:"speed_variants,omitempty"`
+	ExportProfiles    []string              `json:"export_profiles,omitempty"`
+	Provenance        bool                  `json:"provenance,omitempty"`
+	FactCheck         string                `json:"fact_check,omitempty"`
+	MinQuality        float64               `json:"min_quality,omitempty"`
+	QualityRetries    int                   `json:"quality_retries,omitempty"`
+}
+
+// outputSHA256 hashes the output flags, for the episode's fingerprint
+func outputSHA256() string {
+	settings := outputSettings{
+		Show:              showID,
+		SingleRequest:     !turnbyturn,
+		TranscriptFormats: normalizedNames(transcriptFormats),
+		WordTimings:       wordTimings,
+		EpisodePage:       episodePage,
+		ShowNotes:         showNotesFile,
+		Disclosure:        disclosure,
+		Ads:               adsFile,
+		ContentFilter:     contentFilter,
+		NaturalPacing:     naturalPacing,
+		SpeakMath:         speakMath,
+		Verbalize:         verbalize,
+		ExpandAcronyms:    expandAcronyms,
+		Preprocess:        preprocessCommand,
+		Crossfade:         crossfade,
+		SampleRate:        audioFormat.SampleRate,
+		Channels:          audioFormat.Channels,
+		SpeedVariants:     slices.Compact(slices.Sorted(slices.Values(speeds))),
+		ExportProfiles:    normalizedNames(exportFlag),
+		Provenance:        writeProvenance,
+		FactCheck:         factCheckMode,
+		MinQuality:        minQuality,
+	}
+	if disclosure != "" {
+		settings.DisclosureVoice, settings.DisclosureText = disclosureVoice, disclosureText
+	}
+	if contentFilter != "" {
+		settings.FilterTerms = filterTerms
+	}
+	if redact {
+		settings.Redact = redactMode + ":" + redactTypes
+	}
+	if expandAcronyms {
+		settings.Acronyms = acronymsFile
+	}
+	if interjections {
+		settings.InterjectionRate = interjectionRate
+	}
+	if master {
+		settings.Mastering = &mastering
+	}
+	if music.Music != "" {
+		settings.Music = &music
+	}
+	if minQuality > 0 {
+		settings.QualityRetries = qualityRetries
+	}
+	return fabulae.OutputSHA256(settings)
+}
+
+// normalizedNames are a comma-separated list's names lowercased, sorted and
+// without repeats
+func normalizedNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// findEpisode fingerprints the episode by its source, promptHash, voices and
+// output flags, and reports whether the catalog already has it, unless -force
+func findEpisode(promptHash string) (bool, error) {
+	source := provenance.SourceSHA256
+	if source == "" {
+		// documents read in place, from Cloud Storage or Drive, by their URI
+		source = fabulae.SHA256([]byte(provenance.Source))
+	}
+	fingerprint = &fabulae.Fingerprint{
+		SourceSHA256: source,
+		PromptSHA256: promptHash,
+		Voices:       withProviders([]string{voice1name, voice2name}),
+		OutputSHA256: outputSHA256(),
+	}
+	if force || catalogFile() == "" {
+		return false, nil
+	}
+	catalog, err := fabulae.ReadCatalog(catalogFile())
+	if err != nil {
+		return false, fmt.Errorf("unable to read the catalog: %w", err)
+	}
+	e, ok := catalog.Find(*fingerprint)
+	if !ok {
+		return false, nil
+	}
+	fmt.Printf("already generated from this source, prompt, voices and output settings on %s: %s\n", e.Created.Format(time.DateOnly), e.Audio)
+	fmt.Println("use -force to generate it again")
+	return true, nil
+}
+
+// catalogEpisode adds the finished episode to the catalog
+func catalogEpisode(output string) error {
+	if fingerprint == nil || catalogFile() == "" {
+		return nil
+	}
+	audio, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	catalog, err := fabulae.ReadCatalog(catalogFile())
+	if err != nil {
+		return fmt.Errorf("unable to add the episode to the catalog: %w", err)
+	}
+	catalog.Add(fabulae.CatalogEntry{
+		Fingerprint: *fingerprint,
+		Title:       episodeTitle(),
+		Audio:       audio,
+		Created:     time.Now(),
+	})
+	if err := fabulae.WriteCatalog(catalogFile(), catalog); err != nil {
+		return fmt.Errorf("unable to add the episode to the catalog: %w", err)
+	}
+	log.Printf("episode added to the catalog %s", catalogFile())
+	return nil
+}
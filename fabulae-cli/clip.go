@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	clipTurn    int
+	clipQuote   string
+	clipPadding = fabulae.DefaultClipPadding
+	clipOutput  string
+	clipVideo   bool
+	clipCover   string
+)
+
+func clipCommand() *command {
+	fs := newFlagSet("clip", "Cut a quote from an episode, for sharing")
+	fs.IntVar(&clipTurn, "turn", 0, "the turn to clip, from 1; with -quote, the turn to find it in")
+	fs.StringVar(&clipQuote, "quote", "", "words to clip, found in the episode's JSON transcript")
+	fs.DurationVar(&clipPadding, "padding", clipPadding, "audio kept before and after the quote")
+	fs.StringVar(&clipOutput, "o", "", "clip wav file (default the episode's name with the turn, e.g. episode.clip3.wav)")
+	fs.BoolVar(&clipVideo, "video", false, "also render the clip as an audiogram MP4 for social media, with its waveform and captions, requires ffmpeg")
+	fs.StringVar(&clipCover, "cover", "", "with -video, cover art behind the waveform, JPEG or PNG")
+	debugFlags(fs)
+	return &command{
+		name:        "clip",
+		description: "cut a turn or quote from an episode",
+		flags:       fs,
+		examples: []string{
+			"fabulae clip -turn 12 episode.wav",
+			"fabulae clip -quote \"attention is all you need\" -video episode.provenance.json",
+		},
+		run: runClip,
+	}
+}
+
+func runClip(args []string) error {
+	if len(args) != 1 {
+		return errors.New("clip needs one episode, a wav file or its provenance manifest")
+	}
+	if clipTurn == 0 && clipQuote == "" {
+		return errors.New("clip needs -turn or -quote")
+	}
+	episode := args[0]
+	if manifest, ok := strings.CutSuffix(episode, ".provenance.json"); ok {
+		episode = manifest + ".wav"
+	}
+	turns, err := fabulae.LoadTranscript(episode)
+	if err != nil {
+		return err
+	}
+	opts := fabulae.ClipOptions{Turn: clipTurn, Quote: clipQuote, Padding: clipPadding}
+	output := clipOutput
+	if output == "" {
+		found, err := fabulae.FindClip(turns, opts)
+		if err != nil {
+			return err
+		}
+		output = fmt.Sprintf("%s.clip%d.wav", strings.TrimSuffix(episode, ".wav"), found.Turn)
+	}
+	clip, err := fabulae.ExtractClip(episode, turns, opts, output)
+	if err != nil {
+		return err
+	}
+	if clip.Estimated {
+		fmt.Fprintf(os.Stderr, "the quote is timed by its length in the turn, generate with -word-timings to cut it at its words\n")
+	}
+	if clipVideo {
+		// the clip's captions, burned into its audiogram
+		captions := fabulae.TranscriptFile(output, fabulae.TranscriptSRT)
+		if err := os.WriteFile(captions, fabulae.SRTTranscript(fabulae.ClipTranscript(turns, clip)), 0644); err != nil {
+			return err
+		}
+		err := fabulae.RenderAudiogram(context.Background(), output, fabulae.AudiogramOptions{Cover: clipCover, Captions: captions}, fabulae.VideoFile(output))
+		if err != nil {
+			return err
+		}
+	}
+	record, _ := json.MarshalIndent(clip, "", "  ")
+	fmt.Println(string(record))
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	compareScript     string
+	compareTags       string
+	compareLanguage   string
+	compareSkipSTT    bool
+	compareDuration   float64
+	compareLoudness   float64
+	compareWER        float64
+	compareReportFile string
+)
+
+func compareCommand() *command {
+	fs := newFlagSet("compare", "Compare two renders of the same script and report regressions")
+	fs.StringVar(&compareScript, "script", "", "transcript both renders are from, for word error rate and turns")
+	fs.StringVar(&compareTags, "strip", "AGENT,CUSTOMER", "particpant labels to split")
+	fs.StringVar(&compareLanguage, "language", "en-US", "language of the renders")
+	fs.BoolVar(&compareSkipSTT, "skip-stt", false, "only compare duration and loudness, without Speech-to-Text")
+	fs.Float64Var(&compareDuration, "duration-tolerance", 0.15, "relative duration change reported")
+	fs.Float64Var(&compareLoudness, "loudness-tolerance", 2, "loudness change reported, in dB")
+	fs.Float64Var(&compareWER, "wer-tolerance", 0.03, "word error rate increase reported")
+	fs.StringVar(&compareReportFile, "o", "", "write the comparison as JSON")
+	projectFlags(fs)
+	debugFlags(fs)
+	return &command{
+		name:        "compare",
+		description: "compare two renders of a script, e.g. after changing voices",
+		flags:       fs,
+		examples: []string{
+			"fabulae compare -script transcript.txt before.wav after.wav",
+			"fabulae compare -skip-stt -o report.json before.mp3 after.mp3",
+		},
+		run: runCompare,
+	}
+}
+
+func runCompare(args []string) error {
+	if len(args) != 2 {
+		return errors.New("compare needs two renders, the baseline and the candidate")
+	}
+	var script string
+	if compareScript != "" {
+		var err error
+		if script, err = readInput(compareScript); err != nil {
+			return err
+		}
+		if !compareSkipSTT {
+			if err := requireProject(); err != nil {
+				return err
+			}
+		}
+	}
+	c, err := fabulae.CompareRenders(context.Background(), projectID, args[0], args[1], fabulae.CompareOptions{
+		Script:            script,
+		Tags:              compareTags,
+		LanguageCode:      compareLanguage,
+		SkipRecognition:   compareSkipSTT,
+		DurationTolerance: compareDuration,
+		LoudnessTolerance: compareLoudness,
+		WERTolerance:      compareWER,
+	})
+	if err != nil {
+		return err
+	}
+	if compareReportFile != "" {
+		if err := writeJSON(compareReportFile, c); err != nil {
+			return err
+		}
+		log.Printf("comparison written to %s", compareReportFile)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tBASELINE\tCANDIDATE")
+	fmt.Fprintf(tw, "duration\t%.2fs\t%.2fs\n", c.Baseline.Seconds, c.Candidate.Seconds)
+	if c.Baseline.Loudness != 0 && c.Candidate.Loudness != 0 {
+		fmt.Fprintf(tw, "loudness\t%.1f dBFS\t%.1f dBFS\n", c.Baseline.Loudness, c.Candidate.Loudness)
+	}
+	if c.Baseline.WER != nil && c.Candidate.WER != nil {
+		fmt.Fprintf(tw, "word error rate\t%.1f%%\t%.1f%%\n", 100**c.Baseline.WER, 100**c.Candidate.WER)
+	}
+	for i := 0; i < len(c.Baseline.Turns) && i < len(c.Candidate.Turns); i++ {
+		fmt.Fprintf(tw, "turn %d\t%s\t%s\n", i+1, turnSeconds(c.Baseline.Turns[i]), turnSeconds(c.Candidate.Turns[i]))
+	}
+	tw.Flush()
+
+	if len(c.Regressions) == 0 {
+		fmt.Println("\nno regressions")
+		return nil
+	}
+	fmt.Println("\nregressions:")
+	for _, r := range c.Regressions {
+		fmt.Printf("  %s\n", r)
+	}
+	return fmt.Errorf("%d regressions", len(c.Regressions))
+}
+
+func turnSeconds(t fabulae.TurnReport) string {
+	if !t.Found {
+		return "not found"
+	}
+	return fmt.Sprintf("%.2fs", t.Seconds)
+}
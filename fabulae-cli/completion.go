@@ -0,0 +1,455 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+// knownModels are offered when completing -model
+var knownModels = []string{
+	"gemini-1.5-pro",
+	"gemini-1.5-pro-002",
+	"gemini-1.5-flash",
+	"gemini-1.5-flash-002",
+}
+
+// voiceCacheTTL is how long completion reuses the voice list before asking the API again
+const voiceCacheTTL = 24 * time.Hour
+
+// completeVoicesArg is the hidden completion argument that prints voice names
+const completeVoicesArg = "__voices"
+
+var completionName string
+
+func completionCommand() *command {
+	fs := newFlagSet("completion", "Generate a shell completion script for bash, zsh or fish")
+	fs.StringVar(&completionName, "name", filepath.Base(os.Args[0]), "program name to complete")
+	return &command{
+		name:        "completion",
+		description: "generate shell completion scripts",
+		flags:       fs,
+		examples: []string{
+			"source <(fabulae completion bash)",
+			"fabulae completion zsh > \"${fpath[1]}/_fabulae\"",
+			"fabulae completion fish > ~/.config/fish/completions/fabulae.fish",
+		},
+		args: []string{"bash", "zsh", "fish"},
+		run:  runCompletion,
+	}
+}
+
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return errors.New("specify a shell: bash, zsh or fish")
+	}
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, completionName)
+	case "zsh":
+		writeZshCompletion(os.Stdout, completionName)
+	case "fish":
+		writeFishCompletion(os.Stdout, completionName)
+	case completeVoicesArg:
+		// voice names for the completion scripts, errors are silent so tab doesn't print noise
+		names, _ := cachedVoiceNames()
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	default:
+		return fmt.Errorf("unsupported shell %q, use bash, zsh or fish", args[0])
+	}
+	return nil
+}
+
+// cachedVoiceNames returns voice names, cached in the user cache directory
+// since listing voices is too slow to do on every tab
+func cachedVoiceNames() ([]string, error) {
+	cachefile := ""
+	if dir, err := os.UserCacheDir(); err == nil {
+		cachefile = filepath.Join(dir, "fabulae", "voices.txt")
+		if info, err := os.Stat(cachefile); err == nil && time.Since(info.ModTime()) < voiceCacheTTL {
+			if data, err := os.ReadFile(cachefile); err == nil {
+				return strings.Fields(string(data)), nil
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	voices, err := fabulae.ListVoices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(voices))
+	for _, v := range voices {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+
+	if cachefile != "" {
+		if err := os.MkdirAll(filepath.Dir(cachefile), 0o755); err == nil {
+			os.WriteFile(cachefile, []byte(strings.Join(names, "\n")+"\n"), 0o644)
+		}
+	}
+	return names, nil
+}
+
+// completionTarget is a command, or a command's subcommand, with its flags
+type completionTarget struct {
+	name        string
+	description string
+	flags       *flag.FlagSet
+	args        []string
+	subcommands []completionTarget
+}
+
+// completionTargets describes the commands for the completion scripts
+func completionTargets() []completionTarget {
+	targets := []completionTarget{}
+	for _, cmd := range commands {
+		t := completionTarget{name: cmd.name, description: cmd.description, flags: cmd.flags, args: cmd.args}
+		for _, sub := range cmd.subcommands {
+			t.subcommands = append(t.subcommands, completionTarget{
+				name:        sub.name,
+				description: sub.description,
+				flags:       sub.flags(),
+			})
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// flag value kinds
+const (
+	valueNone   = iota // boolean flags
+	valueAny           // free text
+	valueFile          // a path
+	valueDir           // a directory
+	valueVoice         // a Text-to-Speech voice name
+	valueChoice        // one of flagChoices
+)
+
+// flagChoices are fixed values for flags, by flag name
+var flagChoices = map[string][]string{
+	"model":          knownModels,
+	"fallback-model": knownModels,
+	"gender":         {"male", "female", "neutral"},
+	"slot":           {"voice1", "voice2"},
+	"provider":       fabulae.Providers(),
+	"redact-mode":    {"placeholder", "bleep"},
+	"disclosure":     {fabulae.DisclosureStart, fabulae.DisclosureEnd, fabulae.DisclosureBoth},
+	"content-filter": {fabulae.FilterBlock, fabulae.FilterBleep, fabulae.FilterRewrite},
+	"fixtures":       {fabulae.FixturesRecord, fabulae.FixturesReplay},
+	"code":           {fabulae.CodeDescribe, fabulae.CodeSkip},
+}
+
+// flagKind decides what to complete for a flag's value
+func flagKind(f *flag.Flag) int {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return valueNone
+	}
+	switch f.Name {
+	case "voice", "voice1", "voice2", "disclosure-voice":
+		return valueVoice
+	case "conversationfile", "promptfile", "config", "file", "debug-log", "cover", "filter-terms", "sign-key", "key", "script", "acronyms", "show-notes", "drive-credentials", "video-cover", "youtube-credentials", "podcast-artwork", "analytics", "ads", "music":
+		return valueFile
+	case "assetdir", "fixtures-dir":
+		return valueDir
+	}
+	if _, ok := flagChoices[f.Name]; ok {
+		return valueChoice
+	}
+	return valueAny
+}
+
+func allFlags(fs *flag.FlagSet) []*flag.Flag {
+	flags := []*flag.Flag{}
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+// completionWords are the flags and argument values offered for a target
+func completionWords(t completionTarget) string {
+	names := append([]string{}, t.args...)
+	for _, f := range allFlags(t.flags) {
+		names = append(names, "-"+f.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+// shellFunc turns a program name into a shell function name
+func shellFunc(name string) string {
+	return "_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func writeBashCompletion(w io.Writer, name string) {
+	fn := shellFunc(name)
+	targets := completionTargets()
+
+	names := []string{"help"}
+	for _, t := range targets {
+		names = append(names, t.name)
+	}
+	values := map[int][]string{}
+	choices := []string{}
+	for _, t := range targets {
+		for _, f := range allFlags(t.flags) {
+			values[flagKind(f)] = append(values[flagKind(f)], "-"+f.Name)
+		}
+		for _, sub := range t.subcommands {
+			for _, f := range allFlags(sub.flags) {
+				values[flagKind(f)] = append(values[flagKind(f)], "-"+f.Name)
+			}
+		}
+	}
+	choiceNames := []string{}
+	for name := range flagChoices {
+		choiceNames = append(choiceNames, name)
+	}
+	sort.Strings(choiceNames)
+	for _, name := range choiceNames {
+		choices = append(choices, fmt.Sprintf("    -%s|--%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;", name, name, strings.Join(flagChoices[name], " ")))
+	}
+	caseFlags := func(kind int) string {
+		seen := map[string]bool{}
+		flags := []string{}
+		for _, f := range values[kind] {
+			if !seen[f] {
+				seen[f] = true
+				flags = append(flags, f, "-"+f)
+			}
+		}
+		if len(flags) == 0 {
+			return "__none__"
+		}
+		return strings.Join(flags, "|")
+	}
+
+	fmt.Fprintf(w, "# bash completion for %s\n", name)
+	fmt.Fprintf(w, "%s() {\n", fn)
+	fmt.Fprintf(w, "  local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(w, "  case \"$prev\" in\n")
+	fmt.Fprintf(w, "    %s) COMPREPLY=($(compgen -W \"$(%s completion %s 2>/dev/null)\" -- \"$cur\")); return ;;\n", caseFlags(valueVoice), name, completeVoicesArg)
+	fmt.Fprintf(w, "    %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", caseFlags(valueFile))
+	fmt.Fprintf(w, "    %s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n", caseFlags(valueDir))
+	fmt.Fprintln(w, strings.Join(choices, "\n"))
+	fmt.Fprintf(w, "    %s) return ;;\n", caseFlags(valueAny))
+	fmt.Fprintf(w, "  esac\n")
+	fmt.Fprintf(w, "  if [[ $COMP_CWORD -eq 1 && \"$cur\" != -* ]]; then\n")
+	fmt.Fprintf(w, "    COMPREPLY=($(compgen -W %q -- \"$cur\")); return\n", strings.Join(names, " "))
+	fmt.Fprintf(w, "  fi\n")
+	fmt.Fprintf(w, "  local cmd=\"${COMP_WORDS[1]}\"\n")
+	fmt.Fprintf(w, "  [[ \"$cmd\" == -* ]] && cmd=generate\n")
+	fmt.Fprintf(w, "  case \"$cmd\" in\n")
+	for _, t := range targets {
+		if len(t.subcommands) == 0 {
+			fmt.Fprintf(w, "    %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", t.name, completionWords(t))
+			continue
+		}
+		subs := []string{}
+		for _, sub := range t.subcommands {
+			subs = append(subs, sub.name)
+		}
+		fmt.Fprintf(w, "    %s)\n", t.name)
+		fmt.Fprintf(w, "      if [[ $COMP_CWORD -eq 2 ]]; then COMPREPLY=($(compgen -W %q -- \"$cur\")); return; fi\n", strings.Join(subs, " "))
+		fmt.Fprintf(w, "      case \"${COMP_WORDS[2]}\" in\n")
+		for _, sub := range t.subcommands {
+			fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", sub.name, completionWords(sub))
+		}
+		fmt.Fprintf(w, "      esac ;;\n")
+	}
+	fmt.Fprintf(w, "    help) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(names[1:], " "))
+	fmt.Fprintf(w, "  esac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -F %s %s\n", fn, name)
+}
+
+// zshQuote escapes s for a single quoted _arguments spec
+func zshQuote(s string) string {
+	s = strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+	return s
+}
+
+func zshArguments(fn string, t completionTarget) string {
+	specs := []string{}
+	if len(t.args) > 0 {
+		specs = append(specs, fmt.Sprintf("'1:%s:(%s)'", t.name, strings.Join(t.args, " ")))
+	}
+	for _, f := range allFlags(t.flags) {
+		spec := fmt.Sprintf("'-%s[%s]", f.Name, zshQuote(f.Usage))
+		switch flagKind(f) {
+		case valueNone:
+		case valueVoice:
+			spec += ":voice:" + fn + "_voices"
+		case valueFile:
+			spec += ":file:_files"
+		case valueDir:
+			spec += ":directory:_files -/"
+		case valueChoice:
+			spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(flagChoices[f.Name], " "))
+		default:
+			spec += ":" + f.Name + ":"
+		}
+		specs = append(specs, spec+"'")
+	}
+	if len(specs) == 0 {
+		return "_message 'no flags'"
+	}
+	return "_arguments " + strings.Join(specs, " \\\n        ")
+}
+
+func writeZshCompletion(w io.Writer, name string) {
+	fn := shellFunc(name)
+	targets := completionTargets()
+
+	fmt.Fprintf(w, "#compdef %s\n\n", name)
+	fmt.Fprintf(w, "%s_voices() {\n", fn)
+	fmt.Fprintf(w, "  local -a voices\n")
+	fmt.Fprintf(w, "  voices=(${(f)\"$(%s completion %s 2>/dev/null)\"})\n", name, completeVoicesArg)
+	fmt.Fprintf(w, "  _describe 'voice' voices\n")
+	fmt.Fprintf(w, "}\n\n")
+	fmt.Fprintf(w, "%s() {\n", fn)
+	fmt.Fprintf(w, "  local -a commands\n")
+	fmt.Fprintf(w, "  commands=(\n")
+	for _, t := range targets {
+		fmt.Fprintf(w, "    '%s:%s'\n", t.name, zshQuote(t.description))
+	}
+	fmt.Fprintf(w, "    'help:show help for a command'\n")
+	fmt.Fprintf(w, "  )\n")
+	fmt.Fprintf(w, "  if (( CURRENT == 2 )) && [[ $PREFIX != -* ]]; then\n")
+	fmt.Fprintf(w, "    _describe 'command' commands\n")
+	fmt.Fprintf(w, "    return\n")
+	fmt.Fprintf(w, "  fi\n")
+	fmt.Fprintf(w, "  local cmd=$words[2]\n")
+	fmt.Fprintf(w, "  if [[ $cmd == -* ]]; then\n")
+	fmt.Fprintf(w, "    cmd=generate\n")
+	fmt.Fprintf(w, "  else\n")
+	fmt.Fprintf(w, "    shift words; (( CURRENT-- ))\n")
+	fmt.Fprintf(w, "  fi\n")
+	fmt.Fprintf(w, "  case $cmd in\n")
+	for _, t := range targets {
+		if len(t.subcommands) == 0 {
+			fmt.Fprintf(w, "    %s)\n      %s ;;\n", t.name, zshArguments(fn, t))
+			continue
+		}
+		fmt.Fprintf(w, "    %s)\n", t.name)
+		fmt.Fprintf(w, "      if (( CURRENT == 2 )); then\n")
+		fmt.Fprintf(w, "        local -a subcommands\n")
+		fmt.Fprintf(w, "        subcommands=(")
+		for _, sub := range t.subcommands {
+			fmt.Fprintf(w, " '%s:%s'", sub.name, zshQuote(sub.description))
+		}
+		fmt.Fprintf(w, " )\n")
+		fmt.Fprintf(w, "        _describe 'subcommand' subcommands\n")
+		fmt.Fprintf(w, "        return\n")
+		fmt.Fprintf(w, "      fi\n")
+		fmt.Fprintf(w, "      local sub=$words[2]\n")
+		fmt.Fprintf(w, "      shift words; (( CURRENT-- ))\n")
+		fmt.Fprintf(w, "      case $sub in\n")
+		for _, sub := range t.subcommands {
+			fmt.Fprintf(w, "        %s)\n          %s ;;\n", sub.name, zshArguments(fn, sub))
+		}
+		fmt.Fprintf(w, "      esac ;;\n")
+	}
+	fmt.Fprintf(w, "    help)\n      _describe 'command' commands ;;\n")
+	fmt.Fprintf(w, "  esac\n")
+	fmt.Fprintf(w, "}\n\n")
+	fmt.Fprintf(w, "compdef %s %s\n", fn, name)
+}
+
+// fishQuote escapes s for a single quoted fish string
+func fishQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s)
+}
+
+func fishFlags(w io.Writer, name, condition string, fs *flag.FlagSet) {
+	for _, f := range allFlags(fs) {
+		line := fmt.Sprintf("complete -c %s -n '%s' -o %s -d '%s'", name, condition, f.Name, fishQuote(f.Usage))
+		switch flagKind(f) {
+		case valueNone:
+		case valueVoice:
+			line += fmt.Sprintf(" -x -a '(%s completion %s 2>/dev/null)'", name, completeVoicesArg)
+		case valueFile:
+			line += " -r -F"
+		case valueDir:
+			line += " -x -a '(__fish_complete_directories)'"
+		case valueChoice:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(flagChoices[f.Name], " "))
+		default:
+			line += " -x"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func writeFishCompletion(w io.Writer, name string) {
+	targets := completionTargets()
+	names := []string{"help"}
+	for _, t := range targets {
+		names = append(names, t.name)
+	}
+
+	fmt.Fprintf(w, "# fish completion for %s\n", name)
+	fmt.Fprintf(w, "complete -c %s -f\n", name)
+	for _, t := range targets {
+		fmt.Fprintf(w, "complete -c %s -n '__fish_use_subcommand' -a %s -d '%s'\n", name, t.name, fishQuote(t.description))
+	}
+	fmt.Fprintf(w, "complete -c %s -n '__fish_use_subcommand' -a help -d 'show help for a command'\n", name)
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from help' -a '%s'\n", name, strings.Join(names[1:], " "))
+
+	for _, t := range targets {
+		condition := "__fish_seen_subcommand_from " + t.name
+		if t.name == "generate" {
+			// flags without a subcommand are for generate
+			condition = "__fish_use_subcommand; or " + condition
+		}
+		if len(t.args) > 0 {
+			fmt.Fprintf(w, "complete -c %s -n '%s' -a '%s'\n", name, condition, strings.Join(t.args, " "))
+		}
+		if len(t.subcommands) == 0 {
+			fishFlags(w, name, condition, t.flags)
+			continue
+		}
+		subs := []string{}
+		for _, sub := range t.subcommands {
+			subs = append(subs, sub.name)
+		}
+		for _, sub := range t.subcommands {
+			fmt.Fprintf(w, "complete -c %s -n '%s; and not __fish_seen_subcommand_from %s' -a %s -d '%s'\n",
+				name, condition, strings.Join(subs, " "), sub.name, fishQuote(sub.description))
+		}
+		for _, sub := range t.subcommands {
+			fishFlags(w, name, condition+"; and __fish_seen_subcommand_from "+sub.name, sub.flags)
+		}
+	}
+}
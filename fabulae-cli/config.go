@@ -0,0 +1,218 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghchinoy/fabulae"
+	"github.com/ghchinoy/fabulae/config"
+)
+
+// cliConfig is the JSON config file, values are used when the
+// corresponding flag isn't set
+type cliConfig struct {
+	// Config is the project, region and model, read by loadSettings
+	config.Config
+	Voice1 string `json:"voice1,omitempty"`
+	Voice2 string `json:"voice2,omitempty"`
+	// CustomVoices are licensed custom voices, usable by name for either speaker
+	CustomVoices map[string]fabulae.CustomVoice `json:"custom_voices,omitempty"`
+	// ElevenLabsVoices maps voice names to ElevenLabs voice IDs
+	ElevenLabsVoices map[string]string `json:"elevenlabs_voices,omitempty"`
+	// AzureVoices maps voice names to Azure voices and speaking styles
+	AzureVoices map[string]fabulae.AzureVoice `json:"azure_voices,omitempty"`
+	// FallbackVoices are voices that speak a turn when its voice keeps failing, or auto
+	FallbackVoices map[string]string `json:"fallback_voices,omitempty"`
+	// Preprocess are commands that transform each turn's text, optionally for some voices
+	Preprocess []fabulae.CommandProcessor `json:"preprocess,omitempty"`
+	// Budget refuses documents and scripts that would cost more, unless -force
+	Budget *fabulae.Budget `json:"budget,omitempty"`
+	// Mastering is the effects chain episodes are mastered with, used
+	// unless -master=false
+	Mastering *fabulae.Mastering `json:"mastering,omitempty"`
+	// DriveFolder receives each finished episode, with DriveCredentials if set
+	DriveFolder      string `json:"drive_folder,omitempty"`
+	DriveCredentials string `json:"drive_credentials,omitempty"`
+	// Personas are recurring hosts and experts by ID, see fabulae personas
+	Personas map[string]fabulae.Persona `json:"personas,omitempty"`
+	// Shows are recurring shows by ID, see fabulae shows
+	Shows map[string]fabulae.Show `json:"shows,omitempty"`
+}
+
+// defaultConfigPath is the config file used when -config isn't set,
+// e.g. ~/.config/fabulae/config.json
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fabulae", "config.json")
+}
+
+// loadConfig reads a config file, a missing file is an empty config
+func loadConfig(path string) (cliConfig, error) {
+	var config cliConfig
+	if path == "" {
+		return config, nil
+	}
+	configbytes, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(configbytes, &config)
+	return config, err
+}
+
+// saveConfig writes a config file, creating its directory
+func saveConfig(path string, config cliConfig) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	configbytes, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(configbytes, '\n'), 0644)
+}
+
+func configCommand() *command {
+	fs := newFlagSet("config", "Show the Google Cloud settings and where each comes from")
+	configFileFlag(fs)
+	config.RegisterFlags(fs, "project", "region", "model")
+	return &command{
+		name:        "config",
+		description: "show the Google Cloud settings",
+		flags:       fs,
+		examples: []string{
+			"fabulae config",
+			"REGION=europe-west4 fabulae config -model gemini-1.5-flash",
+		},
+		run: func(args []string) error {
+			if err := settings.Dump(os.Stdout); err != nil {
+				return err
+			}
+			return settings.Validate()
+		},
+	}
+}
+
+// configFileFlag adds -config, for the subcommands that edit the config file
+func configFileFlag(fs *flag.FlagSet) {
+	fs.StringVar(&configfile, "config", "", "path to JSON config file (default "+defaultConfigPath()+")")
+}
+
+// loadConfigFile loads the -config file, or the default one
+func loadConfigFile() (cliConfig, error) {
+	if configfile == "" {
+		configfile = defaultConfigPath()
+	}
+	return loadConfig(configfile)
+}
+
+// applyConfig sets voices, the show and personas from the config file unless
+// given as flags
+func applyConfig(fs *flag.FlagSet) error {
+	if configfile == "" {
+		configfile = defaultConfigPath()
+	}
+	config, err := loadConfig(configfile)
+	if err != nil {
+		return err
+	}
+	if err := registerCustomVoices(config); err != nil {
+		return err
+	}
+	addPreprocessors(config)
+	configFallbacks = config.FallbackVoices
+	elevenLabsVoices = config.ElevenLabsVoices
+	azureVoices = config.AzureVoices
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if config.Budget != nil {
+		if !set["max-tokens"] {
+			budget.DocumentTokens = config.Budget.DocumentTokens
+		}
+		if !set["max-tts-chars"] {
+			budget.TTSCharacters = config.Budget.TTSCharacters
+		}
+	}
+	if config.Mastering != nil {
+		if err := config.Mastering.Validate(); err != nil {
+			return fmt.Errorf("mastering in %s: %w", configfile, err)
+		}
+		mastering = *config.Mastering
+		if !set["master"] {
+			master = true
+		}
+	}
+	if config.DriveFolder != "" && !set["drive-folder"] {
+		driveFolder = config.DriveFolder
+	}
+	if config.DriveCredentials != "" && !set["drive-credentials"] {
+		driveCredentials = config.DriveCredentials
+	}
+	if config.Voice1 != "" && !set["voice1"] {
+		voice1name = config.Voice1
+	}
+	if config.Voice2 != "" && !set["voice2"] {
+		voice2name = config.Voice2
+	}
+	if config.Voice1 != "" || config.Voice2 != "" {
+		log.Printf("voices from %s: %s, %s", configfile, voice1name, voice2name)
+	}
+	if err := applyShow(config, set); err != nil {
+		return err
+	}
+	return applyPersonas(config, set)
+}
+
+// registerCustomVoices makes the config file's custom voices available by name
+func registerCustomVoices(config cliConfig) error {
+	for name, voice := range config.CustomVoices {
+		if err := fabulae.RegisterCustomVoice(name, voice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPreprocessors adds the built-in text normalization that's enabled, then
+// the config file's preprocessing commands and the -preprocess command
+func addPreprocessors(config cliConfig) {
+	if speakMath {
+		fabulae.AddTextProcessor(fabulae.MathSpeaker{})
+	}
+	if verbalize {
+		fabulae.AddTextProcessor(fabulae.Verbalizer{})
+	}
+	for _, p := range config.Preprocess {
+		fabulae.AddTextProcessor(p)
+	}
+	if command := strings.Fields(preprocessCommand); len(command) > 0 {
+		fabulae.AddTextProcessor(fabulae.CommandProcessor{Command: command})
+	}
+}
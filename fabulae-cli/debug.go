@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	verbose     bool
+	veryVerbose bool
+	debugLog    string
+	fixtures    string
+	fixturesDir string
+)
+
+// debugFlags adds -v and -vv, for commands that call Gemini or Text-to-Speech,
+// and -fixtures to record or replay those calls
+func debugFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&verbose, "v", false, "debug log request metadata and timing")
+	fs.BoolVar(&veryVerbose, "vv", false, "debug log prompts, responses and synthesized text too")
+	fs.StringVar(&debugLog, "debug-log", "fabulae-debug.log", "debug log file for -v and -vv")
+	fs.StringVar(&fixtures, "fixtures", envCheck("FABULAE_FIXTURES", ""), "record or replay Gemini and Text-to-Speech responses, or env FABULAE_FIXTURES")
+	fs.StringVar(&fixturesDir, "fixtures-dir", envCheck("FABULAE_FIXTURES_DIR", "testdata/fixtures"), "fixtures folder, or env FABULAE_FIXTURES_DIR")
+}
+
+// startDebug opens the debug log when -v or -vv is set, and sets up fixtures
+func startDebug() error {
+	if err := fabulae.SetFixtures(fixtures, fixturesDir); err != nil {
+		return err
+	}
+	if fixtures != "" {
+		log.Printf("fixtures: %s %s", fixtures, fixturesDir)
+	}
+	level := fabulae.DebugOff
+	switch {
+	case veryVerbose:
+		level = fabulae.DebugPayloads
+	case verbose:
+		level = fabulae.DebugRequests
+	}
+	if level == fabulae.DebugOff {
+		return nil
+	}
+	f, err := os.OpenFile(debugLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open debug log: %w", err)
+	}
+	fabulae.SetDebug(f, level)
+	// the debug log also has the regular log output, for context
+	log.SetOutput(io.MultiWriter(os.Stderr, f))
+	fmt.Fprintf(f, "--- %s\n", strings.Join(os.Args, " "))
+	log.Printf("debug log: %s", debugLog)
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	experimentPrompts     string
+	experimentModels      string
+	experimentOutput      string
+	experimentSamples     bool
+	experimentSampleTurns int
+	experimentReportTurns int
+)
+
+func experimentCommand() *command {
+	fs := newFlagSet("experiment", "Generate an episode with several prompts or models and compare them")
+	fs.StringVar(&pdfurl, "pdf-url", "", "URL for PDF, http(s), gs:// or a Google Drive file ID/Docs URL")
+	fs.StringVar(&experimentPrompts, "prompts", "", "comma-separated prompt files, builtin for the built-in prompt (default builtin)")
+	fs.StringVar(&experimentModels, "models", "gemini-1.5-pro", "comma-separated generative model names")
+	fs.StringVar(&experimentOutput, "o", "", "output folder (default experiment_<time>)")
+	fs.BoolVar(&experimentSamples, "samples", false, "synthesize the first turns of each script")
+	fs.IntVar(&experimentSampleTurns, "sample-turns", 4, "turns in each audio sample")
+	fs.IntVar(&experimentReportTurns, "report-turns", 6, "turns shown side by side in the report")
+	fs.StringVar(&voice1name, "voice1", "en-US-Chirp3-HD-Charon", "voice 1, for samples")
+	fs.StringVar(&voice2name, "voice2", "en-US-Chirp3-HD-Kore", "voice 2, for samples")
+	fs.StringVar(&striptags, "strip", "AGENT,CUSTOMER", "particpant labels to split")
+	promptFlags(fs)
+	projectFlags(fs)
+	debugFlags(fs)
+	return &command{
+		name:        "experiment",
+		description: "compare prompts or models on the same source",
+		flags:       fs,
+		examples: []string{
+			"fabulae experiment -pdf-url https://arxiv.org/pdf/2209.03143 -prompts builtin,casual.tpl",
+			"fabulae experiment -pdf-url gs://my-bucket/paper.pdf -models gemini-1.5-pro,gemini-1.5-flash -samples",
+		},
+		run: runExperiment,
+	}
+}
+
+func runExperiment(args []string) error {
+	if pdfurl == "" {
+		return errors.New("experiment needs a -pdf-url source")
+	}
+	if err := requireProject(); err != nil {
+		return err
+	}
+
+	if err := fabulae.ValidateCodeMode(codeMode); err != nil {
+		return err
+	}
+
+	// every prompt with every model
+	prompts := strings.Split(experimentPrompts, ",")
+	models := strings.Split(experimentModels, ",")
+	if err := checkModels(models...); err != nil {
+		return err
+	}
+	variants := []fabulae.ExperimentVariant{}
+	for _, promptfile := range prompts {
+		prompt, err := fabulae.PodcastPromptWith(promptData())
+		if err != nil {
+			return err
+		}
+		base := "builtin"
+		if promptfile != "" && promptfile != "builtin" {
+			data, err := os.ReadFile(promptfile)
+			if err != nil {
+				return fmt.Errorf("unable to read prompt: %w", err)
+			}
+			prompt = string(data)
+			base = strings.TrimSuffix(filepath.Base(promptfile), filepath.Ext(promptfile))
+		}
+		for _, model := range models {
+			name := base
+			if len(models) > 1 {
+				name = fmt.Sprintf("%s_%s", base, model)
+			}
+			variants = append(variants, fabulae.ExperimentVariant{Name: name, Model: model, Prompt: prompt})
+		}
+	}
+	if len(variants) < 2 {
+		return errors.New("experiment needs two or more -prompts or -models")
+	}
+
+	dir := experimentOutput
+	if dir == "" {
+		dir = fmt.Sprintf("experiment_%s", time.Now().Format("20060102.030405.06"))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	source, localpdf, err := documentSource(pdfurl)
+	if err != nil {
+		return err
+	}
+	if localpdf != "" {
+		defer os.Remove(localpdf)
+	}
+	log.Printf("generating %d variants from %s", len(variants), pdfurl)
+	results := fabulae.RunExperiment(context.Background(), projectID, location, source, striptags, variants)
+
+	for _, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		scriptfile := filepath.Join(dir, r.Variant.Name+".txt")
+		if err := os.WriteFile(scriptfile, []byte(r.Script), 0644); err != nil {
+			return err
+		}
+		if experimentSamples {
+			if err := experimentSample(dir, r); err != nil {
+				log.Printf("sample for %s failed: %v", r.Variant.Name, err)
+			}
+		}
+	}
+	if err := writeJSON(filepath.Join(dir, "report.json"), results); err != nil {
+		return err
+	}
+	report := fabulae.ExperimentReport(pdfurl, results, experimentReportTurns)
+	if err := os.WriteFile(filepath.Join(dir, "report.md"), []byte(report), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("experiment written to %s\n", dir)
+	return nil
+}
+
+// experimentSample synthesizes the first turns of a variant's script
+func experimentSample(dir string, r fabulae.ExperimentResult) error {
+	turns := strings.Split(strings.TrimSpace(r.Script), "\n")
+	opening := []string{}
+	for _, turn := range turns {
+		if strings.TrimSpace(turn) != "" && len(opening) < experimentSampleTurns {
+			opening = append(opening, turn)
+		}
+	}
+	cast, err := fabulae.NewCast("google", voice1name, voice2name)
+	if err != nil {
+		return err
+	}
+	samplefile := filepath.Join(dir, r.Variant.Name+".wav")
+	audiofiles, err := fabulae.SynthesizeConversation(context.Background(), cast, voice1name, voice2name, strings.Join(opening, "\n"), samplefile, striptags)
+	if err != nil {
+		return err
+	}
+	_, err = fabulae.CombineAudioFiles(filepath.Join(dir, r.Variant.Name+"_sample"), audiofiles)
+	return err
+}
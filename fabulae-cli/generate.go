@@ -0,0 +1,1281 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+	"github.com/ghchinoy/fabulae/config"
+	"github.com/schollz/progressbar/v3"
+)
+
+var (
+	conversationfile       string
+	conversationtext       string
+	pdfurl                 string
+	configfile             string
+	voice1name, voice2name string
+	striptags              string
+	turnbyturn             bool
+	modelName              string
+	saveTranscript         bool
+	assetdir               string
+	promptfile             string
+	title                  string
+	interjections          bool
+	naturalPacing          bool
+	interjectionRate       float64
+	provider               string
+	elevenLabsVoices       map[string]string
+	azureVoices            map[string]fabulae.AzureVoice
+	livePreview            bool
+	redact                 bool
+	redactMode             string
+	redactTypes            string
+	contentFilter          string
+	filterTerms            string
+	disclosure             string
+	disclosureVoice        string
+	disclosureText         string
+	sourceName             string // what the episode is from, for the disclosure
+	writeProvenance        bool
+	signingKey             string
+	provenance             fabulae.Provenance // filled in as the episode is made
+	hostNames              string
+	showName               string
+	targetMinutes          int
+	audience               string
+	tone                   string
+	preprocessCommand      string
+	verbalize              bool
+	speakMath              bool
+	codeMode               string
+	skipReferences         bool
+	expandAcronyms         bool
+	acronymsFile           string
+	fallbackFlag           string
+	configFallbacks        map[string]string
+	fallbackVoices         map[string]string // voice to fallback, from the config file and -fallback-voices
+	budget                 fabulae.Budget
+	force                  bool
+	transcriptFormats      string
+	wordTimings            bool
+	episodePage            bool
+	showNotesFile          string
+	driveFolder            string
+	driveCredentials       string
+	publishYouTube         bool
+	videoCover             string
+	youtubePrivacy         string
+	youtubeCredentials     string
+	podcastHost            string
+	podcastShow            string
+	podcastArtwork         string
+	podcastPublish         bool
+	minQuality             float64
+	qualityRetries         int
+	safetyFallback         fabulae.SafetyFallback
+	freeTextScript         bool
+	cacheDocument          bool
+	factCheckMode          string
+	factCheck              *fabulae.FactCheck       // the generated script's, with -fact-check
+	transcriptTurns        []fabulae.TranscriptTurn // timed once the turns are synthesized
+)
+
+func generateCommand() *command {
+	fs := newFlagSet("generate", "Generate a two-voice conversation from a PDF or a transcript")
+	fs.StringVar(&conversationfile, "conversationfile", "", "path to transcript, - for stdin")
+	fs.StringVar(&conversationtext, "text", "", "transcript text")
+	fs.StringVar(&pdfurl, "pdf-url", "", "URL for PDF, http(s), gs:// or a Google Drive file ID/Docs URL")
+	fs.StringVar(&modelName, "model", config.DefaultModel, "generative model name, or env MODEL_NAME")
+	fs.BoolVar(&saveTranscript, "save-transcript", false, "save generated transcript")
+	fs.StringVar(&transcriptFormats, "transcript-formats", "", "also write the transcript alongside the audio, comma-separated: md, json and srt")
+	fs.BoolVar(&wordTimings, "word-timings", false, "with -transcript-formats, time each word by aligning the episode with Speech-to-Text, for the json words and srt cues")
+	fs.BoolVar(&episodePage, "episode-page", false, "also write a web page for the episode, with a player, show notes and the transcript")
+	fs.StringVar(&showNotesFile, "show-notes", "", "text file of show notes for -episode-page, paragraphs separated by blank lines")
+	fs.StringVar(&driveFolder, "drive-folder", "", "upload the episode, transcripts, page and manifest to a Google Drive folder, by ID or URL")
+	fs.StringVar(&driveCredentials, "drive-credentials", "", "service account key or authorized user credentials for -drive-folder (default application default credentials)")
+	fs.BoolVar(&publishYouTube, "youtube", false, "render the episode as a video over a still and upload it to YouTube, requires ffmpeg")
+	fs.StringVar(&videoCover, "video-cover", "", "cover art for -youtube, JPEG or PNG (default the episode's waveform)")
+	fs.StringVar(&youtubePrivacy, "youtube-privacy", "private", "-youtube video privacy: private, unlisted or public")
+	fs.StringVar(&youtubeCredentials, "youtube-credentials", "", "authorized user credentials for the channel, with the youtube.upload scope (default application default credentials)")
+	fs.StringVar(&podcastHost, "podcast-host", "", "push the episode to a show on a podcast host: "+strings.Join(fabulae.PodcastHosts(), ", "))
+	fs.StringVar(&podcastShow, "podcast-show", "", "-podcast-host show or podcast ID (default from the host's environment variable)")
+	fs.StringVar(&podcastArtwork, "podcast-artwork", "", "episode artwork for -podcast-host, a JPEG or PNG file or URL")
+	fs.BoolVar(&podcastPublish, "podcast-publish", false, "publish the -podcast-host episode now, rather than as a draft")
+	fs.Float64Var(&minQuality, "min-quality", 0, "critique the generated script with Gemini and regenerate it with the feedback while it scores under this, 1 to 10 (default no critique)")
+	fs.IntVar(&qualityRetries, "quality-retries", fabulae.DefaultQualityRetries, "most times to regenerate a script under -min-quality")
+	fs.BoolVar(&safetyFallback.Relaxed, "relax-safety", false, "if Gemini blocks the script for safety, retry blocking only content with a high probability of harm")
+	fs.StringVar(&safetyFallback.Model, "fallback-model", "", "if Gemini blocks the script, retry with this model")
+	fs.BoolVar(&freeTextScript, "free-text-script", false, "ask Gemini for the script as lines with speaker markers, rather than JSON turns on models with controlled generation")
+	fs.BoolVar(&cacheDocument, "cache-document", false, "cache the document with Vertex AI context caching, so generating from it again, e.g. in another style, bills its tokens once")
+	fs.DurationVar(&fabulae.ContextCacheTTL, "cache-ttl", fabulae.ContextCacheTTL, "with -cache-document, how long the document stays cached")
+	fs.IntVar(&fabulae.MaxContinuations, "max-continuations", fabulae.MaxContinuations, "follow-up requests to continue a script cut off at Gemini's output limit, 0 to not continue")
+	fs.StringVar(&factCheckMode, "fact-check", "", "check the generated script's claims against the document: report writes the unsupported claims next to the episode, corrections also has the host correct them at the end")
+	fs.StringVar(&promptfile, "promptfile", "", "user-supplied prompt file")
+	promptFlags(fs)
+	personaFlags(fs)
+	showFlags(fs)
+	fs.StringVar(&title, "label", "", "custom title or label for output file")
+	fs.StringVar(&assetdir, "assetdir", ".", "output folder")
+
+	fs.StringVar(&configfile, "config", "", "path to JSON config file (default "+defaultConfigPath()+")")
+	fs.StringVar(&voice1name, "voice1", "en-US-Chirp3-HD-Charon", "voice 1")
+	fs.StringVar(&voice2name, "voice2", "en-US-Chirp3-HD-Kore", "voice 2")
+	fs.StringVar(&striptags, "strip", "AGENT,CUSTOMER", "particpant labels to split")
+	fs.BoolVar(&turnbyturn, "turn-by-turn", true, "output each turn as a wav")
+	fs.StringVar(&disclosure, "disclosure", "", "speak an AI-generated disclosure at the start, end or both")
+	fs.StringVar(&disclosureVoice, "disclosure-voice", "", "voice for the disclosure, default voice1")
+	fs.StringVar(&adsFile, "ads", "", "JSON file of sponsor segments to insert, pre, mid or post-roll, each recorded audio or a script; writes the chapters next to the episode")
+	fs.StringVar(&disclosureText, "disclosure-text", "", "disclosure text, default \"This episode was generated by AI from <source>.\"")
+	fs.BoolVar(&writeProvenance, "provenance", false, "embed a provenance record, of the source, script, models and voices, in the audio and a manifest")
+	fs.StringVar(&signingKey, "sign-key", envCheck("FABULAE_SIGNING_KEY", ""), "ed25519 PEM private key to sign the provenance record, or env FABULAE_SIGNING_KEY")
+	fs.IntVar(&budget.DocumentTokens, "max-tokens", 0, "refuse documents over this many Gemini input tokens, with the prompt (default no limit)")
+	fs.IntVar(&budget.TTSCharacters, "max-tts-chars", 0, "refuse scripts over this many Text-to-Speech characters, estimated before generating (default no limit)")
+	fs.BoolVar(&force, "force", false, "continue when over -max-tokens or -max-tts-chars, and generate an episode already in the catalog again")
+	fs.StringVar(&fallbackFlag, "fallback-voices", "", "voices to use when a voice keeps failing, voice=fallback,..., or auto for the same language and gender")
+	fs.StringVar(&contentFilter, "content-filter", "", "filter profanity in the script: block, bleep or rewrite")
+	fs.StringVar(&filterTerms, "filter-terms", "", "file of terms to filter, one per line with an optional =rewrite, instead of the built-in list")
+	fs.BoolVar(&redact, "redact", false, "redact names, phone numbers, emails and other personal information with DLP before synthesis")
+	fs.StringVar(&redactMode, "redact-mode", "placeholder", "how redacted text is spoken: placeholder or bleep")
+	fs.StringVar(&redactTypes, "redact-types", strings.Join(fabulae.DefaultRedactInfoTypes, ","), "DLP info types to redact")
+	fs.BoolVar(&livePreview, "live-preview", false, "experimental: stream the first minute through Gemini Live and listen before the full render")
+	fs.StringVar(&provider, "provider", "google", "text-to-speech provider: "+strings.Join(fabulae.Providers(), ", "))
+	fs.BoolVar(&naturalPacing, "natural-pacing", false, "add pauses and rate changes from punctuation and sentence length, for voices that accept SSML")
+	fs.BoolVar(&speakMath, "speak-math", false, "read LaTeX math as spoken English, e.g. $x^2 + y^2$ as \"x squared plus y squared\"")
+	fs.BoolVar(&verbalize, "verbalize", false, "speak numbers with units, currency, percentages and dates as words, e.g. 3.5GHz, $1.2B and 2024-06-01")
+	fs.BoolVar(&expandAcronyms, "expand-acronyms", false, "spell out acronyms on first mention, e.g. \"LLM, or large language model\"")
+	fs.StringVar(&acronymsFile, "acronyms", "", "file of acronyms to expand, one per line as ACRONYM=expansion, adding to the built-in list")
+	fs.StringVar(&preprocessCommand, "preprocess", "", "command that transforms each turn's text before synthesis, reading it on stdin with the voice in FABULAE_VOICE")
+	fs.BoolVar(&interjections, "interjections", false, "mix quiet listener reactions, like mm-hmm, under the end of some turns")
+	fs.Float64Var(&interjectionRate, "interjection-rate", fabulae.DefaultInterjectionRate, "share of turns with an interjection, 0 to 1")
+	fs.BoolVar(&fabulae.TurnChecks, "check-turns", false, "check each turn for clipping, DC offset, silence and static, and synthesize it again if it fails")
+	fs.BoolVar(&streamCombine, "stream-combine", false, "write each turn to the episode as it's synthesized, in order, so very long episodes aren't held in memory; wav voices only")
+	fs.DurationVar(&crossfade, "crossfade", 0, "crossfade between turns rather than cutting, e.g. 40ms, wav only")
+	fs.IntVar(&sampleRate, "sample-rate", 0, "sample rate to synthesize and combine the episode at, 8000 to 48000 Hz, wav only (default the voices')")
+	fs.StringVar(&channelsFlag, "channels", "", "combine the episode as mono or stereo, wav only (default the voices')")
+	fs.BoolVar(&master, "master", false, "master the episode with a high-pass filter, de-esser and gentle compressor, or the config file's mastering chain; wav only")
+	fs.StringVar(&music.Music, "music", "", "wav music to play under the episode, ducked under speech")
+	fs.Float64Var(&music.Gain, "music-gain", fabulae.DefaultMusicGain, "-music level under speech, 0 to 1")
+	fs.DurationVar(&music.Lead, "music-lead", fabulae.DefaultMusicLead, "how long -music plays alone before and after speech")
+	fs.DurationVar(&music.Fade, "music-fade", fabulae.DefaultMusicFade, "how long -music fades in and out")
+	fs.StringVar(&speedFlag, "speed-variants", "", "also write the episode at these speeds, e.g. 1.25,1.5, time-stretched to keep the voices' pitch; wav only")
+	fs.StringVar(&exportFlag, "export-profiles", "", "also write the episode for these destinations, comma-separated: podcast, -16 LUFS stereo mp3; voice-note, -19 LUFS mono mp3; broadcast, -23 LUFS stereo 48 kHz wav; telephony and telephony-alaw, 8 kHz G.711 μ-law or A-law wav")
+	projectFlags(fs)
+	debugFlags(fs)
+	return &command{
+		name:        "generate",
+		description: "generate a conversation from a PDF or transcript",
+		flags:       fs,
+		examples: []string{
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143",
+			"fabulae generate -pdf-url gs://my-bucket/paper.pdf -save-transcript -voice2 en-US-Chirp3-HD-Aoede",
+			"fabulae generate -conversationfile transcript.txt -strip AGENT,CUSTOMER",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -transcript-formats md,json,srt -provenance",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -live-preview",
+			"fabulae generate -conversationfile call.txt -redact -redact-mode bleep",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -content-filter rewrite",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -disclosure both -disclosure-voice en-US-Studio-O",
+			"cat transcript.txt | fabulae generate -",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -provenance -sign-key key.pem",
+			"fabulae generate -conversationfile transcript.txt -preprocess \"./normalize --units metric\"",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -max-tokens 200000 -max-tts-chars 20000",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -fallback-voices en-US-Chirp3-HD-Charon=en-US-Studio-Q,en-US-Chirp3-HD-Kore=en-US-Studio-O",
+			"fabulae generate -conversationfile transcript.txt -provider azure -voice1 en-US-JennyNeural:chat -voice2 en-US-GuyNeural",
+			"PIPER_MODEL_DIR=~/piper fabulae generate -conversationfile transcript.txt -provider piper -voice1 en_US-lessac-medium -voice2 en_US-amy-medium",
+			"fabulae generate -conversationfile transcript.txt -voice1 en-US-Chirp3-HD-Charon -voice2 elevenlabs:Rachel",
+			"ELEVENLABS_API_KEY=... fabulae generate -conversationfile transcript.txt -provider elevenlabs -voice1 Rachel -voice2 Adam",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -host-persona ada -expert-persona lee",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -ads sponsors.json",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -crossfade 40ms -music theme.wav",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -master",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -speed-variants 1.25,1.5",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -sample-rate 48000 -channels stereo",
+			"fabulae generate -show paper-trail -pdf-url https://arxiv.org/pdf/2209.03143",
+		},
+		run: func(args []string) error {
+			if err := applyConfig(fs); err != nil {
+				return err
+			}
+			return runGenerate(args)
+		},
+	}
+}
+
+func runGenerate(args []string) (err error) {
+	fabulae.SetNaturalPacing(naturalPacing)
+	fabulae.StructuredScripts = !freeTextScript
+	fabulae.ContextCaching = cacheDocument
+	// caches are reused by later runs until they expire
+	if dir, err := os.UserCacheDir(); err == nil {
+		fabulae.ContextCacheFile = filepath.Join(dir, "fabulae", "context-caches.json")
+	}
+	// voices with a provider prefix, e.g. elevenlabs:Rachel, cast speakers from different providers
+	provider1, _ := fabulae.VoiceProvider(voice1name)
+	provider2, _ := fabulae.VoiceProvider(voice2name)
+	// -stream-combine merges turns through a cast, as they're synthesized
+	casting := provider != "google" || provider1 != "" || provider2 != "" || streamCombine
+	// other providers only need a project to generate from a PDF
+	usesGoogle := provider == "google" && (provider1 == "" || provider2 == "")
+	if usesGoogle || provider1 == "google" || provider2 == "google" || pdfurl != "" {
+		if err := requireProject(); err != nil {
+			return err
+		}
+	}
+
+	// a lone - reads the transcript from stdin, e.g. cat transcript.txt | fabulae generate -
+	if len(args) > 0 {
+		if len(args) > 1 || args[0] != "-" || conversationfile != "" {
+			return fmt.Errorf("unexpected arguments %q, use - to read a transcript from stdin", args)
+		}
+		conversationfile = "-"
+	}
+
+	// Validate input sources
+	sources := 0
+	for _, s := range []string{conversationfile, pdfurl, conversationtext} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("must have one of a -conversationfile transcript, - for stdin, -text or a -pdf-url source")
+	}
+
+	switch disclosure {
+	case "", fabulae.DisclosureStart, fabulae.DisclosureEnd, fabulae.DisclosureBoth:
+	default:
+		return fmt.Errorf("unknown -disclosure %s, use start, end or both", disclosure)
+	}
+	if err := fabulae.ValidateCodeMode(codeMode); err != nil {
+		return err
+	}
+	if transcriptFormats != "" {
+		if err := fabulae.ValidateTranscriptFormats(strings.Split(transcriptFormats, ",")); err != nil {
+			return err
+		}
+	} else if wordTimings {
+		return errors.New("-word-timings needs -transcript-formats")
+	}
+	if err := checkMix(); err != nil {
+		return err
+	}
+	if _, err := loadAds(); err != nil {
+		return err
+	}
+	if err := setFallbackVoices(); err != nil {
+		return err
+	}
+	if err := checkVoices(voice1name, voice2name, disclosureVoice); err != nil {
+		return err
+	}
+	if err := fabulae.ValidateFactCheckMode(factCheckMode); err != nil {
+		return err
+	}
+	if factCheckMode != "" && pdfurl == "" {
+		return errors.New("-fact-check checks a script generated from -pdf-url")
+	}
+	if minQuality < 0 || minQuality > 10 {
+		return errors.New("-min-quality is a score from 1 to 10, or 0 for no critique")
+	}
+	if minQuality > 0 && qualityRetries < 1 {
+		return errors.New("-quality-retries must be at least 1, use -min-quality 0 for no critique")
+	}
+	if publishYouTube {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return fabulae.ErrNoFFmpeg
+		}
+		if !slices.Contains([]string{"private", "unlisted", "public"}, youtubePrivacy) {
+			return fmt.Errorf("unknown -youtube-privacy %q, use private, unlisted or public", youtubePrivacy)
+		}
+	}
+	// the podcast host's configuration is checked before generating
+	if podcastHost != "" {
+		if _, err := fabulae.NewPodcastHost(podcastHost, podcastShow); err != nil {
+			return err
+		}
+	}
+	if _, ok := fabulae.DriveFolderID(driveFolder); driveFolder != "" && !ok {
+		return fmt.Errorf("invalid -drive-folder %q, use a folder ID or URL", driveFolder)
+	}
+	if pdfurl != "" {
+		models := []string{modelName}
+		if safetyFallback.Model != "" {
+			models = append(models, safetyFallback.Model)
+		}
+		if err := checkModels(models...); err != nil {
+			return err
+		}
+	}
+	if redact && redactMode != "placeholder" && redactMode != "bleep" {
+		return fmt.Errorf("unknown -redact-mode %s, use placeholder or bleep", redactMode)
+	}
+	if ((redact && redactMode == "bleep") || contentFilter == fabulae.FilterBleep) && !turnbyturn {
+		return errors.New("bleeps require -turn-by-turn")
+	}
+	if interjections && !turnbyturn {
+		return errors.New("-interjections requires -turn-by-turn")
+	}
+	if streamCombine && (!turnbyturn || interjections || adsFile != "" || crossfade > 0) {
+		return errors.New("-stream-combine writes each turn straight to the episode, without -interjections, -ads or -crossfade and with -turn-by-turn")
+	}
+	if casting && (!turnbyturn || interjections) {
+		return errors.New("other providers require -turn-by-turn and don't support -interjections")
+	}
+
+	var conversation string
+	storytype := "podcast"
+
+	// Process PDF URL if provided
+	if pdfurl != "" {
+		source, localpdf, err := documentSource(pdfurl)
+		if err != nil {
+			return err
+		}
+		if localpdf != "" {
+			defer os.Remove(localpdf)
+			if pdf, err := os.ReadFile(localpdf); err == nil {
+				provenance.SourceSHA256 = fabulae.SHA256(pdf)
+			}
+		}
+		provenance.Source = pdfurl
+		provenance.Models = []string{modelName}
+		prompt, err := episodePrompt()
+		if err != nil {
+			return err
+		}
+		if found, err := findEpisode(fabulae.PromptSHA256(modelName, prompt)); found || err != nil {
+			return err
+		}
+		// the title is extracted from the same source while the
+		// conversation is generated, rather than before it
+		var documentTitle chan string
+		if title == "" {
+			documentTitle = make(chan string, 1)
+			go func() { documentTitle <- getTitleOfDocument(source) }()
+		}
+
+		if promptfile != "" {
+			storytype = "custom"
+		}
+
+		conversation, err = createConversationFromPDFURL(source, prompt)
+		if err != nil {
+			return fmt.Errorf("unable to create conversation from url %s: %w", pdfurl, err)
+		}
+		if documentTitle != nil {
+			title = <-documentTitle
+			log.Printf("Document title: %s", title)
+			sourceName = title
+			title = removeNonAlphanumerics(title)
+		}
+		log.Printf("title: %s", title)
+		transcriptfilename := fmt.Sprintf("%s-%s_%s_transcript.txt",
+			storytype,
+			title,
+			time.Now().Format("20060102.030405.06"),
+		)
+		if saveTranscript {
+			os.WriteFile(transcriptfilename, []byte(conversation), 0644)
+			log.Printf("transcript saved to: %s", transcriptfilename)
+		} else {
+			// keep the generated script if synthesis fails, so it isn't generated again
+			generated := conversation
+			defer func() {
+				if err == nil {
+					return
+				}
+				if werr := os.WriteFile(transcriptfilename, []byte(generated), 0644); werr != nil {
+					log.Printf("unable to save transcript: %v", werr)
+					return
+				}
+				err = fmt.Errorf("%w; the transcript was saved to %s, use -conversationfile %s to retry", err, transcriptfilename, transcriptfilename)
+			}()
+		}
+	} else if conversationtext != "" {
+		storytype = "transcript"
+		conversation = conversationtext
+	} else { // Process conversation file, or stdin, if provided
+		storytype = "transcript"
+		var err error
+		conversation, err = readInput(conversationfile)
+		if err != nil {
+			return err
+		}
+		provenance.Source = conversationfile
+	}
+	if pdfurl == "" {
+		provenance.SourceSHA256 = fabulae.SHA256([]byte(conversation))
+		if found, err := findEpisode(""); found || err != nil {
+			return err
+		}
+	}
+
+	var filterChanges []fabulae.FilterChange
+	if contentFilter != "" {
+		var err error
+		conversation, filterChanges, err = filterScript(conversation)
+		if err != nil {
+			return err
+		}
+	}
+
+	if redact {
+		if err := requireProject(); err != nil {
+			return err
+		}
+		var err error
+		conversation, err = fabulae.Redact(context.Background(), projectID, conversation, fabulae.RedactOptions{
+			InfoTypes: strings.Split(redactTypes, ","),
+			Bleep:     redactMode == "bleep",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if expandAcronyms {
+		var err error
+		if conversation, err = spellOutAcronyms(conversation); err != nil {
+			return err
+		}
+	}
+
+	// the script as spoken, after filtering, redaction and acronyms
+	provenance.ScriptSHA256 = fabulae.SHA256([]byte(conversation))
+	episodeScript = conversation
+
+	title = fmt.Sprintf("%s-%s", storytype, title)
+
+	// create file name for conversation audio output
+	inputname := strings.Split(conversationfile, ".")[0]
+	switch {
+	case conversationfile == "-":
+		inputname = "stdin"
+	case conversationtext != "":
+		inputname = "text"
+	}
+	var outputfilename string
+	if title != "" {
+		outputfilename = fmt.Sprintf("%s_%s_%s.wav",
+			inputname,
+			title,
+			time.Now().Format("20060102.030405.06"),
+		)
+	} else {
+		outputfilename = fmt.Sprintf("%s_%s.wav",
+			inputname,
+			time.Now().Format("20060102.030405.06"),
+		)
+	}
+
+	if len(filterChanges) > 0 {
+		reportfilename := strings.TrimSuffix(outputfilename, filepath.Ext(outputfilename)) + "_filter.json"
+		if err := writeJSON(reportfilename, filterChanges); err != nil {
+			return err
+		}
+		log.Printf("content filter: %d changes, report written to %s", len(filterChanges), reportfilename)
+	}
+
+	if err := withinBudget(budget.CheckCharacters(fabulae.ScriptCharacters(conversation))); err != nil {
+		return err
+	}
+	if err := checkDisk(conversation); err != nil {
+		return err
+	}
+	casting = casting || streamCombine
+
+	if livePreview {
+		proceed, err := runLivePreview(conversation, outputfilename)
+		if err != nil || !proceed {
+			return err
+		}
+	}
+
+	if casting {
+		return synthesizeWithProvider(conversation, outputfilename)
+	}
+
+	// Generate audio files from the conversation
+	audiofiles, err := fabulae.FabulaeContext(synthesisContext(), voice1name, voice2name, conversation, outputfilename, turnbyturn, striptags)
+	if err != nil {
+		return fmt.Errorf("error in Fabulae: %w", err)
+	}
+	// combining removes the turns, this removes them if a step before fails
+	defer func() { fabulae.RemoveFiles(audiofiles...) }()
+	timeTranscript(conversation, audiofiles)
+
+	if interjections {
+		err := fabulae.AddInterjections(context.Background(), audiofiles, voice1name, voice2name, fabulae.InterjectionOptions{Rate: interjectionRate})
+		if err != nil {
+			return err
+		}
+	}
+
+	if audiofiles, err = insertAds(audiofiles); err != nil {
+		return err
+	}
+
+	// Combine generated audio files into a single output
+	output, err := combineEpisode(audiofiles, fabulae.CombineWavFiles)
+	if err != nil {
+		return err
+	}
+	if err := finishEpisode(output); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Printf("audio file created: %s\n", output)
+	return nil
+}
+
+// finishEpisode adds the disclosure and provenance to the combined audio
+func finishEpisode(output string) error {
+	voice := disclosureVoice
+	if voice == "" {
+		voice = voice1name
+	}
+	if err := masterEpisode(output); err != nil {
+		return err
+	}
+	if err := addMusic(output); err != nil {
+		return err
+	}
+	var before time.Duration
+	if durations, err := fabulae.AudioDurations([]string{output}); err == nil {
+		before = durations[0]
+	}
+	if disclosure != "" {
+		synth, err := fabulae.NewCast(provider, voice)
+		if err != nil {
+			return err
+		}
+		err = fabulae.AddDisclosure(context.Background(), synth, output, fabulae.DisclosureOptions{
+			Text:     disclosureText,
+			Source:   sourceName,
+			Voice:    voice,
+			Position: disclosure,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	alignEpisode(output, before)
+	if err := writeTranscripts(output); err != nil {
+		return err
+	}
+	if err := writeEpisodeChapters(output); err != nil {
+		return err
+	}
+	if err := writeEpisodePage(output); err != nil {
+		return err
+	}
+	if factCheck != nil {
+		report, err := fabulae.WriteFactCheck(output, episodeTitle(), *factCheck)
+		if err != nil {
+			return fmt.Errorf("unable to write fact check: %w", err)
+		}
+		log.Printf("fact check written to %s", report)
+	}
+	if err := publishVideo(output); err != nil {
+		return err
+	}
+	if err := publishEpisode(output); err != nil {
+		return err
+	}
+	if err := writeEpisodeProvenance(output, voice); err != nil {
+		return err
+	}
+	if err := writeSpeedVariants(output); err != nil {
+		return err
+	}
+	if err := writeExports(output); err != nil {
+		return err
+	}
+	if err := uploadEpisode(output); err != nil {
+		return err
+	}
+	if err := rememberEpisode(); err != nil {
+		return err
+	}
+	if err := recordShowEpisode(); err != nil {
+		return err
+	}
+	return catalogEpisode(output)
+}
+
+// writeEpisodeProvenance writes the -provenance record, with voice if it
+// spoke the disclosure
+func writeEpisodeProvenance(output, voice string) error {
+	if !writeProvenance {
+		return nil
+	}
+	var key ed25519.PrivateKey
+	if signingKey != "" {
+		var err error
+		if key, err = fabulae.ReadSigningKey(signingKey); err != nil {
+			return fmt.Errorf("unable to read signing key: %w", err)
+		}
+	}
+	voices := []string{voice1name, voice2name}
+	if disclosure != "" && !slices.Contains(voices, voice) {
+		voices = append(voices, voice)
+	}
+	provenance.Substitutions = fabulae.VoiceSubstitutions()
+	for _, s := range provenance.Substitutions {
+		if !slices.Contains(voices, s.Fallback) {
+			voices = append(voices, s.Fallback)
+		}
+	}
+	provenance.Generator = "fabulae " + version
+	provenance.Title = sourceName
+	provenance.Created = time.Now()
+	provenance.Voices = withProviders(voices)
+	return fabulae.WriteProvenance(output, provenance, key)
+}
+
+// uploadEpisode uploads the episode and the files written with it to the
+// -drive-folder
+func uploadEpisode(output string) error {
+	if driveFolder == "" {
+		return nil
+	}
+	files := append([]string{output}, provenance.Transcripts...)
+	if episodePage {
+		files = append(files, fabulae.EpisodePageFile(output))
+	}
+	if factCheck != nil {
+		files = append(files, fabulae.FactCheckFile(output))
+	}
+	if len(episodeChapters) > 0 {
+		files = append(files, fabulae.ChaptersFile(output))
+	}
+	if writeProvenance {
+		files = append(files, fabulae.ProvenanceManifest(output))
+	}
+	files = append(files, speedVariants...)
+	files = append(files, exportFiles...)
+	fabulae.SetDriveCredentials(driveCredentials)
+	uploaded, err := fabulae.UploadToDrive(context.Background(), driveFolder, files...)
+	if err != nil {
+		return fmt.Errorf("unable to upload to Drive: %w", err)
+	}
+	fmt.Printf("uploaded to Drive: %s\n", uploaded[0].Link)
+	return nil
+}
+
+// setFallbackVoices sets fallbacks from the config file and -fallback-voices,
+// which is voice=fallback pairs or auto for both voices
+func setFallbackVoices() error {
+	fallbackVoices = map[string]string{}
+	for voice, fallback := range configFallbacks {
+		fallbackVoices[voice] = fallback
+	}
+	if fallbackFlag == fabulae.FallbackAuto {
+		fallbackVoices[voice1name], fallbackVoices[voice2name] = fabulae.FallbackAuto, fabulae.FallbackAuto
+	} else if fallbackFlag != "" {
+		for _, pair := range strings.Split(fallbackFlag, ",") {
+			voice, fallback, ok := strings.Cut(pair, "=")
+			if !ok || voice == "" || fallback == "" {
+				return fmt.Errorf("invalid -fallback-voices %q, use voice=fallback or auto", pair)
+			}
+			fallbackVoices[voice] = fallback
+		}
+	}
+	fabulae.SetFallbackVoices(fallbackVoices)
+	return nil
+}
+
+// filterScript applies the content filter to a script
+func filterScript(script string) (string, []fabulae.FilterChange, error) {
+	filter, err := fabulae.NewContentFilter(contentFilter)
+	if err != nil {
+		return "", nil, err
+	}
+	if filterTerms != "" {
+		terms, err := os.ReadFile(filterTerms)
+		if err != nil {
+			return "", nil, err
+		}
+		filter.Terms = fabulae.ParseFilterTerms(string(terms))
+	}
+	filtered, changes, err := filter.Apply(script)
+	if errors.Is(err, fabulae.ErrContentBlocked) {
+		for _, c := range changes {
+			log.Printf("content filter: line %d: %s", c.Line, c.Term)
+		}
+	}
+	return filtered, changes, err
+}
+
+// spellOutAcronyms expands acronyms on first mention with the built-in and
+// -acronyms expansions
+func spellOutAcronyms(script string) (string, error) {
+	user := map[string]string{}
+	if acronymsFile != "" {
+		data, err := os.ReadFile(acronymsFile)
+		if err != nil {
+			return "", err
+		}
+		user = fabulae.ParseAcronyms(string(data))
+	}
+	expanded, unknown := fabulae.ExpandAcronyms(script, user)
+	if len(unknown) > 0 {
+		log.Printf("acronyms without an expansion, add them to -acronyms: %s", strings.Join(unknown, ", "))
+	}
+	return expanded, nil
+}
+
+// turnProgress is a context that shows a bar of the turns synthesized
+func synthesisContext() context.Context {
+	var bar *progressbar.ProgressBar
+	return fabulae.WithProgress(context.Background(), func(e fabulae.ProgressEvent) {
+		if bar == nil {
+			bar = progressbar.NewOptions(
+				e.Turns,
+				progressbar.OptionSetDescription("synthesizing turns ..."),
+				progressbar.OptionSetWidth(15),
+				progressbar.OptionShowCount(),
+			)
+		}
+		if e.Kind != fabulae.TurnDone {
+			return
+		}
+		bar.Set(e.Done)
+		if e.Done == e.Turns {
+			bar.Finish()
+			fmt.Println()
+		}
+	})
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(filename string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// runLivePreview plays a quick Gemini Live preview of the conversation and
+// asks whether to continue with the full render
+func runLivePreview(conversation, outputfilename string) (bool, error) {
+	if err := requireProject(); err != nil {
+		return false, err
+	}
+	previewfilename := strings.TrimSuffix(outputfilename, filepath.Ext(outputfilename)) + "_preview.wav"
+	if _, err := fabulae.LivePreview(context.Background(), projectID, location, conversation, striptags, previewfilename, fabulae.LivePreviewOptions{}); err != nil {
+		return false, err
+	}
+	if player, err := audioPlayer(); err == nil {
+		cmd := exec.Command(player, previewfilename)
+		cmd.Stdout, cmd.Stderr = io.Discard, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("unable to play preview: %v", err)
+		}
+	}
+
+	// the transcript may have come from stdin, only ask at a terminal
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Printf("preview written to %s, not continuing without a terminal\n", previewfilename)
+		return false, nil
+	}
+	answer, err := ask(bufio.NewReader(os.Stdin), fmt.Sprintf("preview written to %s, continue with the full render? [y/N] ", previewfilename))
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes"), nil
+}
+
+// synthesizeWithProvider speaks the conversation with a provider other than
+// Cloud Text-to-Speech, or a provider for each voice, and combines the turns
+func synthesizeWithProvider(conversation, outputfilename string) error {
+	castVoices := []string{voice1name, voice2name}
+	for _, fallback := range fallbackVoices {
+		if fallback != fabulae.FallbackAuto {
+			castVoices = append(castVoices, fallback)
+		}
+	}
+	cast, err := fabulae.NewCast(provider, castVoices...)
+	if err != nil {
+		return err
+	}
+	// voice mappings from the config file add to those from the environment
+	for _, synth := range cast.Providers {
+		switch s := synth.(type) {
+		case *fabulae.ElevenLabs:
+			for name, id := range elevenLabsVoices {
+				s.Voices[name] = id
+			}
+		case *fabulae.Azure:
+			for name, voice := range azureVoices {
+				s.Voices[name] = voice
+			}
+		}
+	}
+	log.Printf("synthesizing with %s: %s, %s", provider, voice1name, voice2name)
+	if streamCombine {
+		return streamEpisode(cast, conversation, outputfilename)
+	}
+	audiofiles, err := fabulae.SynthesizeConversation(synthesisContext(), cast, voice1name, voice2name, conversation, outputfilename, striptags)
+	if err != nil {
+		return err
+	}
+	// combining removes the turns, this removes them if a step before fails
+	defer func() { fabulae.RemoveFiles(audiofiles...) }()
+	timeTranscript(conversation, audiofiles)
+	if audiofiles, err = insertAds(audiofiles); err != nil {
+		return err
+	}
+	output, err := combineEpisode(audiofiles, fabulae.CombineAudioFiles)
+	if err != nil {
+		return err
+	}
+	if err := finishEpisode(output); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Printf("audio file created: %s\n", output)
+	return nil
+}
+
+// createConversationFromPDFURL generates a conversation from a PDF URL using a generative AI model
+func createConversationFromPDFURL(pdfurl, prompt string) (string, error) {
+	log.Printf("generating conversation from %s ...", pdfurl)
+	conversation, err := generateConversationFrom(projectID, location, modelName, pdfurl, prompt)
+	if err != nil {
+		return "", err
+	}
+	log.Print("conversation created")
+	return conversation, nil
+}
+
+// promptFlags adds the built-in prompt's settings
+func promptFlags(fs *flag.FlagSet) {
+	fs.StringVar(&hostNames, "host-names", "", "comma-separated names for the host and expert, unnamed by default")
+	fs.StringVar(&showName, "show-name", "", "podcast name for the host to introduce")
+	fs.IntVar(&targetMinutes, "target-minutes", 0, "target episode length in minutes (default 26 turns)")
+	fs.StringVar(&audience, "audience", "", "who the episode is for, e.g. \"high school students\"")
+	fs.StringVar(&tone, "tone", "", "tone of the conversation, e.g. playful")
+	fs.StringVar(&codeMode, "code", "", "source code in the document: describe it in prose or skip it (default read as written)")
+	fs.BoolVar(&skipReferences, "skip-references", false, "ignore the document's references, footnotes and page headers and footers")
+}
+
+// promptData is the built-in prompt's settings from flags
+func promptData() fabulae.PromptData {
+	data := fabulae.PromptData{
+		ShowName:       showName,
+		TargetMinutes:  targetMinutes,
+		Audience:       audience,
+		Tone:           tone,
+		Code:           codeMode,
+		SkipReferences: skipReferences,
+	}
+	if hostNames != "" {
+		data.HostNames = strings.Split(hostNames, ",")
+	}
+	if len(castPersonas) > 0 {
+		data = data.WithPersonas(castPersonas...)
+	}
+	if currentShow != nil {
+		data.PreviousEpisodes = currentShow.PreviousEpisodes(episodeNumber)
+	}
+	return data
+}
+
+// documentSource returns a source Gemini can read for a PDF URL: Cloud
+// Storage and Drive files in place, others downloaded to a local file for
+// the caller to remove
+func documentSource(pdfurl string) (source, localpdf string, err error) {
+	if err := fabulae.ValidateSourceURI(pdfurl); err != nil {
+		return "", "", err
+	}
+	if fabulae.IsGCSURI(pdfurl) {
+		log.Printf("using Cloud Storage source in place: %s", pdfurl)
+		return pdfurl, "", nil
+	}
+	if _, ok := fabulae.DriveFileID(pdfurl); ok {
+		return pdfurl, "", nil
+	}
+	localpdf, err = retrievePDFContent(pdfurl)
+	if err != nil {
+		return "", "", err
+	}
+	return "file://" + localpdf, localpdf, nil
+}
+
+// retrievePDFContent given an URL, retrieve the PDF at that URL into a
+// temporary file and return its path
+func retrievePDFContent(pdfurl string) (string, error) {
+	f, err := os.CreateTemp("", "fabulae-*.pdf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	n, err := fabulae.FetchPDF(context.Background(), pdfurl, f, fabulae.FetchOptions{})
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("unable to retrieve %s: %w", pdfurl, err)
+	}
+	log.Printf("retrieved %d bytes from %s", n, pdfurl)
+	return f.Name(), nil
+}
+
+// episodePrompt is the -promptfile, otherwise the built-in prompt
+func episodePrompt() (string, error) {
+	var prompt string
+	if promptfile != "" {
+		log.Printf("using user supplied prompt file: %s", promptfile)
+		promptBytes, err := os.ReadFile(promptfile)
+		if err != nil {
+			log.Printf("using default prompt - unable to read file %s", promptfile)
+		} else {
+			prompt = string(promptBytes)
+		}
+	}
+
+	if prompt == "" {
+		var err error
+		if prompt, err = fabulae.PodcastPromptWith(promptData()); err != nil {
+			return "", fmt.Errorf("unable to load prompt: %w", err)
+		}
+	} else if hostNames != "" || len(castPersonas) > 0 || showName != "" || targetMinutes > 0 || audience != "" || tone != "" || codeMode != "" || skipReferences {
+		log.Print("-promptfile is used as is, the built-in prompt's settings are ignored")
+	}
+	return prompt, nil
+}
+
+// generateConversationFrom creates a conversation using the provided file URL
+func generateConversationFrom(projectID, location, modelName, pdfurl, prompt string) (string, error) {
+	ctx := context.Background()
+
+	// refuse before generating if the document or the script would be over budget
+	if budget.DocumentTokens > 0 {
+		tokens, err := fabulae.CountTokens(ctx, projectID, location, modelName, pdfurl, prompt)
+		if err != nil {
+			log.Printf("unable to count tokens, skipping the token budget: %v", err)
+		} else if err := withinBudget(budget.CheckTokens(tokens)); err != nil {
+			return "", err
+		}
+	}
+	if promptfile == "" {
+		if err := withinBudget(budget.CheckCharacters(promptData().Characters())); err != nil {
+			return "", fmt.Errorf("estimated from the target length, %w", err)
+		}
+	}
+
+	// generate content
+	bar := progressbar.NewOptions(
+		-1,
+		progressbar.OptionSetDescription("generating conversation ..."),
+		progressbar.OptionSetWidth(15),
+	)
+	bar.Add(1)
+
+	var conversation string
+	var err error
+	if minQuality > 0 {
+		conversation, _, err = fabulae.GenerateReviewedConversation(ctx, projectID, location, modelName, pdfurl, prompt, fabulae.QualityOptions{
+			MinScore:   minQuality,
+			MaxRetries: qualityRetries,
+			Safety:     safetyFallback,
+		})
+	} else {
+		var g fabulae.Generation
+		g, err = fabulae.GenerateConversationDetails(ctx, projectID, location, modelName, pdfurl, prompt, safetyFallback)
+		conversation = g.Text
+		if err == nil {
+			// the fallback model, if the first was blocked
+			provenance.Models, provenance.Generation = []string{g.Model}, &g
+		}
+	}
+	var blocked *fabulae.BlockedError
+	if errors.As(err, &blocked) && !safetyFallback.Relaxed && safetyFallback.Model == "" {
+		return "", fmt.Errorf("%w, use -relax-safety or -fallback-model to retry", err)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	bar.Finish()
+	fmt.Println()
+
+	if factCheckMode != "" {
+		check, err := fabulae.CheckFacts(ctx, projectID, location, modelName, pdfurl, conversation)
+		if err != nil {
+			return "", fmt.Errorf("unable to fact check: %w", err)
+		}
+		log.Printf("fact check: %d claims, %d not supported by the document", len(check.Claims), len(check.Flagged()))
+		factCheck = &check
+		if factCheckMode == fabulae.FactCheckCorrections {
+			conversation = fabulae.AppendCorrections(conversation, check)
+		}
+	}
+
+	return conversation, nil
+}
+
+// getTitleOfDocument uses Gemini Controlled Generation to output a title
+func getTitleOfDocument(pdfurl string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*120))
+	defer cancel()
+
+	return fabulae.GetTitleOfDocument(ctx, projectID, location, pdfurl)
+}
+
+func removeNonAlphanumerics(input string) string {
+	input = strings.ReplaceAll(input, " ", "")
+
+	// Remove all non-alphanumeric characters
+	input = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, input)
+	return input
+}
+
+// checkDisk refuses before synthesis if the turns won't fit on disk, or
+// switches to -stream-combine if only the episode would
+func checkDisk(conversation string) error {
+	err := fabulae.CheckDisk(".", fabulae.SynthesisDisk(conversation, audioFormat, streamCombine), 0)
+	if err == nil || streamCombine {
+		return err
+	}
+	// streaming needs wav turns, merged as they are, which ElevenLabs doesn't return
+	canStream := turnbyturn && !interjections && adsFile == "" && crossfade == 0 &&
+		provider != "elevenlabs" && !strings.HasPrefix(voice1name, "elevenlabs:") && !strings.HasPrefix(voice2name, "elevenlabs:")
+	if !canStream {
+		return fmt.Errorf("%w, free some space or use -stream-combine, with wav voices and without -ads, -crossfade or -interjections", err)
+	}
+	if err := fabulae.CheckDisk(".", fabulae.SynthesisDisk(conversation, audioFormat, true), 0); err != nil {
+		return fmt.Errorf("%w, even streaming turns into the episode", err)
+	}
+	log.Printf("%v, streaming turns into the episode", err)
+	streamCombine = true
+	return nil
+}
+
+// withinBudget adds the -force hint to a budget error, or with -force logs it
+// and continues
+func withinBudget(err error) error {
+	var over *fabulae.BudgetError
+	if !errors.As(err, &over) {
+		return err
+	}
+	if force {
+		log.Printf("%v, continuing with -force", err)
+		return nil
+	}
+	return fmt.Errorf("%w, use -force to continue anyway", err)
+}
+
+// timeTranscript times the transcript's turns from their audio, before the
+// turns are combined, for -transcript-formats
+func timeTranscript(conversation string, audiofiles []string) {
+	if transcriptFormats == "" && !episodePage {
+		return
+	}
+	durations, err := fabulae.AudioDurations(audiofiles)
+	if err != nil {
+		log.Printf("transcript times are estimated, unable to read the audio: %v", err)
+	}
+	timeTurns(conversation, durations)
+}
+
+// timeTurns times the transcript's turns from their durations, or
+// estimates them without
+func timeTurns(conversation string, durations []time.Duration) {
+	if transcriptFormats == "" && !episodePage {
+		return
+	}
+	transcriptTurns = fabulae.TranscriptTurns(conversation, voice1name, voice2name, striptags)
+	fabulae.TimeTurns(transcriptTurns, durations)
+}
+
+// writeTranscripts writes the -transcript-formats next to the episode and
+// adds them to the provenance
+func writeTranscripts(output string) error {
+	if transcriptFormats == "" || len(transcriptTurns) == 0 {
+		return nil
+	}
+	heading := sourceName
+	if heading == "" {
+		heading = title
+	}
+	if wordTimings {
+		if err := fabulae.AlignTranscript(context.Background(), projectID, output, transcriptTurns, ""); err != nil {
+			log.Printf("transcript words aren't timed, unable to align them: %v", err)
+		}
+	}
+	formats := strings.Split(transcriptFormats, ",")
+	files, err := fabulae.WriteTranscripts(output, heading, transcriptTurns, formats)
+	if err != nil {
+		return fmt.Errorf("unable to write transcripts: %w", err)
+	}
+	for _, format := range formats {
+		log.Printf("transcript written to %s", files[format])
+		provenance.Transcripts = append(provenance.Transcripts, files[format])
+	}
+	return nil
+}
+
+// episodeTitle is the source's title, or the -label, numbered for a -show
+func episodeTitle() string {
+	name := title
+	if sourceName != "" {
+		name = sourceName
+	}
+	if currentShow != nil {
+		return currentShow.EpisodeTitle(episodeNumber, name)
+	}
+	return name
+}
+
+// episodeShowNotes are the -show-notes, or the AI disclosure
+func episodeShowNotes() (string, error) {
+	if showNotesFile == "" {
+		return fabulae.DisclosureText(sourceName), nil
+	}
+	notes, err := os.ReadFile(showNotesFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read show notes: %w", err)
+	}
+	return string(notes), nil
+}
+
+// writeEpisodePage writes the -episode-page next to the episode, with the
+// -show-notes or the AI disclosure as show notes
+func writeEpisodePage(output string) error {
+	if !episodePage {
+		return nil
+	}
+	notes, err := episodeShowNotes()
+	if err != nil {
+		return err
+	}
+	page := fabulae.EpisodePage{
+		Title:     episodeTitle(),
+		Audio:     filepath.Base(output),
+		Source:    pdfurl,
+		ShowNotes: notes,
+		Turns:     transcriptTurns,
+		Created:   time.Now(),
+	}
+	page.Speakers = promptData().HostNames
+	if durations, err := fabulae.AudioDurations([]string{output}); err == nil {
+		page.Duration = durations[0]
+	}
+	filename := fabulae.EpisodePageFile(output)
+	if err := fabulae.WriteEpisodePage(filename, page); err != nil {
+		return err
+	}
+	log.Printf("episode page written to %s", filename)
+	return nil
+}
+
+// publishVideo renders the episode over the -video-cover, or its waveform,
+// and uploads it to YouTube, recording the video in the provenance
+func publishVideo(output string) error {
+	if !publishYouTube {
+		return nil
+	}
+	ctx := context.Background()
+	still := videoCover
+	if still == "" {
+		still = strings.TrimSuffix(output, filepath.Ext(output)) + ".cover.png"
+		if err := fabulae.WaveformImage(output, still); err != nil {
+			return fmt.Errorf("unable to draw a cover: %w", err)
+		}
+	}
+	video := fabulae.VideoFile(output)
+	if err := fabulae.RenderVideo(ctx, output, still, video); err != nil {
+		return err
+	}
+	notes, err := episodeShowNotes()
+	if err != nil {
+		return err
+	}
+	if pdfurl != "" {
+		notes += "\n\nSource: " + pdfurl
+	}
+	link, err := fabulae.UploadToYouTube(ctx, video, fabulae.YouTubeUpload{
+		Title:       episodeTitle(),
+		Description: notes,
+		Privacy:     youtubePrivacy,
+		Credentials: youtubeCredentials,
+	})
+	if err != nil {
+		return err
+	}
+	provenance.Videos = append(provenance.Videos, link)
+	fmt.Printf("published to YouTube: %s\n", link)
+	return nil
+}
+
+// publishEpisode pushes the episode to the -podcast-host show, with the show
+// notes, artwork and transcript
+func publishEpisode(output string) error {
+	if podcastHost == "" {
+		return nil
+	}
+	host, err := fabulae.NewPodcastHost(podcastHost, podcastShow)
+	if err != nil {
+		return err
+	}
+	notes, err := episodeShowNotes()
+	if err != nil {
+		return err
+	}
+	summary, _, _ := strings.Cut(strings.TrimSpace(notes), "\n\n")
+	var transcript strings.Builder
+	for _, turn := range transcriptTurns {
+		fmt.Fprintf(&transcript, "%s: %s\n", turn.Speaker, turn.Text)
+	}
+	link, err := host.PublishEpisode(context.Background(), fabulae.PodcastEpisode{
+		Title:       episodeTitle(),
+		Summary:     summary,
+		Description: notes,
+		Audio:       output,
+		Artwork:     podcastArtwork,
+		Transcript:  transcript.String(),
+		Publish:     podcastPublish,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to publish to %s: %w", podcastHost, err)
+	}
+	fmt.Printf("published to %s: %s\n", podcastHost, link)
+	return nil
+}
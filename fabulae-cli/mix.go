@@ -0,0 +1,166 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	crossfade     time.Duration
+	sampleRate    int
+	channelsFlag  string
+	audioFormat   fabulae.AudioFormat // from -sample-rate and -channels
+	music         fabulae.MusicOptions
+	streamCombine bool
+	master        bool
+	mastering     = fabulae.DefaultMastering // or the config file's
+	speedFlag     string
+	speeds        []float64
+	speedVariants []string
+	exportFlag    string
+	exports       []fabulae.OutputProfile
+	exportFiles   []string
+)
+
+// checkMix checks -crossfade, -music and -speed-variants can be mixed, and
+// sets the -sample-rate and -channels turns are synthesized and combined in
+func checkMix() error {
+	channels, err := fabulae.ParseChannels(channelsFlag)
+	if err != nil {
+		return fmt.Errorf("-channels: %w", err)
+	}
+	audioFormat = fabulae.AudioFormat{SampleRate: sampleRate, Channels: channels}
+	if err := audioFormat.Validate(); err != nil {
+		return fmt.Errorf("-sample-rate: %w", err)
+	}
+	if crossfade < 0 {
+		return errors.New("-crossfade can't be negative")
+	}
+	if music.Music != "" && !strings.EqualFold(filepath.Ext(music.Music), "."+fabulae.FormatWAV) {
+		return errors.New("-music is a wav file")
+	}
+	if music.Gain < 0 || music.Gain > 1 {
+		return errors.New("-music-gain is 0 to 1")
+	}
+	if speeds, err = fabulae.ParseSpeeds(speedFlag); err != nil {
+		return fmt.Errorf("-speed-variants: %w", err)
+	}
+	if exports, err = fabulae.ParseOutputProfiles(exportFlag); err != nil {
+		return fmt.Errorf("-export-profiles: %w", err)
+	}
+	return nil
+}
+
+// combineEpisode combines the turns, crossfading them with -crossfade and
+// retiming the transcript and chapters to match
+func combineEpisode(audiofiles []string, combine func(string, []string) (string, error)) (string, error) {
+	// mp3 turns are only combined, not mixed or converted
+	wavs := len(audiofiles) > 0 && strings.EqualFold(filepath.Ext(audiofiles[0]), "."+fabulae.FormatWAV)
+	if crossfade == 0 && (audioFormat == (fabulae.AudioFormat{}) || !wavs) {
+		return combine(title, audiofiles)
+	}
+	output, timeline, err := fabulae.MixWavFiles(title, audiofiles, crossfade, audioFormat)
+	if err != nil {
+		return "", err
+	}
+	timeline.RetimeTurns(transcriptTurns)
+	timeline.RetimeChapters(episodeChapters)
+	return output, nil
+}
+
+// masterEpisode applies the mastering chain to the episode, with -master
+func masterEpisode(output string) error {
+	if !master {
+		return nil
+	}
+	return fabulae.MasterEpisode(output, mastering)
+}
+
+// addMusic plays the -music under the episode, moving the transcript and
+// chapters after its lead
+func addMusic(output string) error {
+	if music.Music == "" {
+		return nil
+	}
+	if err := fabulae.AddMusic(output, music); err != nil {
+		return err
+	}
+	fabulae.ShiftTurns(transcriptTurns, music.LeadTime())
+	fabulae.ShiftChapters(episodeChapters, music.LeadTime())
+	log.Printf("speech starts %s into the music", music.LeadTime())
+	return nil
+}
+
+// writeSpeedVariants writes the episode at each of the -speed-variants
+func writeSpeedVariants(output string) error {
+	if len(speeds) == 0 {
+		return nil
+	}
+	var err error
+	if speedVariants, err = fabulae.WriteSpeedVariants(output, speeds); err != nil {
+		return fmt.Errorf("unable to write speed variants: %w", err)
+	}
+	return nil
+}
+
+// writeExports writes the episode for each of the -export-profiles
+func writeExports(output string) error {
+	if len(exports) == 0 {
+		return nil
+	}
+	var err error
+	if exportFiles, err = fabulae.WriteExports(context.Background(), output, exports); err != nil {
+		return fmt.Errorf("unable to write exports: %w", err)
+	}
+	return nil
+}
+
+// streamEpisode synthesizes the conversation straight into the episode, for
+// -stream-combine
+func streamEpisode(synth fabulae.Synthesizer, conversation, outputfilename string) error {
+	output := fmt.Sprintf("%s_%s.wav", title, time.Now().Format("20060102.030405.06"))
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	durations, err := fabulae.StreamConversation(synthesisContext(), synth, voice1name, voice2name, conversation, outputfilename, striptags, f)
+	if err != nil {
+		f.Close()
+		fabulae.RemoveFiles(output)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	timeTurns(conversation, durations)
+	if err := finishEpisode(output); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Printf("audio file created: %s\n", output)
+	return nil
+}
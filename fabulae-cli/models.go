@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+func modelsCommand() *command {
+	fs := newFlagSet("models", "Work with Gemini models on Vertex AI")
+	subcommands := []subcommand{
+		{"list", "list available Gemini models and what they support", modelsListFlags},
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Work with Gemini models on Vertex AI\n\nUsage:\n  fabulae models <subcommand> [flags]\n\nSubcommands:\n")
+		for _, sub := range subcommands {
+			fmt.Fprintf(os.Stderr, "  %-7s %s\n", sub.name, sub.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nUse \"fabulae models <subcommand> -h\" for a subcommand's flags\n")
+	}
+	return &command{
+		name:        "models",
+		description: "list Gemini models",
+		flags:       fs,
+		examples: []string{
+			"fabulae models list",
+			"REGION=europe-west4 fabulae models list",
+		},
+		subcommands: subcommands,
+		run: func(args []string) error {
+			if len(args) == 0 {
+				fs.Usage()
+				return errors.New("missing subcommand")
+			}
+			switch args[0] {
+			case "list":
+				list := modelsListFlags()
+				list.Parse(args[1:])
+				if err := loadSettings(list); err != nil {
+					return err
+				}
+				return runModelsList()
+			default:
+				fs.Usage()
+				return fmt.Errorf("unknown subcommand %q", args[0])
+			}
+		},
+	}
+}
+
+func modelsListFlags() *flag.FlagSet {
+	fs := newFlagSet("models list", "List the Gemini models available in the project's region, with PDF input and controlled generation support")
+	projectFlags(fs)
+	return fs
+}
+
+func runModelsList() error {
+	if err := requireProject(); err != nil {
+		return err
+	}
+	models, err := fabulae.ListModels(context.Background(), projectID, location)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tLAUNCH STAGE\tPDF INPUT\tCONTROLLED GENERATION")
+	for _, m := range models {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", m.Name, m.Version, m.LaunchStage, yesNo(m.PDFInput), yesNo(m.ControlledGeneration))
+	}
+	return tw.Flush()
+}
+
+// yesNo formats a capability for a table
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// checkModels fails if a model can't generate from a PDF or isn't available
+// in the region; the list of models being unavailable isn't an error
+func checkModels(names ...string) error {
+	needs := fabulae.ModelRequirements{PDFInput: true}
+	for _, name := range names {
+		if !fabulae.ModelCapabilities(name).PDFInput {
+			return fmt.Errorf("model %s doesn't accept PDF input, use gemini-1.5 or later", name)
+		}
+	}
+	models, err := fabulae.ListModels(context.Background(), projectID, location)
+	if err != nil {
+		log.Printf("unable to list models: %v", err)
+		return nil
+	}
+	for _, name := range names {
+		if err := fabulae.CheckModel(models, name, needs); err != nil {
+			return fmt.Errorf("%w in %s, see fabulae models list", err, location)
+		}
+	}
+	return nil
+}
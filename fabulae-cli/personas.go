@@ -0,0 +1,327 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	hostPersona   string
+	expertPersona string
+	// castPersonas are the -host-persona and -expert-persona, in that order
+	castPersonas   []fabulae.Persona
+	castPersonaIDs []string
+)
+
+func personasCommand() *command {
+	fs := newFlagSet("personas", "Manage recurring host and expert personas")
+	subcommands := []subcommand{
+		{"list", "list the personas in the config file", personasListFlags},
+		{"show", "print a persona as JSON", personasShowFlags},
+		{"set", "add or update a persona", personasSetFlags},
+		{"remove", "remove a persona", personasRemoveFlags},
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Manage recurring host and expert personas\n\nUsage:\n  fabulae personas <subcommand> [flags] <id>\n\nSubcommands:\n")
+		for _, sub := range subcommands {
+			fmt.Fprintf(os.Stderr, "  %-7s %s\n", sub.name, sub.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nUse \"fabulae personas <subcommand> -h\" for a subcommand's flags\n")
+	}
+	return &command{
+		name:        "personas",
+		description: "manage recurring host and expert personas",
+		flags:       fs,
+		examples: []string{
+			"fabulae personas set -name Ada -voice en-US-Chirp3-HD-Kore -personality \"a curious, dry-witted former teacher\" -catchphrases \"Let's dig in;Wait, really?\" ada",
+			"fabulae personas set -name \"Dr. Lee\" -expertise \"machine learning,speech\" lee",
+			"fabulae personas list",
+			"fabulae generate -pdf-url https://arxiv.org/pdf/2209.03143 -host-persona ada -expert-persona lee",
+		},
+		subcommands: subcommands,
+		run: func(args []string) error {
+			if len(args) == 0 {
+				fs.Usage()
+				return errors.New("missing subcommand")
+			}
+			switch args[0] {
+			case "list":
+				list := personasListFlags()
+				list.Parse(args[1:])
+				return runPersonasList()
+			case "show":
+				show := personasShowFlags()
+				show.Parse(args[1:])
+				return runPersonasShow(show.Args())
+			case "set":
+				set := personasSetFlags()
+				set.Parse(args[1:])
+				return runPersonasSet(set)
+			case "remove":
+				remove := personasRemoveFlags()
+				remove.Parse(args[1:])
+				return runPersonasRemove(remove.Args())
+			default:
+				fs.Usage()
+				return fmt.Errorf("unknown subcommand %q", args[0])
+			}
+		},
+	}
+}
+
+// personaFlags adds the generate flags that cast personas
+func personaFlags(fs *flag.FlagSet) {
+	fs.StringVar(&hostPersona, "host-persona", "", "config file persona for the host, with its voice as -voice1 unless set")
+	fs.StringVar(&expertPersona, "expert-persona", "", "config file persona for the expert, with its voice as -voice2 unless set")
+}
+
+func personasListFlags() *flag.FlagSet {
+	fs := newFlagSet("personas list", "List the personas in the config file")
+	configFileFlag(fs)
+	return fs
+}
+
+func personasShowFlags() *flag.FlagSet {
+	fs := newFlagSet("personas show", "Print a persona, with its memory of recent episodes, as JSON")
+	configFileFlag(fs)
+	return fs
+}
+
+var (
+	personaName         string
+	personaVoice        string
+	personaPersonality  string
+	personaCatchphrases string
+	personaExpertise    string
+	personaClearMemory  bool
+)
+
+func personasSetFlags() *flag.FlagSet {
+	fs := newFlagSet("personas set", "Add a persona, or update the given settings of one")
+	configFileFlag(fs)
+	fs.StringVar(&personaName, "name", "", "name as spoken in the show")
+	fs.StringVar(&personaVoice, "voice", "", "voice name")
+	fs.StringVar(&personaPersonality, "personality", "", "personality, e.g. \"a curious, dry-witted former teacher\"")
+	fs.StringVar(&personaCatchphrases, "catchphrases", "", "semicolon-separated catchphrases")
+	fs.StringVar(&personaExpertise, "expertise", "", "comma-separated areas of expertise")
+	fs.BoolVar(&personaClearMemory, "clear-memory", false, "forget the episodes the persona has been in")
+	return fs
+}
+
+func personasRemoveFlags() *flag.FlagSet {
+	fs := newFlagSet("personas remove", "Remove a persona from the config file")
+	configFileFlag(fs)
+	return fs
+}
+
+// personaArg is the single persona ID a subcommand takes
+func personaArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected one persona id")
+	}
+	return args[0], fabulae.ValidatePersonaID(args[0])
+}
+
+func runPersonasList() error {
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	if len(config.Personas) == 0 {
+		fmt.Printf("no personas in %s, add one with fabulae personas set\n", configfile)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tVOICE\tEXPERTISE\tEPISODES")
+	var ids []string
+	for id := range config.Personas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		p := config.Personas[id]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", id, p.Name, p.Voice, strings.Join(p.Expertise, ", "), len(p.Memory))
+	}
+	return w.Flush()
+}
+
+func runPersonasShow(args []string) error {
+	id, err := personaArg(args)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	p, ok := config.Personas[id]
+	if !ok {
+		return fmt.Errorf("no persona %q in %s", id, configfile)
+	}
+	out, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func runPersonasSet(fs *flag.FlagSet) error {
+	id, err := personaArg(fs.Args())
+	if err != nil {
+		return err
+	}
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := registerCustomVoices(config); err != nil {
+		return err
+	}
+	p, exists := config.Personas[id]
+	if !exists {
+		p.Name = id
+	}
+	// only the given settings change an existing persona
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			p.Name = personaName
+		case "voice":
+			p.Voice = personaVoice
+		case "personality":
+			p.Personality = personaPersonality
+		case "catchphrases":
+			p.Catchphrases = splitList(personaCatchphrases, ";")
+		case "expertise":
+			p.Expertise = splitList(personaExpertise, ",")
+		case "clear-memory":
+			if personaClearMemory {
+				p.Memory = nil
+			}
+		}
+	})
+	if p.Voice != "" {
+		if err := checkVoices(p.Voice); err != nil {
+			return err
+		}
+	}
+	if config.Personas == nil {
+		config.Personas = map[string]fabulae.Persona{}
+	}
+	config.Personas[id] = p
+	if err := saveConfig(configfile, config); err != nil {
+		return err
+	}
+	log.Printf("saved persona %s to %s", id, configfile)
+	return nil
+}
+
+func runPersonasRemove(args []string) error {
+	id, err := personaArg(args)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	if _, ok := config.Personas[id]; !ok {
+		return fmt.Errorf("no persona %q in %s", id, configfile)
+	}
+	delete(config.Personas, id)
+	if err := saveConfig(configfile, config); err != nil {
+		return err
+	}
+	log.Printf("removed persona %s from %s", id, configfile)
+	return nil
+}
+
+// splitList splits a flag's list, dropping empty items
+func splitList(s, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// applyPersonas casts the -host-persona and -expert-persona from the config
+// file, with their voices unless -voice1 or -voice2 is set
+func applyPersonas(config cliConfig, set map[string]bool) error {
+	if expertPersona != "" && hostPersona == "" {
+		return errors.New("-expert-persona needs a -host-persona")
+	}
+	castPersonas, castPersonaIDs = nil, nil
+	for i, id := range []string{hostPersona, expertPersona} {
+		if id == "" {
+			continue
+		}
+		p, ok := config.Personas[id]
+		if !ok {
+			return fmt.Errorf("no persona %q in %s, add it with fabulae personas set", id, configfile)
+		}
+		switch {
+		case p.Voice == "":
+		case i == 0 && !set["voice1"]:
+			voice1name = p.Voice
+		case i == 1 && !set["voice2"]:
+			voice2name = p.Voice
+		}
+		castPersonas = append(castPersonas, p)
+		castPersonaIDs = append(castPersonaIDs, id)
+	}
+	if len(castPersonas) > 0 {
+		log.Printf("personas from %s: %s", configfile, strings.Join(castPersonaIDs, ", "))
+	}
+	return nil
+}
+
+// rememberEpisode adds the finished episode to the cast personas' memory,
+// rereading the config file so it keeps changes made meanwhile
+func rememberEpisode() error {
+	if len(castPersonas) == 0 || episodeTitle() == "" {
+		return nil
+	}
+	config, err := loadConfig(configfile)
+	if err != nil {
+		return fmt.Errorf("unable to update persona memory: %w", err)
+	}
+	for _, id := range castPersonaIDs {
+		p, ok := config.Personas[id]
+		if !ok {
+			continue
+		}
+		p.Remember(episodeTitle())
+		config.Personas[id] = p
+	}
+	if err := saveConfig(configfile, config); err != nil {
+		return fmt.Errorf("unable to update persona memory: %w", err)
+	}
+	return nil
+}
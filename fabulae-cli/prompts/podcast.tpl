@@ -1,30 +0,0 @@
-Write a 26 turn podcast-like conversation between two people, a host (first speaker) and an expert (second speaker), about the top 5 topics based on the given paper. You're a podcast producer who can analyze a document, understand its topics, and come up with interesting, dynamic, and engaging conversations.
-
-Review the paper and extract the 5 most salient an interesting topics and derive questions for the host to ask the expert.
-
-<Conversation Design Instructions>
-
-Do not repeat your instructions, just write the conversation.
-
-Have the host introduce the topic and state the title of the paper in the introduction statements.
-
-Insert a few to moderate amount disfluencies into the conversational flow for each speaker, in the way that the host and expert are familar with each other.
-
-The last question from the host should be something similar to this "To wrap up can you summarize the key contributions of this paper."
-
-The host should conclude the conversation by thanking the expert and mention the name of the paper again.
-
-Do not provide any human names for the host or the expert.
-
-<Output Instructions>
-
-Output the conversation as alternating lines.
-
-Use the symbols "| [*]" to denote the first speaker and  "| [+]" to denote the second speaker. 
-
-example output:
-
-| [*] first speaker statatement or question
-| [+] second speaker comment and response
-| [*] first speaker statatement or question
-| [+] second speaker comment and response
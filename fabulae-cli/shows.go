@@ -0,0 +1,440 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	showID        string
+	episodeNumber int
+	// currentShow is the -show an episode is made for
+	currentShow *fabulae.Show
+	// episodeScript is the script as spoken, summarized for the show
+	episodeScript string
+)
+
+func showsCommand() *command {
+	fs := newFlagSet("shows", "Manage recurring shows")
+	subcommands := []subcommand{
+		{"list", "list the shows in the config file", showsListFlags},
+		{"show", "print a show as JSON", showsShowFlags},
+		{"set", "add or update a show", showsSetFlags},
+		{"remove", "remove a show", showsRemoveFlags},
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Manage recurring shows\n\nUsage:\n  fabulae shows <subcommand> [flags] <id>\n\nSubcommands:\n")
+		for _, sub := range subcommands {
+			fmt.Fprintf(os.Stderr, "  %-7s %s\n", sub.name, sub.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nUse \"fabulae shows <subcommand> -h\" for a subcommand's flags\n")
+	}
+	return &command{
+		name:        "shows",
+		description: "manage recurring shows",
+		flags:       fs,
+		examples: []string{
+			"fabulae shows set -name \"Paper Trail\" -host-persona ada -expert-persona lee -tone playful -target-minutes 10 paper-trail",
+			"fabulae shows set -description \"Papers, explained\" -url https://example.com/paper-trail paper-trail",
+			"fabulae shows list",
+			"fabulae generate -show paper-trail -pdf-url https://arxiv.org/pdf/2209.03143",
+		},
+		subcommands: subcommands,
+		run: func(args []string) error {
+			if len(args) == 0 {
+				fs.Usage()
+				return errors.New("missing subcommand")
+			}
+			switch args[0] {
+			case "list":
+				list := showsListFlags()
+				list.Parse(args[1:])
+				return runShowsList()
+			case "show":
+				show := showsShowFlags()
+				show.Parse(args[1:])
+				return runShowsShow(show.Args())
+			case "set":
+				set := showsSetFlags()
+				set.Parse(args[1:])
+				return runShowsSet(set)
+			case "remove":
+				remove := showsRemoveFlags()
+				remove.Parse(args[1:])
+				return runShowsRemove(remove.Args())
+			default:
+				fs.Usage()
+				return fmt.Errorf("unknown subcommand %q", args[0])
+			}
+		},
+	}
+}
+
+// showFlags adds the generate flags that make an episode of a show
+func showFlags(fs *flag.FlagSet) {
+	fs.StringVar(&showID, "show", "", "config file show the episode is for, with its personas, voices and prompt settings unless set")
+	fs.IntVar(&episodeNumber, "episode", 0, "episode number for -show (default the show's next)")
+}
+
+func showsListFlags() *flag.FlagSet {
+	fs := newFlagSet("shows list", "List the shows in the config file")
+	configFileFlag(fs)
+	return fs
+}
+
+func showsShowFlags() *flag.FlagSet {
+	fs := newFlagSet("shows show", "Print a show as JSON")
+	configFileFlag(fs)
+	return fs
+}
+
+var (
+	setShow       fabulae.Show
+	setSchedule   fabulae.ShowSchedule
+	clearSchedule bool
+	clearPrevious bool
+)
+
+func showsSetFlags() *flag.FlagSet {
+	fs := newFlagSet("shows set", "Add a show, or update the given settings of one")
+	configFileFlag(fs)
+	fs.StringVar(&setShow.Name, "name", "", "show name, as the host introduces it")
+	fs.StringVar(&setShow.HostPersona, "host-persona", "", "persona for the host")
+	fs.StringVar(&setShow.ExpertPersona, "expert-persona", "", "persona for the expert")
+	fs.StringVar(&setShow.Voice1, "voice1", "", "host voice, over the persona's")
+	fs.StringVar(&setShow.Voice2, "voice2", "", "expert voice, over the persona's")
+	fs.StringVar(&setShow.Audience, "audience", "", "who the episodes are for")
+	fs.StringVar(&setShow.Tone, "tone", "", "tone of the conversation")
+	fs.IntVar(&setShow.TargetMinutes, "target-minutes", 0, "target episode length in minutes")
+	fs.StringVar(&setShow.Code, "code", "", "source code in documents: describe or skip")
+	fs.BoolVar(&setShow.SkipReferences, "skip-references", false, "ignore documents' references, footnotes and page headers and footers")
+	fs.StringVar(&setShow.Feed.Description, "description", "", "show description, for the site and feed")
+	fs.StringVar(&setShow.Feed.URL, "url", "", "where the show's site is hosted")
+	fs.StringVar(&setShow.Feed.AudioURL, "audio-url", "", "where the show's audio is served from")
+	fs.StringVar(&setShow.Feed.TrackingPrefix, "tracking-prefix", "", "podcast analytics prefix for the audio URLs")
+	fs.StringVar(&setShow.BucketPrefix, "bucket-prefix", "", "folder under the service's audio bucket for the show's episodes")
+	fs.StringVar(&setSchedule.FeedURL, "schedule-feed", "", "RSS or Atom feed whose new items the service makes episodes from")
+	fs.IntVar(&setSchedule.MaxItems, "max-items", 0, "new feed items made into episodes per scheduled run (default 1)")
+	fs.BoolVar(&clearSchedule, "clear-schedule", false, "stop making episodes from the schedule feed")
+	fs.IntVar(&setShow.Episodes, "episodes", 0, "episodes made so far, the next is numbered one more")
+	fs.BoolVar(&clearPrevious, "clear-previous", false, "forget the summaries of earlier episodes")
+	return fs
+}
+
+func showsRemoveFlags() *flag.FlagSet {
+	fs := newFlagSet("shows remove", "Remove a show from the config file")
+	configFileFlag(fs)
+	return fs
+}
+
+// showArg is the single show ID a subcommand takes
+func showArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected one show id")
+	}
+	return args[0], fabulae.ValidateShowID(args[0])
+}
+
+func runShowsList() error {
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	if len(config.Shows) == 0 {
+		fmt.Printf("no shows in %s, add one with fabulae shows set\n", configfile)
+		return nil
+	}
+	var ids []string
+	for id := range config.Shows {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPERSONAS\tEPISODES")
+	for _, id := range ids {
+		s := config.Shows[id]
+		personas := strings.Trim(s.HostPersona+", "+s.ExpertPersona, ", ")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", id, s.Name, personas, s.Episodes)
+	}
+	return w.Flush()
+}
+
+func runShowsShow(args []string) error {
+	id, err := showArg(args)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	s, ok := config.Shows[id]
+	if !ok {
+		return fmt.Errorf("no show %q in %s", id, configfile)
+	}
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func runShowsSet(fs *flag.FlagSet) error {
+	id, err := showArg(fs.Args())
+	if err != nil {
+		return err
+	}
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := registerCustomVoices(config); err != nil {
+		return err
+	}
+	s, exists := config.Shows[id]
+	if !exists {
+		s.Name = id
+	}
+	// only the given settings change an existing show
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			s.Name = setShow.Name
+		case "host-persona":
+			s.HostPersona = setShow.HostPersona
+		case "expert-persona":
+			s.ExpertPersona = setShow.ExpertPersona
+		case "voice1":
+			s.Voice1 = setShow.Voice1
+		case "voice2":
+			s.Voice2 = setShow.Voice2
+		case "audience":
+			s.Audience = setShow.Audience
+		case "tone":
+			s.Tone = setShow.Tone
+		case "target-minutes":
+			s.TargetMinutes = setShow.TargetMinutes
+		case "code":
+			s.Code = setShow.Code
+		case "skip-references":
+			s.SkipReferences = setShow.SkipReferences
+		case "description":
+			s.Feed.Description = setShow.Feed.Description
+		case "url":
+			s.Feed.URL = setShow.Feed.URL
+		case "audio-url":
+			s.Feed.AudioURL = setShow.Feed.AudioURL
+		case "tracking-prefix":
+			s.Feed.TrackingPrefix = setShow.Feed.TrackingPrefix
+		case "bucket-prefix":
+			s.BucketPrefix = setShow.BucketPrefix
+		case "schedule-feed", "max-items":
+			if s.Schedule == nil {
+				s.Schedule = &fabulae.ShowSchedule{}
+			}
+			if f.Name == "schedule-feed" {
+				s.Schedule.FeedURL = setSchedule.FeedURL
+			} else {
+				s.Schedule.MaxItems = setSchedule.MaxItems
+			}
+		case "episodes":
+			s.Episodes = setShow.Episodes
+		}
+	})
+	if clearSchedule {
+		s.Schedule = nil
+	}
+	if clearPrevious {
+		s.Previous = nil
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	for _, persona := range []string{s.HostPersona, s.ExpertPersona} {
+		if _, ok := config.Personas[persona]; persona != "" && !ok {
+			log.Printf("no persona %q in %s yet, add it with fabulae personas set", persona, configfile)
+		}
+	}
+	for _, voice := range []string{s.Voice1, s.Voice2} {
+		if voice == "" {
+			continue
+		}
+		if err := checkVoices(voice); err != nil {
+			return err
+		}
+	}
+	if config.Shows == nil {
+		config.Shows = map[string]fabulae.Show{}
+	}
+	config.Shows[id] = s
+	if err := saveConfig(configfile, config); err != nil {
+		return err
+	}
+	log.Printf("saved show %s to %s", id, configfile)
+	return nil
+}
+
+func runShowsRemove(args []string) error {
+	id, err := showArg(args)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	if _, ok := config.Shows[id]; !ok {
+		return fmt.Errorf("no show %q in %s", id, configfile)
+	}
+	delete(config.Shows, id)
+	if err := saveConfig(configfile, config); err != nil {
+		return err
+	}
+	log.Printf("removed show %s from %s", id, configfile)
+	return nil
+}
+
+// applyShow uses the -show's personas, voices and prompt settings for the
+// ones not given as flags, and numbers the episode
+func applyShow(config cliConfig, set map[string]bool) error {
+	currentShow = nil
+	if showID == "" {
+		if episodeNumber != 0 {
+			return errors.New("-episode numbers an episode of a -show")
+		}
+		return nil
+	}
+	s, ok := config.Shows[showID]
+	if !ok {
+		return fmt.Errorf("no show %q in %s, add it with fabulae shows set", showID, configfile)
+	}
+	for _, v := range []struct {
+		flag  string
+		value string
+		to    *string
+	}{
+		{"host-persona", s.HostPersona, &hostPersona},
+		{"expert-persona", s.ExpertPersona, &expertPersona},
+		{"voice1", s.Voice1, &voice1name},
+		{"voice2", s.Voice2, &voice2name},
+		{"show-name", s.Name, &showName},
+		{"audience", s.Audience, &audience},
+		{"tone", s.Tone, &tone},
+		{"code", s.Code, &codeMode},
+	} {
+		if v.value != "" && !set[v.flag] {
+			*v.to = v.value
+			// the show's voices are used over its personas'
+			set[v.flag] = true
+		}
+	}
+	if s.TargetMinutes > 0 && !set["target-minutes"] {
+		targetMinutes = s.TargetMinutes
+	}
+	if s.SkipReferences && !set["skip-references"] {
+		skipReferences = true
+	}
+	if episodeNumber <= 0 {
+		episodeNumber = s.Episodes + 1
+	}
+	currentShow = &s
+	log.Printf("episode %d of %s from %s", episodeNumber, s.Name, configfile)
+	return nil
+}
+
+// recordShowEpisode counts the -show's finished episode and adds its summary,
+// for later episodes to refer back to, rereading the config file so it keeps
+// changes made meanwhile
+func recordShowEpisode() error {
+	if currentShow == nil {
+		return nil
+	}
+	var summary string
+	switch {
+	case projectID == "":
+		log.Print("without PROJECT_ID the episode isn't summarized for the show's later episodes")
+	case episodeScript != "":
+		var err error
+		if summary, err = fabulae.SummarizeEpisode(context.Background(), projectID, location, modelName, episodeScript); err != nil {
+			log.Printf("unable to summarize the episode for the show: %v", err)
+		}
+	}
+	config, err := loadConfig(configfile)
+	if err != nil {
+		return fmt.Errorf("unable to record the show's episode: %w", err)
+	}
+	s, ok := config.Shows[showID]
+	if !ok {
+		return nil
+	}
+	s.Episodes = max(s.Episodes, episodeNumber)
+	if summary != "" {
+		s.AddEpisode(fabulae.EpisodeSummary{Number: episodeNumber, Title: episodeTitle(), Summary: summary, Created: time.Now()})
+	}
+	config.Shows[showID] = s
+	if err := saveConfig(configfile, config); err != nil {
+		return fmt.Errorf("unable to record the show's episode: %w", err)
+	}
+	return nil
+}
+
+// applySiteShow uses a show's feed settings for the site flags not given, and
+// only its episodes, those under its bucket prefix
+func applySiteShow(fs *flag.FlagSet) error {
+	if siteShow == "" {
+		return nil
+	}
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	s, ok := config.Shows[siteShow]
+	if !ok {
+		return fmt.Errorf("no show %q in %s", siteShow, configfile)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, v := range []struct {
+		flag  string
+		value string
+		to    *string
+	}{
+		{"title", s.Name, &siteTitle},
+		{"description", s.Feed.Description, &siteDescription},
+		{"url", s.Feed.URL, &siteURL},
+		{"audio-url", s.Feed.AudioURL, &siteAudioURL},
+		{"tracking-prefix", s.Feed.TrackingPrefix, &trackingPrefix},
+	} {
+		if v.value != "" && !set[v.flag] {
+			*v.to = v.value
+		}
+	}
+	siteShowPrefix = s.BucketPrefix
+	return nil
+}
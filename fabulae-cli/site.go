@@ -0,0 +1,328 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghchinoy/fabulae"
+	"google.golang.org/api/iterator"
+)
+
+var (
+	siteCatalog     string
+	siteOutput      string
+	siteTitle       string
+	siteDescription string
+	siteURL         string
+	siteAudioURL    string
+	trackingPrefix  string
+	analyticsFile   string
+	siteShow        string
+	siteShowPrefix  string // the -show's episodes are under it in the catalog
+)
+
+func siteCommand() *command {
+	fs := newFlagSet("site", "Publish the episode library as a static website")
+	subcommands := []subcommand{
+		{"build", "build a static site with an index, episode pages and RSS", siteBuildFlags},
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Publish the episode library as a static website\n\nUsage:\n  fabulae site <subcommand> [flags]\n\nSubcommands:\n")
+		for _, sub := range subcommands {
+			fmt.Fprintf(os.Stderr, "  %-7s %s\n", sub.name, sub.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nUse \"fabulae site <subcommand> -h\" for a subcommand's flags\n")
+	}
+	return &command{
+		name:        "site",
+		description: "build a static website of episodes",
+		flags:       fs,
+		examples: []string{
+			"fabulae site build -catalog gs://my-bucket/audio -title \"Paper Trail\" -url https://storage.googleapis.com/my-site",
+			"fabulae site build -catalog . -output public",
+			"fabulae site build -catalog gs://my-bucket/audio -show paper-trail",
+		},
+		subcommands: subcommands,
+		run: func(args []string) error {
+			if len(args) == 0 {
+				fs.Usage()
+				return errors.New("missing subcommand")
+			}
+			switch args[0] {
+			case "build":
+				build := siteBuildFlags()
+				build.Parse(args[1:])
+				if err := applySiteShow(build); err != nil {
+					return err
+				}
+				return runSiteBuild()
+			default:
+				fs.Usage()
+				return fmt.Errorf("unknown subcommand %q", args[0])
+			}
+		},
+	}
+}
+
+func siteBuildFlags() *flag.FlagSet {
+	fs := newFlagSet("site build", "Build a static site from the episodes' provenance manifests and the service's job records")
+	fs.StringVar(&siteCatalog, "catalog", "", "folder of episodes, local or gs://bucket/prefix, e.g. the service's GCS_AUDIO_BUCKET")
+	fs.StringVar(&siteOutput, "output", "site", "folder to write the site to")
+	fs.StringVar(&siteTitle, "title", "fabulae", "site title")
+	fs.StringVar(&siteDescription, "description", "", "site description, for the index and feed")
+	fs.StringVar(&siteURL, "url", "", "where the site will be hosted, for the feed's links")
+	fs.StringVar(&siteAudioURL, "audio-url", "", "where the catalog's audio is served from (default public Cloud Storage URLs, or relative paths for a local catalog)")
+	fs.StringVar(&trackingPrefix, "tracking-prefix", "", "podcast analytics prefix for the audio URLs in the feed and pages, e.g. https://dts.podtrac.com/redirect.mp3/ or https://op3.dev/e/")
+	fs.StringVar(&analyticsFile, "analytics", "", "HTML file added to the head of every page, e.g. an analytics script")
+	fs.StringVar(&siteShow, "show", "", "config file show whose feed settings are used for the flags not set, with only its episodes if it has a bucket prefix")
+	configFileFlag(fs)
+	return fs
+}
+
+// catalog is a folder of episodes, local or in Cloud Storage, with the
+// files' sizes by name relative to the folder
+type catalog struct {
+	root   string
+	bucket *storage.BucketHandle
+	prefix string
+	sizes  map[string]int64
+}
+
+// openCatalog lists the files in a local folder or under a gs:// prefix
+func openCatalog(ctx context.Context, client *storage.Client, root string) (*catalog, error) {
+	c := &catalog{root: root, sizes: map[string]int64{}}
+	if rest, ok := strings.CutPrefix(root, "gs://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		c.bucket, c.prefix = client.Bucket(bucket), strings.TrimSuffix(prefix, "/")
+		query := &storage.Query{}
+		if c.prefix != "" {
+			query.Prefix = c.prefix + "/"
+		}
+		it := c.bucket.Objects(ctx, query)
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to list %s: %w", root, err)
+			}
+			c.sizes[strings.TrimPrefix(attrs.Name, query.Prefix)] = attrs.Size
+		}
+		return c, nil
+	}
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		c.sizes[filepath.ToSlash(rel)] = info.Size()
+		return nil
+	})
+	return c, err
+}
+
+// read reads a file in the catalog
+func (c *catalog) read(ctx context.Context, name string) ([]byte, error) {
+	if c.bucket == nil {
+		return os.ReadFile(filepath.Join(c.root, filepath.FromSlash(name)))
+	}
+	rc, err := c.bucket.Object(path.Join(c.prefix, name)).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// audioURL is where an episode page in the site's episodes folder finds a
+// catalog file
+func (c *catalog) audioURL(name string) (string, error) {
+	switch {
+	case siteAudioURL != "":
+		return strings.TrimSuffix(siteAudioURL, "/") + "/" + name, nil
+	case c.bucket != nil:
+		return "https://storage.googleapis.com/" + path.Join(c.bucket.BucketName(), c.prefix, name), nil
+	}
+	abs, err := filepath.Abs(filepath.Join(c.root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	episodes, err := filepath.Abs(filepath.Join(siteOutput, "episodes"))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(episodes, abs)
+	return filepath.ToSlash(rel), err
+}
+
+// jobRecord is the part of a service job record used for the site
+type jobRecord struct {
+	JobID    string `json:"job_id"`
+	Status   string `json:"status"`
+	Response struct {
+		OutputFiles []string          `json:"outputfiles"`
+		Transcripts map[string]string `json:"transcripts"`
+	} `json:"response"`
+	Updated time.Time `json:"updated"`
+}
+
+// catalogEpisodes finds the episodes in a catalog: one for each provenance
+// manifest, from generate -provenance, and each finished service job
+func catalogEpisodes(ctx context.Context, c *catalog) ([]fabulae.SiteEpisode, error) {
+	episodes := []fabulae.SiteEpisode{}
+	for name := range c.sizes {
+		var e fabulae.SiteEpisode
+		var transcript string
+		switch {
+		case strings.HasSuffix(name, ".provenance.json"):
+			data, err := c.read(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			var p fabulae.Provenance
+			if err := json.Unmarshal(data, &p); err != nil {
+				log.Printf("skipping %s: %v", name, err)
+				continue
+			}
+			base := strings.TrimSuffix(name, ".provenance.json")
+			for _, ext := range []string{".wav", ".mp3"} {
+				if _, ok := c.sizes[base+ext]; ok {
+					e.Audio = base + ext
+				}
+			}
+			e.Title, e.Created, e.ShowNotes = p.Title, p.Created, fabulae.DisclosureText(p.Title)
+			e.Source = p.Source
+			transcript = fabulae.TranscriptFile(e.Audio, fabulae.TranscriptJSON)
+		case path.Dir(name) == "jobs" && strings.HasSuffix(name, ".json"):
+			data, err := c.read(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			var job jobRecord
+			if err := json.Unmarshal(data, &job); err != nil || job.Status != "done" || len(job.Response.OutputFiles) == 0 {
+				continue
+			}
+			e.Audio, e.Created = job.Response.OutputFiles[0], job.Updated
+			e.ShowNotes = fabulae.DisclosureText("")
+			transcript = job.Response.Transcripts[fabulae.TranscriptJSON]
+		default:
+			continue
+		}
+		if _, ok := c.sizes[e.Audio]; !ok || e.Audio == "" {
+			log.Printf("skipping %s, its audio isn't in the catalog", name)
+			continue
+		}
+		if siteShowPrefix != "" && !strings.HasPrefix(e.Audio, siteShowPrefix+"/") {
+			continue
+		}
+		e.Slug = strings.TrimSuffix(path.Base(e.Audio), path.Ext(e.Audio))
+		if e.Title == "" {
+			e.Title = "Episode " + e.Created.Format("January 2, 2006")
+		}
+		e.Bytes = c.sizes[e.Audio]
+		e.AudioType = "audio/wav"
+		if path.Ext(e.Audio) == ".mp3" {
+			e.AudioType = "audio/mpeg"
+		}
+		if _, ok := c.sizes[transcript]; ok && transcript != "" {
+			if data, err := c.read(ctx, transcript); err == nil {
+				json.Unmarshal(data, &e.Turns)
+			}
+		}
+		if c.bucket == nil {
+			if durations, err := fabulae.AudioDurations([]string{filepath.Join(c.root, filepath.FromSlash(e.Audio))}); err == nil {
+				e.Duration = durations[0]
+			}
+		}
+		var err error
+		if e.Audio, err = c.audioURL(e.Audio); err != nil {
+			return nil, err
+		}
+		episodes = append(episodes, e)
+	}
+	return episodes, nil
+}
+
+// runSiteBuild writes the site for the catalog's episodes
+func runSiteBuild() error {
+	if siteCatalog == "" {
+		return errors.New("site build needs a -catalog, a folder or gs://bucket/prefix")
+	}
+	ctx := context.Background()
+	var client *storage.Client
+	if strings.HasPrefix(siteCatalog, "gs://") {
+		var err error
+		if client, err = storage.NewClient(ctx); err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+	c, err := openCatalog(ctx, client, siteCatalog)
+	if err != nil {
+		return err
+	}
+	episodes, err := catalogEpisodes(ctx, c)
+	if err != nil {
+		return err
+	}
+	if len(episodes) == 0 {
+		return fmt.Errorf("no episodes in %s, episodes need a provenance manifest or a service job record", siteCatalog)
+	}
+	var analytics []byte
+	if analyticsFile != "" {
+		if analytics, err = os.ReadFile(analyticsFile); err != nil {
+			return fmt.Errorf("unable to read analytics: %w", err)
+		}
+	}
+	if siteURL == "" {
+		log.Print("without -url the feed's links are relative, which most podcast apps don't accept")
+	}
+	err = fabulae.BuildSite(siteOutput, fabulae.Site{
+		Title:          siteTitle,
+		Description:    siteDescription,
+		URL:            siteURL,
+		Episodes:       episodes,
+		TrackingPrefix: trackingPrefix,
+		// the snippet is the site owner's own HTML, added as is
+		Analytics: template.HTML(analytics),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("site with %d episodes written to %s\n", len(episodes), siteOutput)
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	speakVoice string
+	speakText  string
+	speakFile  string
+
+	narrate        bool
+	noAnnounce     bool
+	sectionPause   time.Duration
+	paragraphPause time.Duration
+	chapterFiles   bool
+	m4b            bool
+	bookTitle      string
+	bookAuthor     string
+	bookCover      string
+)
+
+func speakCommand() *command {
+	fs := newFlagSet("speak", "Synthesize text with a single voice")
+	fs.StringVar(&speakVoice, "voice", "en-US-Chirp3-HD-Charon", "voice name")
+	fs.StringVar(&speakText, "text", "", "text to speak")
+	fs.StringVar(&speakFile, "file", "", "path to a text file to speak, - for stdin")
+	fs.BoolVar(&naturalPacing, "natural-pacing", false, "add pauses and rate changes from punctuation and sentence length, for voices that accept SSML")
+	fs.BoolVar(&speakMath, "speak-math", false, "read LaTeX math as spoken English, e.g. $x^2 + y^2$ as \"x squared plus y squared\"")
+	fs.BoolVar(&verbalize, "verbalize", false, "speak numbers with units, currency, percentages and dates as words, e.g. 3.5GHz, $1.2B and 2024-06-01")
+	fs.StringVar(&preprocessCommand, "preprocess", "", "command that transforms the text before synthesis, reading it on stdin with the voice in FABULAE_VOICE")
+	fs.BoolVar(&narrate, "narrate", false, "narrate long-form text, with headings as chapters")
+	fs.BoolVar(&noAnnounce, "no-announce", false, "with -narrate, don't speak section headings")
+	fs.DurationVar(&sectionPause, "section-pause", fabulae.DefaultSectionPause, "with -narrate, pause before each section")
+	fs.DurationVar(&paragraphPause, "paragraph-pause", fabulae.DefaultParagraphPause, "with -narrate, pause between paragraphs")
+	fs.StringVar(&codeMode, "code", "", "with -narrate, code blocks: describe them in prose or skip them (default read as written)")
+	fs.BoolVar(&skipReferences, "skip-references", false, "with -narrate, leave out references, footnotes, citations and page headers and footers")
+	fs.BoolVar(&chapterFiles, "chapter-files", false, "with -narrate, also write each chapter as its own wav")
+	fs.BoolVar(&m4b, "m4b", false, "with -narrate, package the narration as an M4B audiobook with chapters, requires ffmpeg")
+	fs.StringVar(&bookTitle, "book-title", "", "audiobook title, defaults to the first heading")
+	fs.StringVar(&bookAuthor, "author", "", "audiobook author")
+	fs.StringVar(&bookCover, "cover", "", "audiobook cover image, JPEG or PNG")
+	debugFlags(fs)
+	return &command{
+		name:        "speak",
+		description: "synthesize text with a single voice",
+		flags:       fs,
+		examples: []string{
+			"fabulae speak -voice en-US-Chirp3-HD-Kore -text \"Welcome to the show\"",
+			"fabulae speak -voice en-GB-Neural2-B -file intro.txt",
+			"fortune | fabulae speak -",
+			"fabulae speak -narrate -voice en-US-Studio-O -file article.md",
+			"fabulae speak -narrate -m4b -author \"Ada Lovelace\" -cover cover.jpg -file notes.md",
+		},
+		run: runSpeak,
+	}
+}
+
+func runSpeak(args []string) error {
+	fabulae.SetNaturalPacing(naturalPacing)
+	config, err := loadConfig(defaultConfigPath())
+	if err != nil {
+		return err
+	}
+	if err := registerCustomVoices(config); err != nil {
+		return err
+	}
+	addPreprocessors(config)
+	// a lone - reads the text from stdin, e.g. echo "hello" | fabulae speak -
+	if len(args) > 0 {
+		if len(args) > 1 || args[0] != "-" || speakFile != "" {
+			return fmt.Errorf("unexpected arguments %q, use - to read text from stdin", args)
+		}
+		speakFile = "-"
+	}
+	if speakText != "" && speakFile != "" {
+		return errors.New("use only one of -text, -file or - for stdin")
+	}
+
+	text := speakText
+	if speakFile != "" {
+		var err error
+		text, err = readInput(speakFile)
+		if err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.New("must have one of -text, -file or - for stdin")
+	}
+
+	if err := fabulae.ValidateCodeMode(codeMode); err != nil {
+		return err
+	}
+	if err := checkVoices(speakVoice); err != nil {
+		return err
+	}
+	if narrate {
+		return runNarrate(text)
+	}
+
+	outputfile, err := fabulae.Speak(speakVoice, text, "")
+	if err != nil {
+		return err
+	}
+	log.Printf("generated audio at: %s", outputfile)
+	return nil
+}
+
+// runNarrate narrates text to a wav file, with the chapters alongside as JSON
+func runNarrate(text string) error {
+	name := fmt.Sprintf("narration_%s", time.Now().Format("20060102.030405.06"))
+	if speakFile != "" && speakFile != "-" {
+		name = fmt.Sprintf("%s_%s", strings.TrimSuffix(filepath.Base(speakFile), filepath.Ext(speakFile)), name)
+	}
+	chapters, err := fabulae.Narrate(context.Background(), text, name+".wav", fabulae.NarrationOptions{
+		Voice:          speakVoice,
+		SectionPause:   sectionPause,
+		ParagraphPause: paragraphPause,
+		NoAnnounce:     noAnnounce,
+		ChapterFiles:   chapterFiles,
+		Code:           codeMode,
+		SkipReferences: skipReferences,
+	})
+	if err != nil {
+		return err
+	}
+	if err := fabulae.WriteChapters(name+".chapters.json", chapters); err != nil {
+		return err
+	}
+	for i, c := range chapters {
+		fmt.Printf("%3d  %8s  %s  %s\n", i+1, c.Start.Round(time.Second), c.Title, c.Filename)
+	}
+	fmt.Printf("narration: %s.wav, chapters: %s.chapters.json\n", name, name)
+
+	if m4b {
+		title := bookTitle
+		if title == "" {
+			title = chapters[0].Title
+		}
+		err := fabulae.PackageM4B(context.Background(), name+".wav", chapters, fabulae.AudiobookMetadata{
+			Title:    title,
+			Author:   bookAuthor,
+			Narrator: speakVoice,
+			Cover:    bookCover,
+		}, name+".m4b")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("audiobook: %s.m4b\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	transcribeLanguage string
+	transcribeSpeakers int
+	transcribeLabels   string
+	transcribeModel    string
+	transcribeRate     int
+	transcribeOutput   string
+)
+
+func transcribeCommand() *command {
+	fs := newFlagSet("transcribe", "Transcribe a recording, by speaker, into a fabulae transcript")
+	fs.StringVar(&transcribeLanguage, "language", "en-US", "language of the recording")
+	fs.IntVar(&transcribeSpeakers, "speakers", 2, "number of speakers, at most")
+	fs.StringVar(&transcribeLabels, "labels", "AGENT,CUSTOMER", "speaker labels, in order of first speaking")
+	fs.StringVar(&transcribeModel, "speech-model", "", "Speech-to-Text model, e.g. phone_call or video")
+	fs.IntVar(&transcribeRate, "sample-rate", 0, "sample rate, needed for Opus audio")
+	fs.StringVar(&transcribeOutput, "o", "", "transcript file, default stdout")
+	projectFlags(fs)
+	debugFlags(fs)
+	return &command{
+		name:        "transcribe",
+		description: "transcribe a recording into turns, for re-voicing",
+		flags:       fs,
+		examples: []string{
+			"fabulae transcribe call.wav > transcript.txt",
+			"fabulae transcribe -speakers 3 -labels HOST,GUEST,CALLER gs://my-bucket/episode.flac",
+			"fabulae transcribe call.wav | fabulae generate -voice1 en-US-Studio-O -voice2 en-US-Studio-Q -",
+		},
+		run: runTranscribe,
+	}
+}
+
+func runTranscribe(args []string) error {
+	if len(args) != 1 {
+		return errors.New("transcribe needs one recording, a file or gs:// URI")
+	}
+	if err := requireProject(); err != nil {
+		return err
+	}
+	transcript, err := fabulae.Transcribe(context.Background(), projectID, args[0], fabulae.TranscribeOptions{
+		LanguageCode: transcribeLanguage,
+		Speakers:     transcribeSpeakers,
+		Labels:       strings.Split(transcribeLabels, ","),
+		Model:        transcribeModel,
+		SampleRate:   transcribeRate,
+	})
+	if err != nil {
+		return err
+	}
+	if transcribeOutput == "" {
+		fmt.Print(transcript)
+		return nil
+	}
+	if err := os.WriteFile(transcribeOutput, []byte(transcript), 0644); err != nil {
+		return err
+	}
+	log.Printf("transcript written to %s", transcribeOutput)
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+var verifyKey string
+
+func verifyCommand() *command {
+	fs := newFlagSet("verify", "Verify an episode against its provenance record")
+	fs.StringVar(&verifyKey, "key", "", "trusted ed25519 PEM public key, default the key in the record")
+	debugFlags(fs)
+	return &command{
+		name:        "verify",
+		description: "verify an episode's provenance",
+		flags:       fs,
+		examples: []string{
+			"fabulae verify episode.wav",
+			"openssl pkey -in key.pem -pubout -out key.pub && fabulae verify -key key.pub episode.mp3",
+		},
+		run: runVerify,
+	}
+}
+
+func runVerify(args []string) error {
+	if len(args) != 1 {
+		return errors.New("verify needs one audio file")
+	}
+	var trusted ed25519.PublicKey
+	if verifyKey != "" {
+		var err error
+		if trusted, err = fabulae.ReadPublicKey(verifyKey); err != nil {
+			return fmt.Errorf("unable to read key: %w", err)
+		}
+	}
+	p, err := fabulae.VerifyProvenance(args[0], trusted)
+	if err != nil && !errors.Is(err, fabulae.ErrUnsigned) {
+		return err
+	}
+	record, _ := json.MarshalIndent(p, "", "  ")
+	fmt.Println(string(record))
+	if err != nil {
+		return fmt.Errorf("%s matches its provenance, but %w", args[0], err)
+	}
+	if trusted == nil {
+		fmt.Printf("%s matches its signed provenance, check the public key is one you trust\n", args[0])
+	} else {
+		fmt.Printf("%s matches its provenance, signed by the trusted key\n", args[0])
+	}
+	return nil
+}
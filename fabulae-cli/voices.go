@@ -0,0 +1,401 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	ttspb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+	"github.com/ghchinoy/fabulae"
+)
+
+var (
+	voicesLanguage string
+	voicesGender   string
+	voicesName     string
+)
+
+func voicesCommand() *command {
+	fs := newFlagSet("voices", "Work with Text-to-Speech voices")
+	subcommands := []subcommand{
+		{"list", "list available voices", voicesListFlags},
+		{"pick", "choose a voice and save it to the config file", voicesPickFlags},
+		{"migrate", "replace retired voices in config files", voicesMigrateFlags},
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Work with Text-to-Speech voices\n\nUsage:\n  fabulae voices <subcommand> [flags]\n\nSubcommands:\n")
+		for _, sub := range subcommands {
+			fmt.Fprintf(os.Stderr, "  %-7s %s\n", sub.name, sub.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nUse \"fabulae voices <subcommand> -h\" for a subcommand's flags\n")
+	}
+	return &command{
+		name:        "voices",
+		description: "list and pick voices",
+		flags:       fs,
+		examples: []string{
+			"fabulae voices list -language en-US -name Chirp3",
+			"fabulae voices pick -language en-GB -preview -slot voice2",
+			"fabulae voices migrate -write schedule.json",
+		},
+		subcommands: subcommands,
+		run: func(args []string) error {
+			if len(args) == 0 {
+				fs.Usage()
+				return errors.New("missing subcommand")
+			}
+			switch args[0] {
+			case "list":
+				list := voicesListFlags()
+				list.Parse(args[1:])
+				return runVoicesList()
+			case "pick":
+				pick := voicesPickFlags()
+				pick.Parse(args[1:])
+				return runVoicesPick()
+			case "migrate":
+				migrate := voicesMigrateFlags()
+				migrate.Parse(args[1:])
+				return runVoicesMigrate(migrate.Args())
+			default:
+				fs.Usage()
+				return fmt.Errorf("unknown subcommand %q", args[0])
+			}
+		},
+	}
+}
+
+// voicesFilterFlags adds the flags used to select voices
+func voicesFilterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&voicesLanguage, "language", "", "language code prefix, e.g. en or en-US")
+	fs.StringVar(&voicesGender, "gender", "", "male, female or neutral")
+	fs.StringVar(&voicesName, "name", "", "text the voice name contains, e.g. Chirp3")
+}
+
+func voicesListFlags() *flag.FlagSet {
+	fs := newFlagSet("voices list", "List available Text-to-Speech voices")
+	voicesFilterFlags(fs)
+	return fs
+}
+
+var (
+	pickSlot    string
+	pickPreview bool
+	pickPhrase  string
+)
+
+func voicesPickFlags() *flag.FlagSet {
+	fs := newFlagSet("voices pick", "Choose a voice, optionally previewing it, and save it to the config file")
+	voicesFilterFlags(fs)
+	fs.StringVar(&pickSlot, "slot", "", "config entry to set, voice1 or voice2; asked if not set")
+	fs.BoolVar(&pickPreview, "preview", false, "play a preview of each voice before choosing")
+	fs.StringVar(&pickPhrase, "phrase", "Hello, and welcome to the show. Today we're talking about something fascinating.", "preview text")
+	fs.StringVar(&configfile, "config", "", "path to JSON config file (default "+defaultConfigPath()+")")
+	return fs
+}
+
+// filterVoices returns voices matching the filter flags, sorted by name
+func filterVoices() ([]*ttspb.Voice, error) {
+	voices, err := fabulae.ListVoices(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list voices: %w", err)
+	}
+	matches := []*ttspb.Voice{}
+	for _, v := range voices {
+		if voicesName != "" && !strings.Contains(strings.ToLower(v.Name), strings.ToLower(voicesName)) {
+			continue
+		}
+		if voicesGender != "" && !strings.EqualFold(v.SsmlGender.String(), voicesGender) {
+			continue
+		}
+		if voicesLanguage != "" {
+			found := false
+			for _, lc := range v.LanguageCodes {
+				if strings.HasPrefix(strings.ToLower(lc), strings.ToLower(voicesLanguage)) {
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		matches = append(matches, v)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Name < matches[j].Name })
+	return matches, nil
+}
+
+func runVoicesList() error {
+	voices, err := filterVoices()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tLANGUAGES\tGENDER\tSAMPLE RATE")
+	for _, v := range voices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", v.Name, strings.Join(v.LanguageCodes, ","), strings.ToLower(v.SsmlGender.String()), v.NaturalSampleRateHertz)
+	}
+	return tw.Flush()
+}
+
+// runVoicesPick lists matching voices, lets the user preview and choose one,
+// and writes the choice to the config file
+func runVoicesPick() error {
+	voices, err := filterVoices()
+	if err != nil {
+		return err
+	}
+	if len(voices) == 0 {
+		return errors.New("no voices match, try fewer filters")
+	}
+	for i, v := range voices {
+		fmt.Printf("%3d  %-32s %-12s %s\n", i+1, v.Name, strings.Join(v.LanguageCodes, ","), strings.ToLower(v.SsmlGender.String()))
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	var chosen *ttspb.Voice
+	for chosen == nil {
+		prompt := "voice number"
+		if pickPreview {
+			prompt += " (p <number> to preview)"
+		}
+		answer, err := ask(in, prompt+", q to quit: ")
+		if err != nil {
+			return err
+		}
+		preview := false
+		if rest, ok := strings.CutPrefix(answer, "p"); ok && pickPreview {
+			preview, answer = true, strings.TrimSpace(rest)
+		}
+		if answer == "q" {
+			return nil
+		}
+		n, err := strconv.Atoi(answer)
+		if err != nil || n < 1 || n > len(voices) {
+			fmt.Printf("choose a number from 1 to %d\n", len(voices))
+			continue
+		}
+		if preview {
+			if err := playPreview(voices[n-1]); err != nil {
+				fmt.Printf("unable to preview %s: %v\n", voices[n-1].Name, err)
+			}
+			continue
+		}
+		chosen = voices[n-1]
+	}
+
+	slot := pickSlot
+	for slot != "voice1" && slot != "voice2" {
+		answer, err := ask(in, fmt.Sprintf("save %s as voice1 or voice2? [1/2]: ", chosen.Name))
+		if err != nil {
+			return err
+		}
+		switch answer {
+		case "1", "voice1":
+			slot = "voice1"
+		case "2", "voice2":
+			slot = "voice2"
+		}
+	}
+
+	if configfile == "" {
+		configfile = defaultConfigPath()
+	}
+	config, err := loadConfig(configfile)
+	if err != nil {
+		return err
+	}
+	if slot == "voice1" {
+		config.Voice1 = chosen.Name
+	} else {
+		config.Voice2 = chosen.Name
+	}
+	if err := saveConfig(configfile, config); err != nil {
+		return err
+	}
+	fmt.Printf("%s set to %s in %s\n", slot, chosen.Name, configfile)
+	return nil
+}
+
+var migrateWrite bool
+
+func voicesMigrateFlags() *flag.FlagSet {
+	fs := newFlagSet("voices migrate", "Find deprecated or unavailable voices in the config file and other JSON files, e.g. a schedule, and replace them with current equivalents")
+	fs.StringVar(&configfile, "config", "", "path to JSON config file (default "+defaultConfigPath()+")")
+	fs.BoolVar(&migrateWrite, "write", false, "update the files, otherwise only list the replacements")
+	return fs
+}
+
+// quotedVoiceRe matches quoted Cloud Text-to-Speech voice names in JSON,
+// e.g. "en-US-Journey-D" or "google:en-US-Journey-D"
+var quotedVoiceRe = regexp.MustCompile(`"((?:google:)?[a-z]{2,3}-[A-Z]{2}-[A-Za-z0-9]+(?:-[A-Za-z0-9]+)*)"`)
+
+// runVoicesMigrate lists, and with -write replaces, the deprecated or
+// unavailable voices in the config file and files
+func runVoicesMigrate(files []string) error {
+	if configfile == "" {
+		configfile = defaultConfigPath()
+	}
+	files = append([]string{configfile}, files...)
+	contents := map[string][]byte{}
+	names := []string{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) && file == configfile {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		contents[file] = b
+		for _, m := range quotedVoiceRe.FindAllSubmatch(b, -1) {
+			names = append(names, string(m[1]))
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("no voices found")
+		return nil
+	}
+	migrations, err := fabulae.CheckVoices(context.Background(), names...)
+	if err != nil {
+		return fmt.Errorf("unable to check voices: %w", err)
+	}
+	if len(migrations) == 0 {
+		fmt.Println("all voices are current")
+		return nil
+	}
+
+	for _, file := range files {
+		b, ok := contents[file]
+		if !ok {
+			continue
+		}
+		changed := false
+		for _, m := range migrations {
+			quoted := []byte(`"` + m.Voice + `"`)
+			if !bytes.Contains(b, quoted) {
+				continue
+			}
+			fmt.Printf("%s: %s\n", file, m)
+			if m.Replacement != "" {
+				b = bytes.ReplaceAll(b, quoted, []byte(`"`+m.Replacement+`"`))
+				changed = true
+			}
+		}
+		if !migrateWrite || !changed {
+			continue
+		}
+		if err := os.WriteFile(file, b, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("updated %s\n", file)
+	}
+	if !migrateWrite {
+		fmt.Println("use -write to update the files")
+	}
+	return nil
+}
+
+// checkVoices warns about deprecated Cloud Text-to-Speech voices and fails
+// for unavailable ones without a fallback; the check itself failing, e.g.
+// when replaying fixtures, isn't an error
+func checkVoices(voices ...string) error {
+	names := []string{}
+	for _, v := range voices {
+		if p, _ := fabulae.VoiceProvider(v); p != "" || provider == "google" {
+			names = append(names, v)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	migrations, err := fabulae.CheckVoices(context.Background(), names...)
+	if err != nil {
+		log.Printf("unable to check voices: %v", err)
+		return nil
+	}
+	for _, m := range migrations {
+		if fallback := fallbackVoices[m.Voice]; fallback != "" {
+			log.Printf("%s, falling back to %s", m, fallback)
+			continue
+		}
+		if m.Reason == "deprecated" {
+			log.Printf("warning: %s, run fabulae voices migrate to update the config", m)
+			continue
+		}
+		return fmt.Errorf("%s, run fabulae voices migrate to update the config or set -fallback-voices", m)
+	}
+	return nil
+}
+
+// ask prompts and reads a trimmed line from the terminal
+func ask(in *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// playPreview synthesizes the preview phrase and plays it with the local audio player
+func playPreview(voice *ttspb.Voice) error {
+	audio, err := fabulae.Preview(context.Background(), voice, pickPhrase)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "fabulae-preview-*.wav")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(audio); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	player, err := audioPlayer()
+	if err != nil {
+		return fmt.Errorf("%w, preview written to %s", err, f.Name())
+	}
+	cmd := exec.Command(player, f.Name())
+	cmd.Stdout, cmd.Stderr = io.Discard, os.Stderr
+	return cmd.Run()
+}
+
+// audioPlayer finds a command line audio player: afplay on macOS, or sox play or aplay
+func audioPlayer() (string, error) {
+	for _, player := range []string{"afplay", "play", "aplay"} {
+		if path, err := exec.LookPath(player); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("no audio player found, install sox")
+}
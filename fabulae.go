@@ -16,20 +16,21 @@ package fabulae
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	texttospeech "cloud.google.com/go/texttospeech/apiv1"
 	"github.com/go-audio/wav"
 	"google.golang.org/api/option"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
 
 	ttspb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
 )
@@ -38,10 +39,20 @@ var striptags string
 
 const timeformat = "20060102.030405.06"
 
+// Speak synthesizes text with a single voice to a wav file
 func Speak(voice1name string, text string, gcsbucket string) (string, error) {
+	return SpeakContext(context.Background(), voice1name, text, gcsbucket)
+}
+
+// SpeakContext is Speak with a context, e.g. one with an audio format from
+// WithAudioFormat
+func SpeakContext(ctx context.Context, voice1name string, text string, gcsbucket string) (string, error) {
 	outputfilename := fmt.Sprintf("%s.wav", time.Now().Format(timeformat))
 	//voices := voice(voice1name)
 	voices := getSpeechVoicesForName([]string{voice1name})
+	if voices[voice1name] == nil {
+		return "", fmt.Errorf("unknown voice %s", voice1name)
+	}
 
 	log.Printf("Using: %s", jsonify(voices[voice1name]))
 	log.Printf("text length: %d", len(text))
@@ -49,13 +60,10 @@ func Speak(voice1name string, text string, gcsbucket string) (string, error) {
 	log.Printf("synthesizing ...")
 
 	// generate audio
-	ctx := context.Background()
-
-	client, err := texttospeech.NewClient(ctx)
+	text, err := preprocess(ctx, voice1name, text)
 	if err != nil {
-		return outputfilename, err
+		return "", err
 	}
-	defer client.Close()
 
 	//var input ttspb.SynthesisInput
 	input := ttspb.SynthesisInput{
@@ -67,18 +75,26 @@ func Speak(voice1name string, text string, gcsbucket string) (string, error) {
 	}
 
 	voice := voices[voice1name]
+	if naturalPacing && supportsSSML(voice.Name) {
+		input.InputSource = &ttspb.SynthesisInput_Ssml{Ssml: "<speak>" + pacedSSML(text) + "</speak>"}
+	}
 	req := ttspb.SynthesizeSpeechRequest{
 		Input: &input,
-		Voice: &voice,
+		Voice: voice,
 		AudioConfig: &ttspb.AudioConfig{
-			AudioEncoding: ttspb.AudioEncoding_LINEAR16,
+			AudioEncoding:   ttspb.AudioEncoding_LINEAR16,
+			SampleRateHertz: int32(audioFormatOf(ctx).SampleRate),
 		},
 	}
-	resp, err := client.SynthesizeSpeech(ctx, &req)
+	debugf(DebugRequests, "tts: voice %s (%s), %d characters", voiceName(voice), voice.LanguageCode, len(text))
+	debugf(DebugPayloads, "tts: text: %s", text)
+	start := time.Now()
+	audiobytes, err := synthesizeSpeech(ctx, clientOptions(voice), &req)
 	if err != nil {
+		debugf(DebugRequests, "tts: voice %s failed after %s: %v", voiceName(voice), time.Since(start), err)
 		return "", err
 	}
-	audiobytes := resp.AudioContent
+	debugf(DebugRequests, "tts: voice %s, %d bytes in %s", voiceName(voice), len(audiobytes), time.Since(start))
 
 	// write audio to output file and report
 	err = os.WriteFile(outputfilename, audiobytes, 0644)
@@ -106,11 +122,21 @@ func Speak(voice1name string, text string, gcsbucket string) (string, error) {
 type turnconfig struct {
 	ID             int
 	Turn           string
-	Voice          ttspb.VoiceSelectionParams
+	Style          string
+	Voice          *ttspb.VoiceSelectionParams
 	OutputFilename string
 }
 
+// Fabulae synthesizes a conversation with Cloud TTS voices, alternating
+// voice1 and voice2, turn by turn to files named for outputfilename or as
+// one file
 func Fabulae(voice1name, voice2name string, conversation string, outputfilename string, turnbyturn bool, tags string) ([]string, error) {
+	return FabulaeContext(context.Background(), voice1name, voice2name, conversation, outputfilename, turnbyturn, tags)
+}
+
+// FabulaeContext is Fabulae with a context, e.g. one that reports progress
+// with WithProgress
+func FabulaeContext(ctx context.Context, voice1name, voice2name string, conversation string, outputfilename string, turnbyturn bool, tags string) ([]string, error) {
 	striptags = tags
 
 	if outputfilename == "" {
@@ -122,51 +148,46 @@ func Fabulae(voice1name, voice2name string, conversation string, outputfilename
 
 	// create SSML from conversation
 	voices := getSpeechVoicesForName([]string{voice1name, voice2name})
-
-	ctx := context.Background()
+	for _, name := range []string{voice1name, voice2name} {
+		if voices[name] == nil {
+			return nil, fmt.Errorf("unknown voice %q", name)
+		}
+	}
 
 	outputfiles := []string{}
 
-	v1re := regexp.MustCompile(`^\|\s\[\*\]`)
-	v2re := regexp.MustCompile(`^\|\s\[\+\]`)
-
 	if turnbyturn {
 		log.Print("turn-by-turn requested")
-		// remove blank lines
-		cleanturns := []string{}
-		for _, turn := range turns {
-			if turn == "" {
-				continue
-			} else {
-				turn = v1re.ReplaceAllString(turn, "")
-				turn = v2re.ReplaceAllString(turn, "")
-			}
-			cleanturns = append(cleanturns, strings.TrimSpace(turn))
-		}
+		cleanturns := splitTurns(conversation)
 
 		// goroutines
 
 		// Configure turns
 		configuredTurns := []turnconfig{}
 		for i, turn := range cleanturns {
-			var voice ttspb.VoiceSelectionParams
+			var voice *ttspb.VoiceSelectionParams
 			if i%2 == 0 {
 				voice = voices[voice1name]
 			} else {
 				voice = voices[voice2name]
 			}
-			turn = stripParticipantTags(turn, tags)
+			// a leading directive, e.g. [excited], sets the turn's style
+			style, turn := parseStyle(strings.TrimSpace(stripParticipantTags(turn, tags)))
 			configuredTurns = append(configuredTurns, turnconfig{
 				ID:             i,
 				Voice:          voice,
+				Style:          style,
 				Turn:           turn,
 				OutputFilename: outputfilename,
 			})
 		}
 		//log.Printf("turns configured: %d", len(configuredTurns))
 
-		outputfiles = processAudioTurns(configuredTurns)
-		sort.Sort(sort.StringSlice(outputfiles))
+		var err error
+		p := newProgress(ctx, len(configuredTurns), false)
+		if outputfiles, err = processAudioTurns(ctx, configuredTurns, p); err != nil {
+			return nil, err
+		}
 		//log.Printf("files: %s", outputfiles)
 
 		/*
@@ -202,7 +223,10 @@ func Fabulae(voice1name, voice2name string, conversation string, outputfilename
 		*/
 
 	} else {
-		ssml := generateSSMLfromConversation(turns, []ttspb.VoiceSelectionParams{voices[voice1name], voices[voice2name]})
+		ssml, err := generateSSMLfromConversation(ctx, turns, []*ttspb.VoiceSelectionParams{voices[voice1name], voices[voice2name]})
+		if err != nil {
+			return outputfiles, err
+		}
 		//log.Print(ssml)
 
 		// generate audio
@@ -240,95 +264,155 @@ func Fabulae(voice1name, voice2name string, conversation string, outputfilename
 
 }
 
-// processAudioTurns concurrenctly creates audio and writes to temp dir
-func processAudioTurns(turns []turnconfig) []string {
-	ctx := context.Background()
+// splitTurns splits a conversation into turns, one per line, removing blank
+// lines and the | [*] and | [+] speaker markers
+func splitTurns(conversation string) []string {
+	v1re := regexp.MustCompile(`^\|\s\[\*\]`)
+	v2re := regexp.MustCompile(`^\|\s\[\+\]`)
+
+	cleanturns := []string{}
+	for _, turn := range strings.Split(conversation, "\n") {
+		if turn == "" {
+			continue
+		}
+		turn = v1re.ReplaceAllString(turn, "")
+		turn = v2re.ReplaceAllString(turn, "")
+		cleanturns = append(cleanturns, strings.TrimSpace(turn))
+	}
+	return cleanturns
+}
 
+// processAudioTurns concurrenctly creates audio and writes to temp dir, in
+// turn order, reporting to p; if a turn fails, those written are removed
+func processAudioTurns(ctx context.Context, turns []turnconfig, p *progress) ([]string, error) {
 	var wg sync.WaitGroup
-	results := []string{}
-	resultChan := make(chan string, len(turns))
+	results := make([]string, len(turns))
+	errs := make([]error, len(turns))
+	// bounded, so long episodes don't hold every turn's audio at once
+	limit := make(chan struct{}, defaultSynthesisParallelism)
 
 	for i, turn := range turns {
 		wg.Add(1)
 		go func(i int, turn turnconfig) {
 			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			p.started(turn.ID)
 			//log.Printf("goroutine: %d; turn %d; voice: %s", i, turn.ID, turn.Voice.Name)
-			audiobytes, err := synthesizeWithVoice(ctx, turn.Voice, turn.Turn)
+			audio, err := withTurnChecks(turn.ID, func() (Audio, error) {
+				return withFallback(ctx, turn.ID, turn.Voice.Name, func(name string) (Audio, error) {
+					voice := turn.Voice
+					if name != turn.Voice.Name {
+						if voice = getSpeechVoicesForName([]string{name})[name]; voice == nil {
+							return Audio{}, fmt.Errorf("unknown voice %s", name)
+						}
+					}
+					return withBleeps(turn.Turn, func(text string) (Audio, error) {
+						text, err := preprocess(ctx, voiceName(voice), text)
+						if err != nil {
+							return Audio{}, err
+						}
+						return inSentences(text, func(text string) (Audio, error) {
+							audiobytes, err := synthesizeStyled(ctx, voice, turn.Style, text)
+							return Audio{audiobytes, FormatWAV}, err
+						})
+					})
+				})
+			})
 			if err != nil {
-				resultChan <- fmt.Sprintf("error goroutine: %d; turn %d; voice: %s", i, turn.ID, turn.Voice.Name)
+				errs[i] = fmt.Errorf("turn %d, voice %s: %w", turn.ID, turn.Voice.Name, err)
+				return
 			}
+			audiobytes := audio.Data
 
 			dir, filename := filepath.Split(turn.OutputFilename)
 			filename = fmt.Sprintf("%02d_%s", turn.ID, filename)
 
 			turnfilename := filepath.Join(dir, filename)
-			err = os.WriteFile(turnfilename, audiobytes, 0644)
-
-			if err != nil {
-				resultChan <- fmt.Sprintf("unable to write to %s: %v", turnfilename, err)
+			if err := os.WriteFile(turnfilename, audiobytes, 0644); err != nil {
+				errs[i] = fmt.Errorf("unable to write to %s: %w", turnfilename, err)
+				return
 			}
 			log.Printf("%2d %s Audio content (%7d bytes) written to file: %v",
-				turn.ID, turn.Voice.Name,
+				turn.ID, voiceName(turn.Voice),
 				len(audiobytes), turnfilename,
 			)
-			resultChan <- turnfilename
+			results[i] = turnfilename
+			p.finished(turn.ID, len(audiobytes))
 		}(i, turn)
 	}
+	wg.Wait()
 
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
-
-	for r := range resultChan {
-		results = append(results, r)
+	if err := errors.Join(errs...); err != nil {
+		RemoveFiles(results...)
+		return nil, err
 	}
+	return results, nil
+}
 
-	return results
+// Preview synthesizes text with a voice, returning wav audio bytes
+func Preview(ctx context.Context, voice *ttspb.Voice, text string) ([]byte, error) {
+	return synthesizeWithVoice(ctx, &ttspb.VoiceSelectionParams{
+		Name:         voice.Name,
+		SsmlGender:   voice.SsmlGender,
+		LanguageCode: voice.LanguageCodes[0],
+	}, text)
 }
 
 // synthesizeWithVoice takes a string and a voice and returns audio bytes using GCP TTS
-func synthesizeWithVoice(ctx context.Context, voice ttspb.VoiceSelectionParams, turn string) ([]byte, error) {
+func synthesizeWithVoice(ctx context.Context, voice *ttspb.VoiceSelectionParams, turn string) ([]byte, error) {
+	return synthesizeStyled(ctx, voice, "", turn)
+}
+
+// synthesizeStyled synthesizes a turn in a style, e.g. excited, using SSML
+// prosody where the voice supports it
+func synthesizeStyled(ctx context.Context, voice *ttspb.VoiceSelectionParams, style, turn string) ([]byte, error) {
 	//log.Printf("voice: %s", voice.Name)
-	opts := []option.ClientOption{}
+	opts := clientOptions(voice)
 	//if strings.Contains(voice.Name, "Neural") {
 	//	opts = append(opts, option.WithEndpoint("texttospeech.googleapis.com:443"))
 	//}
-	client, err := texttospeech.NewClient(ctx, opts...)
-	if err != nil {
-		return []byte{}, err
-	}
-	defer client.Close()
 
 	//log.Printf("Using: %s", jsonify(voice))
+	input := &ttspb.SynthesisInput{
+		InputSource: &ttspb.SynthesisInput_Text{Text: turn},
+	}
+	if style != "" || naturalPacing {
+		ssml, known := turnSSML(style, turn)
+		switch {
+		case !supportsSSML(voice.Name):
+			debugf(DebugRequests, "tts: style %q and pacing ignored, %s doesn't support SSML", style, voiceName(voice))
+		case known || naturalPacing:
+			input.InputSource = &ttspb.SynthesisInput_Ssml{Ssml: "<speak>" + ssml + "</speak>"}
+			debugf(DebugRequests, "tts: ssml with style %q, natural pacing %t", style, naturalPacing)
+		default:
+			debugf(DebugRequests, "tts: unknown style %s ignored", style)
+		}
+	}
 	req := ttspb.SynthesizeSpeechRequest{
-		Input: &ttspb.SynthesisInput{
-			InputSource: &ttspb.SynthesisInput_Text{Text: turn},
-		},
-		Voice: &voice,
+		Input: input,
+		Voice: voice,
 		AudioConfig: &ttspb.AudioConfig{
-			AudioEncoding: ttspb.AudioEncoding_LINEAR16,
+			AudioEncoding:   ttspb.AudioEncoding_LINEAR16,
+			SampleRateHertz: int32(audioFormatOf(ctx).SampleRate),
 		},
 	}
-	resp, err := client.SynthesizeSpeech(ctx, &req)
+	debugf(DebugRequests, "tts: voice %s (%s), %d characters", voiceName(voice), voice.LanguageCode, len(turn))
+	debugf(DebugPayloads, "tts: text: %s", turn)
+	start := time.Now()
+	audio, err := synthesizeSpeech(ctx, opts, &req)
 	if err != nil {
+		debugf(DebugRequests, "tts: voice %s failed after %s: %v", voiceName(voice), time.Since(start), err)
 		return []byte{}, err
 	}
-	return resp.AudioContent, nil
+	debugf(DebugRequests, "tts: voice %s, %d bytes in %s", voiceName(voice), len(audio), time.Since(start))
+	return audio, nil
 }
 
 // synthesize takes a block of SSML and generates audio bytes using GCP TTS
 func synthesize(ctx context.Context, ssml string) ([]byte, error) {
-	// note use of us-central1 endpoint for Neural2 voices
-	client, err := texttospeech.NewClient(
-		ctx,
-		//option.WithEndpoint("texttospeech.googleapis.com:443"),
-	)
-	if err != nil {
-		return []byte{}, err
-	}
-	defer client.Close()
-
+	// note use of us-central1 endpoint for Neural2 voices, e.g.
+	// option.WithEndpoint("texttospeech.googleapis.com:443")
 	//var input ttspb.SynthesisInput
 	input := ttspb.SynthesisInput{
 		InputSource: &ttspb.SynthesisInput_Ssml{Ssml: string(ssml)},
@@ -347,60 +431,103 @@ func synthesize(ctx context.Context, ssml string) ([]byte, error) {
 			AudioEncoding: ttspb.AudioEncoding_LINEAR16,
 		},
 	}
-	log.Printf("%v", req)
-	resp, err := client.SynthesizeSpeech(ctx, &req)
+	log.Printf("%v", &req)
+	debugf(DebugRequests, "tts: ssml, %d characters", len(ssml))
+	debugf(DebugPayloads, "tts: ssml: %s", ssml)
+	start := time.Now()
+	audio, err := synthesizeSpeech(ctx, nil, &req)
 	if err != nil {
 		log.Printf("error in SynthesizeSpeech: %v", err)
 		return []byte{}, err
 	}
-	return resp.AudioContent, nil
+	debugf(DebugRequests, "tts: ssml, %d bytes in %s", len(audio), time.Since(start))
+	return audio, nil
+}
+
+// synthesizeSpeech sends a Text-to-Speech request, or in replay mode
+// returns its fixture
+func synthesizeSpeech(ctx context.Context, opts []option.ClientOption, req *ttspb.SynthesizeSpeechRequest) ([]byte, error) {
+	key, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return withFixture("tts", "wav", key, prototext.Format(req), func() ([]byte, error) {
+		client, release, err := ttsClient(opts)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		resp, err := client.SynthesizeSpeech(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.AudioContent, nil
+	})
 }
 
 // generateSSMLfromConversation takes a turn-by-turn 2 person conversation, one turn per line
 // and turns it into a <speak>...</speak> ssml string
-func generateSSMLfromConversation(turns []string, voices []ttspb.VoiceSelectionParams) string {
+func generateSSMLfromConversation(ctx context.Context, turns []string, voices []*ttspb.VoiceSelectionParams) (string, error) {
 	ssml := []string{}
 	ssml = append(ssml, "<speak>")
 
 	for k, v := range turns {
 		v := stripParticipantTags(v, striptags)
+		style, text := parseStyle(strings.TrimSpace(v))
+		text, err := preprocess(ctx, voiceName(voices[k%2]), text)
+		if err != nil {
+			return "", err
+		}
+		v, _ = turnSSML(style, text)
 		ssml = append(ssml, fmt.Sprintf("<mark name=\"%d\"/><voice name=\"%s\">%s</voice>", k, voices[k%2].Name, v))
 		ssml = append(ssml, "<break time=\"250ms\"/>")
 	}
 	ssml = append(ssml, "</speak>")
-	return strings.Join(ssml, "")
+	return strings.Join(ssml, ""), nil
 }
 
 func stripParticipantTags(text string, striptags string) string {
 	if len(striptags) == 0 {
 		return text
 	}
-	strip := strings.Split(striptags, ",")
-	for _, s := range strip {
-		if !strings.HasSuffix(s, ":") {
-			strip = append(strip, fmt.Sprintf("%s:", s))
+	// a label with its colon, so AGENT: doesn't leave the colon
+	for _, s := range strings.Split(striptags, ",") {
+		if label := strings.TrimSuffix(s, ":") + ":"; strings.Contains(text, label) {
+			s = label
 		}
-	}
-	for _, s := range strip {
 		text = strings.Replace(text, s, "", 1)
 	}
 
 	return text
 }
 
-func getSpeechVoicesForName(voicenames []string) map[string]ttspb.VoiceSelectionParams {
-	voices, err := listVoices()
+func getSpeechVoicesForName(voicenames []string) map[string]*ttspb.VoiceSelectionParams {
+	response := make(map[string]*ttspb.VoiceSelectionParams, len(voicenames))
+
+	// custom voices aren't listed, they're registered with RegisterCustomVoice
+	lookup := []string{}
+	for _, name := range voicenames {
+		if custom, ok := customVoice(name); ok {
+			log.Printf("custom voice %s: %s", name, custom.Model)
+			response[name] = custom.selectionParams()
+			continue
+		}
+		lookup = append(lookup, name)
+	}
+	if len(lookup) == 0 {
+		return response
+	}
+
+	voices, err := ListVoices(context.Background())
 	if err != nil {
 		log.Fatalf("unable to list voices: %v", err)
 	}
 
-	response := make(map[string]ttspb.VoiceSelectionParams, len(voicenames))
-
-	for _, name := range voicenames {
+	for _, name := range lookup {
 		for _, v := range voices {
 			if v.Name == name {
 				log.Printf("found %s: %v", name, v)
-				voice := ttspb.VoiceSelectionParams{
+				voice := &ttspb.VoiceSelectionParams{
 					Name:         v.Name,
 					SsmlGender:   v.SsmlGender,
 					LanguageCode: v.LanguageCodes[0], //"en-US",
@@ -414,32 +541,70 @@ func getSpeechVoicesForName(voicenames []string) map[string]ttspb.VoiceSelection
 	return response
 }
 
-func listVoices() ([]*ttspb.Voice, error) {
-	ctx := context.Background()
-	client, err := texttospeech.NewClient(
-		ctx,
-		//option.WithEndpoint("texttospeech.googleapis.com:443"),
-	)
-	if err != nil {
-		return nil, err
+// voiceListTTL is how long the voice list is reused, as every episode looks
+// up its voices in it
+const voiceListTTL = time.Hour
+
+// voiceList is the last voice list, unless fixtures are recorded or replayed
+var voiceList struct {
+	sync.Mutex
+	data    []byte
+	fetched time.Time
+}
+
+// ListVoices returns all voices available from Cloud Text-to-Speech
+func ListVoices(ctx context.Context) ([]*ttspb.Voice, error) {
+	fixturesMu.Lock()
+	cache := fixturesMode == FixturesOff
+	fixturesMu.Unlock()
+	voiceList.Lock()
+	defer voiceList.Unlock()
+	data := voiceList.data
+	if !cache || time.Since(voiceList.fetched) > voiceListTTL {
+		data = nil
+	}
+	if data == nil {
+		var err error
+		if data, err = listVoices(ctx); err != nil {
+			return nil, err
+		}
+		if cache {
+			voiceList.data, voiceList.fetched = data, time.Now()
+		}
 	}
-	defer client.Close()
 
-	listRequest := &ttspb.ListVoicesRequest{}
-	voicesResponse, err := client.ListVoices(ctx, listRequest)
-	if err != nil {
+	voicesResponse := &ttspb.ListVoicesResponse{}
+	if err := proto.Unmarshal(data, voicesResponse); err != nil {
 		return nil, err
 	}
-
 	return voicesResponse.Voices, nil
 }
 
+// listVoices lists the voices, or in replay mode returns the fixture, as a
+// ListVoicesResponse
+func listVoices(ctx context.Context) ([]byte, error) {
+	return withFixture("tts-voices", "pb", nil, "list voices", func() ([]byte, error) {
+		client, release, err := ttsClient(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		listRequest := &ttspb.ListVoicesRequest{}
+		voicesResponse, err := client.ListVoices(ctx, listRequest)
+		if err != nil {
+			return nil, err
+		}
+		return proto.Marshal(voicesResponse)
+	})
+}
+
 // jsonify prints nicely
-func jsonify(voice ttspb.VoiceSelectionParams) string {
+func jsonify(voice *ttspb.VoiceSelectionParams) string {
 	encoder := protojson.MarshalOptions{
 		Indent: " ",
 	}
-	voicebytes, err := encoder.Marshal(&voice)
+	voicebytes, err := encoder.Marshal(voice)
 	if err != nil {
 		return fmt.Sprintf("%+v", voice)
 	}
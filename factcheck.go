@@ -0,0 +1,227 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// fact check modes: write a report of unsupported claims, or also have the
+// host correct them at the end of the episode
+const (
+	FactCheckReport      = "report"
+	FactCheckCorrections = "corrections"
+)
+
+// claim verdicts against the source document
+const (
+	ClaimSupported    = "supported"
+	ClaimUnsupported  = "unsupported"
+	ClaimContradicted = "contradicted"
+)
+
+// maxSpokenCorrections keeps the corrections segment short
+const maxSpokenCorrections = 5
+
+// factCheckPrompt asks for the script's factual claims, each checked against
+// the source document
+const factCheckPrompt = `You are a fact checker for a podcast written from the document above. List the factual claims the speakers make in the script below about the document's subject: results, numbers, methods, dates, names and attributions. Skip opinions, jokes and greetings.
+
+For each claim give its verdict against the document: supported if the document says it, contradicted if the document says otherwise, unsupported if the document doesn't say it. Give the evidence, a short quote or paraphrase of the relevant part of the document, and for claims that aren't supported, one sentence the host could say to listeners to correct it.
+
+<Script>
+%s
+</Script>`
+
+// Claim is a factual claim from a script, checked against its source
+type Claim struct {
+	Claim      string `json:"claim"`
+	Verdict    string `json:"verdict"`
+	Evidence   string `json:"evidence,omitempty"`
+	Correction string `json:"correction,omitempty"` // spoken, for claims that aren't supported
+}
+
+// FactCheck is the claims checked in a script
+type FactCheck struct {
+	Claims []Claim `json:"claims"`
+}
+
+// Flagged are the claims that aren't supported by the source
+func (f FactCheck) Flagged() []Claim {
+	flagged := []Claim{}
+	for _, c := range f.Claims {
+		if c.Verdict != ClaimSupported {
+			flagged = append(flagged, c)
+		}
+	}
+	return flagged
+}
+
+// ValidateFactCheckMode checks a fact check mode, empty for none
+func ValidateFactCheckMode(mode string) error {
+	switch mode {
+	case "", FactCheckReport, FactCheckCorrections:
+		return nil
+	}
+	return fmt.Errorf("unknown fact check %q, use %s or %s", mode, FactCheckReport, FactCheckCorrections)
+}
+
+// factCheckSchema is the controlled generation schema for FactCheck
+var factCheckSchema = &genai.Schema{
+	Type: genai.TypeObject,
+	Properties: map[string]*genai.Schema{
+		"claims": {
+			Type: genai.TypeArray,
+			Items: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"claim":      {Type: genai.TypeString},
+					"verdict":    {Type: genai.TypeString, Enum: []string{ClaimSupported, ClaimUnsupported, ClaimContradicted}},
+					"evidence":   {Type: genai.TypeString},
+					"correction": {Type: genai.TypeString},
+				},
+				Required: []string{"claim", "verdict"},
+			},
+		},
+	},
+	Required: []string{"claims"},
+}
+
+// CheckFacts extracts a script's factual claims and checks them against its
+// source document
+func CheckFacts(ctx context.Context, projectID, location, modelName, source, script string) (FactCheck, error) {
+	var check FactCheck
+	request := fmt.Sprintf("fact check, model: %s\nsource: %s\nscript:\n%s", modelName, fixtureSource(source), script)
+	res, err := withFixture("gemini-factcheck", "json", []byte(request), request, func() ([]byte, error) {
+		return checkFacts(ctx, projectID, location, modelName, source, script)
+	})
+	if err != nil {
+		return check, err
+	}
+	if err := json.Unmarshal(res, &check); err != nil {
+		return check, fmt.Errorf("couldn't unmarshal fact check: %s: %w", res, err)
+	}
+	return check, nil
+}
+
+// checkFacts asks Gemini for a script's checked claims as JSON
+func checkFacts(ctx context.Context, projectID, location, modelName, source, script string) ([]byte, error) {
+	client, err := genaiClient(projectID, location)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %w", err)
+	}
+
+	model := client.GenerativeModel(modelName)
+	model.ResponseMIMEType = "application/json"
+	model.ResponseSchema = factCheckSchema
+	model.SetTemperature(0)
+	model.SafetySettings = safetySettings
+
+	document, err := documentPart(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read document: %w", err)
+	}
+
+	debugf(DebugRequests, "gemini: fact check, model %s, source %s", modelName, source)
+	start := time.Now()
+	res, err := model.GenerateContent(ctx, document, genai.Text(fmt.Sprintf(factCheckPrompt, script)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to fact check script: %w", err)
+	}
+	debugResponse(res, start)
+	if len(res.Candidates) == 0 ||
+		len(res.Candidates[0].Content.Parts) == 0 {
+		return nil, errors.New("empty fact check response from model")
+	}
+	return []byte(fmt.Sprintf("%s", res.Candidates[0].Content.Parts[0])), nil
+}
+
+// AppendCorrections ends a script with the host correcting the flagged
+// claims, the expert leading in if the next turn is theirs so turns keep
+// alternating; a script without flagged claims is unchanged
+func AppendCorrections(script string, check FactCheck) string {
+	corrections := []string{}
+	for _, c := range check.Flagged() {
+		if c.Correction != "" && len(corrections) < maxSpokenCorrections {
+			corrections = append(corrections, strings.TrimSpace(c.Correction))
+		}
+	}
+	if len(corrections) == 0 {
+		return script
+	}
+	script = strings.TrimRight(script, "\n") + "\n"
+	lead := "Before we go, a few corrections to what we said today."
+	if len(splitTurns(script))%2 == 1 {
+		script += "| [+] Actually, before we go, I want to correct a few things we said.\n"
+		lead = "Right, a few corrections."
+	}
+	return script + "| [*] " + lead + " " + strings.Join(corrections, " ") + "\n"
+}
+
+// FactCheckFile is the fact check report for an audio file, e.g. episode.factcheck.md
+func FactCheckFile(audiofile string) string {
+	return strings.TrimSuffix(audiofile, filepath.Ext(audiofile)) + ".factcheck.md"
+}
+
+// FactCheckMarkdown is a report of the flagged claims, then the supported ones
+func FactCheckMarkdown(title string, check FactCheck) []byte {
+	var b bytes.Buffer
+	if title == "" {
+		title = "Fact check"
+	} else {
+		title = "Fact check: " + title
+	}
+	flagged := check.Flagged()
+	fmt.Fprintf(&b, "# %s\n\n%d claims checked against the source, %d not supported\n", title, len(check.Claims), len(flagged))
+	if len(flagged) > 0 {
+		b.WriteString("\n## Not supported\n\n")
+		for _, c := range flagged {
+			fmt.Fprintf(&b, "- **%s** (%s)", c.Claim, c.Verdict)
+			if c.Evidence != "" {
+				fmt.Fprintf(&b, "\n  - Source: %s", c.Evidence)
+			}
+			if c.Correction != "" {
+				fmt.Fprintf(&b, "\n  - Correction: %s", c.Correction)
+			}
+			b.WriteString("\n")
+		}
+	}
+	if supported := len(check.Claims) - len(flagged); supported > 0 {
+		b.WriteString("\n## Supported\n\n")
+		for _, c := range check.Claims {
+			if c.Verdict == ClaimSupported {
+				fmt.Fprintf(&b, "- %s\n", c.Claim)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// WriteFactCheck writes the fact check report next to an audio file,
+// returning its name
+func WriteFactCheck(audiofile, title string, check FactCheck) (string, error) {
+	filename := FactCheckFile(audiofile)
+	return filename, os.WriteFile(filename, FactCheckMarkdown(title, check), 0644)
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ttspb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+)
+
+// FallbackAuto picks a Cloud Text-to-Speech fallback voice with the same
+// language and gender, preferring the same kind of voice
+const FallbackAuto = "auto"
+
+const (
+	// synthesisAttempts is how many times a turn is tried with its voice
+	// before its fallback is used
+	synthesisAttempts = 3
+	// synthesisBackoff is the wait before the first retry, doubled after
+	synthesisBackoff = time.Second
+)
+
+// VoiceSubstitution records a turn spoken by a fallback voice
+type VoiceSubstitution struct {
+	Turn     int    `json:"turn"`
+	Voice    string `json:"voice"`
+	Fallback string `json:"fallback"`
+	Error    string `json:"error"` // the voice's last error
+}
+
+var (
+	fallbackMu     sync.Mutex
+	fallbackVoices map[string]string
+	substitutions  []VoiceSubstitution
+)
+
+// SetFallbackVoices sets the voices that speak a turn when its voice keeps
+// failing, e.g. when it's retired or in a regional outage: voice names to
+// fallback names, or FallbackAuto; it clears recorded substitutions
+func SetFallbackVoices(fallbacks map[string]string) {
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+	fallbackVoices, substitutions = fallbacks, nil
+}
+
+// VoiceSubstitutions returns the turns spoken by fallback voices, in order
+func VoiceSubstitutions() []VoiceSubstitution {
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+	list := append([]VoiceSubstitution{}, substitutions...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Turn < list[j].Turn })
+	return list
+}
+
+// withFallback synthesizes a turn with voice, retrying with backoff, then
+// with the voice's fallback if it has one
+func withFallback(ctx context.Context, turn int, voice string, synth func(voice string) (Audio, error)) (Audio, error) {
+	var audio Audio
+	var err error
+	backoff := synthesisBackoff
+	for attempt := 1; attempt <= synthesisAttempts; attempt++ {
+		if audio, err = synth(voice); err == nil {
+			return audio, nil
+		}
+		// replays and cancellations fail the same way again
+		if errors.Is(err, ErrNoFixture) || ctx.Err() != nil {
+			return audio, err
+		}
+		if attempt < synthesisAttempts {
+			log.Printf("turn %d, voice %s failed, retrying in %s: %v", turn, voice, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	fallbackMu.Lock()
+	fallback := fallbackVoices[voice]
+	fallbackMu.Unlock()
+	if fallback == "" {
+		return audio, err
+	}
+	if fallback == FallbackAuto {
+		var autoErr error
+		if fallback, autoErr = autoFallback(ctx, voice); autoErr != nil {
+			log.Printf("no fallback for %s: %v", voice, autoErr)
+			return audio, err
+		}
+	}
+	log.Printf("turn %d, voice %s failed %d times, using %s: %v", turn, voice, synthesisAttempts, fallback, err)
+	audio, fallbackErr := synth(fallback)
+	if fallbackErr != nil {
+		return audio, fmt.Errorf("%w, and fallback %s: %v", err, fallback, fallbackErr)
+	}
+	fallbackMu.Lock()
+	substitutions = append(substitutions, VoiceSubstitution{Turn: turn, Voice: voice, Fallback: fallback, Error: err.Error()})
+	fallbackMu.Unlock()
+	return audio, nil
+}
+
+// autoFallback picks a Cloud Text-to-Speech voice like voice
+func autoFallback(ctx context.Context, voice string) (string, error) {
+	provider, _ := VoiceProvider(voice)
+	if provider != "" && provider != "google" {
+		return "", fmt.Errorf("automatic fallbacks are Cloud Text-to-Speech voices, not %s", provider)
+	}
+	voices, err := ListVoices(ctx)
+	if err != nil {
+		return "", err
+	}
+	return similarVoice(voices, voice)
+}
+
+// similarVoice picks another of voices with the voice's language and gender,
+// the voice's current equivalent if it's deprecated, or one of the same kind
+func similarVoice(voices []*ttspb.Voice, voice string) (string, error) {
+	provider, name := VoiceProvider(voice)
+	prefix := ""
+	if provider != "" {
+		prefix = provider + ":"
+	}
+	if current, ok := DeprecatedVoice(name); ok && slices.ContainsFunc(voices, func(v *ttspb.Voice) bool { return v.Name == current }) {
+		return prefix + current, nil
+	}
+	var language, gender string
+	for _, v := range voices {
+		if v.Name == name {
+			language, gender = v.LanguageCodes[0], v.SsmlGender.String()
+		}
+	}
+	if language == "" {
+		// a retired voice isn't listed, its name has the language, e.g. en-US-Journey-D
+		if parts := strings.SplitN(name, "-", 3); len(parts) == 3 {
+			language = parts[0] + "-" + parts[1]
+		}
+	}
+	kind := voiceKind(name)
+
+	candidates := []string{}
+	for _, v := range voices {
+		if v.Name == name || len(v.LanguageCodes) == 0 || v.LanguageCodes[0] != language || (gender != "" && v.SsmlGender.String() != gender) {
+			continue
+		}
+		if _, deprecated := DeprecatedVoice(v.Name); deprecated {
+			continue
+		}
+		candidates = append(candidates, v.Name)
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no other %s %s voices", language, strings.ToLower(gender))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		sameI, sameJ := voiceKind(candidates[i]) == kind, voiceKind(candidates[j]) == kind
+		if sameI != sameJ {
+			return sameI
+		}
+		return candidates[i] < candidates[j]
+	})
+	return prefix + candidates[0], nil
+}
+
+// voiceKind is the kind of a Cloud Text-to-Speech voice, e.g. Studio for
+// en-US-Studio-O or Chirp3-HD for en-US-Chirp3-HD-Charon
+func voiceKind(name string) string {
+	parts := strings.Split(name, "-")
+	if len(parts) < 4 {
+		return ""
+	}
+	return strings.Join(parts[2:len(parts)-1], "-")
+}
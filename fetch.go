@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultMaxPDFBytes is the largest document FetchPDF will retrieve
+	DefaultMaxPDFBytes int64 = 50 << 20
+	// DefaultFetchTimeout bounds the whole retrieval, including redirects
+	DefaultFetchTimeout = 60 * time.Second
+	// DefaultMaxRedirects is the number of redirects FetchPDF will follow
+	DefaultMaxRedirects = 5
+)
+
+// pdfSniffLen is how far into the document the %PDF- header may appear
+const pdfSniffLen = 1024
+
+var (
+	// ErrTooLarge is returned when a document exceeds the size limit
+	ErrTooLarge = errors.New("document exceeds maximum size")
+	// ErrNotPDF is returned when the retrieved content isn't a PDF
+	ErrNotPDF = errors.New("document is not a PDF")
+)
+
+// FetchOptions configures FetchPDF, zero values use the defaults
+type FetchOptions struct {
+	MaxBytes     int64
+	Timeout      time.Duration
+	MaxRedirects int
+	Policy       *URLPolicy // if set, checked for the URL, every redirect, and dialed addresses
+}
+
+func (o FetchOptions) withDefaults() FetchOptions {
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = DefaultMaxPDFBytes
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultFetchTimeout
+	}
+	if o.MaxRedirects <= 0 {
+		o.MaxRedirects = DefaultMaxRedirects
+	}
+	return o
+}
+
+// FetchPDF retrieves the PDF at pdfurl and streams the body into w, returning
+// the number of bytes written
+// Redirects are followed up to a limit, the size is capped, and the content
+// must start with the %PDF- magic bytes; set a Policy when fetching untrusted URLs
+func FetchPDF(ctx context.Context, pdfurl string, w io.Writer, opts FetchOptions) (int64, error) {
+	opts = opts.withDefaults()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pdfurl, nil)
+	if err != nil {
+		return 0, err
+	}
+	if opts.Policy != nil {
+		if err := opts.Policy.CheckURL(req.URL); err != nil {
+			return 0, err
+		}
+	}
+	req.Header.Set("Accept", "application/pdf")
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= opts.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			if opts.Policy != nil {
+				return opts.Policy.CheckURL(req.URL)
+			}
+			return nil
+		},
+	}
+	if opts.Policy != nil {
+		client.Transport = opts.Policy.transport()
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unable to retrieve %s: %s", pdfurl, res.Status)
+	}
+	if res.ContentLength > opts.MaxBytes {
+		return 0, fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, res.ContentLength, opts.MaxBytes)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "" && ct != "application/pdf" {
+		log.Printf("%s has content type %s, checking content", pdfurl, ct)
+	}
+
+	// read one byte past the limit to detect oversized bodies without a Content-Length
+	body := bufio.NewReaderSize(io.LimitReader(res.Body, opts.MaxBytes+1), pdfSniffLen)
+	head, err := body.Peek(pdfSniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return 0, err
+	}
+	if !bytes.Contains(head, []byte("%PDF-")) {
+		return 0, ErrNotPDF
+	}
+
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return n, err
+	}
+	if n > opts.MaxBytes {
+		return n, fmt.Errorf("%w: limit %d", ErrTooLarge, opts.MaxBytes)
+	}
+	return n, nil
+}
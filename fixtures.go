@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fixture modes
+const (
+	// FixturesOff calls Gemini and Text-to-Speech
+	FixturesOff = ""
+	// FixturesRecord calls them and saves their responses as fixtures
+	FixturesRecord = "record"
+	// FixturesReplay returns saved responses without calling them
+	FixturesReplay = "replay"
+)
+
+// ErrNoFixture is returned in replay mode for a request without a fixture
+var ErrNoFixture = errors.New("no fixture for request")
+
+var (
+	fixturesMu   sync.Mutex
+	fixturesMode = FixturesOff
+	fixturesDir  string
+)
+
+// SetFixtures records Gemini and Cloud Text-to-Speech responses as fixture
+// files in dir, or replays them, so a change, e.g. to a prompt template, can
+// be checked against golden scripts and audio without calling the APIs
+func SetFixtures(mode, dir string) error {
+	switch mode {
+	case FixturesOff, FixturesRecord, FixturesReplay:
+	default:
+		return fmt.Errorf("unknown fixtures mode %s, use record or replay", mode)
+	}
+	if mode == FixturesRecord {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	fixturesMu.Lock()
+	defer fixturesMu.Unlock()
+	fixturesMode, fixturesDir = mode, dir
+	return nil
+}
+
+// withFixture returns call's response, or in replay mode the recorded one;
+// fixtures are named for kind and a hash of key, the request, with the
+// request described in a .request.txt file to diff when a replay misses
+func withFixture(kind, ext string, key []byte, request string, call func() ([]byte, error)) ([]byte, error) {
+	fixturesMu.Lock()
+	mode, dir := fixturesMode, fixturesDir
+	fixturesMu.Unlock()
+	if mode == FixturesOff {
+		return call()
+	}
+
+	sum := sha256.Sum256(append([]byte(kind+"\x00"), key...))
+	name := filepath.Join(dir, fmt.Sprintf("%s-%s", kind, hex.EncodeToString(sum[:8])))
+	if mode == FixturesReplay {
+		data, err := os.ReadFile(name + "." + ext)
+		if errors.Is(err, os.ErrNotExist) {
+			recorded, _ := filepath.Glob(filepath.Join(dir, kind+"-*.request.txt"))
+			debugf(DebugPayloads, "fixtures: no %s fixture for:\n%s", kind, request)
+			return nil, fmt.Errorf("%w: %s, %d %s fixtures in %s, record again if the request changed", ErrNoFixture, filepath.Base(name), len(recorded), kind, dir)
+		}
+		debugf(DebugRequests, "fixtures: replayed %s", name+"."+ext)
+		return data, err
+	}
+
+	data, err := call()
+	if err != nil {
+		return data, err
+	}
+	if err := os.WriteFile(name+"."+ext, data, 0644); err != nil {
+		return data, err
+	}
+	if err := os.WriteFile(name+".request.txt", []byte(strings.TrimSpace(request)+"\n"), 0644); err != nil {
+		return data, err
+	}
+	log.Printf("fixture recorded: %s", name+"."+ext)
+	return data, nil
+}
+
+// fixtureSource identifies a document source in fixture keys; local files,
+// e.g. downloaded PDFs with temporary names, by their contents
+func fixtureSource(source string) string {
+	if path, ok := strings.CutPrefix(source, "file://"); ok {
+		if data, err := os.ReadFile(path); err == nil {
+			return "sha256:" + SHA256(data)
+		}
+	}
+	return source
+}
@@ -0,0 +1,241 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// MaxContinuations is how many follow-up calls continue a script cut off
+// at the model's output limit, 0 doesn't continue them
+var MaxContinuations = 2
+
+// continuationTail is how much of the end of a cut off script is quoted
+// in the request to continue it
+const continuationTail = 300
+
+// continuationPrompt asks for the rest of a script cut off after tail
+func continuationPrompt(tail string) string {
+	return fmt.Sprintf("The script was cut off at the output limit. Continue the script from where it stopped, right after:\n\n%s\n\nKeep the same format and speakers, don't repeat any of it, and finish the conversation as the instructions describe.", tail)
+}
+
+// Generation is a generated script and how Gemini finished it
+type Generation struct {
+	Model         string     `json:"model"`
+	FinishReason  string     `json:"finish_reason,omitempty"` // of the last response, e.g. stop or max_tokens; empty when replayed from fixtures
+	Continuations int        `json:"continuations,omitempty"` // follow-up calls for a script cut off at the output limit
+	Citations     []Citation `json:"citations,omitempty"`     // sources Gemini reports the script recites
+	Structured    bool       `json:"structured,omitempty"`    // generated as JSON turns with a response schema
+	Cache         string     `json:"cache,omitempty"`         // the document's Vertex AI context cache
+	Text          string     `json:"-"`
+}
+
+// Citation is a source Gemini reports part of a response recites
+type Citation struct {
+	URI     string `json:"uri,omitempty"`
+	Title   string `json:"title,omitempty"`
+	License string `json:"license,omitempty"`
+}
+
+// Truncated reports whether the script was still cut off at the output
+// limit after the continuations
+func (g Generation) Truncated() bool {
+	return g.FinishReason == "max_tokens"
+}
+
+// generate sends parts in a chat and, while the response is cut off at the
+// output limit, asks for the rest, joining the responses' text; structured
+// responses are JSON turns, rendered as lines
+func generate(ctx context.Context, cs *genai.ChatSession, modelName string, structured bool, parts ...genai.Part) (Generation, error) {
+	g := Generation{Model: modelName, Structured: structured}
+	for {
+		start := time.Now()
+		res, err := cs.SendMessage(ctx, parts...)
+		if blocked := blockedResponse(modelName, res, err); blocked != nil {
+			debugf(DebugRequests, "gemini: %v after %s", blocked, time.Since(start))
+			return g, blocked
+		}
+		if err != nil {
+			debugf(DebugRequests, "gemini: failed after %s: %v", time.Since(start), err)
+			return g, fmt.Errorf("unable to generate contents: %w", err)
+		}
+		debugResponse(res, start)
+		if len(res.Candidates) == 0 {
+			return g, fmt.Errorf("empty response from %s, no candidates", modelName)
+		}
+		c := res.Candidates[0]
+		g.FinishReason = reasonName(strings.TrimPrefix(c.FinishReason.String(), "FinishReason"))
+		g.Citations = addCitations(g.Citations, c)
+		text := candidateText(c)
+		if text == "" {
+			if len(g.Citations) > 0 {
+				return g, fmt.Errorf("empty response from %s, finish reason %s, citing %d sources", modelName, g.FinishReason, len(g.Citations))
+			}
+			return g, fmt.Errorf("empty response from %s, finish reason %s", modelName, g.FinishReason)
+		}
+		if structured {
+			if text, err = renderScript(text); err != nil {
+				return g, fmt.Errorf("unable to read script from %s, finish reason %s: %w", modelName, g.FinishReason, err)
+			}
+		}
+		g.Text = stitchContinuation(g.Text, text)
+		if !g.Truncated() || g.Continuations >= MaxContinuations {
+			break
+		}
+		g.Continuations++
+		log.Printf("script cut off at the output limit, continuing it (%d of %d)", g.Continuations, MaxContinuations)
+		parts = []genai.Part{genai.Text(continuationPrompt(scriptTail(g.Text)))}
+	}
+	if g.Truncated() && !structured && endsMidSentence(g.Text) {
+		// a turn cut off mid-sentence isn't spoken, renderScript already
+		// leaves out a structured one
+		g.Text = dropLastLine(g.Text)
+		log.Printf("script still cut off at the output limit after %d continuations, dropped its unfinished last turn", g.Continuations)
+	}
+	return g, nil
+}
+
+// scriptTail is the end of a script, from the start of a line, or of a
+// rune when the tail has no line break
+func scriptTail(text string) string {
+	if len(text) <= continuationTail {
+		return text
+	}
+	cut := len(text) - continuationTail
+	for cut < len(text) && !utf8.RuneStart(text[cut]) {
+		cut++
+	}
+	tail := text[cut:]
+	if i := strings.Index(tail, "\n"); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+	return tail
+}
+
+// endsMidSentence reports whether a script's last line stops without
+// ending its sentence
+func endsMidSentence(text string) bool {
+	last := strings.TrimSpace(lastLine(text))
+	if last == "" {
+		return false
+	}
+	for _, end := range []string{".", "!", "?", "…", "\"", "”", "'", "’", ")", "]", "*"} {
+		if strings.HasSuffix(last, end) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidateText is the text of a candidate's parts
+func candidateText(c *genai.Candidate) string {
+	if c.Content == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, p := range c.Content.Parts {
+		if t, ok := p.(genai.Text); ok {
+			b.WriteString(string(t))
+		}
+	}
+	return b.String()
+}
+
+// stitchContinuation appends a continuation to text: a continuation that
+// repeats the cut off line replaces it, words it repeats from the end of
+// text are dropped, and one that starts a turn starts a new line
+func stitchContinuation(text, continuation string) string {
+	if text == "" {
+		return continuation
+	}
+	cont := strings.TrimLeft(continuation, "\n")
+	if last := strings.TrimSpace(lastLine(text)); last != "" && strings.HasPrefix(strings.TrimSpace(cont), last) {
+		return dropLastLine(text) + strings.TrimLeft(cont, " ")
+	}
+	if n := overlapWords(text, cont); n > 0 {
+		cont = skipWords(cont, n)
+	}
+	if !strings.HasSuffix(text, "\n") && strings.HasPrefix(strings.TrimSpace(cont), "|") {
+		return text + "\n" + strings.TrimSpace(cont)
+	}
+	return text + cont
+}
+
+// minOverlapWords is the fewest words a continuation must repeat from the
+// end of the text to be taken as an overlap, rather than a coincidence
+const minOverlapWords = 3
+
+// overlapWords is how many of continuation's first words repeat the end of
+// text, 0 if fewer than minOverlapWords
+func overlapWords(text, continuation string) int {
+	tail, head := strings.Fields(lastLine(text)), strings.Fields(continuation)
+	for n := min(len(tail), len(head)); n >= minOverlapWords; n-- {
+		if slices.Equal(tail[len(tail)-n:], head[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// skipWords is s after its first n words, keeping what follows them
+func skipWords(s string, n int) string {
+	for ; n > 0; n-- {
+		s = strings.TrimLeft(s, " \t\n")
+		if i := strings.IndexAny(s, " \t\n"); i >= 0 {
+			s = s[i:]
+		} else {
+			s = ""
+		}
+	}
+	return s
+}
+
+// lastLine is text after its last newline, ignoring a trailing one
+func lastLine(text string) string {
+	text = strings.TrimRight(text, "\n")
+	return text[strings.LastIndex(text, "\n")+1:]
+}
+
+// dropLastLine is text without its last line, ignoring a trailing newline
+func dropLastLine(text string) string {
+	text = strings.TrimRight(text, "\n")
+	return text[:strings.LastIndex(text, "\n")+1]
+}
+
+// addCitations adds a candidate's citations to list, once each
+func addCitations(list []Citation, c *genai.Candidate) []Citation {
+	if c.CitationMetadata == nil {
+		return list
+	}
+	for _, cite := range c.CitationMetadata.Citations {
+		citation := Citation{URI: cite.URI, Title: cite.Title, License: cite.License}
+		seen := false
+		for _, existing := range list {
+			seen = seen || existing == citation
+		}
+		if !seen {
+			list = append(list, citation)
+		}
+	}
+	return list
+}
@@ -3,6 +3,7 @@ module github.com/ghchinoy/fabulae
 go 1.23.1
 
 require (
+	cloud.google.com/go/aiplatform v1.68.0
 	cloud.google.com/go/storage v1.44.0
 	cloud.google.com/go/texttospeech v1.8.1
 	cloud.google.com/go/vertexai v0.13.1
@@ -10,6 +11,8 @@ require (
 	github.com/k0kubun/go-ansi v0.0.0-20180517002512-3bf9e2903213
 	github.com/moutend/go-wav v0.0.0-20170820031854-56127fbbb7ba
 	github.com/schollz/progressbar/v3 v3.16.1
+	golang.org/x/net v0.30.0
+	golang.org/x/oauth2 v0.23.0
 	google.golang.org/api v0.199.0
 	google.golang.org/protobuf v1.35.1
 )
@@ -17,7 +20,6 @@ require (
 require (
 	cel.dev/expr v0.16.2 // indirect
 	cloud.google.com/go v0.116.0 // indirect
-	cloud.google.com/go/aiplatform v1.68.0 // indirect
 	cloud.google.com/go/auth v0.9.8 // indirect
 	cloud.google.com/go/auth/oauth2adapt v0.2.4 // indirect
 	cloud.google.com/go/compute/metadata v0.5.2 // indirect
@@ -57,8 +59,6 @@ require (
 	go.opentelemetry.io/otel/sdk/metric v1.30.0 // indirect
 	go.opentelemetry.io/otel/trace v1.30.0 // indirect
 	golang.org/x/crypto v0.28.0 // indirect
-	golang.org/x/net v0.30.0 // indirect
-	golang.org/x/oauth2 v0.23.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/term v0.25.0 // indirect
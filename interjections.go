@@ -0,0 +1,157 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	ttspb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+	"github.com/moutend/go-wav"
+)
+
+const (
+	// DefaultInterjectionRate is the share of turns that get an interjection
+	DefaultInterjectionRate = 0.3
+	// DefaultInterjectionGain is the volume of an interjection relative to the speaker
+	DefaultInterjectionGain = 0.35
+	// DefaultInterjectionOverlap is how long before the end of a turn an interjection ends
+	DefaultInterjectionOverlap = 300 * time.Millisecond
+)
+
+// interjections are the listener's reactions
+var interjections = []string{
+	"Mm-hmm.",
+	"Right.",
+	"Yeah.",
+	"Uh-huh.",
+	"Oh, wow.",
+	"Huh.",
+	"Ha!",
+	"Sure.",
+}
+
+// InterjectionOptions configures AddInterjections, zero values use the defaults
+type InterjectionOptions struct {
+	Rate    float64 // 0 to 1
+	Gain    float64
+	Overlap time.Duration
+	Seed    int64 // for repeatable choices; 0 is random
+}
+
+func (o InterjectionOptions) withDefaults() InterjectionOptions {
+	if o.Rate <= 0 {
+		o.Rate = DefaultInterjectionRate
+	}
+	if o.Gain <= 0 {
+		o.Gain = DefaultInterjectionGain
+	}
+	if o.Overlap <= 0 {
+		o.Overlap = DefaultInterjectionOverlap
+	}
+	if o.Seed == 0 {
+		o.Seed = time.Now().UnixNano()
+	}
+	return o
+}
+
+// AddInterjections mixes short reactions from the listening voice, like
+// "mm-hmm", quietly under the end of some turns, so the conversation sounds
+// less like ping-pong. The turn-by-turn wav files from Fabulae, alternating
+// voice1 and voice2, are rewritten in place
+func AddInterjections(ctx context.Context, turnfiles []string, voice1name, voice2name string, opts InterjectionOptions) error {
+	opts = opts.withDefaults()
+	voices := getSpeechVoicesForName([]string{voice1name, voice2name})
+	listeners := []*ttspb.VoiceSelectionParams{voices[voice2name], voices[voice1name]}
+	if listeners[0] == nil || listeners[1] == nil {
+		return fmt.Errorf("unknown voice %s or %s", voice1name, voice2name)
+	}
+
+	random := rand.New(rand.NewSource(opts.Seed))
+	// synthesized reactions are reused, by voice and text
+	cache := map[string]*wav.File{}
+	added := 0
+	// the last turn has no one listening afterwards
+	for i := 0; i < len(turnfiles)-1; i++ {
+		if random.Float64() >= opts.Rate {
+			continue
+		}
+		listener := listeners[i%2]
+		text := interjections[random.Intn(len(interjections))]
+
+		key := listener.Name + "|" + text
+		reaction, ok := cache[key]
+		if !ok {
+			audiobytes, err := synthesizeWithVoice(ctx, listener, text)
+			if err != nil {
+				return fmt.Errorf("unable to synthesize interjection: %w", err)
+			}
+			reaction = &wav.File{}
+			if err := wav.Unmarshal(audiobytes, reaction); err != nil {
+				return err
+			}
+			cache[key] = reaction
+		}
+
+		if err := mixIntoTail(turnfiles[i], reaction, opts); err != nil {
+			return err
+		}
+		debugf(DebugRequests, "interjection %q by %s under turn %d", text, listener.Name, i)
+		added++
+	}
+	log.Printf("added %d interjections to %d turns", added, len(turnfiles))
+	return nil
+}
+
+// mixIntoTail mixes a reaction into the end of a turn's wav file
+func mixIntoTail(turnfile string, reaction *wav.File, opts InterjectionOptions) error {
+	audiobytes, err := os.ReadFile(turnfile)
+	if err != nil {
+		return err
+	}
+	turn := &wav.File{}
+	if err := wav.Unmarshal(audiobytes, turn); err != nil {
+		return fmt.Errorf("can't decode %s: %w", turnfile, err)
+	}
+	if turn.SamplesPerSec() != reaction.SamplesPerSec() || turn.Channels() != reaction.Channels() ||
+		turn.BitsPerSample() != 16 || reaction.BitsPerSample() != 16 {
+		log.Printf("%s: audio format differs from the interjection, skipping", turnfile)
+		return nil
+	}
+
+	pcm := turn.Bytes()
+	overlap := len(silence(turn, opts.Overlap))
+	offset := len(pcm) - overlap - len(reaction.Bytes())
+	if offset < 0 {
+		// the turn is too short to hide a reaction under
+		return nil
+	}
+	mixPCM16(pcm[offset:], reaction.Bytes(), opts.Gain)
+
+	output, err := wav.New(turn.SamplesPerSec(), turn.BitsPerSample(), turn.Channels())
+	if err != nil {
+		return err
+	}
+	output.Write(pcm)
+	file, err := wav.Marshal(output)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(turnfile, file, 0644)
+}
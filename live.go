@@ -0,0 +1,262 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moutend/go-wav"
+	"golang.org/x/net/websocket"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// DefaultLiveModel is the Gemini Live model used for previews
+	DefaultLiveModel = "gemini-2.0-flash-live-preview-04-09"
+	// DefaultLivePreviewDuration is how much of a conversation is previewed
+	DefaultLivePreviewDuration = time.Minute
+	// liveSampleRate is the sample rate of Gemini Live audio output
+	liveSampleRate = 24000
+	// wordsPerMinute estimates speaking time, e.g. how many turns fill the preview
+	wordsPerMinute = 160
+)
+
+// liveInstruction keeps the Live model reading, not responding
+const liveInstruction = "You are a voice actor reading a podcast script. Read each message aloud exactly as written, with natural expression. Never answer, add to or comment on it."
+
+// LivePreviewOptions configures LivePreview, zero values use the defaults
+type LivePreviewOptions struct {
+	Model    string
+	Voices   [2]string // Gemini Live voices for the speakers, e.g. Puck and Kore
+	Duration time.Duration
+}
+
+func (o LivePreviewOptions) withDefaults() LivePreviewOptions {
+	if o.Model == "" {
+		o.Model = DefaultLiveModel
+	}
+	if o.Voices[0] == "" {
+		o.Voices[0] = "Puck"
+	}
+	if o.Voices[1] == "" {
+		o.Voices[1] = "Kore"
+	}
+	if o.Duration <= 0 {
+		o.Duration = DefaultLivePreviewDuration
+	}
+	return o
+}
+
+// liveMessage is a Gemini Live server message, only the fields used here
+type liveMessage struct {
+	SetupComplete *struct{} `json:"setupComplete"`
+	ServerContent *struct {
+		ModelTurn *struct {
+			Parts []struct {
+				InlineData *struct {
+					MimeType string `json:"mimeType"`
+					Data     string `json:"data"`
+				} `json:"inlineData"`
+			} `json:"parts"`
+		} `json:"modelTurn"`
+		TurnComplete bool `json:"turnComplete"`
+	} `json:"serverContent"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// LivePreview streams the start of a conversation through the Gemini Live
+// realtime API, with a session for each speaker, and writes about
+// opts.Duration of lower quality audio to outputfilename; it's an
+// experimental quick listen before the full render
+// The time until the first audio arrived is returned
+func LivePreview(ctx context.Context, projectID, location, conversation, tags, outputfilename string, opts LivePreviewOptions) (time.Duration, error) {
+	opts = opts.withDefaults()
+	turns := splitTurns(conversation)
+	if len(turns) == 0 {
+		return 0, errors.New("no turns in conversation")
+	}
+
+	// only send the turns that fill the preview
+	maxWords := int(opts.Duration.Minutes() * wordsPerMinute)
+	words := 0
+	for i, turn := range turns {
+		words += len(strings.Fields(turn))
+		if words >= maxWords {
+			turns = turns[:i+1]
+			break
+		}
+	}
+
+	sessions := [2]*websocket.Conn{}
+	for i, voice := range opts.Voices {
+		ws, err := dialLive(ctx, projectID, location, opts.Model, voice)
+		if err != nil {
+			return 0, err
+		}
+		defer ws.Close()
+		sessions[i] = ws
+	}
+
+	output, err := wav.New(liveSampleRate, 16, 1)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	var firstAudio time.Duration
+	maxBytes := int(opts.Duration.Seconds() * liveSampleRate * 2)
+	for i, turn := range turns {
+		_, text := parseStyle(strings.TrimSpace(stripParticipantTags(turn, tags)))
+		pcm, err := liveTurn(sessions[i%2], text, func() {
+			if firstAudio == 0 {
+				firstAudio = time.Since(start)
+				log.Printf("live preview: first audio after %s", firstAudio.Round(time.Millisecond))
+			}
+		})
+		if err != nil {
+			return firstAudio, fmt.Errorf("live preview turn %d: %w", i, err)
+		}
+		output.Write(pcm)
+		debugf(DebugRequests, "live preview: turn %d, %s, %d bytes", i, opts.Voices[i%2], len(pcm))
+		if len(output.Bytes()) >= maxBytes || ctx.Err() != nil {
+			break
+		}
+	}
+
+	file, err := wav.Marshal(output)
+	if err != nil {
+		return firstAudio, err
+	}
+	if err := os.WriteFile(outputfilename, file, 0644); err != nil {
+		return firstAudio, err
+	}
+	log.Printf("live preview written to %s in %s", outputfilename, time.Since(start).Round(time.Millisecond))
+	return firstAudio, nil
+}
+
+// dialLive opens a Gemini Live session on Vertex AI that speaks with voice
+func dialLive(ctx context.Context, projectID, location, model, voice string) (*websocket.Conn, error) {
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("wss://%s-aiplatform.googleapis.com/ws/google.cloud.aiplatform.v1beta1.LlmBidiService/BidiGenerateContent", location)
+	config, err := websocket.NewConfig(endpoint, "https://localhost")
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	debugf(DebugRequests, "live preview: connecting to %s, model %s, voice %s", endpoint, model, voice)
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to Gemini Live: %w", err)
+	}
+
+	setup := map[string]any{
+		"setup": map[string]any{
+			"model": fmt.Sprintf("projects/%s/locations/%s/publishers/google/models/%s", projectID, location, model),
+			"generationConfig": map[string]any{
+				"responseModalities": []string{"AUDIO"},
+				"speechConfig": map[string]any{
+					"voiceConfig": map[string]any{"prebuiltVoiceConfig": map[string]any{"voiceName": voice}},
+				},
+			},
+			"systemInstruction": map[string]any{"parts": []map[string]string{{"text": liveInstruction}}},
+		},
+	}
+	if err := websocket.JSON.Send(ws, setup); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	for {
+		msg, err := receiveLive(ws)
+		if err != nil {
+			ws.Close()
+			return nil, err
+		}
+		if msg.SetupComplete != nil {
+			return ws, nil
+		}
+	}
+}
+
+// liveTurn sends a turn's text and returns the audio spoken for it;
+// onAudio is called as audio arrives
+func liveTurn(ws *websocket.Conn, text string, onAudio func()) ([]byte, error) {
+	content := map[string]any{
+		"clientContent": map[string]any{
+			"turns":        []map[string]any{{"role": "user", "parts": []map[string]string{{"text": text}}}},
+			"turnComplete": true,
+		},
+	}
+	if err := websocket.JSON.Send(ws, content); err != nil {
+		return nil, err
+	}
+	pcm := []byte{}
+	for {
+		msg, err := receiveLive(ws)
+		if err != nil {
+			return nil, err
+		}
+		if msg.ServerContent == nil {
+			continue
+		}
+		if msg.ServerContent.ModelTurn != nil {
+			for _, part := range msg.ServerContent.ModelTurn.Parts {
+				if part.InlineData == nil || !strings.HasPrefix(part.InlineData.MimeType, "audio/pcm") {
+					continue
+				}
+				data, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+				if err != nil {
+					return nil, err
+				}
+				onAudio()
+				pcm = append(pcm, data...)
+			}
+		}
+		if msg.ServerContent.TurnComplete {
+			return pcm, nil
+		}
+	}
+}
+
+// receiveLive reads a server message, which may arrive as a text or binary frame
+func receiveLive(ws *websocket.Conn) (liveMessage, error) {
+	var msg liveMessage
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, err
+	}
+	if msg.Error != nil {
+		return msg, fmt.Errorf("gemini live: %s", msg.Error.Message)
+	}
+	return msg, nil
+}
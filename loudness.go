@@ -0,0 +1,217 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// ITU-R BS.1770 integrated loudness is measured on 400ms blocks overlapping
+// by 75%, gated at -70 LUFS and then 10 LU under the ungated loudness
+const (
+	loudnessBlock        = 0.4
+	loudnessStep         = 0.1
+	loudnessAbsoluteGate = -70
+	loudnessRelativeGate = -10
+)
+
+// normalizing stops within loudnessTolerance LU of the target, after at most
+// loudnessPasses, as limiting peaks lowers the loudness a little each time
+const (
+	loudnessTolerance = 0.5
+	loudnessPasses    = 3
+)
+
+// biquad is a second order IIR filter
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x1, f.x2, f.y1, f.y2 = x, f.x1, y, f.y1
+	return y
+}
+
+// lowpass is a second order low-pass filter at f0 Hz, from the Audio EQ
+// Cookbook, Butterworth at q 1/√2
+func lowpass(rate int, f0, q float64) biquad {
+	w := 2 * math.Pi * f0 / float64(rate)
+	alpha := math.Sin(w) / (2 * q)
+	a0 := 1 + alpha
+	return biquad{
+		b0: (1 - math.Cos(w)) / 2 / a0,
+		b1: (1 - math.Cos(w)) / a0,
+		b2: (1 - math.Cos(w)) / 2 / a0,
+		a1: -2 * math.Cos(w) / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+// highpass is a second order high-pass filter at f0 Hz, like lowpass
+func highpass(rate int, f0, q float64) biquad {
+	w := 2 * math.Pi * f0 / float64(rate)
+	alpha := math.Sin(w) / (2 * q)
+	a0 := 1 + alpha
+	return biquad{
+		b0: (1 + math.Cos(w)) / 2 / a0,
+		b1: -(1 + math.Cos(w)) / a0,
+		b2: (1 + math.Cos(w)) / 2 / a0,
+		a1: -2 * math.Cos(w) / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+// kWeighting is BS.1770's K-weighting at rate: a high shelf for the head,
+// then a high-pass, derived for any rate rather than only 48 kHz
+func kWeighting(rate int) (shelf, highpass biquad) {
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / float64(rate))
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf = biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / float64(rate))
+	a0 = 1 + k/q + k*k
+	highpass = biquad{b0: 1, b1: -2, b2: 1, a1: 2 * (k*k - 1) / a0, a2: (1 - k/q + k*k) / a0}
+	return shelf, highpass
+}
+
+// integratedLoudness is the integrated loudness of 16-bit audio in LUFS,
+// with every channel weighted equally, or -inf for silence
+func integratedLoudness(data []byte, rate, channels int) float64 {
+	frames := len(data) / (2 * channels)
+	// each channel's K-weighted energy in each 100ms step
+	step := int(loudnessStep * float64(rate))
+	steps := make([]float64, (frames+step-1)/max(1, step))
+	for c := 0; c < channels; c++ {
+		shelf, highpass := kWeighting(rate)
+		for i := 0; i < frames; i++ {
+			x := float64(int16(binary.LittleEndian.Uint16(data[(i*channels+c)*2:]))) / math.MaxInt16
+			y := highpass.filter(shelf.filter(x))
+			steps[i/step] += y * y
+		}
+	}
+	per := int(loudnessBlock / loudnessStep)
+	blockFrames := float64(per * step)
+	var blocks []float64
+	for i := 0; i+per <= len(steps); i++ {
+		sum := 0.0
+		for _, e := range steps[i : i+per] {
+			sum += e
+		}
+		blocks = append(blocks, sum/blockFrames)
+	}
+	if len(blocks) == 0 && len(steps) > 0 && frames > 0 {
+		// shorter than a block
+		sum := 0.0
+		for _, e := range steps {
+			sum += e
+		}
+		blocks = append(blocks, sum/float64(frames))
+	}
+	lufs := func(power float64) float64 { return -0.691 + 10*math.Log10(power) }
+	gated := func(threshold float64) float64 {
+		sum, n := 0.0, 0
+		for _, p := range blocks {
+			if lufs(p) > threshold {
+				sum += p
+				n++
+			}
+		}
+		if n == 0 {
+			return math.Inf(-1)
+		}
+		return lufs(sum / float64(n))
+	}
+	ungated := gated(loudnessAbsoluteGate)
+	if math.IsInf(ungated, -1) {
+		return ungated
+	}
+	return gated(max(loudnessAbsoluteGate, ungated+loudnessRelativeGate))
+}
+
+// limiter lookahead and release, so peaks are caught before they clip and
+// the gain recovers without pumping
+const (
+	limiterLookahead = 0.005
+	limiterRelease   = 0.050
+)
+
+// applyGain scales 16-bit audio by gain, in place, keeping its peaks under
+// ceiling, a linear level, with a lookahead limiter
+func applyGain(data []byte, rate, channels int, gain, ceiling float64) {
+	frames := len(data) / (2 * channels)
+	sample := func(i, c int) float64 {
+		return float64(int16(binary.LittleEndian.Uint16(data[(i*channels+c)*2:]))) / math.MaxInt16
+	}
+	// the gain each lookahead's stretch of frames needs to stay under the ceiling
+	chunk := max(1, int(limiterLookahead*float64(rate)))
+	need := make([]float64, (frames+chunk-1)/chunk)
+	for k := range need {
+		peak := 0.0
+		for i := k * chunk; i < min(frames, (k+1)*chunk); i++ {
+			for c := 0; c < channels; c++ {
+				peak = max(peak, math.Abs(sample(i, c)*gain))
+			}
+		}
+		need[k] = 1
+		if peak > ceiling {
+			need[k] = ceiling / peak
+		}
+	}
+	// reach a stretch's gain by the time it's played, then release
+	release := math.Exp(-1 / (limiterRelease * float64(rate)))
+	limit := 1.0
+	for i := 0; i < frames; i++ {
+		k := i / chunk
+		target := need[k]
+		if k+1 < len(need) {
+			target = min(target, need[k+1])
+		}
+		if target < limit {
+			limit = target
+		} else {
+			limit = target + (limit-target)*release
+		}
+		for c := 0; c < channels; c++ {
+			v := sample(i, c) * gain * limit * math.MaxInt16
+			v = math.Max(math.MinInt16, math.Min(math.MaxInt16, v))
+			binary.LittleEndian.PutUint16(data[(i*channels+c)*2:], uint16(int16(v)))
+		}
+	}
+}
+
+// normalizeLoudness scales 16-bit audio, in place, to target LUFS with its
+// peaks under peak dBFS, returning its loudness before and after; silence
+// is left as it is
+func normalizeLoudness(data []byte, rate, channels int, target, peak float64) (before, after float64) {
+	before = integratedLoudness(data, rate, channels)
+	after = before
+	for pass := 0; pass < loudnessPasses && !math.IsInf(after, -1) && math.Abs(target-after) > loudnessTolerance; pass++ {
+		applyGain(data, rate, channels, math.Pow(10, (target-after)/20), math.Pow(10, peak/20))
+		after = integratedLoudness(data, rate, channels)
+	}
+	return before, after
+}
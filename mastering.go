@@ -0,0 +1,295 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mastering defaults
+const (
+	DefaultHighPass          = 80   // Hz, under the lowest voices
+	DefaultDeEssFrequency    = 5000 // Hz, where sibilance starts
+	DefaultDeEssThreshold    = -30  // dBFS
+	DefaultDeEssRatio        = 4
+	DefaultCompressThreshold = -20 // dBFS
+	DefaultCompressRatio     = 2
+	DefaultCompressAttackMS  = 10
+	DefaultCompressReleaseMS = 150
+)
+
+const (
+	// maxHighPass keeps the high-pass under the voices' fundamentals
+	maxHighPass = 500
+	// the de-esser reacts quickly and turns sibilance down by at most
+	// maxDeEss dB, so esses are softened rather than lisped
+	deEssAttackMS  = 1
+	deEssReleaseMS = 60
+	maxDeEss       = 12
+	// compressKnee is the width of the compressor's soft knee in dB,
+	// centred on the threshold
+	compressKnee = 6
+)
+
+// Mastering is a chain of effects applied to a combined episode, in order:
+// a high-pass filter for rumble and plosives, a de-esser and a gentle
+// compressor. Effects left out are skipped
+type Mastering struct {
+	HighPass   float64     `json:"highpass_hz,omitempty"` // cutoff, 0 for none
+	DeEsser    *DeEsser    `json:"deesser,omitempty"`
+	Compressor *Compressor `json:"compressor,omitempty"`
+}
+
+// DeEsser turns down sibilance above Frequency when it's louder than
+// Threshold, leaving the rest of the voice alone; zero values use the
+// defaults
+type DeEsser struct {
+	Frequency float64 `json:"frequency_hz,omitempty"`
+	Threshold float64 `json:"threshold_db,omitempty"`
+	Ratio     float64 `json:"ratio,omitempty"`
+}
+
+// Compressor evens out the level of speech over Threshold by Ratio, with a
+// soft knee, then raises it by Makeup; zero values use the defaults
+type Compressor struct {
+	Threshold float64 `json:"threshold_db,omitempty"`
+	Ratio     float64 `json:"ratio,omitempty"`
+	Attack    float64 `json:"attack_ms,omitempty"`
+	Release   float64 `json:"release_ms,omitempty"`
+	Makeup    float64 `json:"makeup_db,omitempty"`
+}
+
+// DefaultMastering is every effect with its defaults
+var DefaultMastering = Mastering{HighPass: DefaultHighPass, DeEsser: &DeEsser{}, Compressor: &Compressor{}}
+
+func (d DeEsser) withDefaults() DeEsser {
+	if d.Frequency == 0 {
+		d.Frequency = DefaultDeEssFrequency
+	}
+	if d.Threshold == 0 {
+		d.Threshold = DefaultDeEssThreshold
+	}
+	if d.Ratio == 0 {
+		d.Ratio = DefaultDeEssRatio
+	}
+	return d
+}
+
+func (c Compressor) withDefaults() Compressor {
+	if c.Threshold == 0 {
+		c.Threshold = DefaultCompressThreshold
+	}
+	if c.Ratio == 0 {
+		c.Ratio = DefaultCompressRatio
+	}
+	if c.Attack == 0 {
+		c.Attack = DefaultCompressAttackMS
+	}
+	if c.Release == 0 {
+		c.Release = DefaultCompressReleaseMS
+	}
+	return c
+}
+
+// Validate checks the effects' settings are in range
+func (m Mastering) Validate() error {
+	var errs []error
+	if m.HighPass < 0 || m.HighPass > maxHighPass {
+		errs = append(errs, fmt.Errorf("high-pass %g Hz isn't 0 to %d", m.HighPass, maxHighPass))
+	}
+	if d := m.DeEsser; d != nil {
+		if d.Frequency < 0 {
+			errs = append(errs, fmt.Errorf("de-esser frequency %g Hz can't be negative", d.Frequency))
+		}
+		if d.Threshold > 0 {
+			errs = append(errs, fmt.Errorf("de-esser threshold %g dB is over full scale", d.Threshold))
+		}
+		if d.Ratio != 0 && d.Ratio < 1 {
+			errs = append(errs, fmt.Errorf("de-esser ratio %g is under 1", d.Ratio))
+		}
+	}
+	if c := m.Compressor; c != nil {
+		if c.Threshold > 0 {
+			errs = append(errs, fmt.Errorf("compressor threshold %g dB is over full scale", c.Threshold))
+		}
+		if c.Ratio != 0 && c.Ratio < 1 {
+			errs = append(errs, fmt.Errorf("compressor ratio %g is under 1", c.Ratio))
+		}
+		if c.Attack < 0 || c.Release < 0 {
+			errs = append(errs, errors.New("compressor attack and release can't be negative"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String describes the chain, e.g. for logs
+func (m Mastering) String() string {
+	var effects []string
+	if m.HighPass > 0 {
+		effects = append(effects, fmt.Sprintf("high-pass at %g Hz", m.HighPass))
+	}
+	if m.DeEsser != nil {
+		d := m.DeEsser.withDefaults()
+		effects = append(effects, fmt.Sprintf("de-esser above %g Hz at %g dB", d.Frequency, d.Threshold))
+	}
+	if m.Compressor != nil {
+		c := m.Compressor.withDefaults()
+		effects = append(effects, fmt.Sprintf("compressor %g:1 at %g dB", c.Ratio, c.Threshold))
+	}
+	if len(effects) == 0 {
+		return "no effects"
+	}
+	return strings.Join(effects, ", ")
+}
+
+// MasterEpisode applies a mastering chain to a wav episode, rewritten in
+// place
+func MasterEpisode(audiofile string, m Mastering) error {
+	if !strings.EqualFold(filepath.Ext(audiofile), "."+FormatWAV) {
+		return fmt.Errorf("mastering is applied to wav audio, %s isn't", filepath.Base(audiofile))
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	w, err := readWav16(audiofile, 0, 0)
+	if err != nil {
+		return err
+	}
+	data := w.Bytes()
+	m.process(data, w.SamplesPerSec(), w.Channels())
+	log.Printf("mastered %s: %s", filepath.Base(audiofile), m)
+	return os.WriteFile(audiofile, pcmAudio{w.SamplesPerSec(), 16, w.Channels(), data}.encode(), 0644)
+}
+
+// process runs the chain over 16-bit audio, in place
+func (m Mastering) process(data []byte, rate, channels int) {
+	frames := len(data) / (2 * channels)
+	x := make([]float64, frames*channels)
+	for i := range x {
+		x[i] = float64(int16(binary.LittleEndian.Uint16(data[i*2:]))) / math.MaxInt16
+	}
+
+	if m.HighPass > 0 {
+		for c := 0; c < channels; c++ {
+			f := highpass(rate, m.HighPass, math.Sqrt2/2)
+			for i := c; i < len(x); i += channels {
+				x[i] = f.filter(x[i])
+			}
+		}
+	}
+	if m.DeEsser != nil {
+		m.DeEsser.withDefaults().process(x, rate, channels)
+	}
+	if m.Compressor != nil {
+		m.Compressor.withDefaults().process(x, rate, channels)
+	}
+
+	for i, v := range x {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(int16(math.Round(max(-1, min(1, v))*math.MaxInt16))))
+	}
+}
+
+// envelope follows a level, rising over attack and falling over release
+type envelope struct {
+	attack, release, level float64
+}
+
+func newEnvelope(rate int, attackMS, releaseMS float64) envelope {
+	coefficient := func(ms float64) float64 {
+		if ms <= 0 {
+			return 0
+		}
+		return math.Exp(-1000 / (ms * float64(rate)))
+	}
+	return envelope{attack: coefficient(attackMS), release: coefficient(releaseMS)}
+}
+
+func (e *envelope) follow(v float64) float64 {
+	a := e.release
+	if v > e.level {
+		a = e.attack
+	}
+	e.level = a*e.level + (1-a)*v
+	return e.level
+}
+
+// decibels is a linear level in dBFS
+func decibels(v float64) float64 {
+	return 20 * math.Log10(max(v, 1e-9))
+}
+
+// process splits off the band above the frequency, the rest being what's
+// left so the two always add back to the original, and turns the band down
+// while it's over the threshold, detected across the channels together
+func (d DeEsser) process(x []float64, rate, channels int) {
+	if d.Frequency >= 0.45*float64(rate) {
+		// too close to the Nyquist frequency for there to be sibilance
+		return
+	}
+	filters := make([]biquad, channels)
+	for c := range filters {
+		filters[c] = highpass(rate, d.Frequency, math.Sqrt2/2)
+	}
+	env := newEnvelope(rate, deEssAttackMS, deEssReleaseMS)
+	band := make([]float64, channels)
+	for i := 0; i+channels <= len(x); i += channels {
+		peak := 0.0
+		for c := 0; c < channels; c++ {
+			band[c] = filters[c].filter(x[i+c])
+			peak = max(peak, math.Abs(band[c]))
+		}
+		over := decibels(env.follow(peak)) - d.Threshold
+		if over <= 0 {
+			continue
+		}
+		reduction := min(maxDeEss, over*(1-1/d.Ratio))
+		cut := 1 - math.Pow(10, -reduction/20)
+		for c := 0; c < channels; c++ {
+			x[i+c] -= cut * band[c]
+		}
+	}
+}
+
+// process compresses the channels together, by their peak level
+func (c Compressor) process(x []float64, rate, channels int) {
+	env := newEnvelope(rate, c.Attack, c.Release)
+	slope := 1/c.Ratio - 1
+	for i := 0; i+channels <= len(x); i += channels {
+		peak := 0.0
+		for ch := 0; ch < channels; ch++ {
+			peak = max(peak, math.Abs(x[i+ch]))
+		}
+		over := decibels(env.follow(peak)) - c.Threshold
+		gain := c.Makeup
+		switch {
+		case 2*over > compressKnee:
+			gain += slope * over
+		case 2*over > -compressKnee:
+			// within the knee the ratio eases in
+			gain += slope * (over + compressKnee/2) * (over + compressKnee/2) / (2 * compressKnee)
+		}
+		g := math.Pow(10, gain/20)
+		for ch := 0; ch < channels; ch++ {
+			x[i+ch] *= g
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// MathSpeaker reads LaTeX math in text as spoken English, e.g. $x^2 + y^2$
+// as "x squared plus y squared", instead of leaving text-to-speech to read
+// the symbols; it's a TextProcessor
+type MathSpeaker struct{}
+
+var (
+	// mathSpanRe matches delimited math: $$...$$, $...$, \(...\) and \[...\]
+	mathSpanRe = regexp.MustCompile(`\$\$(.+?)\$\$|\$([^$\n]+?)\$|\\\((.+?)\\\)|\\\[(.+?)\\\]`)
+	// plainWordRe matches a word, which math between dollar signs doesn't have
+	plainWordRe = regexp.MustCompile(`(^|[^\\A-Za-z])[A-Za-z]{3,}`)
+	// bareMathRe matches undelimited superscripts and subscripts, e.g. x^2 or a_{ij}
+	bareMathRe = regexp.MustCompile(`\b[A-Za-z0-9]+(?:[\^_](?:\{[^{}\s]*\}|[A-Za-z0-9]+))+`)
+	// bareCommandRe matches undelimited LaTeX, e.g. \frac{1}{2} or \alpha
+	bareCommandRe = regexp.MustCompile(`\\[A-Za-z]+(?:\{[^{}]*\}|[\^_]\{?[A-Za-z0-9]*\}?)*`)
+)
+
+// Process speaks the math in text
+func (MathSpeaker) Process(ctx context.Context, voice, text string) (string, error) {
+	return SpeakMath(text), nil
+}
+
+// SpeakMath replaces LaTeX math in text with spoken English; a $...$ span is
+// only math if it has LaTeX in it, or letters but no words, so prices
+// aren't changed
+func SpeakMath(text string) string {
+	text = mathSpanRe.ReplaceAllStringFunc(text, func(span string) string {
+		m := mathSpanRe.FindStringSubmatch(span)
+		latex := m[1] + m[2] + m[3] + m[4]
+		if m[2] != "" && !strings.ContainsAny(latex, `\^_{}=`) && (strings.IndexFunc(latex, unicode.IsLetter) < 0 || plainWordRe.MatchString(latex)) {
+			return span
+		}
+		return speakLatex(latex)
+	})
+	text = bareCommandRe.ReplaceAllStringFunc(text, speakLatex)
+	return bareMathRe.ReplaceAllStringFunc(text, speakLatex)
+}
+
+// spoken LaTeX commands
+var (
+	greekLetters = []string{"alpha", "beta", "gamma", "delta", "epsilon", "varepsilon", "zeta", "eta", "theta", "vartheta",
+		"iota", "kappa", "lambda", "mu", "nu", "xi", "pi", "rho", "sigma", "tau", "upsilon", "phi", "varphi", "chi", "psi", "omega",
+		"Gamma", "Delta", "Theta", "Lambda", "Xi", "Pi", "Sigma", "Phi", "Psi", "Omega"}
+	mathCommands = map[string]string{
+		"times": "times", "cdot": "times", "div": "divided by", "pm": "plus or minus", "mp": "minus or plus",
+		"leq": "is less than or equal to", "le": "is less than or equal to", "geq": "is greater than or equal to", "ge": "is greater than or equal to",
+		"neq": "is not equal to", "ne": "is not equal to", "approx": "is approximately", "sim": "is distributed as", "equiv": "is equivalent to",
+		"propto": "is proportional to", "ll": "is much less than", "gg": "is much greater than",
+		"in": "in", "notin": "not in", "subset": "a subset of", "subseteq": "a subset of", "cup": "union", "cap": "intersection",
+		"forall": "for all", "exists": "there exists", "infty": "infinity", "partial": "partial", "nabla": "the gradient of",
+		"to": "goes to", "rightarrow": "goes to", "mapsto": "maps to", "Rightarrow": "implies", "implies": "implies", "iff": "if and only if",
+		"ldots": "and so on", "cdots": "and so on", "dots": "and so on", "prime": "prime", "circ": "composed with",
+		"log": "log", "ln": "natural log of", "exp": "e to the", "sin": "sine", "cos": "cosine", "tan": "tangent",
+		"max": "max", "min": "min", "arg": "arg", "argmax": "arg max", "argmin": "arg min", "lim": "the limit", "det": "the determinant of",
+		"mathbb{R}": "the real numbers", "mathbb{N}": "the natural numbers", "mathbb{Z}": "the integers", "mathbb{E}": "the expected value of",
+	}
+	// commands that are spoken as their argument
+	mathStyles = map[string]bool{"mathbf": true, "mathrm": true, "mathit": true, "mathcal": true, "mathsf": true, "boldsymbol": true,
+		"text": true, "textrm": true, "textit": true, "operatorname": true, "mathbb": true}
+	// accents spoken after their argument, e.g. x hat
+	mathAccents = map[string]string{"hat": "hat", "bar": "bar", "tilde": "tilde", "vec": "vector", "dot": "dot", "overline": "bar"}
+	mathSymbols = map[rune]string{'+': "plus", '-': "minus", '=': "equals", '<': "is less than", '>': "is greater than",
+		'*': "times", '/': "over", '!': "factorial", ',': ",", '\'': "prime"}
+	// big operators with limits, e.g. the sum from i equals 1 to n of
+	mathOperators = map[string]string{"sum": "the sum", "prod": "the product", "int": "the integral", "oint": "the integral"}
+)
+
+// mathReader reads LaTeX math into words
+type mathReader struct {
+	s   []rune
+	pos int
+}
+
+// speakLatex reads LaTeX math as words
+func speakLatex(latex string) string {
+	r := &mathReader{s: []rune(strings.TrimSpace(latex))}
+	words := strings.Join(r.expression(0), " ")
+	return strings.ReplaceAll(strings.Join(strings.Fields(words), " "), " ,", ",")
+}
+
+// expression reads until the end, a closing brace or stop
+func (r *mathReader) expression(stop rune) []string {
+	words := []string{}
+	for r.pos < len(r.s) && r.s[r.pos] != '}' && r.s[r.pos] != stop {
+		words = append(words, r.term()...)
+	}
+	return words
+}
+
+// term reads an atom and its superscripts and subscripts
+func (r *mathReader) term() []string {
+	r.skipSpace()
+	grouped := r.pos < len(r.s) && r.s[r.pos] == '('
+	words := r.atom()
+	if grouped && len(words) > 1 && r.pos < len(r.s) && r.s[r.pos] == '^' {
+		words = append([]string{"the quantity"}, words...)
+	}
+	for r.pos < len(r.s) && (r.s[r.pos] == '^' || r.s[r.pos] == '_') {
+		op := r.s[r.pos]
+		r.pos++
+		arg := r.argument()
+		if op == '_' {
+			words = append(words, "sub")
+			words = append(words, arg...)
+			continue
+		}
+		switch strings.Join(arg, " ") {
+		case "2":
+			words = append(words, "squared")
+		case "3":
+			words = append(words, "cubed")
+		case "T", "top":
+			words = append(words, "transpose")
+		case "minus 1":
+			words = append(words, "inverse")
+		case "prime":
+			words = append(words, "prime")
+		default:
+			words = append(words, "to the")
+			words = append(words, arg...)
+		}
+	}
+	return words
+}
+
+// argument reads a braced group or a single atom
+func (r *mathReader) argument() []string {
+	r.skipSpace()
+	if r.pos < len(r.s) && r.s[r.pos] == '{' {
+		r.pos++
+		words := r.expression(0)
+		if r.pos < len(r.s) {
+			r.pos++ // }
+		}
+		return words
+	}
+	if r.pos < len(r.s) && unicode.IsDigit(r.s[r.pos]) {
+		r.pos++ // x^10 is x to the 1 then 0 in LaTeX
+		return []string{string(r.s[r.pos-1])}
+	}
+	return r.atom()
+}
+
+func (r *mathReader) skipSpace() {
+	for r.pos < len(r.s) && unicode.IsSpace(r.s[r.pos]) {
+		r.pos++
+	}
+}
+
+// atom reads a command, group, number, letter or symbol
+func (r *mathReader) atom() []string {
+	r.skipSpace()
+	if r.pos >= len(r.s) {
+		return nil
+	}
+	c := r.s[r.pos]
+	switch {
+	case c == '{':
+		return r.argument()
+	case c == '\\':
+		return r.command()
+	case c == '(':
+		r.pos++
+		words := r.expression(')')
+		if r.pos < len(r.s) && r.s[r.pos] == ')' {
+			r.pos++
+		}
+		return words
+	case unicode.IsDigit(c) || c == '.' && r.pos+1 < len(r.s) && unicode.IsDigit(r.s[r.pos+1]):
+		start := r.pos
+		for r.pos < len(r.s) && (unicode.IsDigit(r.s[r.pos]) || r.s[r.pos] == '.') {
+			r.pos++
+		}
+		return []string{string(r.s[start:r.pos])}
+	case unicode.IsLetter(c):
+		r.pos++
+		return []string{string(c)}
+	}
+	r.pos++
+	if word, ok := mathSymbols[c]; ok {
+		return []string{word}
+	}
+	return nil // brackets, bars and alignment
+}
+
+// command reads a LaTeX command and its arguments
+func (r *mathReader) command() []string {
+	r.pos++ // \
+	start := r.pos
+	for r.pos < len(r.s) && unicode.IsLetter(r.s[r.pos]) {
+		r.pos++
+	}
+	name := string(r.s[start:r.pos])
+	if name == "" { // \, \; \\ and escaped symbols
+		if r.pos < len(r.s) {
+			r.pos++
+			if word, ok := mathSymbols[r.s[r.pos-1]]; ok && r.s[r.pos-1] != ',' {
+				return []string{word}
+			}
+		}
+		return nil
+	}
+
+	switch {
+	case name == "frac" || name == "dfrac" || name == "tfrac":
+		numerator, denominator := r.argument(), r.argument()
+		words := append(numerator, "over")
+		return append(words, denominator...)
+	case name == "sqrt":
+		words := []string{"the square root of"}
+		r.skipSpace()
+		if r.pos < len(r.s) && r.s[r.pos] == '[' {
+			end := strings.IndexRune(string(r.s[r.pos:]), ']')
+			if end > 0 {
+				index := string(r.s[r.pos+1 : r.pos+end])
+				r.pos += end + 1
+				words = []string{"the", speakLatex(index) + "th", "root of"}
+				if index == "3" {
+					words = []string{"the cube root of"}
+				}
+			}
+		}
+		return append(words, r.argument()...)
+	case name == "left" || name == "right" || name == "big" || name == "Big" || name == "quad" || name == "qquad":
+		if (name == "left" || name == "right") && r.pos < len(r.s) {
+			r.pos++ // the delimiter
+		}
+		return nil
+	case mathStyles[name]:
+		if name == "mathbb" {
+			letter := strings.Join(r.argument(), "")
+			if word, ok := mathCommands["mathbb{"+letter+"}"]; ok {
+				return []string{word}
+			}
+			return []string{letter}
+		}
+		return r.argument()
+	case mathAccents[name] != "":
+		return append(r.argument(), mathAccents[name])
+	case mathOperators[name] != "":
+		words := []string{mathOperators[name]}
+		var lower, upper []string
+		for i := 0; i < 2 && r.pos < len(r.s) && (r.s[r.pos] == '_' || r.s[r.pos] == '^'); i++ {
+			op := r.s[r.pos]
+			r.pos++
+			if op == '_' {
+				lower = r.argument()
+			} else {
+				upper = r.argument()
+			}
+		}
+		if lower != nil {
+			words = append(append(words, "from"), lower...)
+		}
+		if upper != nil {
+			words = append(append(words, "to"), upper...)
+		}
+		return append(words, "of")
+	}
+	for _, letter := range greekLetters {
+		if name == letter {
+			return []string{strings.TrimPrefix(strings.ToLower(name), "var")}
+		}
+	}
+	if word, ok := mathCommands[name]; ok {
+		return []string{word}
+	}
+	return []string{name}
+}
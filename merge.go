@@ -0,0 +1,242 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WavMerger writes wav turns to a single wav as they're ready, in turn
+// order, so only the turn being written is held in memory. Turns that are
+// ready early wait on disk for those before them. A file output has its
+// header sizes written on Close; other writers, e.g. a Cloud Storage
+// object, get the streaming sizes players treat as "to the end"
+type WavMerger struct {
+	w         io.Writer
+	crossfade time.Duration
+	output    AudioFormat // the rate and channels turns are converted to, where set
+
+	mu       sync.Mutex
+	format   *pcmAudio // the output's, from the first turn unless set
+	pending  map[int]string
+	next     int
+	written  int64
+	tail     []byte // held back from the last turn to crossfade the next
+	last     int    // the last turn's size, converted
+	start    time.Duration
+	shift    time.Duration
+	timeline Timeline
+	err      error
+}
+
+// NewWavMerger merges turns to w, overlapping each pair by crossfade as
+// MixWavFiles does, or not at all if it's 0
+func NewWavMerger(w io.Writer, crossfade time.Duration) *WavMerger {
+	return &WavMerger{w: w, crossfade: crossfade, pending: map[int]string{}}
+}
+
+// Add gives the merger turn i, numbered from 0, as a wav file, which is
+// written once the turns before it have been and then removed. It's safe
+// to call as each turn is ready, from any goroutine
+func (m *WavMerger) Add(i int, filename string) error {
+	if !strings.EqualFold(filepath.Ext(filename), "."+FormatWAV) {
+		return fmt.Errorf("merging needs wav turns, %s isn't", filepath.Base(filename))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if _, ok := m.pending[i]; ok || i < m.next {
+		return fmt.Errorf("turn %d added twice", i)
+	}
+	m.pending[i] = filename
+	for {
+		file, ok := m.pending[m.next]
+		if !ok {
+			return nil
+		}
+		delete(m.pending, m.next)
+		if m.err = m.write(file); m.err != nil {
+			return m.err
+		}
+		if err := os.Remove(file); err != nil {
+			log.Printf("os.Remove: %v", err)
+		}
+		m.next++
+	}
+}
+
+// Close writes the held back audio and the header sizes, failing if a
+// turn is missing. It doesn't close the writer
+func (m *WavMerger) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if len(m.pending) > 0 {
+		return fmt.Errorf("turn %d is missing, %d turns after it weren't merged", m.next, len(m.pending))
+	}
+	if m.format == nil {
+		return errors.New("no audio files to combine")
+	}
+	if _, err := m.w.Write(m.tail); err != nil {
+		return err
+	}
+	m.written += int64(len(m.tail))
+	m.tail = nil
+	if m.written%2 == 1 {
+		// chunks are padded to an even size
+		if _, err := m.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if m.crossfade > 0 {
+		log.Printf("crossfaded %d turns, %s shorter", m.next, m.shift.Round(time.Millisecond))
+	}
+	if m.written > int64(wavStreamSize-36) {
+		return fmt.Errorf("%d bytes of audio is more than a wav file holds", m.written)
+	}
+	ws, ok := m.w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ws.Write(m.format.header(uint32(m.written))); err != nil {
+		return err
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
+
+// bytesWritten is how much audio has been merged so far
+func (m *WavMerger) bytesWritten() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.written
+}
+
+// Timeline maps times in the turns laid end to end to times in the merged
+// audio, once it's closed
+func (m *WavMerger) Timeline() Timeline {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.timeline
+}
+
+// Durations are the turns' durations, end to end, for timing transcripts
+func (m *WavMerger) Durations() []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	durations := make([]time.Duration, len(m.timeline.starts))
+	for i, s := range m.timeline.starts {
+		end := m.start
+		if i+1 < len(m.timeline.starts) {
+			end = m.timeline.starts[i+1]
+		}
+		durations[i] = end - s
+	}
+	return durations
+}
+
+// setFormat sets the output's format, rather than taking the first turn's
+func (m *WavMerger) setFormat(rate, bits, channels int) {
+	m.format = &pcmAudio{rate: rate, bits: bits, channels: channels}
+}
+
+// write appends a turn, converted to the output's format
+func (m *WavMerger) write(file string) error {
+	p, err := readPCM(file)
+	if err != nil {
+		return err
+	}
+	duration := p.duration()
+	if m.format == nil {
+		bits := p.bits
+		if m.crossfade > 0 {
+			// crossfades are mixed as 16-bit samples
+			bits = 16
+		}
+		format := m.output.apply(pcmAudio{rate: p.rate, bits: bits, channels: p.channels})
+		m.setFormat(format.rate, format.bits, format.channels)
+	}
+	if m.next == 0 {
+		size := uint32(wavStreamSize)
+		if _, ok := m.w.(io.WriteSeeker); ok {
+			size = 0
+		}
+		if _, err := m.w.Write(m.format.header(size)); err != nil {
+			return err
+		}
+	}
+	if !p.sameFormat(*m.format) {
+		if m.format.bits != 16 {
+			return fmt.Errorf("%s is %d Hz, %d-bit, %d channel, the episode %d-bit audio can't be converted to",
+				filepath.Base(file), p.rate, p.bits, p.channels, m.format.bits)
+		}
+		w, err := p.wavFile()
+		if err != nil {
+			return err
+		}
+		if w, err = convertWav(w, m.format.rate, m.format.channels); err != nil {
+			return err
+		}
+		p = pcmAudio{m.format.rate, 16, m.format.channels, w.Bytes()}
+	}
+
+	data := p.data
+	if m.next > 0 && m.crossfade > 0 {
+		n := m.crossfadeBytes(m.last, len(data))
+		n = min(n, len(m.tail))
+		crossfadePCM16(m.tail[len(m.tail)-n:], data[:n], m.format.channels)
+		data = data[n:]
+		m.shift += time.Duration(n/m.format.frameSize()) * time.Second / time.Duration(m.format.rate)
+	}
+	m.timeline.starts = append(m.timeline.starts, m.start)
+	m.timeline.shifts = append(m.timeline.shifts, m.shift)
+	m.start += duration
+	m.last = len(p.data)
+
+	// hold back what the next turn could crossfade with
+	held := 0
+	if m.crossfade > 0 {
+		held = min(m.crossfadeBytes(len(p.data), len(p.data)), len(data))
+	}
+	out := append(m.tail, data[:len(data)-held]...)
+	if _, err := m.w.Write(out); err != nil {
+		return err
+	}
+	m.written += int64(len(out))
+	m.tail = append([]byte{}, data[len(data)-held:]...)
+	return nil
+}
+
+// crossfadeBytes is the overlap between turns of prev and next bytes, at
+// most half of either, in whole frames
+func (m *WavMerger) crossfadeBytes(prev, next int) int {
+	n := min(int(m.crossfade.Seconds()*float64(m.format.rate*m.format.frameSize())), prev/2, next/2)
+	return n - n%m.format.frameSize()
+}
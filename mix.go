@@ -0,0 +1,317 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moutend/go-wav"
+)
+
+const (
+	// DefaultCrossfade is the overlap between turns with crossfading
+	DefaultCrossfade = 40 * time.Millisecond
+	// DefaultMusicGain is the music's level under speech, ducked from full
+	DefaultMusicGain = 0.15
+	// DefaultMusicLead is how long the music plays alone before and after speech
+	DefaultMusicLead = 4 * time.Second
+	// DefaultMusicFade is how long the music fades in at the start and out at the end
+	DefaultMusicFade = 2 * time.Second
+)
+
+// ducking reads speech in 10ms windows, ducking the music a little before
+// it starts and holding it down through pauses between turns
+const (
+	duckWindow    = 10 * time.Millisecond
+	duckThreshold = 0.01 // RMS of full scale, about -40 dBFS
+	duckLookahead = 100 * time.Millisecond
+	duckHold      = 600 * time.Millisecond
+	duckAttack    = 100 * time.Millisecond
+	duckRelease   = 500 * time.Millisecond
+)
+
+// Timeline maps times in files played end to end to times in their mix,
+// where crossfades overlap them
+type Timeline struct {
+	starts []time.Duration // each file's start, end to end
+	shifts []time.Duration // how much earlier it starts in the mix
+}
+
+// Time is when t, end to end, is in the mix
+func (tl Timeline) Time(t time.Duration) time.Duration {
+	var shift time.Duration
+	for i, s := range tl.starts {
+		// times come from the same durations, within rounding
+		if t < s-time.Millisecond {
+			break
+		}
+		shift = tl.shifts[i]
+	}
+	return t - shift
+}
+
+// RetimeTurns moves turns timed end to end to their times in the mix
+func (tl Timeline) RetimeTurns(turns []TranscriptTurn) {
+	for i := range turns {
+		turns[i].Start, turns[i].End = tl.Time(turns[i].Start), tl.Time(turns[i].End)
+		for j := range turns[i].Words {
+			w := &turns[i].Words[j]
+			w.Start, w.End = tl.Time(w.Start), tl.Time(w.End)
+		}
+	}
+}
+
+// RetimeChapters moves chapters timed end to end to their times in the mix
+func (tl Timeline) RetimeChapters(chapters []Chapter) {
+	for i := range chapters {
+		chapters[i].Start, chapters[i].End = tl.Time(chapters[i].Start), tl.Time(chapters[i].End)
+	}
+}
+
+// MixWavFiles combines wav files like CombineWavFiles, overlapping each pair
+// of turns by crossfade, at most half of either, with one fading out as the
+// next fades in rather than a hard cut. The Timeline retimes transcripts
+// and chapters timed from the files' durations. The episode is in format,
+// where it's set, rather than the files'
+func MixWavFiles(title string, audiolist []string, crossfade time.Duration, output AudioFormat) (_ string, _ Timeline, err error) {
+	// the files are temporary, removed even if they can't be combined
+	defer func() {
+		if err != nil {
+			RemoveFiles(audiolist...)
+		}
+	}()
+	if len(audiolist) == 0 {
+		return "", Timeline{}, errors.New("no audio files to combine")
+	}
+	// every turn is checked before any are combined, one at a time
+	var formats []pcmAudio
+	var errs []error
+	for _, audiofile := range audiolist {
+		p, err := readPCM(audiofile)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		formats = append(formats, pcmAudio{rate: p.rate, bits: p.bits, channels: p.channels})
+	}
+	if len(errs) > 0 {
+		return "", Timeline{}, fmt.Errorf("can't combine %d of %d files: %w", len(errs), len(audiolist), errors.Join(errs...))
+	}
+	format := formats[0]
+	for _, f := range formats {
+		if !f.sameFormat(formats[0]) {
+			// mixed formats, e.g. from different providers, are converted to
+			// 16-bit audio at the highest sample rate and channel count
+			format.rate, format.channels, format.bits = max(format.rate, f.rate), max(format.channels, f.channels), 16
+		}
+	}
+	if crossfade > 0 {
+		format.bits = 16
+	}
+	format = output.apply(format)
+	log.Printf("Samples per sec: %d, Bits per sample: %d, Channels: %d", format.rate, format.bits, format.channels)
+	log.Printf("%d wav files", len(audiolist))
+
+	outputfilename := fmt.Sprintf("%s_%s.wav", title, time.Now().Format(timeformat))
+	out, err := os.Create(outputfilename)
+	if err != nil {
+		return "", Timeline{}, err
+	}
+	defer func() {
+		if err != nil {
+			RemoveFiles(outputfilename)
+		}
+	}()
+	defer out.Close()
+	merger := NewWavMerger(out, crossfade)
+	merger.setFormat(format.rate, format.bits, format.channels)
+	for i, audiofile := range audiolist {
+		if err := merger.Add(i, audiofile); err != nil {
+			return "", Timeline{}, err
+		}
+	}
+	if err := merger.Close(); err != nil {
+		return "", Timeline{}, err
+	}
+	return outputfilename, merger.Timeline(), out.Close()
+}
+
+// crossfadePCM16 fades the 16-bit samples in tail out as those in head fade
+// in, with equal power, into tail
+func crossfadePCM16(tail, head []byte, channels int) {
+	frames := len(tail) / (2 * channels)
+	for i := 0; i+1 < len(tail) && i+1 < len(head); i += 2 {
+		x := float64(i/(2*channels)) / float64(frames) * math.Pi / 2
+		a := float64(int16(binary.LittleEndian.Uint16(tail[i:])))
+		b := float64(int16(binary.LittleEndian.Uint16(head[i:])))
+		mixed := a*math.Cos(x) + b*math.Sin(x)
+		mixed = math.Max(math.MinInt16, math.Min(math.MaxInt16, mixed))
+		binary.LittleEndian.PutUint16(tail[i:], uint16(int16(mixed)))
+	}
+}
+
+// MusicOptions configures AddMusic, zero values use the defaults
+type MusicOptions struct {
+	Music string        // wav file, looped under the episode
+	Gain  float64       // the music's level under speech, 0 to 1
+	Lead  time.Duration // music alone before and after speech
+	Fade  time.Duration // fade in at the start and out at the end
+}
+
+func (o MusicOptions) withDefaults() MusicOptions {
+	if o.Gain <= 0 {
+		o.Gain = DefaultMusicGain
+	}
+	if o.Lead <= 0 {
+		o.Lead = DefaultMusicLead
+	}
+	if o.Fade <= 0 {
+		o.Fade = DefaultMusicFade
+	}
+	return o
+}
+
+// LeadTime is how much later speech starts with the music, Lead or its
+// default
+func (o MusicOptions) LeadTime() time.Duration {
+	return o.withDefaults().Lead
+}
+
+// AddMusic plays music under a wav episode, rewritten in place: it fades in
+// and plays alone for the lead, ducks under speech, comes back up in longer
+// pauses and after the last turn, then fades out. Speech starts opts.Lead
+// later
+func AddMusic(audiofile string, opts MusicOptions) error {
+	opts = opts.withDefaults()
+	for _, f := range []string{audiofile, opts.Music} {
+		if !strings.EqualFold(filepath.Ext(f), "."+FormatWAV) {
+			return fmt.Errorf("music is mixed with wav audio, %s isn't", filepath.Base(f))
+		}
+	}
+	if opts.Gain > 1 {
+		return fmt.Errorf("music gain %g is more than full, use 0 to 1", opts.Gain)
+	}
+	speech, err := readWav16(audiofile, 0, 0)
+	if err != nil {
+		return err
+	}
+	music, err := readWav16(opts.Music, speech.SamplesPerSec(), speech.Channels())
+	if err != nil {
+		return err
+	}
+	musicData := music.Bytes()
+	if len(musicData) == 0 {
+		return fmt.Errorf("%s has no audio", filepath.Base(opts.Music))
+	}
+
+	lead := silence(speech, opts.Lead)
+	data := append(append(append([]byte{}, lead...), speech.Bytes()...), lead...)
+	gains := duckGains(speech, data, opts.Gain)
+	frameBytes := speech.BlockAlign()
+	frames := len(data) / frameBytes
+	window := max(int(duckWindow.Seconds()*float64(speech.SamplesPerSec())), 1)
+	fade := max(int(opts.Fade.Seconds()*float64(speech.SamplesPerSec())), 1)
+	for i := 0; i < frames; i++ {
+		// interpolate between the windows' gains, so ducking doesn't step
+		w, frac := i/window, float64(i%window)/float64(window)
+		g := gains[w]
+		if w+1 < len(gains) {
+			g += frac * (gains[w+1] - g)
+		}
+		g *= math.Min(1, math.Min(float64(i)/float64(fade), float64(frames-i)/float64(fade)))
+		offset := i * frameBytes
+		m := (offset % len(musicData)) / frameBytes * frameBytes
+		mixPCM16(data[offset:offset+frameBytes], musicData[m:min(m+frameBytes, len(musicData))], g)
+	}
+
+	file := pcmAudio{speech.SamplesPerSec(), 16, speech.Channels(), data}.encode()
+	log.Printf("music from %s under %s, ducked to %g", filepath.Base(opts.Music), filepath.Base(audiofile), opts.Gain)
+	return os.WriteFile(audiofile, file, 0644)
+}
+
+// readWav16 reads a wav file as 16-bit audio, converted to rate and
+// channels if they're set
+func readWav16(filename string, rate, channels int) (*wav.File, error) {
+	p, err := readPCM(filename)
+	if err != nil {
+		return nil, err
+	}
+	w, err := p.wavFile()
+	if err != nil {
+		return nil, err
+	}
+	if rate == 0 {
+		rate, channels = w.SamplesPerSec(), w.Channels()
+	}
+	if w.BitsPerSample() == 16 && w.SamplesPerSec() == rate && w.Channels() == channels {
+		return w, nil
+	}
+	return convertWav(w, rate, channels)
+}
+
+// duckGains is the music's gain for each duckWindow of 16-bit data, in
+// the format of f: gain where there's speech nearby, full elsewhere,
+// moving between them at the attack and release rates
+func duckGains(f *wav.File, data []byte, gain float64) []float64 {
+	windowBytes := int(duckWindow.Seconds() * float64(f.AvgBytesPerSec()))
+	windowBytes = max(windowBytes-windowBytes%f.BlockAlign(), f.BlockAlign())
+	windows := (len(data) + windowBytes - 1) / windowBytes
+	speaking := make([]bool, windows)
+	for w := range speaking {
+		sum, n := 0.0, 0
+		for i := w * windowBytes; i+1 < min((w+1)*windowBytes, len(data)); i += 2 {
+			v := float64(int16(binary.LittleEndian.Uint16(data[i:]))) / math.MaxInt16
+			sum += v * v
+			n++
+		}
+		speaking[w] = n > 0 && math.Sqrt(sum/float64(n)) > duckThreshold
+	}
+
+	// duck from the lookahead before speech through the hold after it
+	ahead, hold := int(duckLookahead/duckWindow), int(duckHold/duckWindow)
+	ducked := make([]bool, windows)
+	last := -hold - 1
+	for w := range speaking {
+		if speaking[w] {
+			last = w
+			for a := max(w-ahead, 0); a < w; a++ {
+				ducked[a] = true
+			}
+		}
+		ducked[w] = ducked[w] || w-last <= hold
+	}
+
+	gains := make([]float64, windows)
+	down := (1 - gain) / float64(duckAttack/duckWindow)
+	up := (1 - gain) / float64(duckRelease/duckWindow)
+	g := 1.0
+	for w := range gains {
+		if ducked[w] {
+			g = math.Max(gain, g-down)
+		} else {
+			g = math.Min(1, g+up)
+		}
+		gains[w] = g
+	}
+	return gains
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	aiplatform "cloud.google.com/go/aiplatform/apiv1beta1"
+	"cloud.google.com/go/aiplatform/apiv1beta1/aiplatformpb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GeminiModel is a Gemini model on Vertex AI and the inputs and outputs it supports
+type GeminiModel struct {
+	Name                 string `json:"name"`                   // e.g. gemini-1.5-pro
+	Version              string `json:"version,omitempty"`      // e.g. 002
+	LaunchStage          string `json:"launch_stage,omitempty"` // e.g. GA or PUBLIC_PREVIEW
+	PDFInput             bool   `json:"pdf_input"`
+	ControlledGeneration bool   `json:"controlled_generation"` // JSON responses with a response schema
+}
+
+// ModelRequirements are what a job needs from its model
+type ModelRequirements struct {
+	PDFInput             bool
+	ControlledGeneration bool
+}
+
+// ErrUnknownModel is returned for a model that isn't available
+var ErrUnknownModel = errors.New("unknown model")
+
+// geminiVersionRe matches the version in a Gemini model name, e.g. 1.5 in gemini-1.5-pro-002
+var geminiVersionRe = regexp.MustCompile(`^gemini-(\d+)\.(\d+)`)
+
+// ModelCapabilities returns what a Gemini model supports, from its name:
+// PDF input and controlled generation arrived with Gemini 1.5
+func ModelCapabilities(name string) GeminiModel {
+	model := GeminiModel{Name: name}
+	supported := true
+	if m := geminiVersionRe.FindStringSubmatch(name); m != nil {
+		major, _ := strconv.Atoi(m[1])
+		minor, _ := strconv.Atoi(m[2])
+		supported = major > 1 || (major == 1 && minor >= 5)
+	} else if name == "gemini-pro" || strings.HasPrefix(name, "gemini-pro-") {
+		// gemini-pro and gemini-pro-vision are Gemini 1.0
+		supported = false
+	}
+	model.PDFInput, model.ControlledGeneration = supported, supported
+	return model
+}
+
+// ListModels lists the Gemini models available on Vertex AI in location, by name
+func ListModels(ctx context.Context, projectID, location string) ([]GeminiModel, error) {
+	data, err := withFixture("vertex-models", "json", []byte(location), "list models, location "+location, func() ([]byte, error) {
+		models, err := listModels(ctx, projectID, location)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(models)
+	})
+	if err != nil {
+		return nil, err
+	}
+	models := []GeminiModel{}
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+func listModels(ctx context.Context, projectID, location string) ([]GeminiModel, error) {
+	client, err := aiplatform.NewModelGardenClient(ctx,
+		option.WithEndpoint(fmt.Sprintf("%s-aiplatform.googleapis.com:443", location)),
+		option.WithQuotaProject(projectID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create model garden client: %w", err)
+	}
+	defer client.Close()
+
+	debugf(DebugRequests, "vertex: list models, location %s", location)
+	models := []GeminiModel{}
+	it := client.ListPublisherModels(ctx, &aiplatformpb.ListPublisherModelsRequest{Parent: "publishers/google"})
+	for {
+		m, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to list models: %w", err)
+		}
+		name := m.Name[strings.LastIndex(m.Name, "/")+1:]
+		if !strings.HasPrefix(name, "gemini") {
+			continue
+		}
+		model := ModelCapabilities(name)
+		model.Version = m.VersionId
+		model.LaunchStage = m.LaunchStage.String()
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models, nil
+}
+
+// CheckModel checks that a model is one of models, or a version of one,
+// e.g. gemini-1.5-pro-002, and supports what the job needs
+func CheckModel(models []GeminiModel, name string, needs ModelRequirements) error {
+	found := false
+	for _, m := range models {
+		if name == m.Name || strings.HasPrefix(name, m.Name+"-") {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w %s", ErrUnknownModel, name)
+	}
+	model := ModelCapabilities(name)
+	if needs.PDFInput && !model.PDFInput {
+		return fmt.Errorf("model %s doesn't accept PDF input", name)
+	}
+	if needs.ControlledGeneration && !model.ControlledGeneration {
+		return fmt.Errorf("model %s doesn't support controlled generation", name)
+	}
+	return nil
+}
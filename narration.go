@@ -0,0 +1,367 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/moutend/go-wav"
+)
+
+const (
+	// DefaultSectionPause is the silence before each section announcement
+	DefaultSectionPause = 1500 * time.Millisecond
+	// DefaultParagraphPause is the silence between paragraphs
+	DefaultParagraphPause = 600 * time.Millisecond
+	// maxNarrationChars keeps each request under the Text-to-Speech input limit
+	maxNarrationChars = 4500
+	// narrationParallelism is the number of concurrent synthesis requests
+	narrationParallelism = 4
+)
+
+var (
+	markdownHeadingRe = regexp.MustCompile(`^#{1,6}\s+(.+?)\s*#*$`)
+	numberedHeadingRe = regexp.MustCompile(`^(\d+(\.\d+)*)\.?\s+(\p{Lu}.{0,78})$`)
+	setextUnderlineRe = regexp.MustCompile(`^(={3,}|-{3,})\s*$`)
+	sentenceEndRe     = regexp.MustCompile(`[.!?]["')\]]?\s+`)
+)
+
+// Section is a part of a document under a heading; text before the first
+// heading is a section without a title
+type Section struct {
+	Title      string
+	Paragraphs []string
+}
+
+// Chapter is the position of a section in the narration audio
+type Chapter struct {
+	Title    string
+	Start    time.Duration
+	End      time.Duration
+	Filename string // the chapter's own audio, with NarrationOptions.ChapterFiles
+}
+
+// MarshalJSON writes chapter times in seconds
+func (c Chapter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Title string  `json:"title"`
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		File  string  `json:"file,omitempty"`
+	}{c.Title, c.Start.Seconds(), c.End.Seconds(), c.Filename})
+}
+
+// NarrationOptions configures Narrate, zero values use the defaults
+type NarrationOptions struct {
+	Voice          string
+	SectionPause   time.Duration
+	ParagraphPause time.Duration
+	NoAnnounce     bool   // don't speak section headings
+	ChapterFiles   bool   // also write each chapter to its own file
+	Code           string // how code blocks are narrated, CodeDescribe or CodeSkip
+	SkipReferences bool   // leave out references, footnotes and page headers and footers
+}
+
+func (o NarrationOptions) withDefaults() NarrationOptions {
+	if o.Voice == "" {
+		o.Voice = "en-US-Chirp3-HD-Charon"
+	}
+	if o.SectionPause <= 0 {
+		o.SectionPause = DefaultSectionPause
+	}
+	if o.ParagraphPause <= 0 {
+		o.ParagraphPause = DefaultParagraphPause
+	}
+	return o
+}
+
+// ParseSections splits text into sections at headings: markdown # headings,
+// underlined headings, numbered headings like "2.1 Methods", and short lines
+// in capitals
+func ParseSections(text string) []Section {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	sections := []Section{}
+	current := Section{}
+	paragraph := []string{}
+
+	endParagraph := func() {
+		if len(paragraph) > 0 {
+			current.Paragraphs = append(current.Paragraphs, strings.Join(paragraph, " "))
+			paragraph = []string{}
+		}
+	}
+	startSection := func(title string) {
+		endParagraph()
+		if current.Title != "" || len(current.Paragraphs) > 0 {
+			sections = append(sections, current)
+		}
+		current = Section{Title: title}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		next := ""
+		if i+1 < len(lines) {
+			next = strings.TrimSpace(lines[i+1])
+		}
+		switch {
+		case line == "":
+			endParagraph()
+		case markdownHeadingRe.MatchString(line):
+			startSection(markdownHeadingRe.FindStringSubmatch(line)[1])
+		case len(paragraph) == 0 && setextUnderlineRe.MatchString(next):
+			startSection(line)
+			i++ // skip the underline
+		case len(paragraph) == 0 && isHeading(line):
+			startSection(line)
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	startSection("")
+	return sections
+}
+
+// isHeading reports whether a line at the start of a paragraph is a
+// numbered or capitalized heading
+func isHeading(line string) bool {
+	if strings.ContainsAny(line[len(line)-1:], ".,;:?!") {
+		return false
+	}
+	if numberedHeadingRe.MatchString(line) {
+		return true
+	}
+	// short lines in capitals, e.g. INTRODUCTION
+	letters := 0
+	for _, r := range line {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters >= 3 && len(line) <= 60
+}
+
+// narrationSegment is a piece of speech and the silence before it
+type narrationSegment struct {
+	section int
+	pause   time.Duration
+	text    string
+	audio   *wav.File
+}
+
+// Narrate reads text with a single voice, announcing each section's heading
+// after a pause, and writes the audio to outputfilename
+// The chapters returned give the start and end of each section in the audio
+func Narrate(ctx context.Context, text, outputfilename string, opts NarrationOptions) ([]Chapter, error) {
+	opts = opts.withDefaults()
+	// before sections, as comments in code look like headings
+	text = NarrateCode(text, opts.Code)
+	if opts.SkipReferences {
+		text = StripReferences(text)
+	}
+	sections := ParseSections(text)
+	if len(sections) == 0 {
+		return nil, errors.New("no text to narrate")
+	}
+	voice := getSpeechVoicesForName([]string{opts.Voice})[opts.Voice]
+	if voice == nil {
+		return nil, fmt.Errorf("unknown voice %s", opts.Voice)
+	}
+
+	segments := []*narrationSegment{}
+	for i, section := range sections {
+		pause := opts.SectionPause
+		if i == 0 {
+			pause = 0
+		}
+		if section.Title != "" && !opts.NoAnnounce {
+			segments = append(segments, &narrationSegment{section: i, pause: pause, text: section.Title + "."})
+			pause = opts.ParagraphPause
+		}
+		for _, paragraph := range section.Paragraphs {
+			for _, chunk := range splitText(paragraph, maxNarrationChars) {
+				segments = append(segments, &narrationSegment{section: i, pause: pause, text: chunk})
+				pause = 0
+			}
+			pause = opts.ParagraphPause
+		}
+	}
+	log.Printf("narrating %d sections in %d segments with %s", len(sections), len(segments), opts.Voice)
+
+	// synthesize concurrently, the first error stops the narration
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	limit := make(chan struct{}, narrationParallelism)
+	for i, segment := range segments {
+		wg.Add(1)
+		go func(i int, segment *narrationSegment) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			mu.Lock()
+			failed := firstErr != nil
+			mu.Unlock()
+			if failed {
+				return
+			}
+			text, err := preprocess(ctx, opts.Voice, segment.text)
+			var audiobytes []byte
+			if err == nil {
+				audiobytes, err = synthesizeWithVoice(ctx, voice, text)
+			}
+			if err == nil {
+				segment.audio = &wav.File{}
+				err = wav.Unmarshal(audiobytes, segment.audio)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("segment %d: %w", i, err)
+				}
+				mu.Unlock()
+			}
+		}(i, segment)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// assemble the audio, tracking where each section starts and ends
+	first := segments[0].audio
+	output, err := wav.New(first.SamplesPerSec(), first.BitsPerSample(), first.Channels())
+	if err != nil {
+		return nil, err
+	}
+	chapters := []Chapter{}
+	chapterAudio := []*wav.File{}
+	var position time.Duration
+	for i, segment := range segments {
+		if i == 0 || segments[i-1].section != segment.section {
+			title := sections[segment.section].Title
+			if title == "" {
+				title = fmt.Sprintf("Part %d", len(chapters)+1)
+			}
+			// the chapter starts after its pause, its own file doesn't include it
+			position += bytesDuration(first, len(silence(first, segment.pause)))
+			chapters = append(chapters, Chapter{Title: title, Start: position})
+			chapterwav, err := wav.New(first.SamplesPerSec(), first.BitsPerSample(), first.Channels())
+			if err != nil {
+				return nil, err
+			}
+			chapterAudio = append(chapterAudio, chapterwav)
+			output.Write(silence(first, segment.pause))
+		} else if segment.pause > 0 {
+			pause := silence(first, segment.pause)
+			output.Write(pause)
+			chapterAudio[len(chapterAudio)-1].Write(pause)
+			position += bytesDuration(first, len(pause))
+		}
+		output.Write(segment.audio.Bytes())
+		chapterAudio[len(chapterAudio)-1].Write(segment.audio.Bytes())
+		position += bytesDuration(first, len(segment.audio.Bytes()))
+		chapters[len(chapters)-1].End = position
+	}
+
+	if opts.ChapterFiles {
+		base := strings.TrimSuffix(outputfilename, filepath.Ext(outputfilename))
+		for i, chapterwav := range chapterAudio {
+			file, err := wav.Marshal(chapterwav)
+			if err != nil {
+				return nil, err
+			}
+			chapters[i].Filename = fmt.Sprintf("%s_%02d.wav", base, i+1)
+			if err := os.WriteFile(chapters[i].Filename, file, 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	file, err := wav.Marshal(output)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(outputfilename, file, 0644); err != nil {
+		return nil, err
+	}
+	log.Printf("narration written to %s: %s, %d chapters", outputfilename, position.Round(time.Second), len(chapters))
+	return chapters, nil
+}
+
+// WriteChapters writes chapters as JSON
+func WriteChapters(filename string, chapters []Chapter) error {
+	data, err := json.MarshalIndent(chapters, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// silence returns d of silent audio in the format of f
+func silence(f *wav.File, d time.Duration) []byte {
+	n := int(d.Seconds() * float64(f.AvgBytesPerSec()))
+	return make([]byte, n-n%f.BlockAlign())
+}
+
+// bytesDuration is the duration of n bytes of audio in the format of f
+func bytesDuration(f *wav.File, n int) time.Duration {
+	return time.Duration(float64(n) / float64(f.AvgBytesPerSec()) * float64(time.Second))
+}
+
+// splitText splits text into chunks of at most max bytes, at sentence ends
+// where possible
+func splitText(text string, max int) []string {
+	if len(text) <= max {
+		return []string{text}
+	}
+	chunks := []string{}
+	for len(text) > max {
+		cut := -1
+		for _, loc := range sentenceEndRe.FindAllStringIndex(text[:max], -1) {
+			cut = loc[1]
+		}
+		if cut <= 0 {
+			cut = strings.LastIndex(text[:max], " ") + 1
+		}
+		if cut <= 0 {
+			cut = max
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+		chunks = append(chunks, strings.TrimSpace(text[:cut]))
+		text = text[cut:]
+	}
+	if strings.TrimSpace(text) != "" {
+		chunks = append(chunks, strings.TrimSpace(text))
+	}
+	return chunks
+}
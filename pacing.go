@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// naturalPacing turns punctuation and sentence length into SSML breaks and rate
+var naturalPacing bool
+
+// SetNaturalPacing enables punctuation-aware pacing for voices that accept SSML
+func SetNaturalPacing(on bool) {
+	naturalPacing = on
+}
+
+const (
+	// sentences with more words are read a little slower, those with fewer a little faster
+	longSentenceWords  = 25
+	shortSentenceWords = 5
+)
+
+var (
+	// sentenceBoundaryRe matches closing punctuation followed by a space, so 5.2 isn't a boundary
+	sentenceBoundaryRe = regexp.MustCompile(`[.!?…]+["')\]]?(\s+|$)`)
+	// clauseBreakRe matches punctuation within a sentence that takes a breath
+	clauseBreakRe = regexp.MustCompile(`(,|;|:| [-–—] |—)\s*`)
+)
+
+// clauseBreaks are the pauses for punctuation within a sentence
+var clauseBreaks = map[string]string{
+	",": "150ms",
+	";": "250ms",
+	":": "250ms",
+	"-": "200ms",
+	"–": "200ms",
+	"—": "200ms",
+}
+
+// pacedSSML converts text to SSML, with breaks at clause and sentence
+// punctuation and a rate for each sentence based on its length
+func pacedSSML(text string) string {
+	parts := []string{}
+	for _, sentence := range splitSentences(text) {
+		sentence = strings.TrimSpace(sentence)
+		if sentence == "" {
+			continue
+		}
+
+		// breaks within the sentence
+		var b strings.Builder
+		last := 0
+		for _, loc := range clauseBreakRe.FindAllStringIndex(sentence, -1) {
+			mark := strings.TrimSpace(sentence[loc[0]:loc[1]])
+			b.WriteString(escapeSSML(sentence[last:loc[0]]))
+			if mark == "," || mark == ";" || mark == ":" {
+				b.WriteString(mark)
+			}
+			fmt.Fprintf(&b, `<break time="%s"/>`, clauseBreaks[mark])
+			last = loc[1]
+		}
+		b.WriteString(escapeSSML(sentence[last:]))
+		content := b.String()
+
+		words := len(strings.Fields(sentence))
+		switch {
+		case words > longSentenceWords:
+			content = fmt.Sprintf(`<prosody rate="95%%">%s</prosody>`, content)
+		case words <= shortSentenceWords:
+			content = fmt.Sprintf(`<prosody rate="105%%">%s</prosody>`, content)
+		}
+
+		// a longer breath after ellipses and questions
+		pause := "350ms"
+		switch {
+		case strings.HasSuffix(sentence, "...") || strings.HasSuffix(sentence, "…"):
+			pause = "600ms"
+		case strings.Contains(sentence[max(0, len(sentence)-3):], "?"):
+			pause = "450ms"
+		}
+		parts = append(parts, fmt.Sprintf(`<s>%s</s><break time="%s"/>`, content, pause))
+	}
+	ssml := strings.Join(parts, "")
+	// no break after the last sentence, the turns are spaced already
+	if i := strings.LastIndex(ssml, "<break "); i >= 0 && strings.HasSuffix(ssml, "/>") {
+		ssml = ssml[:i]
+	}
+	return ssml
+}
+
+// splitSentences splits text after sentence punctuation
+func splitSentences(text string) []string {
+	sentences := []string{}
+	last := 0
+	for _, loc := range sentenceBoundaryRe.FindAllStringIndex(text, -1) {
+		sentences = append(sentences, text[last:loc[1]])
+		last = loc[1]
+	}
+	if last < len(text) {
+		sentences = append(sentences, text[last:])
+	}
+	return sentences
+}
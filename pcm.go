@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/moutend/go-wav"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatExtensible = 0xfffe
+	// wavStreamSize is the data size written by streaming encoders that
+	// don't know it yet
+	wavStreamSize = 0xffffffff
+)
+
+// pcmAudio is decoded wav audio: whole frames of little-endian PCM samples
+type pcmAudio struct {
+	rate, bits, channels int
+	data                 []byte
+}
+
+// frameSize is the bytes in one sample for every channel
+func (p pcmAudio) frameSize() int {
+	return p.channels * p.bits / 8
+}
+
+// duration is the audio's length, to the sample
+func (p pcmAudio) duration() time.Duration {
+	return time.Duration(len(p.data)/p.frameSize()) * time.Second / time.Duration(p.rate)
+}
+
+// wavFile is the audio as a go-wav file, for mixing and converting
+func (p pcmAudio) wavFile() (*wav.File, error) {
+	w, err := wav.New(p.rate, p.bits, p.channels)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p.data); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// encode writes the audio as a canonical 44-byte header wav, with sizes
+// from the data
+func (p pcmAudio) encode() []byte {
+	return append(p.header(uint32(len(p.data))), p.data...)
+}
+
+// header is a canonical 44-byte wav header for size bytes of audio in the
+// format of p
+func (p pcmAudio) header(size uint32) []byte {
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	riffSize := size + 36
+	if size == wavStreamSize {
+		riffSize = wavStreamSize
+	}
+	binary.Write(&out, binary.LittleEndian, riffSize)
+	out.WriteString("WAVEfmt ")
+	for _, v := range []any{
+		uint32(16),
+		uint16(wavFormatPCM),
+		uint16(p.channels),
+		uint32(p.rate),
+		uint32(p.rate * p.frameSize()),
+		uint16(p.frameSize()),
+		uint16(p.bits),
+	} {
+		binary.Write(&out, binary.LittleEndian, v)
+	}
+	out.WriteString("data")
+	binary.Write(&out, binary.LittleEndian, size)
+	return out.Bytes()
+}
+
+// sameFormat is true if p and q have the same rate, sample size and channels
+func (p pcmAudio) sameFormat(q pcmAudio) bool {
+	return p.rate == q.rate && p.bits == q.bits && p.channels == q.channels
+}
+
+// decodeWav reads a wav file's PCM audio by walking its chunks, rather than
+// assuming a 44-byte header, so metadata chunks aren't read as audio. A
+// trailing partial frame is dropped, so appended audio stays aligned
+func decodeWav(data []byte) (pcmAudio, error) {
+	var p pcmAudio
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return p, errors.New("not a wav file")
+	}
+	haveFormat := false
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		switch {
+		case size <= len(body):
+			body = body[:size]
+		case id == "data" && (uint32(size) == wavStreamSize || size == 0):
+			// streamed, the data runs to the end of the file
+		default:
+			return p, fmt.Errorf("truncated %q chunk, %d bytes of %d", id, len(body), size)
+		}
+		switch id {
+		case "fmt ":
+			if err := p.readFormat(body); err != nil {
+				return p, err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return p, errors.New("data chunk before the fmt chunk")
+			}
+			if extra := len(body) % p.frameSize(); extra != 0 {
+				log.Printf("dropping %d bytes of a partial frame", extra)
+				body = body[:len(body)-extra]
+			}
+			p.data = body
+			return p, nil
+		}
+		pos += 8 + len(body) + len(body)%2
+	}
+	if !haveFormat {
+		return p, errors.New("no fmt chunk")
+	}
+	return p, errors.New("no data chunk")
+}
+
+// readFormat reads and checks a fmt chunk
+func (p *pcmAudio) readFormat(body []byte) error {
+	if len(body) < 16 {
+		return fmt.Errorf("fmt chunk is %d bytes, too short", len(body))
+	}
+	tag := binary.LittleEndian.Uint16(body)
+	if tag == wavFormatExtensible && len(body) >= 26 {
+		// the sub-format GUID starts with the format tag
+		tag = binary.LittleEndian.Uint16(body[24:])
+	}
+	if tag != wavFormatPCM {
+		return fmt.Errorf("format %#x isn't PCM", tag)
+	}
+	p.channels = int(binary.LittleEndian.Uint16(body[2:]))
+	p.rate = int(binary.LittleEndian.Uint32(body[4:]))
+	blockAlign := int(binary.LittleEndian.Uint16(body[12:]))
+	p.bits = int(binary.LittleEndian.Uint16(body[14:]))
+	switch {
+	case p.channels < 1 || p.channels > 8:
+		return fmt.Errorf("%d channels", p.channels)
+	case p.rate < 1000 || p.rate > 384000:
+		return fmt.Errorf("sample rate %d Hz", p.rate)
+	case p.bits != 8 && p.bits != 16 && p.bits != 24 && p.bits != 32:
+		return fmt.Errorf("unsupported %d bit audio", p.bits)
+	case blockAlign != p.frameSize():
+		return fmt.Errorf("block align %d doesn't match %d channels of %d bits", blockAlign, p.channels, p.bits)
+	}
+	return nil
+}
+
+// readPCM reads and decodes a wav file
+func readPCM(filename string) (pcmAudio, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return pcmAudio{}, err
+	}
+	p, err := decodeWav(data)
+	if err != nil {
+		return p, fmt.Errorf("%s: %w", filepath.Base(filename), err)
+	}
+	return p, nil
+}
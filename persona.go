@@ -0,0 +1,72 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// maxPersonaMemory is how many recent episodes a persona remembers
+const maxPersonaMemory = 10
+
+// resourceIDRe matches the IDs personas and shows are stored under, e.g. ada
+// or paper_trail
+var resourceIDRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Persona is a recurring host or expert, so a show's speakers keep their
+// voice and character from episode to episode
+type Persona struct {
+	Name         string   `json:"name"`                  // as spoken in the show
+	Voice        string   `json:"voice,omitempty"`       // e.g. en-US-Chirp3-HD-Charon
+	Personality  string   `json:"personality,omitempty"` // e.g. a curious, dry-witted former teacher
+	Catchphrases []string `json:"catchphrases,omitempty"`
+	Expertise    []string `json:"expertise,omitempty"`
+	// Memory are the titles of the persona's recent episodes, oldest first,
+	// for callbacks to earlier episodes
+	Memory []string `json:"memory,omitempty"`
+}
+
+// ValidatePersonaID checks the ID a persona is stored under
+func ValidatePersonaID(id string) error {
+	if !resourceIDRe.MatchString(id) {
+		return fmt.Errorf("invalid persona %q, use lowercase letters, digits, - and _", id)
+	}
+	return nil
+}
+
+// Remember adds an episode to the persona's memory, forgetting the oldest
+// beyond maxPersonaMemory
+func (p *Persona) Remember(episode string) {
+	if episode == "" || slices.Contains(p.Memory, episode) {
+		return
+	}
+	p.Memory = append(p.Memory, episode)
+	if len(p.Memory) > maxPersonaMemory {
+		p.Memory = p.Memory[len(p.Memory)-maxPersonaMemory:]
+	}
+}
+
+// WithPersonas casts personas as the host and then the expert, named in the
+// prompt as by HostNames
+func (d PromptData) WithPersonas(personas ...Persona) PromptData {
+	d.Personas = personas
+	d.HostNames = nil
+	for _, p := range personas {
+		d.HostNames = append(d.HostNames, p.Name)
+	}
+	return d
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ErrNoPiper is returned when the piper provider is used and piper isn't installed
+var ErrNoPiper = errors.New("piper not found, install it from https://github.com/rhasspy/piper or set PIPER_BINARY")
+
+// piperLengthScale slows or speeds speech for styles, piper has no other
+// expressive controls
+var piperLengthScale = map[string]string{
+	"slow":    "1.2",
+	"sad":     "1.1",
+	"calm":    "1.05",
+	"fast":    "0.85",
+	"excited": "0.92",
+}
+
+// Piper synthesizes offline with the piper neural text-to-speech engine, as
+// wav; it's for development, without cloud costs or credentials
+type Piper struct {
+	Binary string
+	// ModelDir holds voice models, e.g. en_US-lessac-medium.onnx, so voices
+	// can be named without the directory and extension; voices can
+	// also be paths to models
+	ModelDir    string
+	Concurrency int
+}
+
+// newPiperFromEnv configures Piper from the optional PIPER_BINARY and
+// PIPER_MODEL_DIR
+func newPiperFromEnv() (Synthesizer, error) {
+	binary := os.Getenv("PIPER_BINARY")
+	if binary == "" {
+		binary = "piper"
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, ErrNoPiper
+	}
+	return &Piper{Binary: path, ModelDir: os.Getenv("PIPER_MODEL_DIR"), Concurrency: runtime.NumCPU()}, nil
+}
+
+// Parallelism is the number of piper processes to run at once
+func (p *Piper) Parallelism() int {
+	return p.Concurrency
+}
+
+// model returns the model file for a voice name
+func (p *Piper) model(voice string) (string, error) {
+	candidates := []string{voice}
+	if p.ModelDir != "" && !strings.ContainsRune(voice, filepath.Separator) {
+		candidates = append(candidates, filepath.Join(p.ModelDir, voice), filepath.Join(p.ModelDir, voice+".onnx"))
+	}
+	for _, c := range candidates {
+		if info, err := os.Stat(c); err == nil && !info.IsDir() {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("no piper model for voice %s, set PIPER_MODEL_DIR or use a path to an .onnx model", voice)
+}
+
+// Synthesize returns wav audio from a local piper process
+func (p *Piper) Synthesize(ctx context.Context, voice, style, text string) (Audio, error) {
+	model, err := p.model(voice)
+	if err != nil {
+		return Audio{}, err
+	}
+	out, err := os.CreateTemp("", "fabulae-piper-*.wav")
+	if err != nil {
+		return Audio{}, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	args := []string{"--model", model, "--output_file", out.Name()}
+	if scale, ok := piperLengthScale[style]; ok {
+		args = append(args, "--length_scale", scale)
+	}
+	debugf(DebugRequests, "%s %s", p.Binary, strings.Join(args, " "))
+	debugf(DebugPayloads, "piper: text: %s", text)
+	start := time.Now()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Binary, args...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Audio{}, fmt.Errorf("piper: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	audiobytes, err := os.ReadFile(out.Name())
+	if err != nil {
+		return Audio{}, err
+	}
+	debugf(DebugRequests, "piper: voice %s, %d bytes in %s", voice, len(audiobytes), time.Since(start))
+	return Audio{audiobytes, FormatWAV}, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PodcastEpisode is a finished episode to publish to an existing show
+type PodcastEpisode struct {
+	Title       string
+	Summary     string // a sentence or two for podcast apps' lists
+	Description string // the show notes
+	Audio       string // local audio file
+	Artwork     string // optional JPEG or PNG, a local file or an http(s) URL
+	Transcript  string // optional plain text transcript, for hosts that take one
+	Publish     bool   // publish now, rather than leave a draft
+}
+
+// PodcastHost publishes episodes to a show on a podcast hosting service,
+// returning where the episode can be found
+type PodcastHost interface {
+	PublishEpisode(ctx context.Context, episode PodcastEpisode) (string, error)
+}
+
+// podcastHosts are the hosts configurable from the environment, with the
+// show to publish to, empty for the environment's
+var podcastHosts = map[string]func(show string) (PodcastHost, error){
+	"transistor": newTransistorFromEnv,
+	"buzzsprout": newBuzzsproutFromEnv,
+}
+
+// podcastHostClient allows for large audio uploads
+var podcastHostClient = &http.Client{Timeout: 30 * time.Minute}
+
+// PodcastHosts returns the names of the podcast hosts
+func PodcastHosts() []string {
+	names := []string{}
+	for name := range podcastHosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewPodcastHost returns a podcast host configured from the environment,
+// publishing to show if set
+func NewPodcastHost(host, show string) (PodcastHost, error) {
+	newHost, ok := podcastHosts[host]
+	if !ok {
+		return nil, fmt.Errorf("unknown podcast host %q, available: %s", host, strings.Join(PodcastHosts(), ", "))
+	}
+	return newHost(show)
+}
+
+// isURL reports whether artwork is an http(s) URL rather than a file
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// TextProcessor transforms a turn's text before it's spoken by a voice, e.g.
+// expanding numbers or localizing units
+type TextProcessor interface {
+	Process(ctx context.Context, voice, text string) (string, error)
+}
+
+// TextProcessorFunc is a function used as a TextProcessor
+type TextProcessorFunc func(ctx context.Context, voice, text string) (string, error)
+
+// Process calls f
+func (f TextProcessorFunc) Process(ctx context.Context, voice, text string) (string, error) {
+	return f(ctx, voice, text)
+}
+
+// CommandProcessor runs an external command for each turn, with the text on
+// stdin and the voice in FABULAE_VOICE, speaking its output instead
+type CommandProcessor struct {
+	Command []string `json:"command"`          // program and arguments
+	Voices  []string `json:"voices,omitempty"` // voices to process, all if empty
+}
+
+// Process runs the command if it applies to voice
+func (c CommandProcessor) Process(ctx context.Context, voice, text string) (string, error) {
+	if len(c.Command) == 0 || (len(c.Voices) > 0 && !slices.Contains(c.Voices, voice)) {
+		return text, nil
+	}
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Env = append(os.Environ(), "FABULAE_VOICE="+voice)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("preprocessor %s: %w: %s", c.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+var (
+	textProcessorsMu sync.Mutex
+	textProcessors   []TextProcessor
+)
+
+// AddTextProcessor adds a processor applied to each turn before synthesis,
+// after those already added
+func AddTextProcessor(p TextProcessor) {
+	textProcessorsMu.Lock()
+	defer textProcessorsMu.Unlock()
+	textProcessors = append(textProcessors, p)
+}
+
+// preprocess applies the text processors to a turn for a voice
+func preprocess(ctx context.Context, voice, text string) (string, error) {
+	textProcessorsMu.Lock()
+	processors := slices.Clone(textProcessors)
+	textProcessorsMu.Unlock()
+	if strings.TrimSpace(text) == "" {
+		return text, nil
+	}
+	for _, p := range processors {
+		processed, err := p.Process(ctx, voice, text)
+		if err != nil {
+			return "", err
+		}
+		if processed != text {
+			debugf(DebugPayloads, "preprocessed for %s: %q -> %q", voice, text, processed)
+		}
+		text = processed
+	}
+	return text, nil
+}
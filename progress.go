@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// progress event kinds
+const (
+	TurnStarted  = "turn_started"
+	TurnDone     = "turn_done"
+	BytesWritten = "bytes_written"
+)
+
+// ProgressEvent is a step in synthesizing an episode. The counts are
+// totals so far, so an event that's dropped loses nothing the next one
+// doesn't carry
+type ProgressEvent struct {
+	Kind    string
+	Turn    int // from 0, for TurnStarted and TurnDone
+	Turns   int
+	Done    int   // turns synthesized
+	Bytes   int64 // audio written, to the turns' files or, streaming, the episode
+	Elapsed time.Duration
+}
+
+// Percent is how much of the episode's turns are synthesized
+func (e ProgressEvent) Percent() float64 {
+	if e.Turns == 0 {
+		return 0
+	}
+	return 100 * float64(e.Done) / float64(e.Turns)
+}
+
+// Progress is told of each event, one at a time and in order, while turns
+// are synthesized; it should return quickly, as synthesis waits for it.
+// ProgressChannel suits a slow consumer
+type Progress func(ProgressEvent)
+
+type progressKey struct{}
+
+// WithProgress returns a context that reports the progress of episodes
+// synthesized with it to p
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// ProgressChannel is a Progress that sends events to ch without waiting:
+// while ch is full, events are dropped rather than holding up synthesis.
+// The function synthesizing returns once the last turn is done, whether or
+// not its event was delivered
+func ProgressChannel(ch chan<- ProgressEvent) Progress {
+	return func(e ProgressEvent) {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// progress counts an episode's turns and bytes for its context's Progress;
+// a nil progress reports nothing
+type progress struct {
+	report    Progress
+	streaming bool // bytes are counted as the episode is written, not the turns
+	start     time.Time
+
+	mu    sync.Mutex
+	turns int
+	done  int
+	bytes int64
+}
+
+// newProgress returns the context's progress for an episode of turns, or
+// nil if it has no Progress
+func newProgress(ctx context.Context, turns int, streaming bool) *progress {
+	report, _ := ctx.Value(progressKey{}).(Progress)
+	if report == nil {
+		return nil
+	}
+	return &progress{report: report, streaming: streaming, start: time.Now(), turns: turns}
+}
+
+// send reports an event; the caller holds p.mu
+func (p *progress) send(kind string, turn int) {
+	p.report(ProgressEvent{
+		Kind:    kind,
+		Turn:    turn,
+		Turns:   p.turns,
+		Done:    p.done,
+		Bytes:   p.bytes,
+		Elapsed: time.Since(p.start),
+	})
+}
+
+func (p *progress) started(turn int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.send(TurnStarted, turn)
+}
+
+// finished reports a turn written to a file of n bytes
+func (p *progress) finished(turn int, n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if !p.streaming {
+		p.bytes += int64(n)
+	}
+	p.send(TurnDone, turn)
+}
+
+// wrote reports the episode's size, when streaming, if it's grown
+func (p *progress) wrote(total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if total > p.bytes {
+		p.bytes = total
+		p.send(BytesWritten, -1)
+	}
+}
@@ -0,0 +1,59 @@
+Write a {{.Turns}} turn podcast-like conversation{{with .ShowName}} for the podcast "{{.}}"{{end}} between two people, a host (first speaker) and an expert (second speaker), about the top 5 topics based on the given paper. You're a podcast producer who can analyze a document, understand its topics, and come up with interesting, dynamic, and engaging conversations.{{if .TargetMinutes}} The conversation should take about {{.TargetMinutes}} minutes to read aloud, around {{.Words}} words.{{end}}
+
+Review the paper and extract the 5 most salient an interesting topics and derive questions for the host to ask the expert.
+{{- with .Audience}}
+
+The listeners are {{.}}, explain the topics at their level.{{end}}
+{{- with .Tone}}
+
+Keep the tone of the conversation {{.}}.{{end}}
+{{- range $i, $p := .Personas}}
+
+{{if eq $i 0}}The host{{else}}The expert{{end}}{{with $p.Name}}, {{.}},{{end}} is {{with $p.Personality}}{{.}}{{else}}a recurring voice on the show{{end}}; keep them in character.
+{{- with $p.Expertise}} They know {{range $j, $e := .}}{{if $j}}, {{end}}{{$e}}{{end}} well; let that shape their questions and answers.{{end}}
+{{- with $p.Catchphrases}} Have them use one of their catchphrases once or twice where it fits naturally: {{range $j, $e := .}}{{if $j}}; {{end}}"{{$e}}"{{end}}.{{end}}
+{{- with $p.Memory}} In earlier episodes they discussed: {{range $j, $e := .}}{{if $j}}; {{end}}{{$e}}{{end}}. If one of these is related, they can briefly refer back to it, without inventing what was said.{{end}}
+{{- end}}
+{{- with .PreviousEpisodes}}
+
+This is the latest episode of a running show. Earlier episodes were:
+{{range .}}
+- {{with .Title}}{{.}}{{else}}Episode {{.Number}}{{end}}: {{.Summary}}{{end}}
+
+Where one of these connects to today's paper, the hosts can refer back to it briefly and naturally, e.g. "as we discussed a few episodes ago", without claiming details beyond these summaries.{{end}}
+{{- if eq .Code "describe"}}
+
+When the paper includes source code, don't read it out or spell out its syntax; describe in plain words what the code does and why it matters.
+{{- else if eq .Code "skip"}}
+
+Don't read out, describe or discuss source code from the paper.{{end}}
+{{- if .SkipReferences}}
+
+Ignore the paper's reference list, citations, footnotes, acknowledgements and page headers and footers; don't discuss the bibliography or who is cited.{{end}}
+
+<Conversation Design Instructions>
+
+Do not repeat your instructions, just write the conversation.
+
+Have the host {{with .ShowName}}welcome listeners to {{.}}, {{end}}introduce the topic and state the title of the paper in the introduction statements.
+
+Insert a few to moderate amount disfluencies into the conversational flow for each speaker, in the way that the host and expert are familar with each other.
+
+The last question from the host should be something similar to this "To wrap up can you summarize the key contributions of this paper."
+
+The host should conclude the conversation by thanking the expert and mention the name of the paper again.
+
+{{if .HostNames}}The host is named {{index .HostNames 0}}{{if gt (len .HostNames) 1}} and the expert is named {{index .HostNames 1}}{{end}}, use the names naturally and sparingly.{{else}}Do not provide any human names for the host or the expert.{{end}}
+
+<Output Instructions>
+
+Output the conversation as alternating lines.
+
+Use the symbols "| [*]" to denote the first speaker and  "| [+]" to denote the second speaker. 
+
+example output:
+
+| [*] first speaker statatement or question
+| [+] second speaker comment and response
+| [*] first speaker statatement or question
+| [+] second speaker comment and response
@@ -0,0 +1,236 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrUnsigned is returned when verifying provenance without a signature
+var ErrUnsigned = errors.New("provenance isn't signed")
+
+// Provenance records how an episode was made, so its origin can be checked
+type Provenance struct {
+	Generator     string              `json:"generator"`               // e.g. fabulae v0.4.0
+	Created       time.Time           `json:"created"`                 // generation time
+	Title         string              `json:"title,omitempty"`         // the source's title, for catalogs
+	Source        string              `json:"source,omitempty"`        // source document URI or file
+	SourceSHA256  string              `json:"source_sha256,omitempty"` // when the source was read locally
+	ScriptSHA256  string              `json:"script_sha256"`           // the spoken script
+	Models        []string            `json:"models,omitempty"`        // generative models used for the script
+	Generation    *Generation         `json:"generation,omitempty"`    // how the script's generation finished, with its citations
+	Voices        []string            `json:"voices,omitempty"`        // text-to-speech voices, with providers
+	Substitutions []VoiceSubstitution `json:"substitutions,omitempty"` // turns spoken by fallback voices
+	Transcripts   []string            `json:"transcripts,omitempty"`   // transcript files, e.g. Markdown and SRT
+	Videos        []string            `json:"videos,omitempty"`        // where the episode was published as video, e.g. YouTube
+	AudioSHA256   string              `json:"audio_sha256"`            // audio samples, without metadata
+	PublicKey     string              `json:"public_key,omitempty"`    // base64 ed25519 public key
+	Signature     string              `json:"signature,omitempty"`     // base64 ed25519 signature of the rest
+}
+
+// SHA256 returns the hex SHA-256 of data, for provenance hashes
+func SHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ProvenanceManifest is the manifest file written next to an audio file
+func ProvenanceManifest(audiofile string) string {
+	return strings.TrimSuffix(audiofile, filepath.Ext(audiofile)) + ".provenance.json"
+}
+
+// WriteProvenance hashes an audio file's samples into p, signs it if key
+// isn't nil, and writes it into the file's metadata and a manifest file
+func WriteProvenance(audiofile string, p Provenance, key ed25519.PrivateKey) error {
+	hash, err := audioContentHash(audiofile)
+	if err != nil {
+		return err
+	}
+	p.AudioSHA256 = hash
+	p.PublicKey, p.Signature = "", ""
+	if key != nil {
+		p.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+		payload, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		p.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	}
+	record, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	// keep other metadata, e.g. a disclosure
+	tags, err := ReadTags(audiofile)
+	if err != nil {
+		return err
+	}
+	tags.Provenance = string(record)
+	if tags.Software == "" {
+		tags.Software = p.Generator
+	}
+	if tags.Created.IsZero() {
+		tags.Created = p.Created
+	}
+	if err := WriteTags(audiofile, tags); err != nil {
+		return err
+	}
+
+	manifest, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ProvenanceManifest(audiofile), append(manifest, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Printf("provenance written to %s and %s, signed: %t", audiofile, ProvenanceManifest(audiofile), key != nil)
+	return nil
+}
+
+// VerifyProvenance checks an audio file against its embedded provenance, or
+// its manifest file: the audio hash and, if trusted isn't nil, that the
+// signature is by that key; without a trusted key the embedded key is used,
+// which only shows the record wasn't changed after signing
+func VerifyProvenance(audiofile string, trusted ed25519.PublicKey) (Provenance, error) {
+	var p Provenance
+	tags, err := ReadTags(audiofile)
+	if err != nil {
+		return p, err
+	}
+	record := []byte(tags.Provenance)
+	if len(record) == 0 {
+		if record, err = os.ReadFile(ProvenanceManifest(audiofile)); err != nil {
+			return p, fmt.Errorf("no provenance in %s or its manifest", audiofile)
+		}
+	}
+	if err := json.Unmarshal(record, &p); err != nil {
+		return p, fmt.Errorf("invalid provenance: %w", err)
+	}
+
+	hash, err := audioContentHash(audiofile)
+	if err != nil {
+		return p, err
+	}
+	if hash != p.AudioSHA256 {
+		return p, fmt.Errorf("audio doesn't match its provenance: %s, recorded %s", hash, p.AudioSHA256)
+	}
+	if p.Signature == "" {
+		return p, ErrUnsigned
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(p.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return p, errors.New("invalid provenance public key")
+	}
+	if trusted != nil && !trusted.Equal(ed25519.PublicKey(publicKey)) {
+		return p, errors.New("provenance isn't signed by the trusted key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(p.Signature)
+	if err != nil {
+		return p, errors.New("invalid provenance signature")
+	}
+	unsigned := p
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return p, err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), payload, signature) {
+		return p, errors.New("provenance signature doesn't match")
+	}
+	return p, nil
+}
+
+// audioContentHash hashes the audio in a file, without its metadata: a wav
+// file's data chunk or an mp3 file without ID3 tags
+func audioContentHash(audiofile string) (string, error) {
+	data, err := os.ReadFile(audiofile)
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(filepath.Ext(audiofile)) {
+	case ".wav":
+		for pos := 12; pos+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+			end := min(pos+8+size, len(data))
+			if string(data[pos:pos+4]) == "data" {
+				return SHA256(data[pos+8 : end]), nil
+			}
+			pos = end + size%2
+		}
+		return "", fmt.Errorf("no audio in %s", audiofile)
+	case ".mp3":
+		return SHA256(stripID3(data)), nil
+	}
+	return "", fmt.Errorf("can't hash %s files", filepath.Ext(audiofile))
+}
+
+// ReadSigningKey reads an ed25519 private key from a PKCS #8 PEM file, e.g.
+// from openssl genpkey -algorithm ed25519
+func ReadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key in %s", filename)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an ed25519 key", filename)
+	}
+	return edkey, nil
+}
+
+// ReadPublicKey reads an ed25519 public key from a PKIX PEM file, e.g. from
+// openssl pkey -pubout
+func ReadPublicKey(filename string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key in %s", filename)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an ed25519 key", filename)
+	}
+	return edkey, nil
+}
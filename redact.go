@@ -0,0 +1,184 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/moutend/go-wav"
+	dlp "google.golang.org/api/dlp/v2"
+)
+
+const (
+	// bleepMarker replaces redacted text that's bleeped when spoken
+	bleepMarker = "{bleep}"
+	// bleepDuration and bleepFrequency are the bleep tone
+	bleepDuration  = 450 * time.Millisecond
+	bleepFrequency = 1000.0
+)
+
+// DefaultRedactInfoTypes are the DLP info types redacted unless set
+var DefaultRedactInfoTypes = []string{"PERSON_NAME", "PHONE_NUMBER", "EMAIL_ADDRESS", "CREDIT_CARD_NUMBER", "US_SOCIAL_SECURITY_NUMBER"}
+
+// redactPlaceholders are spoken in place of redacted text
+var redactPlaceholders = map[string]string{
+	"PERSON_NAME":               "redacted name",
+	"PHONE_NUMBER":              "redacted phone number",
+	"EMAIL_ADDRESS":             "redacted email",
+	"CREDIT_CARD_NUMBER":        "redacted card number",
+	"US_SOCIAL_SECURITY_NUMBER": "redacted number",
+	"STREET_ADDRESS":            "redacted address",
+}
+
+// RedactOptions configures Redact, zero values use the defaults
+type RedactOptions struct {
+	InfoTypes     []string // DLP info types, e.g. PERSON_NAME
+	Bleep         bool     // bleep redacted text instead of speaking a placeholder
+	MinLikelihood string   // DLP likelihood, e.g. POSSIBLE or LIKELY
+}
+
+func (o RedactOptions) withDefaults() RedactOptions {
+	if len(o.InfoTypes) == 0 {
+		o.InfoTypes = DefaultRedactInfoTypes
+	}
+	if o.MinLikelihood == "" {
+		o.MinLikelihood = "POSSIBLE"
+	}
+	return o
+}
+
+// Redact replaces personal information in a transcript, e.g. names, phone
+// numbers and emails, found by Sensitive Data Protection (DLP), with spoken
+// placeholders or bleeps
+func Redact(ctx context.Context, projectID, transcript string, opts RedactOptions) (string, error) {
+	opts = opts.withDefaults()
+	srv, err := dlp.NewService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to create DLP client: %w", err)
+	}
+
+	infoTypes := []*dlp.GooglePrivacyDlpV2InfoType{}
+	transformations := []*dlp.GooglePrivacyDlpV2InfoTypeTransformation{}
+	for _, name := range opts.InfoTypes {
+		infoType := &dlp.GooglePrivacyDlpV2InfoType{Name: name}
+		infoTypes = append(infoTypes, infoType)
+		replacement := bleepMarker
+		if !opts.Bleep {
+			replacement = redactPlaceholders[name]
+			if replacement == "" {
+				replacement = "redacted"
+			}
+		}
+		transformations = append(transformations, &dlp.GooglePrivacyDlpV2InfoTypeTransformation{
+			InfoTypes: []*dlp.GooglePrivacyDlpV2InfoType{infoType},
+			PrimitiveTransformation: &dlp.GooglePrivacyDlpV2PrimitiveTransformation{
+				ReplaceConfig: &dlp.GooglePrivacyDlpV2ReplaceValueConfig{
+					NewValue: &dlp.GooglePrivacyDlpV2Value{StringValue: replacement},
+				},
+			},
+		})
+	}
+
+	req := &dlp.GooglePrivacyDlpV2DeidentifyContentRequest{
+		Item: &dlp.GooglePrivacyDlpV2ContentItem{Value: transcript},
+		InspectConfig: &dlp.GooglePrivacyDlpV2InspectConfig{
+			InfoTypes:     infoTypes,
+			MinLikelihood: opts.MinLikelihood,
+		},
+		DeidentifyConfig: &dlp.GooglePrivacyDlpV2DeidentifyConfig{
+			InfoTypeTransformations: &dlp.GooglePrivacyDlpV2InfoTypeTransformations{Transformations: transformations},
+		},
+	}
+	debugf(DebugRequests, "dlp: redacting %d characters, %s", len(transcript), strings.Join(opts.InfoTypes, ", "))
+	res, err := srv.Projects.Content.Deidentify("projects/"+projectID, req).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to redact transcript: %w", err)
+	}
+	if res.Overview != nil {
+		log.Printf("redacted %d bytes of personal information", res.Overview.TransformedBytes)
+	}
+	return res.Item.Value, nil
+}
+
+// withBleeps synthesizes the text around bleep markers and puts a tone in
+// their place; audio that can't be spliced, e.g. mp3, says "bleep" instead
+func withBleeps(text string, synth func(string) (Audio, error)) (Audio, error) {
+	if !strings.Contains(text, bleepMarker) {
+		return synth(text)
+	}
+	spoken := func() (Audio, error) {
+		return synth(strings.ReplaceAll(text, bleepMarker, "bleep"))
+	}
+
+	// nil segments are bleeps
+	segments := [][]byte{}
+	var format *wav.File
+	for i, part := range strings.Split(text, bleepMarker) {
+		if i > 0 {
+			segments = append(segments, nil)
+		}
+		if !strings.ContainsFunc(part, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+			continue
+		}
+		audio, err := synth(strings.TrimSpace(part))
+		if err != nil {
+			return Audio{}, err
+		}
+		w := &wav.File{}
+		if audio.Format != FormatWAV || wav.Unmarshal(audio.Data, w) != nil || w.BitsPerSample() != 16 {
+			return spoken()
+		}
+		if format == nil {
+			format = w
+		}
+		segments = append(segments, w.Bytes())
+	}
+	if format == nil {
+		return spoken()
+	}
+
+	output, err := wav.New(format.SamplesPerSec(), 16, format.Channels())
+	if err != nil {
+		return Audio{}, err
+	}
+	for _, segment := range segments {
+		if segment == nil {
+			segment = bleep(output)
+		}
+		output.Write(segment)
+	}
+	data, err := wav.Marshal(output)
+	return Audio{data, FormatWAV}, err
+}
+
+// bleep returns a tone in the format of f, which must be 16-bit
+func bleep(f *wav.File) []byte {
+	frames := int(bleepDuration.Seconds() * float64(f.SamplesPerSec()))
+	data := make([]byte, 0, frames*f.Channels()*2)
+	for i := 0; i < frames; i++ {
+		v := int16(0.3 * math.MaxInt16 * math.Sin(2*math.Pi*bleepFrequency*float64(i)/float64(f.SamplesPerSec())))
+		for c := 0; c < f.Channels(); c++ {
+			data = binary.LittleEndian.AppendUint16(data, uint16(v))
+		}
+	}
+	return data
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	// referencesHeadingRe matches the heading of a reference list
+	referencesHeadingRe = regexp.MustCompile(`(?i)^(#{1,6}\s*)?(\d+\.?\s+)?(references|bibliography|works cited|literature cited|citations)\s*$`)
+	// afterReferencesRe matches headings of sections that follow the references
+	afterReferencesRe = regexp.MustCompile(`(?i)^(#{1,6}\s*)?([A-Z]\.?\s+)?(appendix|appendices|supplementary)\b`)
+	// pageNumberRe matches page number lines, e.g. 12 or Page 3 of 10
+	pageNumberRe = regexp.MustCompile(`(?i)^(page\s+)?\d{1,4}(\s+(of|/)\s+\d{1,4})?$`)
+	// footnoteRe matches footnote lines, e.g. [^1]: or ¹ at the start
+	footnoteRe = regexp.MustCompile(`^(\[\^[^\]]+\]:|[¹²³⁴⁵⁶⁷⁸⁹⁰]+\s)`)
+	// citationRe matches inline citations and footnote marks, e.g. [12], [3, 4-6], [^2] and (Smith et al., 2020)
+	citationRe = regexp.MustCompile(`\s?\[(\d+(\s?[,–-]\s?\d+)*|\^[^\]]+)\]|\s?\([A-Z][\pL-]+( et al\.| and [A-Z][\pL-]+)?,? \d{4}[a-z]?(; [^()]{1,80})?\)`)
+)
+
+// minRepeatedLines is how often a line repeats to be a page header or footer
+const minRepeatedLines = 3
+
+// StripReferences removes what isn't worth narrating from a document's text:
+// the reference list, up to any appendix, footnotes, inline citations, page
+// numbers and page headers and footers, lines repeated on every page
+func StripReferences(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	counts := map[string]int{}
+	for _, line := range lines {
+		// with a letter, so markdown rules and code fences aren't headers
+		if line = strings.TrimSpace(line); len(line) <= 80 && strings.IndexFunc(line, unicode.IsLetter) >= 0 {
+			counts[line]++
+		}
+	}
+
+	kept := []string{}
+	inReferences := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(strings.Trim(line, "\f"))
+		switch {
+		case referencesHeadingRe.MatchString(trimmed):
+			inReferences = true
+			continue
+		case inReferences && afterReferencesRe.MatchString(trimmed):
+			inReferences = false
+		case inReferences:
+			continue
+		case trimmed == "":
+			kept = append(kept, "")
+			continue
+		case pageNumberRe.MatchString(trimmed), footnoteRe.MatchString(trimmed), counts[trimmed] >= minRepeatedLines:
+			continue
+		}
+		kept = append(kept, citationRe.ReplaceAllString(line, ""))
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n")) + "\n"
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// relaxedSafetySettings block only content with a high probability of harm,
+// in every category; lower thresholds, such as BLOCK_NONE, need approval
+var relaxedSafetySettings = []*genai.SafetySetting{
+	{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockOnlyHigh},
+	{Category: genai.HarmCategoryDangerousContent, Threshold: genai.HarmBlockOnlyHigh},
+	{Category: genai.HarmCategoryHateSpeech, Threshold: genai.HarmBlockOnlyHigh},
+	{Category: genai.HarmCategorySexuallyExplicit, Threshold: genai.HarmBlockOnlyHigh},
+}
+
+// harmCategories are the harm categories' names in BlockedError
+var harmCategories = map[genai.HarmCategory]string{
+	genai.HarmCategoryHarassment:       "harassment",
+	genai.HarmCategoryDangerousContent: "dangerous_content",
+	genai.HarmCategoryHateSpeech:       "hate_speech",
+	genai.HarmCategorySexuallyExplicit: "sexually_explicit",
+}
+
+// BlockedError is a generation Gemini refused, for safety or as prohibited
+// content, with the categories that blocked it
+type BlockedError struct {
+	Model      string   `json:"model"`
+	Prompt     bool     `json:"prompt"`               // the document and prompt were blocked, rather than the response
+	Reason     string   `json:"reason"`               // e.g. safety, blocklist, prohibited_content or spii
+	Categories []string `json:"categories,omitempty"` // e.g. harassment
+}
+
+func (e *BlockedError) Error() string {
+	what := "the response"
+	if e.Prompt {
+		what = "the document"
+	}
+	msg := fmt.Sprintf("%s blocked %s: %s", e.Model, what, e.Reason)
+	if len(e.Categories) > 0 {
+		msg += " (" + strings.Join(e.Categories, ", ") + ")"
+	}
+	return msg
+}
+
+// blockedResponse is a BlockedError for genai's, or for a response that
+// was stopped without content, otherwise nil
+func blockedResponse(modelName string, res *genai.GenerateContentResponse, err error) *BlockedError {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		if blocked.PromptFeedback != nil {
+			return &BlockedError{
+				Model:      modelName,
+				Prompt:     true,
+				Reason:     reasonName(strings.TrimPrefix(blocked.PromptFeedback.BlockReason.String(), "BlockedReason")),
+				Categories: blockedCategories(blocked.PromptFeedback.SafetyRatings),
+			}
+		}
+		return candidateBlocked(modelName, blocked.Candidate)
+	}
+	if err != nil || res == nil || len(res.Candidates) == 0 {
+		return nil
+	}
+	c := res.Candidates[0]
+	switch c.FinishReason {
+	case genai.FinishReasonSafety, genai.FinishReasonBlocklist, genai.FinishReasonProhibitedContent, genai.FinishReasonSpii:
+		if c.Content == nil || len(c.Content.Parts) == 0 {
+			return candidateBlocked(modelName, c)
+		}
+	}
+	return nil
+}
+
+// candidateBlocked is the BlockedError for a blocked response
+func candidateBlocked(modelName string, c *genai.Candidate) *BlockedError {
+	if c == nil {
+		return &BlockedError{Model: modelName, Reason: "safety"}
+	}
+	return &BlockedError{
+		Model:      modelName,
+		Reason:     reasonName(strings.TrimPrefix(c.FinishReason.String(), "FinishReason")),
+		Categories: blockedCategories(c.SafetyRatings),
+	}
+}
+
+// reasonName is a finish or block reason in snake case, e.g.
+// ProhibitedContent as prohibited_content
+func reasonName(reason string) string {
+	var b strings.Builder
+	for i, r := range reason {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToLower(b.String())
+}
+
+// blockedCategories are the categories of the ratings that blocked content
+func blockedCategories(ratings []*genai.SafetyRating) []string {
+	var categories []string
+	for _, r := range ratings {
+		if !r.Blocked {
+			continue
+		}
+		name, ok := harmCategories[r.Category]
+		if !ok {
+			name = r.Category.String()
+		}
+		categories = append(categories, name)
+	}
+	return categories
+}
+
+// SafetyFallback is what a blocked generation is retried with, in order
+type SafetyFallback struct {
+	Relaxed bool   `json:"relaxed,omitempty"` // block only content with a high probability of harm, in every category
+	Model   string `json:"model,omitempty"`   // an alternate model, with the relaxed settings if Relaxed
+}
+
+// attempts are the retries for a blocked generation with modelName
+func (f SafetyFallback) attempts(modelName string) []safetyAttempt {
+	var attempts []safetyAttempt
+	if f.Relaxed {
+		attempts = append(attempts, safetyAttempt{modelName, true})
+	}
+	if f.Model != "" && f.Model != modelName {
+		attempts = append(attempts, safetyAttempt{f.Model, f.Relaxed})
+	}
+	return attempts
+}
+
+// safetyAttempt is a model and whether its safety settings are relaxed
+type safetyAttempt struct {
+	model   string
+	relaxed bool
+}
+
+func (a safetyAttempt) String() string {
+	if a.relaxed {
+		return a.model + " with relaxed safety settings"
+	}
+	return a.model
+}
+
+// GenerateConversationWithFallback generates a conversation like
+// GenerateConversation and, if Gemini blocks it, retries with the
+// fallback; if every attempt is blocked the last *BlockedError is returned
+func GenerateConversationWithFallback(ctx context.Context, projectID, location, modelName, source, prompt string, fallback SafetyFallback) (string, error) {
+	g, err := GenerateConversationDetails(ctx, projectID, location, modelName, source, prompt, fallback)
+	return g.Text, err
+}
+
+// GenerateConversationDetails generates a conversation like
+// GenerateConversationWithFallback, with the model that wrote it, how the
+// last response finished and the sources it cites
+func GenerateConversationDetails(ctx context.Context, projectID, location, modelName, source, prompt string, fallback SafetyFallback) (Generation, error) {
+	g, err := generateConversationFixture(ctx, projectID, location, modelName, source, prompt, false)
+	var blocked *BlockedError
+	for _, attempt := range fallback.attempts(modelName) {
+		if !errors.As(err, &blocked) {
+			break
+		}
+		log.Printf("%v, retrying with %s", blocked, attempt)
+		g, err = generateConversationFixture(ctx, projectID, location, attempt.model, source, prompt, attempt.relaxed)
+	}
+	return g, err
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// SecretTTL is how long a secret is used before it's fetched again, so a
+// rotated secret's new version is picked up
+var SecretTTL = 5 * time.Minute
+
+// secretPattern is a Secret Manager secret, or one of its versions
+var secretPattern = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+
+// cachedSecret is a fetched secret value
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+var secrets = struct {
+	sync.Mutex
+	cache map[string]cachedSecret
+}{cache: map[string]cachedSecret{}}
+
+// IsSecretName reports whether s is a Secret Manager resource name, e.g.
+// projects/my-project/secrets/elevenlabs-key or .../versions/2
+func IsSecretName(s string) bool {
+	return secretPattern.MatchString(s)
+}
+
+// SecretEnv is an environment variable's value or, if it's a Secret Manager
+// resource name, the secret's value
+func SecretEnv(ctx context.Context, name string) (string, error) {
+	v, err := ResolveSecret(ctx, os.Getenv(name))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return v, nil
+}
+
+// ResolveSecret returns v, or the secret's value if v is a Secret Manager
+// resource name
+func ResolveSecret(ctx context.Context, v string) (string, error) {
+	if !IsSecretName(v) {
+		return v, nil
+	}
+	return Secret(ctx, v)
+}
+
+// Secret fetches a secret from Secret Manager, its latest version unless
+// name has one. Values are cached for SecretTTL, and if fetching again
+// fails the cached value is used until it succeeds
+func Secret(ctx context.Context, name string) (string, error) {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	secrets.Lock()
+	cached, ok := secrets.cache[name]
+	secrets.Unlock()
+	if ok && time.Since(cached.fetched) < SecretTTL {
+		return cached.value, nil
+	}
+
+	value, err := accessSecret(ctx, name)
+	if err != nil {
+		if ok {
+			log.Printf("unable to refresh secret %s, using the cached value: %v", name, err)
+			return cached.value, nil
+		}
+		return "", fmt.Errorf("secret %s: %w", name, err)
+	}
+	secrets.Lock()
+	secrets.cache[name] = cachedSecret{value, time.Now()}
+	secrets.Unlock()
+	return value, nil
+}
+
+// accessSecret reads a secret version, without the trailing newline
+// secrets created from files and echo often have
+func accessSecret(ctx context.Context, name string) (string, error) {
+	svc, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	resp, err := svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// recordPrefixes hold the service's own records in the audio bucket, rather
+// than episodes
+var recordPrefixes = []string{"jobs/", "transcripts/", "prompts/", "sources/", "catalog/"}
+
+// Artifact is a file in the audio bucket
+type Artifact struct {
+	Name    string    `json:"name"`
+	Bytes   int64     `json:"bytes"`
+	Updated time.Time `json:"updated"`
+}
+
+// EpisodeArtifacts is an episode's audio and the files stored with it: its
+// transcripts, page, chapters and speed variants, named after the audio,
+// and the generated transcript and catalog record for its job
+type EpisodeArtifacts struct {
+	Audio   string     `json:"audio"`
+	Files   []Artifact `json:"files"`
+	Bytes   int64      `json:"bytes"` // of all the files
+	Created time.Time  `json:"created"`
+	JobID   string     `json:"job_id,omitempty"`  // from the catalog
+	Catalog string     `json:"catalog,omitempty"` // the catalog record
+}
+
+// listArtifacts lists the files in the audio bucket, by name relative to
+// the audio bucket path
+func listArtifacts(ctx context.Context, client *storage.Client) (map[string]Artifact, error) {
+	bucketName, prefix := bucketObject("")
+	artifacts := map[string]Artifact{}
+	it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return artifacts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(attrs.Name, prefix)
+		artifacts[name] = Artifact{Name: name, Bytes: attrs.Size, Updated: attrs.Updated}
+	}
+}
+
+// isRecord reports whether a file is one of the service's records
+func isRecord(name string) bool {
+	for _, p := range recordPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEpisodeAudio reports whether a file is an episode's audio, rather than
+// a speed variant of one
+func isEpisodeAudio(name string, artifacts map[string]Artifact) bool {
+	ext := path.Ext(name)
+	if isRecord(name) || (ext != ".wav" && ext != ".mp3") {
+		return false
+	}
+	// e.g. episode_1.25x.wav, when there's an episode.wav
+	base := strings.TrimSuffix(name, ext)
+	i := strings.LastIndex(base, "_")
+	if i < 0 || !strings.HasSuffix(base, "x") {
+		return true
+	}
+	if _, err := strconv.ParseFloat(base[i+1:len(base)-1], 64); err != nil {
+		return true
+	}
+	_, ok := artifacts[base[:i]+ext]
+	return !ok
+}
+
+// listEpisodes lists the audio bucket's episodes, newest first
+func listEpisodes(ctx context.Context, client *storage.Client) ([]EpisodeArtifacts, error) {
+	artifacts, err := listArtifacts(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return groupArtifacts(ctx, client, artifacts)
+}
+
+// groupArtifacts reads the catalog records in the listed files and groups
+// the files into episodes
+func groupArtifacts(ctx context.Context, client *storage.Client, artifacts map[string]Artifact) ([]EpisodeArtifacts, error) {
+	var err error
+	records := map[string]catalogRecord{}
+	for name := range artifacts {
+		if !strings.HasPrefix(name, "catalog/") {
+			continue
+		}
+		if records[name], err = readCatalogRecord(ctx, client, name); err != nil {
+			log.Printf("skipping %s: %v", name, err)
+			delete(records, name)
+		}
+	}
+	return groupEpisodes(artifacts, records), nil
+}
+
+// groupEpisodes groups files into episodes, with the catalog records, by
+// name, of the jobs that made them
+func groupEpisodes(artifacts map[string]Artifact, records map[string]catalogRecord) []EpisodeArtifacts {
+	episodes := map[string]*EpisodeArtifacts{} // by the audio's name without its extension
+	for name, a := range artifacts {
+		if isEpisodeAudio(name, artifacts) {
+			episodes[strings.TrimSuffix(name, path.Ext(name))] = &EpisodeArtifacts{Audio: name, Created: a.Updated}
+		}
+	}
+	// files named after the audio belong to it, to the longest matching name
+	for name, a := range artifacts {
+		if isRecord(name) {
+			continue
+		}
+		for i := len(name) - 1; i > 0; i-- {
+			if name[i] != '.' && name[i] != '_' {
+				continue
+			}
+			if e, ok := episodes[name[:i]]; ok {
+				e.Files = append(e.Files, a)
+				break
+			}
+		}
+	}
+	for name, record := range records {
+		if len(record.Response.OutputFiles) == 0 {
+			continue
+		}
+		audio := record.Response.OutputFiles[0]
+		e, ok := episodes[strings.TrimSuffix(audio, path.Ext(audio))]
+		if !ok {
+			continue
+		}
+		e.JobID, e.Catalog = record.JobID, name
+		e.Files = append(e.Files, artifacts[name])
+		if t, ok := artifacts[fmt.Sprintf("transcripts/%s.txt", record.JobID)]; ok {
+			e.Files = append(e.Files, t)
+		}
+	}
+
+	list := []EpisodeArtifacts{}
+	for _, e := range episodes {
+		sort.Slice(e.Files, func(i, j int) bool { return e.Files[i].Name < e.Files[j].Name })
+		for _, f := range e.Files {
+			e.Bytes += f.Bytes
+		}
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list
+}
+
+// readCatalogRecord reads a catalog record by its name in the audio bucket
+func readCatalogRecord(ctx context.Context, client *storage.Client, name string) (catalogRecord, error) {
+	var record catalogRecord
+	bucketName, objectName := bucketObject(name)
+	err := readObject(ctx, client, bucketName, objectName, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&record)
+	})
+	return record, err
+}
+
+// deleteArtifacts deletes files from the audio bucket, those already gone
+// aren't an error
+func deleteArtifacts(ctx context.Context, client *storage.Client, files []Artifact) error {
+	var errs []error
+	for _, f := range files {
+		bucketName, objectName := bucketObject(f.Name)
+		err := client.Bucket(bucketName).Object(objectName).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// handleListEpisodes lists the episodes in the audio bucket with their
+// files, under the prefix parameter if set
+func handleListEpisodes(w http.ResponseWriter, r *http.Request) {
+	if !authorizedPromptAdmin(w, r) {
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if err := fabulae.ValidateBucketPrefix(prefix); err != nil {
+		writeValidationErrors(w, "", fieldError{codeInvalidSetting, "prefix", err.Error()})
+		return
+	}
+	client, err := storageClient(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to open storage", err.Error(), ""})
+		return
+	}
+	episodes, err := listEpisodes(r.Context(), client)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to list episodes", err.Error(), ""})
+		return
+	}
+	if prefix != "" {
+		var under []EpisodeArtifacts
+		for _, e := range episodes {
+			if strings.HasPrefix(e.Audio, prefix+"/") {
+				under = append(under, e)
+			}
+		}
+		episodes = under
+	}
+	writeJSONResponse(w, http.StatusOK, episodes)
+}
+
+// handleDeleteEpisode deletes an episode, by its audio's name, with the
+// files stored with it and its catalog record
+func handleDeleteEpisode(w http.ResponseWriter, r *http.Request) {
+	if !authorizedPromptAdmin(w, r) {
+		return
+	}
+	audio := r.PathValue("audio")
+	client, err := storageClient(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to open storage", err.Error(), ""})
+		return
+	}
+	episodes, err := listEpisodes(r.Context(), client)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to list episodes", err.Error(), ""})
+		return
+	}
+	for _, e := range episodes {
+		if e.Audio != audio {
+			continue
+		}
+		if err := deleteArtifacts(r.Context(), client, e.Files); err != nil {
+			writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to delete episode", err.Error(), ""})
+			return
+		}
+		log.Printf("episode %s: deleted %d files", audio, len(e.Files))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: fmt.Sprintf("no episode %q", audio)})
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+// validateAds checks the request's ads, recorded ones by their gs:// URI
+func (req FabulaeRequest) validateAds(ctx context.Context) []fieldError {
+	if len(req.Ads) == 0 {
+		return nil
+	}
+	var errs []fieldError
+	if req.Voice2Name == "" {
+		errs = append(errs, fieldError{codeInvalidSetting, "ads", "ads are inserted in two-voice conversations"})
+	}
+	if len(req.Ads) > maxAds {
+		errs = append(errs, fieldError{codeInvalidSetting, "ads", fmt.Sprintf("at most %d ads", maxAds)})
+	}
+	if err := fabulae.ValidateAds(req.Ads); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "ads", err.Error()})
+	}
+	for i, a := range req.Ads {
+		if len(a.Script) > maxAdScript {
+			errs = append(errs, fieldError{codeInvalidSetting, "ads", fmt.Sprintf("ad %d script is %d characters, limit is %d", i+1, len(a.Script), maxAdScript)})
+		}
+		if len(a.Name) > maxPromptSetting {
+			errs = append(errs, fieldError{codeInvalidSetting, "ads", fmt.Sprintf("ad %d name is %d characters, limit is %d", i+1, len(a.Name), maxPromptSetting)})
+		}
+		if a.Audio != "" && !isWavURI(a.Audio) {
+			errs = append(errs, fieldError{codeInvalidSetting, "ads", fmt.Sprintf("ad %d audio is a gs://bucket/object wav", i+1)})
+		} else if a.Audio != "" {
+			if err := fetchPolicy.CheckSource(ctx, a.Audio); err != nil {
+				errs = append(errs, fieldError{codeSourceRejected, "ads", fmt.Sprintf("ad %d: %v", i+1, err)})
+			}
+		}
+		if a.Voice != "" && !fabulae.IsCustomVoice(a.Voice) && !voices.known(ctx, a.Voice) {
+			errs = append(errs, fieldError{codeInvalidVoice, "ads", fmt.Sprintf("ad %d: unknown voice %q", i+1, a.Voice)})
+		}
+	}
+	return errs
+}
+
+// insertAds places the ads among the conversation's turns before they're
+// combined, downloading recorded ones, and returns the files to combine and
+// the episode's chapters
+func insertAds(ctx context.Context, ads []fabulae.AdSegment, files []string, turns []fabulae.TranscriptTurn) ([]string, []fabulae.Chapter, error) {
+	ads = append([]fabulae.AdSegment{}, ads...)
+	var voiceNames []string
+	for i, a := range ads {
+		if a.Script != "" {
+			voiceNames = append(voiceNames, a.Voice)
+			continue
+		}
+		local, err := downloadWav(ctx, a.Audio)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ad %d: %w", i+1, err)
+		}
+		defer os.Remove(local)
+		ads[i].Audio = local
+	}
+	synth, err := fabulae.NewCast("google", voiceNames...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fabulae.InsertAds(ctx, synth, files, ads, turns)
+}
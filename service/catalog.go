@@ -0,0 +1,202 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+
+	"cloud.google.com/go/storage"
+)
+
+// catalogRecord is a finished episode stored by its fingerprint, so a
+// request for the same source, prompt, voices and output settings gets it
+// back rather than generating it again
+type catalogRecord struct {
+	Fingerprint fabulae.Fingerprint `json:"fingerprint"`
+	JobID       string              `json:"job_id"`
+	Episode     int                 `json:"episode,omitempty"` // of the request's show
+	Response    FabulaeResponse     `json:"response"`
+	Created     time.Time           `json:"created"`
+}
+
+// outputSettings are the request's settings that change the audio or the
+// files stored with it, normalized for its fingerprint
+type outputSettings struct {
+	Show              string              `json:"show,omitempty"`
+	BucketPrefix      string              `json:"bucket_prefix,omitempty"`
+	TranscriptFormats []string            `json:"transcript_formats,omitempty"`
+	WordTimings       bool                `json:"word_timings,omitempty"`
+	EpisodePage       bool                `json:"episode_page,omitempty"`
+	ShowNotes         string              `json:"show_notes,omitempty"`
+	Ads               []fabulae.AdSegment `json:"ads,omitempty"`
+	CrossfadeSeconds  float64             `json:"crossfade_seconds,omitempty"`
+	Music             string              `json:"music,omitempty"`
+	MusicGain         float64             `json:"music_gain,omitempty"`
+	SampleRate        int                 `json:"sample_rate,omitempty"`
+	Channels          int                 `json:"channels,omitempty"`
+	Mastering         *fabulae.Mastering  `json:"mastering,omitempty"`
+	SpeedVariants     []float64           `json:"speed_variants,omitempty"`
+	ExportProfiles    []string            `json:"export_profiles,omitempty"`
+	DriveFolder       string              `json:"drive_folder,omitempty"`
+	FactCheck         string              `json:"fact_check,omitempty"`
+	MinQuality        float64             `json:"min_quality,omitempty"`
+	QualityRetries    int                 `json:"quality_retries,omitempty"`
+}
+
+// outputSHA256 hashes the request's output settings, for its fingerprint;
+// the title and episode number aren't, an episode's duplicate keeps its own
+func (req FabulaeRequest) outputSHA256() string {
+	format := req.audioFormat()
+	settings := outputSettings{
+		Show:              req.Show,
+		BucketPrefix:      req.BucketPrefix,
+		TranscriptFormats: normalizedNames(req.TranscriptFormats),
+		WordTimings:       req.WordTimings,
+		EpisodePage:       req.EpisodePage,
+		ShowNotes:         req.ShowNotes,
+		Ads:               req.Ads,
+		CrossfadeSeconds:  req.CrossfadeSeconds,
+		Music:             req.Music,
+		SampleRate:        format.SampleRate,
+		Channels:          format.Channels,
+		Mastering:         req.Mastering,
+		SpeedVariants:     slices.Compact(slices.Sorted(slices.Values(req.SpeedVariants))),
+		ExportProfiles:    normalizedNames(req.ExportProfiles),
+		DriveFolder:       req.DriveFolder,
+		FactCheck:         req.FactCheck,
+		MinQuality:        req.MinQuality,
+	}
+	if req.Music != "" {
+		settings.MusicGain = req.MusicGain
+	}
+	if req.MinQuality > 0 {
+		settings.QualityRetries = req.QualityRetries
+	}
+	return fabulae.OutputSHA256(settings)
+}
+
+// normalizedNames are names lowercased, sorted and without repeats
+func normalizedNames(names []string) []string {
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		normalized = append(normalized, strings.ToLower(strings.TrimSpace(name)))
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+// transcriptFingerprint is what a request with a conversation is made from
+func (req FabulaeRequest) transcriptFingerprint() fabulae.Fingerprint {
+	return fabulae.Fingerprint{
+		SourceSHA256: fabulae.SHA256([]byte(req.Conversation)),
+		Voices:       req.requestVoices(),
+		OutputSHA256: req.outputSHA256(),
+	}
+}
+
+// requestVoices are the request's voices, for its fingerprint
+func (req FabulaeRequest) requestVoices() []string {
+	if req.Voice2Name == "" {
+		return []string{req.Voice1Name}
+	}
+	return []string{req.Voice1Name, req.Voice2Name}
+}
+
+// catalogObject is where the episode with a fingerprint is recorded, under
+// catalog/ in the audio bucket
+func catalogObject(f fabulae.Fingerprint) (string, string) {
+	return bucketObject(fmt.Sprintf("catalog/%s.json", f.Key()))
+}
+
+// findEpisode returns the catalog's episode with the fingerprint, if there
+// is one
+func findEpisode(ctx context.Context, f fabulae.Fingerprint) (catalogRecord, bool, error) {
+	var record catalogRecord
+	client, err := storageClient(ctx)
+	if err != nil {
+		return record, false, err
+	}
+
+	bucketName, objectName := catalogObject(f)
+	err = readObject(ctx, client, bucketName, objectName, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&record)
+	})
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return record, false, nil
+	}
+	return record, err == nil, err
+}
+
+// catalogEpisode records a finished job's episode by its fingerprint
+func catalogEpisode(ctx context.Context, f fabulae.Fingerprint, jobID string, episode int, response FabulaeResponse) error {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(catalogRecord{Fingerprint: f, JobID: jobID, Episode: episode, Response: response, Created: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	bucketName, objectName := catalogObject(f)
+	return writeObject(ctx, client, bucketName, objectName, "application/json", data)
+}
+
+// duplicateEpisode returns the catalog's episode for the fingerprint as the
+// job's response, unless the request is forced or there isn't one; a show's
+// episode is only its own duplicate, its number having been claimed
+func duplicateEpisode(ctx context.Context, jobID string, req FabulaeRequest, f fabulae.Fingerprint) (FabulaeResponse, bool) {
+	if req.Force {
+		return FabulaeResponse{}, false
+	}
+	record, ok, err := findEpisode(ctx, f)
+	if err != nil {
+		log.Printf("job %s: unable to check the catalog: %v", jobID, err)
+	}
+	if !ok || record.Episode != req.Episode {
+		return FabulaeResponse{}, false
+	}
+	log.Printf("job %s: returning job %s's episode, from the same source, prompt, voices and output settings", jobID, record.JobID)
+	response := record.Response
+	response.JobID, response.DuplicateOf = jobID, record.JobID
+	return response, true
+}
+
+// duplicateShowEpisode is the number of the show's episode an unnumbered
+// request with a conversation duplicates, or 0, so the request is numbered as
+// it rather than claiming the show's next episode
+func (req FabulaeRequest) duplicateShowEpisode(ctx context.Context) int {
+	if req.Force || req.Conversation == "" || req.Episode != 0 {
+		return 0
+	}
+	record, ok, err := findEpisode(ctx, req.transcriptFingerprint())
+	if err != nil {
+		log.Printf("unable to check the catalog for show %s: %v", req.Show, err)
+	}
+	if !ok {
+		return 0
+	}
+	return record.Episode
+}
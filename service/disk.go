@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+// diskQuota caps the temporary disk a job's synthesis may take, in bytes,
+// 0 is limited only by the disk's free space
+var diskQuota uint64
+
+// diskFromEnv reads TEMP_DISK_QUOTA_MB, e.g. a Cloud Run instance's memory
+// less what synthesis needs, as the container's disk is in memory
+func diskFromEnv() {
+	s := os.Getenv("TEMP_DISK_QUOTA_MB")
+	if s == "" {
+		return
+	}
+	mb, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		log.Printf("invalid TEMP_DISK_QUOTA_MB %q, not limited", s)
+		return
+	}
+	diskQuota = mb << 20
+}
+
+// checkDisk reports whether a conversation's turns fit on disk, or whether
+// streaming them into the episode does; music is mixed in afterwards, so
+// only ads and crossfades need every turn at once
+func checkDisk(fabulaeRequest FabulaeRequest) (streaming bool, err error) {
+	err = fabulae.CheckDisk(".", fabulae.SynthesisDisk(fabulaeRequest.Conversation, fabulaeRequest.audioFormat(), false), diskQuota)
+	if err == nil {
+		return false, nil
+	}
+	if len(fabulaeRequest.Ads) > 0 || fabulaeRequest.CrossfadeSeconds > 0 {
+		return false, fmt.Errorf("%w, ads and crossfades need every turn on disk", err)
+	}
+	if err := fabulae.CheckDisk(".", fabulae.SynthesisDisk(fabulaeRequest.Conversation, fabulaeRequest.audioFormat(), true), diskQuota); err != nil {
+		return false, err
+	}
+	log.Printf("%v, streaming turns into the episode", err)
+	return true, nil
+}
+
+// streamEpisode synthesizes a conversation's turns straight into the
+// episode, removing each once it's merged, and returns the turns' durations
+func streamEpisode(ctx context.Context, fabulaeRequest FabulaeRequest) (string, []time.Duration, error) {
+	cast, err := fabulae.NewCast("google", fabulaeRequest.Voice1Name, fabulaeRequest.Voice2Name)
+	if err != nil {
+		return "", nil, err
+	}
+	output := fmt.Sprintf("new_%s.wav", time.Now().Format("20060102.030405.06"))
+	f, err := os.Create(output)
+	if err != nil {
+		return "", nil, err
+	}
+	durations, err := fabulae.StreamConversation(ctx, cast, fabulaeRequest.Voice1Name, fabulaeRequest.Voice2Name, fabulaeRequest.Conversation, output, "", f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fabulae.RemoveFiles(output)
+		return "", nil, err
+	}
+	return output, durations, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// error codes returned in errorResponse.Code
+const (
+	codeInvalidRequest    = "invalid_request"
+	codeRequestTooLarge   = "request_too_large"
+	codeNotFound          = "not_found"
+	codeForbidden         = "forbidden"
+	codeQueueFailed       = "queue_failed"
+	codeNotEnabled        = "not_enabled"
+	codeSourceUnavailable = "source_unavailable"
+	codeSourceRejected    = "source_rejected"
+	codeModelsUnavailable = "models_unavailable"
+	codeOverBudget        = "over_budget"
+	codeInsufficientDisk  = "insufficient_disk"
+	codeGenerationFailed  = "generation_failed"
+	codeGenerationBlocked = "generation_blocked"
+	codeSynthesisFailed   = "synthesis_failed"
+	codeStorageFailed     = "storage_failed"
+	codeInternal          = "internal"
+)
+
+// errorResponse is the envelope for every error returned by the service
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+	JobID   string `json:"job_id,omitempty"`
+}
+
+// writeError responds with status and an errorResponse
+func writeError(w http.ResponseWriter, status int, e errorResponse) {
+	if e.JobID != "" {
+		log.Printf("job %s: %d %s: %s", e.JobID, status, e.Code, e.Message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		log.Print(err)
+	}
+}
+
+// newJobID returns an identifier for a request, sortable by time
+func newJobID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(b))
+}
+
+// withBodyLimit caps the size of the request body for a handler
+func withBodyLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+		h(w, r)
+	}
+}
+
+// decodeRequest decodes a JSON body directly from the request stream,
+// writing the error response and returning false if it can't
+func decodeRequest(w http.ResponseWriter, r *http.Request, jobID string, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge, errorResponse{
+			Code:    codeRequestTooLarge,
+			Message: fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit),
+			JobID:   jobID,
+		})
+	case errors.Is(err, io.EOF):
+		writeValidationErrors(w, jobID, fieldError{codeEmptyBody, "", "no content provided"})
+	default:
+		writeValidationErrors(w, jobID, fieldError{codeInvalidJSON, "", fmt.Sprintf("error decoding request: %v", err)})
+	}
+	return false
+}
+
+// handleNotFound answers unknown routes with the error envelope
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, errorResponse{
+		Code:    codeNotFound,
+		Message: fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path),
+	})
+}
@@ -15,35 +15,157 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ghchinoy/fabulae"
-	"github.com/moutend/go-wav"
+	"github.com/ghchinoy/fabulae/config"
 
 	"cloud.google.com/go/storage"
 )
 
-var audioBucketPath string
+// defaultMaxRequestBytes leaves room for the longest conversation plus JSON escaping
+const defaultMaxRequestBytes int64 = 2 << 20
+
+var (
+	maxRequestBytes int64
+	audioBucketPath string
+	projectID       string
+	location        string
+	modelName       string
+	fetchPolicy     fabulae.URLPolicy
+	budget          fabulae.Budget
+	driveFolder     string
+)
 
 type FabulaeRequest struct {
 	Voice1Name   string `json:"voice1"`
 	Voice2Name   string `json:"voice2"`
 	Conversation string `json:"conversation"`
+	Title        string `json:"title,omitempty"`   // episode title, for the episode page and notifications
+	PDFURL       string `json:"pdf_url,omitempty"` // http(s), gs:// or Google Drive source, used when conversation is empty
+	// Show is a stored show whose settings are used for those not in the
+	// request, with Episode its number, default the show's next
+	Show    string `json:"show,omitempty"`
+	Episode int    `json:"episode,omitempty"`
+	// BucketPrefix is the folder under the audio bucket the files are stored
+	// in, default the show's
+	BucketPrefix string `json:"bucket_prefix,omitempty"`
+
+	// settings for the built-in prompt, for pdf_url sources
+	HostNames []string `json:"host_names,omitempty"`
+	// HostPersona and ExpertPersona cast stored personas, with their voices
+	// unless voice1 and voice2 are set, and their names over host_names
+	HostPersona    string `json:"host_persona,omitempty"`
+	ExpertPersona  string `json:"expert_persona,omitempty"`
+	ShowName       string `json:"show_name,omitempty"`
+	TargetMinutes  int    `json:"target_minutes,omitempty"`
+	Audience       string `json:"audience,omitempty"`
+	Tone           string `json:"tone,omitempty"`
+	Code           string `json:"code,omitempty"` // describe or skip source code in the document
+	SkipReferences bool   `json:"skip_references,omitempty"`
+	Model          string `json:"model,omitempty"` // Gemini model, default MODEL_NAME
+	// MinQuality has Gemini critique the script, regenerating it with the
+	// feedback up to QualityRetries times while it scores under this
+	MinQuality     float64 `json:"min_quality,omitempty"`
+	QualityRetries int     `json:"quality_retries,omitempty"`
+	// SafetyFallback retries a generation Gemini blocks, with relaxed
+	// safety settings or another model
+	SafetyFallback fabulae.SafetyFallback `json:"safety_fallback"`
+	// FactCheck checks the generated script's claims against the document:
+	// report or corrections
+	FactCheck string `json:"fact_check,omitempty"`
+
+	// TranscriptFormats are written alongside two-voice audio: md, json and srt
+	TranscriptFormats []string `json:"transcript_formats,omitempty"`
+	// WordTimings times each word of the transcripts by aligning the
+	// episode with Speech-to-Text
+	WordTimings bool `json:"word_timings,omitempty"`
+	// EpisodePage stores a web page for two-voice audio, with ShowNotes if set
+	EpisodePage bool   `json:"episode_page,omitempty"`
+	ShowNotes   string `json:"show_notes,omitempty"`
+	// Ads are sponsor segments inserted in two-voice audio, scripts or gs://
+	// wav recordings, with the episode's chapters stored alongside
+	Ads []fabulae.AdSegment `json:"ads,omitempty"`
+	// CrossfadeSeconds overlaps two-voice turns rather than cutting between
+	// them, and Music, a gs:// wav, plays under the episode, ducked to
+	// MusicGain under speech
+	CrossfadeSeconds float64 `json:"crossfade_seconds,omitempty"`
+	Music            string  `json:"music,omitempty"`
+	MusicGain        float64 `json:"music_gain,omitempty"`
+	// SampleRate and Channels, mono or stereo, are the audio's format, rather
+	// than the voices'
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Channels   string `json:"channels,omitempty"`
+	// Mastering is an effects chain applied to two-voice audio, before Music
+	Mastering *fabulae.Mastering `json:"mastering,omitempty"`
+	// SpeedVariants are speeds two-voice audio is also stored at, e.g. 1.25,
+	// time-stretched to keep the voices' pitch
+	SpeedVariants []float64 `json:"speed_variants,omitempty"`
+	// ExportProfiles are destinations two-voice audio is also stored for,
+	// e.g. podcast or broadcast, normalized to their loudness
+	ExportProfiles []string `json:"export_profiles,omitempty"`
+	// DriveFolder also receives the audio and the files stored with it, default DRIVE_FOLDER
+	DriveFolder string `json:"drive_folder,omitempty"`
+	// Force generates the episode even if one was made from the same source,
+	// prompt, voices and output settings
+	Force bool `json:"force,omitempty"`
 }
 
 type FabulaeResponse struct {
 	ErrorMessage string   `json:"errormessage,omitempty"`
 	OutputFiles  []string `json:"outputfiles"`
+	JobID        string   `json:"job_id,omitempty"`
+
+	// Title is an untitled pdf_url source's title, from Gemini
+	Title string `json:"title,omitempty"`
+	// for pdf_url sources, the generated conversation and where it's stored
+	Transcript    string `json:"transcript,omitempty"`
+	TranscriptURI string `json:"transcript_uri,omitempty"`
+	// Status is partial_failure when the transcript was generated but synthesis failed
+	Status string `json:"status,omitempty"`
+	// Transcripts are the transcript_formats files, by format
+	Transcripts map[string]string `json:"transcripts,omitempty"`
+	// Page is the episode_page file
+	Page string `json:"page,omitempty"`
+	// Chapters is the chapters file, with ads
+	Chapters string `json:"chapters,omitempty"`
+	// SpeedVariants are the speed_variants files, by speed, e.g. 1.25x
+	SpeedVariants map[string]string `json:"speed_variants,omitempty"`
+	// Exports are the export_profiles files, by profile
+	Exports map[string]string `json:"exports,omitempty"`
+	// Duration is the length of the audio in seconds
+	Duration float64 `json:"duration_seconds,omitempty"`
+	// Quality is the script's critique, with min_quality
+	Quality *fabulae.ScriptCritique `json:"quality,omitempty"`
+	// Generation is how Gemini finished the script, with the model that
+	// wrote it and the sources it cites
+	Generation *fabulae.Generation `json:"generation,omitempty"`
+	// FactCheck is the generated script's checked claims, with fact_check,
+	// and FactCheckReport the report stored with two-voice audio
+	FactCheck       *fabulae.FactCheck `json:"fact_check,omitempty"`
+	FactCheckReport string             `json:"fact_check_report,omitempty"`
+	// DriveFiles are the files uploaded to drive_folder
+	DriveFiles []fabulae.DriveFile `json:"drive_files,omitempty"`
+	// DuplicateOf is the earlier job whose episode this is, made from the
+	// same source, prompt, voices and output settings
+	DuplicateOf string `json:"duplicate_of,omitempty"`
 }
 
 func main() {
@@ -51,141 +173,758 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	audioBucketPath = os.Getenv("GCS_AUDIO_BUCKET")
-	if audioBucketPath == "" {
-		log.Print("missing GCS_AUDIO_BUCKET, GCS destination for generated audio")
-		os.Exit(1)
+	// the project, region, bucket and model, from an optional config file,
+	// the environment and flags
+	configPath := flag.String("config", os.Getenv("FABULAE_CONFIG"), "JSON config file with project_id, region, bucket and model, or env FABULAE_CONFIG")
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	settings, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	settings.Flags(flag.CommandLine)
+	if err := settings.Validate("bucket"); err != nil {
+		log.Fatal(err)
+	}
+	var dump strings.Builder
+	settings.Dump(&dump)
+	log.Printf("settings:\n%s", dump.String())
+	audioBucketPath, projectID, location, modelName = settings.Bucket, settings.ProjectID, settings.Region, settings.Model
+	// generating a conversation from a pdf_url source requires a project
+	if projectID == "" {
+		log.Print("PROJECT_ID not set, pdf_url sources are disabled")
+	}
+	fetchPolicy = urlPolicyFromEnv()
+	budget = budgetFromEnv()
+	diskFromEnv()
+	contextCacheFromEnv()
+	turnChecksFromEnv()
+	notifyFromEnv()
+	// a Drive folder shared with the service account, for every job's files
+	driveFolder = os.Getenv("DRIVE_FOLDER")
+	// licensed custom voices, a JSON object of voice name to model, language, endpoint and credentials
+	if v := os.Getenv("CUSTOM_VOICES"); v != "" {
+		if err := fabulae.RegisterCustomVoicesJSON([]byte(v)); err != nil {
+			log.Fatalf("CUSTOM_VOICES: %v", err)
+		}
+	}
+
+	maxRequestBytes = defaultMaxRequestBytes
+	if v := os.Getenv("MAX_REQUEST_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			log.Printf("invalid MAX_REQUEST_BYTES %q, using %d", v, defaultMaxRequestBytes)
+		} else {
+			maxRequestBytes = n
+		}
 	}
 
-	http.HandleFunc("POST /synthesize", handleSynthesis)
-	http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
+	// with a queue, /synthesize enqueues and /tasks/synthesize processes
+	// tasks with OIDC tokens for the worker URL from the service account
+	taskWorkerURL, taskServiceAccount = os.Getenv("TASKS_WORKER_URL"), os.Getenv("TASKS_SERVICE_ACCOUNT")
+	if queuePath := os.Getenv("CLOUD_TASKS_QUEUE"); queuePath != "" {
+		q, err := newCloudTasksQueue(context.Background(), queuePath, taskWorkerURL, taskServiceAccount)
+		if err != nil {
+			log.Fatalf("unable to configure Cloud Tasks queue: %v", err)
+		}
+		queue = q
+		if v := os.Getenv("TASKS_MAX_ATTEMPTS"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				maxTaskAttempts = n
+			}
+		}
+		log.Printf("queueing jobs on %s", queuePath)
+	}
+
+	http.HandleFunc("POST /synthesize", withBodyLimit(handleSynthesis))
+	http.HandleFunc("POST /tasks/synthesize", withBodyLimit(handleTask))
+	http.HandleFunc("GET /jobs/{id}", handleJobStatus)
+
+	// scheduled generation from feeds, triggered by Cloud Scheduler
+	scheduleConfig = os.Getenv("SCHEDULE_CONFIG")
+	if v := os.Getenv("SCHEDULE_COLLECTION"); v != "" {
+		scheduleCollection = v
+	}
+	if v := os.Getenv("FIRESTORE_DATABASE"); v != "" {
+		firestoreDatabase = v
+	}
+	schedulerServiceAccount, schedulerAudience = os.Getenv("SCHEDULER_SERVICE_ACCOUNT"), os.Getenv("SCHEDULER_AUDIENCE")
+	http.HandleFunc("POST /schedule/run", handleScheduleRun)
+
+	// stored prompt versions, updated with the PROMPT_ADMIN_TOKEN bearer token
+	promptAdminToken = os.Getenv("PROMPT_ADMIN_TOKEN")
+	http.HandleFunc("GET /prompts/{name}", handleGetPrompt)
+	http.HandleFunc("PUT /prompts/{name}", handlePutPrompt)
+	http.HandleFunc("GET /prompts/{name}/versions", handleListPromptVersions)
+	http.HandleFunc("GET /prompts/{name}/versions/{version}", handleGetPromptVersion)
+	http.HandleFunc("POST /prompts/{name}/rollback", withBodyLimit(handleRollbackPrompt))
+	http.HandleFunc("GET /models", handleListModels)
+
+	// recurring host and expert personas, updated with the PROMPT_ADMIN_TOKEN bearer token
+	if v := os.Getenv("PERSONA_COLLECTION"); v != "" {
+		personaCollection = v
+	}
+	http.HandleFunc("GET /personas", handleListPersonas)
+	http.HandleFunc("GET /personas/{id}", handleGetPersona)
+	http.HandleFunc("PUT /personas/{id}", withBodyLimit(handlePutPersona))
+	http.HandleFunc("DELETE /personas/{id}", handleDeletePersona)
+
+	// recurring shows, an episode only needs a request's show and pdf_url
+	if v := os.Getenv("SHOW_COLLECTION"); v != "" {
+		showCollection = v
+	}
+	http.HandleFunc("GET /shows", handleListShows)
+	http.HandleFunc("GET /shows/{id}", handleGetShow)
+	http.HandleFunc("PUT /shows/{id}", withBodyLimit(handlePutShow))
+	http.HandleFunc("DELETE /shows/{id}", handleDeleteShow)
+
+	// the episodes in the audio bucket, listed and deleted with the PROMPT_ADMIN_TOKEN bearer token
+	http.HandleFunc("GET /admin/episodes", handleListEpisodes)
+	http.HandleFunc("DELETE /admin/episodes/{audio...}", handleDeleteEpisode)
+	// files past SOURCE_RETENTION, TRANSCRIPT_RETENTION, JOB_RETENTION and
+	// EPISODE_RETENTION, deleted by Cloud Scheduler
+	retentionFromEnv()
+	http.HandleFunc("POST /admin/cleanup", handleCleanup)
+	http.HandleFunc("/", handleNotFound)
+
+	// the voices, clients and bucket are ready before the first request
+	warmStart()
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%s", port),
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    64 << 10,
+	}
+	log.Fatal(server.ListenAndServe())
 }
 
 func handleSynthesis(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "unable to process body", http.StatusInternalServerError)
+	jobID := newJobID()
+
+	var fabulaeRequest FabulaeRequest
+	if !decodeRequest(w, r, jobID, &fabulaeRequest) {
 		return
 	}
-	if len(body) == 0 {
-		http.Error(w, "no content provided", http.StatusBadRequest)
+	errs := fabulaeRequest.prepare(r.Context())
+	log.Printf("job %s: voice1 %s, voice2 %s, pdf_url %q, conversation %d chars", jobID,
+		fabulaeRequest.Voice1Name, fabulaeRequest.Voice2Name, fabulaeRequest.PDFURL, len(fabulaeRequest.Conversation))
+	if len(errs) > 0 {
+		writeValidationErrors(w, jobID, errs...)
 		return
 	}
-	log.Printf("%s", body)
 
-	log.Print("synthesizing... ")
+	// with a queue, the job is processed by the worker endpoint
+	if queue != nil {
+		enqueueJob(w, r, Job{ID: jobID, Request: fabulaeRequest})
+		return
+	}
 
-	var fabulaeRequest FabulaeRequest
-	err = json.NewDecoder(bytes.NewReader(body)).Decode(&fabulaeRequest)
-	if err != nil {
-		http.Error(w, "error decoding Fabulae Request", http.StatusInternalServerError)
+	response, jobErr := processSynthesis(r.Context(), jobID, fabulaeRequest)
+	if jobErr != nil {
+		writeError(w, jobErr.Status, jobErr.errorResponse)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// jobError is a processing failure and the HTTP status it maps to
+type jobError struct {
+	Status int
+	errorResponse
+}
+
+// retryable reports whether processing the job again may succeed
+func (e *jobError) retryable() bool {
+	return e.Status >= 500 && e.Status != http.StatusNotImplemented
+}
+
+// processSynthesis generates a conversation if needed, synthesizes audio and
+// moves it to the audio bucket
+func processSynthesis(ctx context.Context, jobID string, fabulaeRequest FabulaeRequest) (FabulaeResponse, *jobError) {
+	log.Printf("job %s: synthesizing... ", jobID)
+
+	var err error
 	var response FabulaeResponse
+	// what the episode is made from, for the catalog
+	var fingerprint *fabulae.Fingerprint
+	if fabulaeRequest.Conversation != "" {
+		f := fabulaeRequest.transcriptFingerprint()
+		fingerprint = &f
+		if duplicate, ok := duplicateEpisode(ctx, jobID, fabulaeRequest, *fingerprint); ok {
+			return duplicate, nil
+		}
+	}
+
+	// a retried job reuses the transcript generated by an earlier attempt
+	if fabulaeRequest.Conversation == "" && fabulaeRequest.PDFURL != "" {
+		if transcript, uri, err := loadTranscript(ctx, jobID); err == nil {
+			log.Printf("job %s: reusing transcript %s", jobID, uri)
+			fabulaeRequest.Conversation = transcript
+			response.Transcript, response.TranscriptURI = transcript, uri
+		}
+	}
+
+	// generate a conversation from the source document
+	if fabulaeRequest.Conversation == "" && fabulaeRequest.PDFURL != "" {
+		if projectID == "" {
+			return response, &jobError{http.StatusNotImplemented, errorResponse{codeNotEnabled, "pdf_url sources are not enabled", nil, jobID}}
+		}
+		source := fabulaeRequest.PDFURL
+		// documents read in place, from Cloud Storage or Drive, by their URI
+		sourceHash := fabulae.SHA256([]byte(source))
+		if _, ok := fabulae.DriveFileID(source); !ok && !fabulae.IsGCSURI(source) {
+			source, sourceHash, err = addPDFSourceToGCS(ctx, fabulaeRequest.PDFURL)
+			if err != nil {
+				log.Printf("unable to retrieve %s: %v", fabulaeRequest.PDFURL, err)
+				status, code := http.StatusBadGateway, codeSourceUnavailable
+				if errors.Is(err, fabulae.ErrTooLarge) || errors.Is(err, fabulae.ErrNotPDF) || errors.Is(err, fabulae.ErrURLNotAllowed) {
+					status, code = http.StatusBadRequest, codeSourceRejected
+				}
+				return response, &jobError{status, errorResponse{code, "unable to retrieve pdf_url", err.Error(), jobID}}
+			}
+		}
+		data := fabulae.PromptData{
+			HostNames:      fabulaeRequest.HostNames,
+			ShowName:       fabulaeRequest.ShowName,
+			TargetMinutes:  fabulaeRequest.TargetMinutes,
+			Audience:       fabulaeRequest.Audience,
+			Tone:           fabulaeRequest.Tone,
+			Code:           fabulaeRequest.Code,
+			SkipReferences: fabulaeRequest.SkipReferences,
+		}
+		data.PreviousEpisodes = previousEpisodes(ctx, fabulaeRequest)
+		personas, errs := fabulaeRequest.castPersonas(ctx)
+		if len(errs) > 0 {
+			return response, &jobError{http.StatusBadRequest, errorResponse{codeInvalidSetting, errs[0].Message, errs, jobID}}
+		}
+		if len(personas) > 0 {
+			data = data.WithPersonas(personas...)
+			fabulaeRequest.HostNames = data.HostNames // for the episode page
+		}
+		prompt, err := servicePrompt(ctx, "podcast", data)
+		if err != nil {
+			return response, &jobError{http.StatusInternalServerError, errorResponse{codeGenerationFailed, "error loading prompt", err.Error(), jobID}}
+		}
+		fingerprint = &fabulae.Fingerprint{
+			SourceSHA256: sourceHash,
+			PromptSHA256: fabulae.PromptSHA256(fabulaeRequest.model(), prompt),
+			Voices:       fabulaeRequest.requestVoices(),
+			OutputSHA256: fabulaeRequest.outputSHA256(),
+		}
+		if duplicate, ok := duplicateEpisode(ctx, jobID, fabulaeRequest, *fingerprint); ok {
+			return duplicate, nil
+		}
+		// refuse before generating if the document or the script would be over budget
+		if budget.DocumentTokens > 0 {
+			tokens, err := fabulae.CountTokens(ctx, projectID, location, fabulaeRequest.model(), source, prompt)
+			if err != nil {
+				log.Printf("job %s: unable to count tokens, skipping the token budget: %v", jobID, err)
+			} else if jobErr := overBudget(jobID, budget.CheckTokens(tokens)); jobErr != nil {
+				return response, jobErr
+			}
+		}
+		if jobErr := overBudget(jobID, budget.CheckCharacters(data.Characters())); jobErr != nil {
+			return response, jobErr
+		}
+		// an untitled document's title is extracted while the conversation
+		// is generated, from the same source
+		var documentTitle chan string
+		if fabulaeRequest.Title == "" {
+			documentTitle = make(chan string, 1)
+			go func() { documentTitle <- fabulae.GetTitleOfDocument(ctx, projectID, location, source) }()
+		}
+		log.Printf("generating conversation from %s ...", source)
+		var conversation string
+		if fabulaeRequest.MinQuality > 0 {
+			var critique fabulae.ScriptCritique
+			conversation, critique, err = fabulae.GenerateReviewedConversation(ctx, projectID, location, fabulaeRequest.model(), source, prompt, fabulae.QualityOptions{
+				MinScore:   fabulaeRequest.MinQuality,
+				MaxRetries: fabulaeRequest.QualityRetries,
+				Safety:     fabulaeRequest.SafetyFallback,
+			})
+			if err == nil {
+				response.Quality = &critique
+			}
+		} else {
+			var g fabulae.Generation
+			g, err = fabulae.GenerateConversationDetails(ctx, projectID, location, fabulaeRequest.model(), source, prompt, fabulaeRequest.SafetyFallback)
+			conversation = g.Text
+			if err == nil {
+				response.Generation = &g
+			}
+		}
+		var blocked *fabulae.BlockedError
+		if errors.As(err, &blocked) {
+			log.Printf("job %s: %v", jobID, err)
+			return response, &jobError{http.StatusUnprocessableEntity, errorResponse{codeGenerationBlocked, err.Error(), blocked, jobID}}
+		}
+		if err != nil {
+			log.Printf("unable to create conversation from %s: %v", fabulaeRequest.PDFURL, err)
+			return response, &jobError{http.StatusInternalServerError, errorResponse{codeGenerationFailed, "error generating conversation", err.Error(), jobID}}
+		}
+		if documentTitle != nil {
+			fabulaeRequest.Title = <-documentTitle
+			response.Title = fabulaeRequest.Title
+			log.Printf("job %s: document title %q", jobID, fabulaeRequest.Title)
+		}
+		if fabulaeRequest.FactCheck != "" {
+			check, err := fabulae.CheckFacts(ctx, projectID, location, fabulaeRequest.model(), source, conversation)
+			if err != nil {
+				return response, &jobError{http.StatusInternalServerError, errorResponse{codeGenerationFailed, "error fact checking conversation", err.Error(), jobID}}
+			}
+			response.FactCheck = &check
+			if fabulaeRequest.FactCheck == fabulae.FactCheckCorrections {
+				conversation = fabulae.AppendCorrections(conversation, check)
+			}
+		}
+		fabulaeRequest.Conversation = conversation
+		response.Transcript = conversation
+		if response.TranscriptURI, err = saveTranscript(ctx, jobID, conversation); err != nil {
+			log.Printf("job %s: unable to save transcript: %v", jobID, err)
+		}
+	}
 
+	// failures from here keep the generated transcript in the error details
+	failed := func(status int, code, message string, err error) *jobError {
+		if response.Transcript == "" {
+			return &jobError{status, errorResponse{code, message, err.Error(), jobID}}
+		}
+		partial := response
+		partial.ErrorMessage, partial.Status = err.Error(), jobPartial
+		return &jobError{status, errorResponse{code, message + ", the transcript was saved", partial, jobID}}
+	}
+	if err := budget.CheckCharacters(fabulae.ScriptCharacters(fabulaeRequest.Conversation)); err != nil {
+		jobErr := failed(http.StatusBadRequest, codeOverBudget, err.Error(), err)
+		if response.Transcript == "" {
+			jobErr = overBudget(jobID, err)
+		}
+		return response, jobErr
+	}
+
+	response.JobID = jobID
+	// the voices synthesize, and the turns are combined, in the request's
+	// sample rate and channels
+	ctx = fabulae.WithAudioFormat(ctx, fabulaeRequest.audioFormat())
 	if fabulaeRequest.Voice2Name == "" { // single voice text synthesis (aka speak)
 		log.Print("single voice")
-		outputfile, err := fabulae.Speak(fabulaeRequest.Voice1Name, fabulaeRequest.Conversation, audioBucketPath)
+		outputfile, err := fabulae.SpeakContext(ctx, fabulaeRequest.Voice1Name, fabulaeRequest.Conversation, audioBucketPath)
 		if err != nil {
-			http.Error(w, "error synthesizing", http.StatusInternalServerError)
-			return
+			return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error synthesizing", err)
 		}
 		log.Printf("generated audio at: %s", outputfile)
 		outputfiles := []string{}
 		outputfiles = append(outputfiles, outputfile)
+		// moved to the bucket, or removed if the job fails
+		defer fabulae.RemoveFiles(outputfiles...)
+		// synthesized at the sample rate, but Text-to-Speech voices are mono
+		if err := fabulae.ConvertEpisode(outputfile, fabulaeRequest.audioFormat()); err != nil {
+			return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error converting audio", err)
+		}
 		log.Printf("outputfiles: %s", outputfiles)
-		response = FabulaeResponse{"", outputfiles}
-		err = moveFilesToAudioBucket(outputfiles)
+		response.OutputFiles = outputfiles
+		if durations, err := fabulae.AudioDurations(outputfiles); err == nil {
+			response.Duration = durations[0].Seconds()
+		}
+		if response.DriveFiles, err = uploadToDrive(ctx, fabulaeRequest, outputfiles); err != nil {
+			return response, failed(http.StatusInternalServerError, codeStorageFailed, "error uploading to Drive", err)
+		}
+		err = moveFilesToAudioBucket(fabulaeRequest.BucketPrefix, outputfiles)
 		if err != nil {
-			http.Error(w, "error writing to Storage", http.StatusInternalServerError)
-			return
+			return response, failed(http.StatusInternalServerError, codeStorageFailed, "error writing to Storage", err)
 		}
 
 	} else { // two-voice conversation
-		outputfiles, err := fabulae.Fabulae(fabulaeRequest.Voice1Name, fabulaeRequest.Voice2Name, fabulaeRequest.Conversation, "", true, "")
+		// refuse rather than run out of disk partway, or stream the turns
+		// into the episode if only it fits
+		streaming, err := checkDisk(fabulaeRequest)
 		if err != nil {
-			http.Error(w, "error synthesizing", http.StatusInternalServerError)
-			return
+			return response, failed(http.StatusInsufficientStorage, codeInsufficientDisk, err.Error(), err)
+		}
+		var outputfiles []string
+		var durations []time.Duration
+		if streaming {
+			var episode string
+			if episode, durations, err = streamEpisode(ctx, fabulaeRequest); err != nil {
+				return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error synthesizing", err)
+			}
+			outputfiles = []string{episode}
+		} else {
+			if outputfiles, err = fabulae.FabulaeContext(ctx, fabulaeRequest.Voice1Name, fabulaeRequest.Voice2Name, fabulaeRequest.Conversation, "", true, ""); err != nil {
+				return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error synthesizing", err)
+			}
+			// the transcript is untimed if a turn can't be read
+			durations, _ = fabulae.AudioDurations(outputfiles)
 		}
 		log.Printf("outputfiles: %s", outputfiles)
+		// the turns, and the files made from them, are moved to the bucket
+		// or removed if the job fails
+		var uploads []string
+		defer func() { fabulae.RemoveFiles(slices.Concat(outputfiles, uploads)...) }()
+
+		// time the transcript by its turns before they're joined
+		var turns []fabulae.TranscriptTurn
+		if len(fabulaeRequest.TranscriptFormats) > 0 || fabulaeRequest.EpisodePage {
+			turns = fabulae.TranscriptTurns(fabulaeRequest.Conversation, fabulaeRequest.Voice1Name, fabulaeRequest.Voice2Name, "")
+			if durations != nil {
+				fabulae.TimeTurns(turns, durations)
+			}
+		}
 
-		// join
-		combinedWavFile := combineWavFiles("new", outputfiles)
+		var chapters []fabulae.Chapter
+		if len(fabulaeRequest.Ads) > 0 {
+			if outputfiles, chapters, err = insertAds(ctx, fabulaeRequest.Ads, outputfiles, turns); err != nil {
+				return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error inserting ads", err)
+			}
+		}
+
+		// join, unless the turns were streamed into the episode
+		combinedWavFile := outputfiles[0]
+		var timeline fabulae.Timeline
+		if !streaming {
+			combinedWavFile, timeline, err = fabulae.MixWavFiles("new", outputfiles, time.Duration(fabulaeRequest.CrossfadeSeconds*float64(time.Second)), fabulaeRequest.audioFormat())
+			if err != nil {
+				return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error combining audio", err)
+			}
+		}
+		if fabulaeRequest.Mastering != nil {
+			if err := fabulae.MasterEpisode(combinedWavFile, *fabulaeRequest.Mastering); err != nil {
+				return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error mastering audio", err)
+			}
+		}
+		timeline.RetimeTurns(turns)
+		timeline.RetimeChapters(chapters)
+		if fabulaeRequest.Music != "" {
+			if err := addMusic(ctx, combinedWavFile, fabulaeRequest, turns, chapters); err != nil {
+				return response, failed(http.StatusInternalServerError, codeSynthesisFailed, "error mixing music", err)
+			}
+		}
 		outputfiles = []string{combinedWavFile}
+		if durations, err := fabulae.AudioDurations(outputfiles); err == nil {
+			response.Duration = durations[0].Seconds()
+		}
+		uploads = outputfiles
+		if len(chapters) > 0 {
+			response.Chapters = fabulae.ChaptersFile(combinedWavFile)
+			if err := fabulae.WriteChapters(response.Chapters, chapters); err != nil {
+				return response, failed(http.StatusInternalServerError, codeInternal, "error writing chapters", err)
+			}
+			uploads = append(uploads, response.Chapters)
+		}
+		if len(fabulaeRequest.SpeedVariants) > 0 {
+			variants, err := fabulae.WriteSpeedVariants(combinedWavFile, fabulaeRequest.SpeedVariants)
+			if err != nil {
+				return response, failed(http.StatusInternalServerError, codeInternal, "error writing speed variants", err)
+			}
+			response.SpeedVariants = map[string]string{}
+			for i, speed := range fabulaeRequest.SpeedVariants {
+				response.SpeedVariants[fmt.Sprintf("%gx", speed)] = variants[i]
+			}
+			uploads = append(uploads, variants...)
+		}
+		if len(fabulaeRequest.ExportProfiles) > 0 {
+			profiles, _ := fabulae.LookupOutputProfiles(fabulaeRequest.ExportProfiles)
+			exports, err := fabulae.WriteExports(ctx, combinedWavFile, profiles)
+			if err != nil {
+				return response, failed(http.StatusInternalServerError, codeInternal, "error writing exports", err)
+			}
+			response.Exports = map[string]string{}
+			for i, p := range profiles {
+				response.Exports[p.Name] = exports[i]
+			}
+			uploads = append(uploads, exports...)
+		}
+		if fabulaeRequest.EpisodePage {
+			page, err := writeEpisodePage(combinedWavFile, fabulaeRequest, turns)
+			if err != nil {
+				return response, failed(http.StatusInternalServerError, codeInternal, "error writing episode page", err)
+			}
+			response.Page = page
+			uploads = append(uploads, page)
+		}
+		if len(fabulaeRequest.TranscriptFormats) > 0 {
+			if fabulaeRequest.WordTimings {
+				if err := fabulae.AlignTranscript(ctx, projectID, combinedWavFile, turns, ""); err != nil {
+					log.Printf("%s: transcript words aren't timed, unable to align them: %v", jobID, err)
+				}
+			}
+			response.Transcripts, err = fabulae.WriteTranscripts(combinedWavFile, "", turns, fabulaeRequest.TranscriptFormats)
+			if err != nil {
+				return response, failed(http.StatusInternalServerError, codeInternal, "error writing transcripts", err)
+			}
+			for _, format := range fabulaeRequest.TranscriptFormats {
+				uploads = append(uploads, response.Transcripts[format])
+			}
+		}
+		if response.FactCheck != nil {
+			response.FactCheckReport, err = fabulae.WriteFactCheck(combinedWavFile, fabulaeRequest.Title, *response.FactCheck)
+			if err != nil {
+				return response, failed(http.StatusInternalServerError, codeInternal, "error writing fact check", err)
+			}
+			uploads = append(uploads, response.FactCheckReport)
+		}
 
-		response = FabulaeResponse{"", outputfiles}
-		err = moveFilesToAudioBucket(outputfiles)
+		response.OutputFiles = outputfiles
+		if response.DriveFiles, err = uploadToDrive(ctx, fabulaeRequest, uploads); err != nil {
+			return response, failed(http.StatusInternalServerError, codeStorageFailed, "error uploading to Drive", err)
+		}
+		err = moveFilesToAudioBucket(fabulaeRequest.BucketPrefix, uploads)
 		if err != nil {
-			http.Error(w, "error writing to Storage", http.StatusInternalServerError)
-			return
+			return response, failed(http.StatusInternalServerError, codeStorageFailed, "error writing to Storage", err)
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	//fmt.Fprintf(w, "%s", body)
-	err = json.NewEncoder(w).Encode(response)
+	prefixFiles(fabulaeRequest.BucketPrefix, &response)
+	if fingerprint != nil {
+		if err := catalogEpisode(ctx, *fingerprint, jobID, fabulaeRequest.Episode, response); err != nil {
+			log.Printf("job %s: unable to add the episode to the catalog: %v", jobID, err)
+		}
+	}
+	notifyEpisode(ctx, jobID, fabulaeRequest, response)
+	rememberEpisode(ctx, jobID, fabulaeRequest)
+	recordShowEpisode(ctx, jobID, fabulaeRequest)
+	return response, nil
+}
+
+// writeEpisodePage writes the episode's web page next to its audio, for
+// upload with it
+func writeEpisodePage(audiofile string, req FabulaeRequest, turns []fabulae.TranscriptTurn) (string, error) {
+	page := fabulae.EpisodePage{
+		Title:     req.Title,
+		Audio:     filepath.Base(audiofile),
+		Source:    req.PDFURL,
+		ShowNotes: req.ShowNotes,
+		Turns:     turns,
+		Speakers:  req.HostNames,
+		Created:   time.Now(),
+	}
+	if page.Title == "" {
+		page.Title = req.ShowName
+	}
+	if page.Title == "" {
+		page.Title = "Episode " + strings.TrimSuffix(filepath.Base(audiofile), filepath.Ext(audiofile))
+	}
+	if page.ShowNotes == "" {
+		page.ShowNotes = fabulae.DisclosureText("")
+	}
+	if durations, err := fabulae.AudioDurations([]string{audiofile}); err == nil {
+		page.Duration = durations[0]
+	}
+	filename := fabulae.EpisodePageFile(audiofile)
+	return filename, fabulae.WriteEpisodePage(filename, page)
+}
+
+// uploadToDrive uploads a job's files to its Drive folder, if it has one,
+// before they're moved to the audio bucket
+func uploadToDrive(ctx context.Context, req FabulaeRequest, files []string) ([]fabulae.DriveFile, error) {
+	folder := req.DriveFolder
+	if folder == "" {
+		folder = driveFolder
+	}
+	if folder == "" {
+		return nil, nil
+	}
+	return fabulae.UploadToDrive(ctx, folder, files...)
+}
+
+// transcriptObject is where a job's generated transcript is stored in the audio bucket
+func transcriptObject(jobID string) (string, string) {
+	return bucketObject(fmt.Sprintf("transcripts/%s.txt", jobID))
+}
+
+// saveTranscript stores a generated transcript, returning its gs:// URI
+func saveTranscript(ctx context.Context, jobID, transcript string) (string, error) {
+	client, err := storageClient(ctx)
 	if err != nil {
-		log.Print(err)
+		return "", err
 	}
+
+	bucketName, objectName := transcriptObject(jobID)
+	if err := writeObject(ctx, client, bucketName, objectName, "text/plain; charset=utf-8", []byte(transcript)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s", bucketName, objectName), nil
 }
 
-// combineWavFiles appends wav files to a single one
-func combineWavFiles(title string, audiolist []string) string {
-	wavs := []*wav.File{}
-	for _, i := range audiolist {
-		wavfile := &wav.File{}
-		audiofile := filepath.Join(".", i)
-		audiobytes, err := os.ReadFile(audiofile)
-		if err != nil {
-			log.Fatalf("can't read %s: %v", audiofile, err)
+// loadTranscript reads the transcript stored for a job, if there is one
+func loadTranscript(ctx context.Context, jobID string) (string, string, error) {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	bucketName, objectName := transcriptObject(jobID)
+	var data []byte
+	err = readObject(ctx, client, bucketName, objectName, func(r io.Reader) error {
+		data, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return string(data), fmt.Sprintf("gs://%s/%s", bucketName, objectName), nil
+}
+
+// budgetFromEnv reads the job budget, MAX_DOCUMENT_TOKENS and MAX_TTS_CHARACTERS
+func budgetFromEnv() fabulae.Budget {
+	var b fabulae.Budget
+	for _, v := range []struct {
+		name  string
+		limit *int
+	}{{"MAX_DOCUMENT_TOKENS", &b.DocumentTokens}, {"MAX_TTS_CHARACTERS", &b.TTSCharacters}} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
 		}
-		wav.Unmarshal(audiobytes, wavfile)
-		wavs = append(wavs, wavfile)
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			log.Printf("invalid %s %q, not limited", v.name, s)
+			continue
+		}
+		*v.limit = n
 	}
-	log.Printf("Samples per sec: %d, Bits per sample: %d, Channels: %d",
-		wavs[0].SamplesPerSec(),
-		wavs[0].BitsPerSample(),
-		wavs[0].Channels(),
-	)
-	log.Printf("%d wav files", len(wavs))
+	return b
+}
 
-	// combine all wavs into one
-	outputwav, _ := wav.New(wavs[0].SamplesPerSec(), wavs[0].BitsPerSample(), wavs[0].Channels())
-	for _, wav := range wavs {
-		io.Copy(outputwav, wav)
+// overBudget is the job error for a budget error, with the estimate and
+// limit as details
+func overBudget(jobID string, err error) *jobError {
+	var over *fabulae.BudgetError
+	if !errors.As(err, &over) {
+		return nil
 	}
+	return &jobError{http.StatusBadRequest, errorResponse{codeOverBudget, err.Error(), over, jobID}}
+}
 
-	file, _ := wav.Marshal(outputwav)
+// contextCacheFromEnv reads CONTEXT_CACHE_TTL, e.g. 1h, which caches each
+// document with Vertex AI context caching for that long, so the instance
+// generating from it again bills its tokens once
+func contextCacheFromEnv() {
+	s := os.Getenv("CONTEXT_CACHE_TTL")
+	if s == "" {
+		return
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Printf("invalid CONTEXT_CACHE_TTL %q, not caching", s)
+		return
+	}
+	fabulae.ContextCaching, fabulae.ContextCacheTTL = true, d
+}
 
-	outputfilename := fmt.Sprintf("%s_%s.wav", title, time.Now().Format("20060102.030405.06"))
-	os.WriteFile(outputfilename, file, 0644)
+// turnChecksFromEnv reads CHECK_TURNS, true to check each synthesized turn
+// for glitches and synthesize it again if it has any
+func turnChecksFromEnv() {
+	s := os.Getenv("CHECK_TURNS")
+	if s == "" {
+		return
+	}
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Printf("invalid CHECK_TURNS %q, not checking turns", s)
+		return
+	}
+	fabulae.TurnChecks = on
+}
 
-	// delete temp files
-	for _, i := range audiolist {
-		err := os.Remove(i)
+// urlPolicyFromEnv configures which pdf_url sources the service will fetch
+// FETCH_ALLOWED_HOSTS and FETCH_DENIED_HOSTS are comma separated hosts, a
+// leading dot matches subdomains; FETCH_ALLOWED_PORTS are comma separated ports;
+// FETCH_ALLOW_PRIVATE=true permits internal addresses
+func urlPolicyFromEnv() fabulae.URLPolicy {
+	policy := fabulae.URLPolicy{
+		AllowedHosts: splitList(os.Getenv("FETCH_ALLOWED_HOSTS")),
+		DeniedHosts:  append(splitList(os.Getenv("FETCH_DENIED_HOSTS")), "metadata.google.internal"),
+	}
+	for _, p := range splitList(os.Getenv("FETCH_ALLOWED_PORTS")) {
+		port, err := strconv.Atoi(p)
 		if err != nil {
-			log.Printf("os.Remove: %v", err)
+			log.Printf("ignoring invalid FETCH_ALLOWED_PORTS entry %q", p)
+			continue
 		}
+		policy.AllowedPorts = append(policy.AllowedPorts, port)
+	}
+	policy.AllowPrivate, _ = strconv.ParseBool(os.Getenv("FETCH_ALLOW_PRIVATE"))
+	if len(policy.AllowedHosts) > 0 {
+		log.Printf("pdf_url hosts allowed: %s", policy.AllowedHosts)
+	}
+	// gs:// and Drive sources are read as the service account, so only
+	// from these
+	policy.AllowedBuckets = splitList(os.Getenv("SOURCE_BUCKETS"))
+	policy.AllowedDriveFolders = splitList(os.Getenv("DRIVE_SOURCE_FOLDERS"))
+	return policy
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// addPDFSourceToGCS retrieves a PDF from a URL and streams it into the audio
+// bucket under sources/, returning the gs:// URI for generation and the
+// document's SHA-256
+func addPDFSourceToGCS(ctx context.Context, pdfurl string) (string, string, error) {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	parts := strings.Split(audioBucketPath, "/")
+	bucketName := parts[0]
+	storagePath := strings.Join(append(parts[1:], "sources"), "/")
+
+	base := "source"
+	if u, err := url.Parse(pdfurl); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		base = strings.TrimSuffix(path.Base(u.Path), ".pdf")
+	}
+	objectName := fmt.Sprintf("%s/%s_%s.pdf", strings.TrimPrefix(storagePath, "/"), base, time.Now().Format("20060102.030405.06"))
+
+	// cancelling the writer's context before Close discards a partial object
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := client.Bucket(bucketName).Object(objectName).NewWriter(wctx)
+	wc.ContentType = "application/pdf"
+
+	hash := sha256.New()
+	n, err := fabulae.FetchPDF(ctx, pdfurl, io.MultiWriter(wc, hash), fabulae.FetchOptions{Policy: &fetchPolicy})
+	if err != nil {
+		cancel()
+		wc.Close()
+		return "", "", err
+	}
+	if err := wc.Close(); err != nil {
+		return "", "", fmt.Errorf("Writer.Close: %w", err)
 	}
+	log.Printf("wrote %d bytes from %s to gs://%s/%s", n, pdfurl, bucketName, objectName)
 
-	return outputfilename
+	return fmt.Sprintf("gs://%s/%s", bucketName, objectName), hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func moveFilesToAudioBucket(outputfiles []string) error {
+// moveFilesToAudioBucket uploads files to the audio bucket, under prefix if
+// set, and removes them
+func moveFilesToAudioBucket(prefix string, outputfiles []string) error {
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	client, err := storageClient(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Close()
 
 	parts := strings.Split(audioBucketPath, "/")
 	bucketName := parts[0]
 	storagePath := strings.Join(parts[1:], "/")
 
 	for _, audiofile := range outputfiles {
-		objectName := fmt.Sprintf("%s/%s", storagePath, audiofile)
+		objectName := fmt.Sprintf("%s/%s", storagePath, path.Join(prefix, audiofile))
 		f, err := os.Open(audiofile)
 		if err != nil {
 			log.Printf("unable to open file %s: %v", audiofile, err)
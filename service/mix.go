@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+// maxWavBytes bounds a downloaded wav, over 45 minutes of 48 kHz stereo
+const maxWavBytes int64 = 512 << 20
+
+// downloadWav copies a wav, e.g. a recorded ad, from Cloud Storage to a
+// temporary file, up to maxWavBytes
+func downloadWav(ctx context.Context, uri string) (string, error) {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	bucketName, objectName, _ := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+	f, err := os.CreateTemp("", "fabulae-*.wav")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	err = readObject(ctx, client, bucketName, objectName, func(r io.Reader) error {
+		n, err := io.Copy(f, io.LimitReader(r, maxWavBytes+1))
+		if err == nil && n > maxWavBytes {
+			err = fmt.Errorf("%w: limit %d", fabulae.ErrTooLarge, maxWavBytes)
+		}
+		return err
+	})
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("unable to read %s: %w", uri, err)
+	}
+	log.Printf("downloaded %s", uri)
+	return f.Name(), nil
+}
+
+// isWavURI checks uri is a gs://bucket/object wav
+func isWavURI(uri string) bool {
+	return fabulae.IsGCSURI(uri) && fabulae.ValidateSourceURI(uri) == nil && strings.HasSuffix(strings.ToLower(uri), ".wav")
+}
+
+// addMusic plays the request's music under the episode, moving the turns
+// and chapters after its lead
+func addMusic(ctx context.Context, audiofile string, req FabulaeRequest, turns []fabulae.TranscriptTurn, chapters []fabulae.Chapter) error {
+	local, err := downloadWav(ctx, req.Music)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(local)
+	opts := fabulae.MusicOptions{Music: local, Gain: req.MusicGain}
+	if err := fabulae.AddMusic(audiofile, opts); err != nil {
+		return err
+	}
+	fabulae.ShiftTurns(turns, opts.LeadTime())
+	fabulae.ShiftChapters(chapters, opts.LeadTime())
+	// the music before and after belongs to the first and last chapters
+	if len(chapters) > 0 {
+		chapters[0].Start = 0
+		chapters[len(chapters)-1].End += opts.LeadTime()
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+// modelCatalogTTL is how long the list of models is reused
+const modelCatalogTTL = time.Hour
+
+// modelCatalog caches the Gemini models available in the service's region
+type modelCatalog struct {
+	mu      sync.Mutex
+	list    []fabulae.GeminiModel
+	fetched time.Time
+}
+
+var models modelCatalog
+
+// get returns the available models, listing them again when the cache is stale
+func (c *modelCatalog) get(ctx context.Context) ([]fabulae.GeminiModel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.list == nil || time.Since(c.fetched) > modelCatalogTTL {
+		list, err := fabulae.ListModels(ctx, projectID, location)
+		if err != nil {
+			return nil, err
+		}
+		c.list, c.fetched = list, time.Now()
+	}
+	return c.list, nil
+}
+
+// modelsResponse is the response to GET /models
+type modelsResponse struct {
+	Default  string                `json:"default"`
+	Location string                `json:"location"`
+	Models   []fabulae.GeminiModel `json:"models"`
+}
+
+// handleListModels lists the Gemini models available for pdf_url sources
+func handleListModels(w http.ResponseWriter, r *http.Request) {
+	if projectID == "" {
+		writeError(w, http.StatusNotImplemented, errorResponse{Code: codeNotEnabled, Message: "pdf_url sources are not enabled"})
+		return
+	}
+	list, err := models.get(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errorResponse{Code: codeModelsUnavailable, Message: "unable to list models", Details: err.Error()})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, modelsResponse{Default: modelName, Location: location, Models: list})
+}
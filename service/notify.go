@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghchinoy/fabulae"
+)
+
+// defaultLinkExpiry is how long a notification's link to the audio works
+const defaultLinkExpiry = 7 * 24 * time.Hour
+
+var (
+	// notifyWebhook is a Slack or Google Chat incoming webhook, told when
+	// each episode is ready, or the Secret Manager secret that holds it
+	notifyWebhook string
+	linkExpiry    = defaultLinkExpiry
+	notifyClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+// webhookMessage is the text message both Slack and Google Chat incoming
+// webhooks accept
+type webhookMessage struct {
+	Text string `json:"text"`
+}
+
+// notifyFromEnv configures notifications from NOTIFY_WEBHOOK_URL and
+// NOTIFY_LINK_EXPIRY
+func notifyFromEnv() {
+	notifyWebhook = os.Getenv("NOTIFY_WEBHOOK_URL")
+	if v := os.Getenv("NOTIFY_LINK_EXPIRY"); v != "" {
+		d, err := time.ParseDuration(v)
+		// V4 signed URLs last at most 7 days
+		if err != nil || d <= 0 || d > defaultLinkExpiry {
+			log.Printf("invalid NOTIFY_LINK_EXPIRY %q, using %s", v, defaultLinkExpiry)
+		} else {
+			linkExpiry = d
+		}
+	}
+	if notifyWebhook != "" {
+		log.Printf("notifying a webhook of finished episodes, links expire after %s", linkExpiry)
+	}
+	// the secret is read again for each episode, this reports access problems early
+	if fabulae.IsSecretName(notifyWebhook) {
+		if _, err := fabulae.Secret(context.Background(), notifyWebhook); err != nil {
+			log.Printf("NOTIFY_WEBHOOK_URL: %v", err)
+		}
+	}
+}
+
+// signedAudioURL is a link to an uploaded file, named as in the response,
+// that works without Cloud Storage access, until linkExpiry
+func signedAudioURL(ctx context.Context, filename string) (string, error) {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	bucketName, objectName := bucketObject(filename)
+	return client.Bucket(bucketName).SignedURL(objectName, &storage.SignedURLOptions{
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(linkExpiry),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+// episodeMessage describes a finished episode, linking its title to the audio
+func episodeMessage(jobID string, req FabulaeRequest, response FabulaeResponse, link string) string {
+	title := req.Title
+	if title == "" {
+		title = req.ShowName
+	}
+	if title == "" {
+		title = "Episode " + jobID
+	}
+	text := fmt.Sprintf("New episode: <%s|%s>", link, title)
+	if response.Duration > 0 {
+		text += fmt.Sprintf(" (%s)", (time.Duration(response.Duration) * time.Second).Round(time.Second))
+	}
+	if req.PDFURL != "" {
+		text += "\nSource: " + req.PDFURL
+	}
+	return text + fmt.Sprintf("\nJob %s, link expires %s", jobID, time.Now().Add(linkExpiry).UTC().Format(time.RFC1123))
+}
+
+// notifyEpisode posts a finished episode to the webhook, if there is one
+// Failures are logged, the episode is still done
+func notifyEpisode(ctx context.Context, jobID string, req FabulaeRequest, response FabulaeResponse) {
+	if notifyWebhook == "" || len(response.OutputFiles) == 0 {
+		return
+	}
+	link, err := signedAudioURL(ctx, response.OutputFiles[0])
+	if err != nil {
+		log.Printf("job %s: unable to sign a link for the notification: %v", jobID, err)
+		return
+	}
+	body, err := json.Marshal(webhookMessage{episodeMessage(jobID, req, response, link)})
+	if err != nil {
+		log.Printf("job %s: %v", jobID, err)
+		return
+	}
+	// a Secret Manager secret is read for each notification, so rotating it
+	// takes effect without a restart
+	webhook, err := fabulae.ResolveSecret(ctx, notifyWebhook)
+	if err != nil {
+		log.Printf("job %s: unable to read NOTIFY_WEBHOOK_URL: %v", jobID, err)
+		return
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("job %s: invalid NOTIFY_WEBHOOK_URL: %v", jobID, err)
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	resp, err := notifyClient.Do(httpReq)
+	if err != nil {
+		log.Printf("job %s: unable to notify: %v", jobID, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("job %s: notification webhook responded %s", jobID, resp.Status)
+		return
+	}
+	log.Printf("job %s: notified", jobID)
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+// oidcAudience is the audience of OIDC tokens for a URL, its scheme and host
+func oidcAudience(target string) string {
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	}
+	return target
+}
+
+// verifyOIDC checks r has a Google-signed OIDC bearer token for audience,
+// issued to the service account email
+func verifyOIDC(ctx context.Context, r *http.Request, audience, email string) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return errors.New("no OIDC bearer token")
+	}
+	payload, err := idtoken.Validate(ctx, token, audience)
+	if err != nil {
+		return err
+	}
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if claimed, _ := payload.Claims["email"].(string); !verified || !strings.EqualFold(claimed, email) {
+		return fmt.Errorf("the token isn't from %s", email)
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ghchinoy/fabulae"
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// personaCollection is the Firestore collection of host and expert personas
+var personaCollection = "fabulae_personas"
+
+// errNoPersona is a persona ID that isn't stored
+var errNoPersona = errors.New("no such persona")
+
+// PersonaResource is a stored persona and the ID requests cast it by
+type PersonaResource struct {
+	ID string `json:"id"`
+	fabulae.Persona
+}
+
+// personaStore keeps personas in Firestore
+type personaStore struct {
+	docs   *firestore.ProjectsDatabasesDocumentsService
+	parent string
+}
+
+func newPersonaStore(ctx context.Context) (*personaStore, error) {
+	if projectID == "" {
+		return nil, errors.New("personas require PROJECT_ID")
+	}
+	srv, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &personaStore{
+		docs:   srv.Projects.Databases.Documents,
+		parent: fmt.Sprintf("projects/%s/databases/%s/documents", projectID, firestoreDatabase),
+	}, nil
+}
+
+func (s *personaStore) name(id string) string {
+	return fmt.Sprintf("%s/%s/%s", s.parent, personaCollection, id)
+}
+
+func stringValue(s string) firestore.Value {
+	return firestore.Value{StringValue: s, ForceSendFields: []string{"StringValue"}}
+}
+
+func arrayValue(items []string) firestore.Value {
+	values := &firestore.ArrayValue{}
+	for _, item := range items {
+		v := stringValue(item)
+		values.Values = append(values.Values, &v)
+	}
+	return firestore.Value{ArrayValue: values}
+}
+
+func arrayStrings(v firestore.Value) []string {
+	if v.ArrayValue == nil {
+		return nil
+	}
+	var items []string
+	for _, item := range v.ArrayValue.Values {
+		items = append(items, item.StringValue)
+	}
+	return items
+}
+
+func personaFields(p fabulae.Persona) map[string]firestore.Value {
+	return map[string]firestore.Value{
+		"name":         stringValue(p.Name),
+		"voice":        stringValue(p.Voice),
+		"personality":  stringValue(p.Personality),
+		"catchphrases": arrayValue(p.Catchphrases),
+		"expertise":    arrayValue(p.Expertise),
+		"memory":       arrayValue(p.Memory),
+	}
+}
+
+func personaFrom(doc *firestore.Document) PersonaResource {
+	f := doc.Fields
+	return PersonaResource{
+		ID: doc.Name[strings.LastIndex(doc.Name, "/")+1:],
+		Persona: fabulae.Persona{
+			Name:         f["name"].StringValue,
+			Voice:        f["voice"].StringValue,
+			Personality:  f["personality"].StringValue,
+			Catchphrases: arrayStrings(f["catchphrases"]),
+			Expertise:    arrayStrings(f["expertise"]),
+			Memory:       arrayStrings(f["memory"]),
+		},
+	}
+}
+
+// get returns a persona, errNoPersona if it isn't stored
+func (s *personaStore) get(ctx context.Context, id string) (PersonaResource, error) {
+	doc, err := s.docs.Get(s.name(id)).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return PersonaResource{}, fmt.Errorf("%w %q", errNoPersona, id)
+	}
+	if err != nil {
+		return PersonaResource{}, err
+	}
+	return personaFrom(doc), nil
+}
+
+// list returns every persona, by ID
+func (s *personaStore) list(ctx context.Context) ([]PersonaResource, error) {
+	personas := []PersonaResource{}
+	err := s.docs.List(s.parent, personaCollection).Pages(ctx, func(page *firestore.ListDocumentsResponse) error {
+		for _, doc := range page.Documents {
+			personas = append(personas, personaFrom(doc))
+		}
+		return nil
+	})
+	sort.Slice(personas, func(i, j int) bool { return personas[i].ID < personas[j].ID })
+	return personas, err
+}
+
+// put creates or replaces a persona
+func (s *personaStore) put(ctx context.Context, id string, p fabulae.Persona) error {
+	doc := &firestore.Document{Fields: personaFields(p)}
+	_, err := s.docs.Patch(s.name(id), doc).Context(ctx).Do()
+	return err
+}
+
+func (s *personaStore) remove(ctx context.Context, id string) error {
+	_, err := s.docs.Delete(s.name(id)).Context(ctx).Do()
+	return err
+}
+
+// personaIDs are the request's host_persona and expert_persona, in that order
+func (req FabulaeRequest) personaIDs() []string {
+	var ids []string
+	for _, id := range []string{req.HostPersona, req.ExpertPersona} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// castPersonas loads the request's personas, using their voices for voice1
+// and voice2 unless they're set
+func (req *FabulaeRequest) castPersonas(ctx context.Context) ([]fabulae.Persona, []fieldError) {
+	if req.HostPersona == "" && req.ExpertPersona == "" {
+		return nil, nil
+	}
+	if req.HostPersona == "" {
+		return nil, []fieldError{{codeMissingField, "host_persona", "expert_persona needs a host_persona"}}
+	}
+	store, err := newPersonaStore(ctx)
+	if err != nil {
+		return nil, []fieldError{{codeInvalidSetting, "host_persona", err.Error()}}
+	}
+	var personas []fabulae.Persona
+	var errs []fieldError
+	for i, v := range []struct{ field, id string }{{"host_persona", req.HostPersona}, {"expert_persona", req.ExpertPersona}} {
+		if v.id == "" {
+			continue
+		}
+		if err := fabulae.ValidatePersonaID(v.id); err != nil {
+			errs = append(errs, fieldError{codeInvalidSetting, v.field, err.Error()})
+			continue
+		}
+		p, err := store.get(ctx, v.id)
+		if err != nil {
+			errs = append(errs, fieldError{codeInvalidSetting, v.field, err.Error()})
+			continue
+		}
+		switch {
+		case p.Voice == "":
+		case i == 0 && req.Voice1Name == "":
+			req.Voice1Name = p.Voice
+		case i == 1 && req.Voice2Name == "":
+			req.Voice2Name = p.Voice
+		}
+		personas = append(personas, p.Persona)
+	}
+	return personas, errs
+}
+
+// rememberEpisode adds a finished episode to its personas' memory, failures
+// are only logged since the episode is done
+func rememberEpisode(ctx context.Context, jobID string, req FabulaeRequest) {
+	ids := req.personaIDs()
+	if len(ids) == 0 || req.Title == "" {
+		return
+	}
+	store, err := newPersonaStore(ctx)
+	if err != nil {
+		log.Printf("job %s: unable to update persona memory: %v", jobID, err)
+		return
+	}
+	for _, id := range ids {
+		p, err := store.get(ctx, id)
+		if err == nil {
+			p.Remember(req.Title)
+			err = store.put(ctx, id, p.Persona)
+		}
+		if err != nil {
+			log.Printf("job %s: unable to update persona %s memory: %v", jobID, id, err)
+		}
+	}
+}
+
+// personaFromPath checks the persona ID in the path and opens the store,
+// writing the error response if it can't
+func personaFromPath(w http.ResponseWriter, r *http.Request) (*personaStore, string, bool) {
+	id := r.PathValue("id")
+	if err := fabulae.ValidatePersonaID(id); err != nil {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: err.Error()})
+		return nil, "", false
+	}
+	store, ok := openPersonas(w, r)
+	return store, id, ok
+}
+
+func openPersonas(w http.ResponseWriter, r *http.Request) (*personaStore, bool) {
+	if projectID == "" {
+		writeError(w, http.StatusNotImplemented, errorResponse{Code: codeNotEnabled, Message: "personas require PROJECT_ID"})
+		return nil, false
+	}
+	store, err := newPersonaStore(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read personas", err.Error(), ""})
+		return nil, false
+	}
+	return store, true
+}
+
+// handleListPersonas lists the stored personas
+func handleListPersonas(w http.ResponseWriter, r *http.Request) {
+	store, ok := openPersonas(w, r)
+	if !ok {
+		return
+	}
+	personas, err := store.list(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read personas", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, personas)
+}
+
+// handleGetPersona returns a persona, with its memory of recent episodes
+func handleGetPersona(w http.ResponseWriter, r *http.Request) {
+	store, id, ok := personaFromPath(w, r)
+	if !ok {
+		return
+	}
+	p, err := store.get(r.Context(), id)
+	if errors.Is(err, errNoPersona) {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: err.Error()})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read persona", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, p)
+}
+
+// handlePutPersona creates or replaces a persona; without memory in the body
+// an existing persona keeps its memory, an empty list clears it
+func handlePutPersona(w http.ResponseWriter, r *http.Request) {
+	if !authorizedPromptAdmin(w, r) {
+		return
+	}
+	store, id, ok := personaFromPath(w, r)
+	if !ok {
+		return
+	}
+	var p fabulae.Persona
+	if !decodeRequest(w, r, "", &p) {
+		return
+	}
+	ctx := r.Context()
+	if p.Name == "" {
+		p.Name = id
+	}
+	if errs := validatePersona(ctx, p); len(errs) > 0 {
+		writeValidationErrors(w, "", errs...)
+		return
+	}
+	if p.Memory == nil {
+		existing, err := store.get(ctx, id)
+		if err != nil && !errors.Is(err, errNoPersona) {
+			writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read persona", err.Error(), ""})
+			return
+		}
+		p.Memory = existing.Memory
+	}
+	if err := store.put(ctx, id, p); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to store persona", err.Error(), ""})
+		return
+	}
+	log.Printf("persona %s: updated", id)
+	writeJSONResponse(w, http.StatusOK, PersonaResource{id, p})
+}
+
+// handleDeletePersona removes a persona
+func handleDeletePersona(w http.ResponseWriter, r *http.Request) {
+	if !authorizedPromptAdmin(w, r) {
+		return
+	}
+	store, id, ok := personaFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := store.remove(r.Context(), id); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to remove persona", err.Error(), ""})
+		return
+	}
+	log.Printf("persona %s: removed", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validatePersona checks a persona's voice and the length of its settings,
+// which are all part of the prompt
+func validatePersona(ctx context.Context, p fabulae.Persona) []fieldError {
+	errs := []fieldError{}
+	if p.Voice != "" && !fabulae.IsCustomVoice(p.Voice) && !voices.known(ctx, p.Voice) {
+		errs = append(errs, fieldError{codeInvalidVoice, "voice", fmt.Sprintf("unknown voice %q", p.Voice)})
+	}
+	settings := []struct{ field, value string }{{"name", p.Name}, {"personality", p.Personality}}
+	for _, field := range []struct {
+		name  string
+		items []string
+	}{{"catchphrases", p.Catchphrases}, {"expertise", p.Expertise}, {"memory", p.Memory}} {
+		if len(field.items) > maxPersonaItems {
+			errs = append(errs, fieldError{codeInvalidSetting, field.name, fmt.Sprintf("%s has at most %d items", field.name, maxPersonaItems)})
+		}
+		for _, item := range field.items {
+			settings = append(settings, struct{ field, value string }{field.name, item})
+		}
+	}
+	for _, v := range settings {
+		if len(v.value) > maxPromptSetting {
+			errs = append(errs, fieldError{codeInvalidSetting, v.field, fmt.Sprintf("%s is %d characters, limit is %d", v.field, len(v.value), maxPromptSetting)})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,418 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghchinoy/fabulae"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// builtinVersion is the version of a prompt built into fabulae
+	builtinVersion = "builtin"
+	// promptCacheTTL is how long an instance reuses the current prompt, so
+	// updates reach every instance within it
+	promptCacheTTL = time.Minute
+	// maxPromptBytes bounds a stored prompt
+	maxPromptBytes = 64 << 10
+)
+
+var (
+	// promptAdminToken authorizes prompt updates, which are disabled without it
+	promptAdminToken string
+	prompts          promptCache
+)
+
+// PromptVersion is a version of a prompt template
+type PromptVersion struct {
+	Name    string    `json:"name"`
+	Version string    `json:"version"`
+	Updated time.Time `json:"updated,omitempty"`
+	Current bool      `json:"current"`
+	Text    string    `json:"text,omitempty"`
+}
+
+// promptPointer is prompts/NAME/current.json, the version in use
+type promptPointer struct {
+	Version string    `json:"version"`
+	Updated time.Time `json:"updated"`
+}
+
+// promptObject is where a prompt's files are under the audio bucket path
+func promptObject(name, file string) (string, string) {
+	return bucketObject(path.Join("prompts", name, file))
+}
+
+// promptCache keeps current prompts for promptCacheTTL
+type promptCache struct {
+	mu      sync.Mutex
+	current map[string]PromptVersion
+	fetched map[string]time.Time
+}
+
+// get returns the current version of a prompt, stored or built in
+func (c *promptCache) get(ctx context.Context, name string) (PromptVersion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.current[name]; ok && time.Since(c.fetched[name]) < promptCacheTTL {
+		return v, nil
+	}
+	v, err := loadCurrentPrompt(ctx, name)
+	if err != nil {
+		return v, err
+	}
+	if c.current == nil {
+		c.current, c.fetched = map[string]PromptVersion{}, map[string]time.Time{}
+	}
+	c.current[name], c.fetched[name] = v, time.Now()
+	return v, nil
+}
+
+// forget drops a prompt from the cache after it changes
+func (c *promptCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.current, name)
+}
+
+// loadCurrentPrompt reads the version current.json points to, or the
+// built-in prompt if there isn't one
+func loadCurrentPrompt(ctx context.Context, name string) (PromptVersion, error) {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return PromptVersion{}, err
+	}
+
+	var pointer promptPointer
+	bucketName, objectName := promptObject(name, "current.json")
+	if err := readObject(ctx, client, bucketName, objectName, func(r io.Reader) error { return json.NewDecoder(r).Decode(&pointer) }); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return builtinPrompt(name)
+		}
+		return PromptVersion{}, err
+	}
+	v, err := loadPromptVersion(ctx, client, name, pointer.Version)
+	v.Current = true
+	return v, err
+}
+
+// builtinPrompt is the text of a prompt built into fabulae
+func builtinPrompt(name string) (PromptVersion, error) {
+	text, err := fabulae.BuiltinPrompt(name)
+	return PromptVersion{Name: name, Version: builtinVersion, Current: true, Text: text}, err
+}
+
+// loadPromptVersion reads a stored version of a prompt
+func loadPromptVersion(ctx context.Context, client *storage.Client, name, version string) (PromptVersion, error) {
+	v := PromptVersion{Name: name, Version: version}
+	bucketName, objectName := promptObject(name, path.Join("versions", version+".tpl"))
+	err := readObject(ctx, client, bucketName, objectName, func(r io.Reader) error {
+		text, err := io.ReadAll(r)
+		v.Text = string(text)
+		return err
+	})
+	return v, err
+}
+
+func readObject(ctx context.Context, client *storage.Client, bucketName, objectName string, read func(io.Reader) error) error {
+	rc, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return read(rc)
+}
+
+func writeObject(ctx context.Context, client *storage.Client, bucketName, objectName, contentType string, data []byte) error {
+	wc := client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
+	wc.ContentType = contentType
+	if _, err := wc.Write(data); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// setCurrentPrompt points current.json at a version, or removes it for the
+// built-in prompt
+func setCurrentPrompt(ctx context.Context, client *storage.Client, name, version string) error {
+	defer prompts.forget(name)
+	bucketName, objectName := promptObject(name, "current.json")
+	if version == builtinVersion {
+		err := client.Bucket(bucketName).Object(objectName).Delete(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil
+		}
+		return err
+	}
+	pointer, err := json.Marshal(promptPointer{Version: version, Updated: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return writeObject(ctx, client, bucketName, objectName, "application/json", pointer)
+}
+
+// listPromptVersions lists a prompt's stored versions, oldest first, and the
+// built-in one
+func listPromptVersions(ctx context.Context, client *storage.Client, name string) ([]PromptVersion, error) {
+	current, err := prompts.get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	versions := []PromptVersion{{Name: name, Version: builtinVersion, Current: current.Version == builtinVersion}}
+	bucketName, prefix := promptObject(name, "versions/")
+	it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		version := strings.TrimSuffix(path.Base(attrs.Name), ".tpl")
+		versions = append(versions, PromptVersion{Name: name, Version: version, Updated: attrs.Created, Current: version == current.Version})
+	}
+	sort.SliceStable(versions[1:], func(i, j int) bool { return versions[1+i].Version < versions[1+j].Version })
+	return versions, nil
+}
+
+// servicePrompt renders the current version of a prompt for a request
+func servicePrompt(ctx context.Context, name string, data fabulae.PromptData) (string, error) {
+	v, err := prompts.get(ctx, name)
+	if err != nil {
+		log.Printf("unable to load prompt %s, using the built-in one: %v", name, err)
+		if v, err = builtinPrompt(name); err != nil {
+			return "", err
+		}
+	}
+	return fabulae.RenderPrompt(name, v.Text, data)
+}
+
+// knownPrompt checks the prompt name in the path, writing a 404 if it's unknown
+func knownPrompt(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := r.PathValue("name")
+	if !slices.Contains(fabulae.PromptNames(), name) {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: fmt.Sprintf("unknown prompt %q, prompts are %s", name, strings.Join(fabulae.PromptNames(), ", "))})
+		return "", false
+	}
+	return name, true
+}
+
+// authorizedPromptAdmin checks the bearer token for prompt updates
+func authorizedPromptAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if promptAdminToken == "" {
+		writeError(w, http.StatusNotImplemented, errorResponse{Code: codeNotEnabled, Message: "prompt updates require PROMPT_ADMIN_TOKEN"})
+		return false
+	}
+	if !hasAdminToken(r) {
+		writeError(w, http.StatusForbidden, errorResponse{Code: codeForbidden, Message: "prompt updates need the admin bearer token"})
+		return false
+	}
+	return true
+}
+
+// hasAdminToken reports whether r has the PROMPT_ADMIN_TOKEN bearer token
+func hasAdminToken(r *http.Request) bool {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return promptAdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(promptAdminToken)) == 1
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+// handleGetPrompt returns the current version of a prompt
+func handleGetPrompt(w http.ResponseWriter, r *http.Request) {
+	name, ok := knownPrompt(w, r)
+	if !ok {
+		return
+	}
+	v, err := prompts.get(r.Context(), name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read prompt", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, v)
+}
+
+// handleListPromptVersions lists a prompt's versions
+func handleListPromptVersions(w http.ResponseWriter, r *http.Request) {
+	name, ok := knownPrompt(w, r)
+	if !ok {
+		return
+	}
+	client, err := storageClient(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read prompts", err.Error(), ""})
+		return
+	}
+	versions, err := listPromptVersions(r.Context(), client, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read prompts", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, versions)
+}
+
+// handleGetPromptVersion returns a version of a prompt
+func handleGetPromptVersion(w http.ResponseWriter, r *http.Request) {
+	name, ok := knownPrompt(w, r)
+	if !ok {
+		return
+	}
+	version := r.PathValue("version")
+	if version == builtinVersion {
+		v, err := builtinPrompt(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errorResponse{Code: codeInternal, Message: err.Error()})
+			return
+		}
+		v.Current = false
+		writeJSONResponse(w, http.StatusOK, v)
+		return
+	}
+	if !jobIDRe.MatchString(version) {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "unknown prompt version"})
+		return
+	}
+	client, err := storageClient(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read prompt", err.Error(), ""})
+		return
+	}
+	v, err := loadPromptVersion(r.Context(), client, name, version)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "unknown prompt version"})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read prompt", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, v)
+}
+
+// handlePutPrompt stores the body, a template, as a new version of a prompt
+// and makes it current
+func handlePutPrompt(w http.ResponseWriter, r *http.Request) {
+	name, ok := knownPrompt(w, r)
+	if !ok || !authorizedPromptAdmin(w, r) {
+		return
+	}
+	text, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPromptBytes))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, errorResponse{Code: codeRequestTooLarge, Message: fmt.Sprintf("prompt exceeds %d bytes", maxPromptBytes)})
+		return
+	}
+	if err != nil || strings.TrimSpace(string(text)) == "" {
+		writeValidationErrors(w, "", fieldError{codeEmptyBody, "", "the body is the prompt template"})
+		return
+	}
+	// a template that doesn't render would fail every generation
+	if _, err := fabulae.RenderPrompt(name, string(text), fabulae.PromptData{}); err != nil {
+		writeValidationErrors(w, "", fieldError{codeInvalidTemplate, "", err.Error()})
+		return
+	}
+
+	ctx := r.Context()
+	client, err := storageClient(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to store prompt", err.Error(), ""})
+		return
+	}
+	v := PromptVersion{Name: name, Version: newJobID(), Updated: time.Now().UTC(), Current: true, Text: string(text)}
+	bucketName, objectName := promptObject(name, path.Join("versions", v.Version+".tpl"))
+	if err := writeObject(ctx, client, bucketName, objectName, "text/plain; charset=utf-8", text); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to store prompt", err.Error(), ""})
+		return
+	}
+	if err := setCurrentPrompt(ctx, client, name, v.Version); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to update prompt", err.Error(), ""})
+		return
+	}
+	log.Printf("prompt %s: version %s is current", name, v.Version)
+	writeJSONResponse(w, http.StatusOK, v)
+}
+
+// handleRollbackPrompt makes a version of a prompt current, by default the
+// one before the current one; builtin goes back to the built-in prompt
+func handleRollbackPrompt(w http.ResponseWriter, r *http.Request) {
+	name, ok := knownPrompt(w, r)
+	if !ok || !authorizedPromptAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Version string `json:"version"`
+	}
+	if r.ContentLength != 0 && !decodeRequest(w, r, "", &req) {
+		return
+	}
+
+	ctx := r.Context()
+	client, err := storageClient(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read prompts", err.Error(), ""})
+		return
+	}
+	prompts.forget(name) // another instance may have changed it
+	versions, err := listPromptVersions(ctx, client, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read prompts", err.Error(), ""})
+		return
+	}
+	i := slices.IndexFunc(versions, func(v PromptVersion) bool { return v.Version == req.Version })
+	if req.Version == "" {
+		current := slices.IndexFunc(versions, func(v PromptVersion) bool { return v.Current })
+		if current <= 0 {
+			writeValidationErrors(w, "", fieldError{codeInvalidVersion, "version", "the built-in prompt is current, there's nothing to roll back"})
+			return
+		}
+		i = current - 1
+	}
+	if i < 0 {
+		writeValidationErrors(w, "", fieldError{codeInvalidVersion, "version", fmt.Sprintf("unknown version %q", req.Version)})
+		return
+	}
+	if err := setCurrentPrompt(ctx, client, name, versions[i].Version); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to update prompt", err.Error(), ""})
+		return
+	}
+	log.Printf("prompt %s: rolled back to version %s", name, versions[i].Version)
+	v := versions[i]
+	v.Current = true
+	writeJSONResponse(w, http.StatusOK, v)
+}
@@ -0,0 +1,328 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghchinoy/fabulae"
+	"google.golang.org/api/cloudtasks/v2"
+)
+
+// job statuses
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+	jobPartial = "partial_failure" // the transcript was generated, the audio failed
+)
+
+// progressInterval is how often a running job's progress is saved
+const progressInterval = 5 * time.Second
+
+// defaultTaskAttempts matches the Cloud Tasks default max attempts
+const defaultTaskAttempts = 5
+
+var (
+	// queue is set when synthesis is processed asynchronously
+	queue Queue
+	// maxTaskAttempts is the attempt after which a retryable failure is final
+	maxTaskAttempts = defaultTaskAttempts
+	// the worker only accepts tasks with an OIDC token for taskWorkerURL,
+	// from taskServiceAccount
+	taskWorkerURL      string
+	taskServiceAccount string
+
+	jobIDRe = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+)
+
+// Job is a unit of synthesis work
+type Job struct {
+	ID      string         `json:"job_id"`
+	Request FabulaeRequest `json:"request"`
+}
+
+// JobStatus is the persisted state of a job
+type JobStatus struct {
+	JobID    string           `json:"job_id"`
+	Status   string           `json:"status"`
+	Attempts int              `json:"attempts"`
+	Progress *JobProgress     `json:"progress,omitempty"` // while it's running
+	Response *FabulaeResponse `json:"response,omitempty"`
+	Error    *errorResponse   `json:"error,omitempty"`
+	Updated  time.Time        `json:"updated"`
+}
+
+// JobProgress is how far a running job's synthesis has got
+type JobProgress struct {
+	TurnsDone    int     `json:"turns_done"`
+	Turns        int     `json:"turns"`
+	Percent      float64 `json:"percent"`
+	BytesWritten int64   `json:"bytes_written"`
+}
+
+// Queue accepts jobs for processing by the worker endpoint, POST /tasks/synthesize
+// The queue is responsible for delivery, retries and backoff
+type Queue interface {
+	Enqueue(ctx context.Context, job Job) error
+}
+
+// cloudTasksQueue dispatches jobs as Cloud Tasks HTTP tasks
+type cloudTasksQueue struct {
+	service        *cloudtasks.Service
+	queuePath      string // projects/PROJECT/locations/LOCATION/queues/QUEUE
+	workerURL      string
+	serviceAccount string // for the task OIDC token
+}
+
+func newCloudTasksQueue(ctx context.Context, queuePath, workerURL, serviceAccount string) (*cloudTasksQueue, error) {
+	if workerURL == "" {
+		return nil, errors.New("TASKS_WORKER_URL is required with CLOUD_TASKS_QUEUE")
+	}
+	if serviceAccount == "" {
+		return nil, errors.New("TASKS_SERVICE_ACCOUNT is required with CLOUD_TASKS_QUEUE, the worker checks each task's OIDC token")
+	}
+	srv, err := cloudtasks.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudTasksQueue{srv, queuePath, workerURL, serviceAccount}, nil
+}
+
+// Enqueue creates a task named for the job, so a job is only queued once
+func (q *cloudTasksQueue) Enqueue(ctx context.Context, job Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	task := &cloudtasks.Task{
+		Name: fmt.Sprintf("%s/tasks/%s", q.queuePath, job.ID),
+		HttpRequest: &cloudtasks.HttpRequest{
+			HttpMethod: "POST",
+			Url:        q.workerURL,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       base64.StdEncoding.EncodeToString(body),
+		},
+		// synthesis of long conversations takes a while, 30m is the maximum
+		DispatchDeadline: "1800s",
+	}
+	task.HttpRequest.OidcToken = &cloudtasks.OidcToken{
+		ServiceAccountEmail: q.serviceAccount,
+		Audience:            oidcAudience(q.workerURL),
+	}
+	_, err = q.service.Projects.Locations.Queues.Tasks.Create(q.queuePath, &cloudtasks.CreateTaskRequest{Task: task}).Context(ctx).Do()
+	return err
+}
+
+// bucketObject returns the bucket and object name for name under the audio bucket path
+func bucketObject(name string) (string, string) {
+	bucketName, prefix, _ := strings.Cut(audioBucketPath, "/")
+	if prefix == "" {
+		return bucketName, name
+	}
+	return bucketName, fmt.Sprintf("%s/%s", strings.TrimSuffix(prefix, "/"), name)
+}
+
+// saveJobStatus writes the job status to jobs/JOB_ID.json in the audio bucket
+func saveJobStatus(ctx context.Context, status JobStatus) error {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	status.Updated = time.Now().UTC()
+	bucketName, objectName := bucketObject(fmt.Sprintf("jobs/%s.json", status.JobID))
+	wc := client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
+	wc.ContentType = "application/json"
+	if err := json.NewEncoder(wc).Encode(status); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// loadJobStatus reads a job status from the audio bucket
+func loadJobStatus(ctx context.Context, jobID string) (JobStatus, error) {
+	var status JobStatus
+	client, err := storageClient(ctx)
+	if err != nil {
+		return status, err
+	}
+
+	bucketName, objectName := bucketObject(fmt.Sprintf("jobs/%s.json", jobID))
+	rc, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	if err != nil {
+		return status, err
+	}
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(&status)
+	return status, err
+}
+
+// enqueueJob records a queued job and responds with 202 and where to find its status
+func enqueueJob(w http.ResponseWriter, r *http.Request, job Job) {
+	ctx := r.Context()
+	status := JobStatus{JobID: job.ID, Status: jobQueued}
+	if err := saveJobStatus(ctx, status); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to record job", err.Error(), job.ID})
+		return
+	}
+	if err := queue.Enqueue(ctx, job); err != nil {
+		writeError(w, http.StatusServiceUnavailable, errorResponse{codeQueueFailed, "unable to queue job", err.Error(), job.ID})
+		return
+	}
+	log.Printf("job %s: queued", job.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%s", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Print(err)
+	}
+}
+
+// handleTask is the worker endpoint called by Cloud Tasks
+// Retryable failures respond with an error status so the queue retries with
+// backoff, until the final attempt, when the job is marked failed
+func handleTask(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-CloudTasks-QueueName") == "" {
+		writeError(w, http.StatusForbidden, errorResponse{Code: codeForbidden, Message: "worker endpoint only accepts Cloud Tasks requests"})
+		return
+	}
+	if taskWorkerURL == "" || taskServiceAccount == "" {
+		writeError(w, http.StatusNotImplemented, errorResponse{Code: codeNotEnabled, Message: "the worker requires TASKS_WORKER_URL and TASKS_SERVICE_ACCOUNT"})
+		return
+	}
+	if err := verifyOIDC(r.Context(), r, oidcAudience(taskWorkerURL), taskServiceAccount); err != nil {
+		writeError(w, http.StatusForbidden, errorResponse{codeForbidden, "worker endpoint only accepts Cloud Tasks requests", err.Error(), ""})
+		return
+	}
+	var job Job
+	if !decodeRequest(w, r, "", &job) {
+		return
+	}
+	if !jobIDRe.MatchString(job.ID) {
+		writeValidationErrors(w, "", fieldError{codeMissingField, "job_id", "invalid job_id"})
+		return
+	}
+	retries, _ := strconv.Atoi(r.Header.Get("X-CloudTasks-TaskRetryCount"))
+	attempt := retries + 1
+
+	ctx := r.Context()
+	// the job was prepared when it was queued, so numbering its episode
+	// again is skipped, but it's validated again like any request
+	if errs := job.Request.validate(ctx); len(errs) > 0 {
+		rejected := validationError(job.ID, errs)
+		if err := saveJobStatus(ctx, JobStatus{JobID: job.ID, Status: jobFailed, Attempts: attempt, Error: &rejected}); err != nil {
+			log.Printf("job %s: unable to record status: %v", job.ID, err)
+		}
+		log.Printf("job %s: failed validation: %s", job.ID, rejected.Message)
+		// a failed validation is final, so the queue doesn't retry it
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	status := JobStatus{JobID: job.ID, Status: jobRunning, Attempts: attempt}
+	if err := saveJobStatus(ctx, status); err != nil {
+		log.Printf("job %s: unable to record status: %v", job.ID, err)
+	}
+
+	// progress is saved as the turns are synthesized; events that arrive
+	// while it's saving are dropped, the next carries their counts
+	events := make(chan fabulae.ProgressEvent, 1)
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		saveProgress(ctx, status, events)
+	}()
+	response, jobErr := processSynthesis(fabulae.WithProgress(ctx, fabulae.ProgressChannel(events)), job.ID, job.Request)
+	// synthesis is over, so nothing sends to events
+	close(events)
+	<-reported
+	if jobErr != nil {
+		status.Error = &jobErr.errorResponse
+		if jobErr.retryable() && attempt < maxTaskAttempts {
+			log.Printf("job %s: attempt %d failed, retrying: %s", job.ID, attempt, jobErr.Message)
+			if err := saveJobStatus(ctx, status); err != nil {
+				log.Printf("job %s: unable to record status: %v", job.ID, err)
+			}
+			writeError(w, jobErr.Status, jobErr.errorResponse)
+			return
+		}
+		status.Status = jobFailed
+		if partial, ok := jobErr.Details.(FabulaeResponse); ok {
+			status.Status, status.Response = jobPartial, &partial
+		}
+	} else {
+		status.Status = jobDone
+		status.Response = &response
+	}
+	if err := saveJobStatus(ctx, status); err != nil {
+		log.Printf("job %s: unable to record status: %v", job.ID, err)
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to record job", err.Error(), job.ID})
+		return
+	}
+	log.Printf("job %s: %s after %d attempt(s)", job.ID, status.Status, attempt)
+	w.WriteHeader(http.StatusOK)
+}
+
+// saveProgress saves a running job's status with its progress, at most
+// every progressInterval, until events is closed
+func saveProgress(ctx context.Context, status JobStatus, events <-chan fabulae.ProgressEvent) {
+	var saved time.Time
+	for e := range events {
+		if e.Kind != fabulae.TurnDone || (e.Done < e.Turns && time.Since(saved) < progressInterval) {
+			continue
+		}
+		status.Progress = &JobProgress{TurnsDone: e.Done, Turns: e.Turns, Percent: e.Percent(), BytesWritten: e.Bytes}
+		if err := saveJobStatus(ctx, status); err != nil {
+			log.Printf("job %s: unable to record progress: %v", status.JobID, err)
+		}
+		saved = time.Now()
+	}
+}
+
+// handleJobStatus returns the status of a queued job
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+	if !jobIDRe.MatchString(jobID) {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "unknown job"})
+		return
+	}
+	status, err := loadJobStatus(r.Context(), jobID)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: "unknown job", JobID: jobID})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read job", err.Error(), jobID})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Print(err)
+	}
+}
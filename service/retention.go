@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSourceRetention is how long fetched documents are kept, long
+// enough for a queued job's retries
+const defaultSourceRetention = 7 * 24 * time.Hour
+
+// retentionPolicy is how long the audio bucket keeps each kind of file,
+// 0 keeps them
+type retentionPolicy struct {
+	Sources     time.Duration // sources/, documents fetched from pdf_url
+	Transcripts time.Duration // transcripts/, generated scripts kept for retries
+	Jobs        time.Duration // jobs/, queued jobs' statuses
+	Episodes    time.Duration // episodes, with their files and catalog records
+}
+
+var retention = retentionPolicy{Sources: defaultSourceRetention}
+
+// retentionFromEnv reads the retention policy from SOURCE_RETENTION,
+// TRANSCRIPT_RETENTION, JOB_RETENTION and EPISODE_RETENTION, e.g. 720h
+func retentionFromEnv() {
+	for _, v := range []struct {
+		name string
+		keep *time.Duration
+	}{
+		{"SOURCE_RETENTION", &retention.Sources},
+		{"TRANSCRIPT_RETENTION", &retention.Transcripts},
+		{"JOB_RETENTION", &retention.Jobs},
+		{"EPISODE_RETENTION", &retention.Episodes},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			log.Printf("invalid %s %q, using %s", v.name, s, *v.keep)
+			continue
+		}
+		*v.keep = d
+	}
+}
+
+// CleanupReport lists the files a cleanup deleted, or would have with
+// dry_run
+type CleanupReport struct {
+	DryRun   bool       `json:"dry_run,omitempty"`
+	Files    []Artifact `json:"files"`
+	Episodes []string   `json:"episodes,omitempty"` // the expired episodes' audio
+	Bytes    int64      `json:"bytes"`
+}
+
+// expired finds the files past the policy at now: records by their age,
+// episodes by their audio's with all their files, and catalog records
+// whose episode is gone
+func (p retentionPolicy) expired(artifacts map[string]Artifact, episodes []EpisodeArtifacts, now time.Time) CleanupReport {
+	report := CleanupReport{Files: []Artifact{}}
+	seen := map[string]bool{}
+	add := func(a Artifact) {
+		if !seen[a.Name] {
+			seen[a.Name] = true
+			report.Files = append(report.Files, a)
+			report.Bytes += a.Bytes
+		}
+	}
+	cataloged := map[string]bool{}
+	for _, e := range episodes {
+		cataloged[e.Catalog] = true
+		if p.Episodes > 0 && now.Sub(e.Created) > p.Episodes {
+			report.Episodes = append(report.Episodes, e.Audio)
+			for _, f := range e.Files {
+				add(f)
+			}
+		}
+	}
+	for _, rule := range []struct {
+		prefix string
+		keep   time.Duration
+	}{{"sources/", p.Sources}, {"transcripts/", p.Transcripts}, {"jobs/", p.Jobs}} {
+		if rule.keep == 0 {
+			continue
+		}
+		for name, a := range artifacts {
+			if strings.HasPrefix(name, rule.prefix) && now.Sub(a.Updated) > rule.keep {
+				add(a)
+			}
+		}
+	}
+	for name, a := range artifacts {
+		if strings.HasPrefix(name, "catalog/") && !cataloged[name] {
+			add(a)
+		}
+	}
+	return report
+}
+
+// cleanup deletes the audio bucket's files past the retention policy, or
+// only reports them if dryRun
+func cleanup(ctx context.Context, dryRun bool) (CleanupReport, error) {
+	client, err := storageClient(ctx)
+	if err != nil {
+		return CleanupReport{}, err
+	}
+
+	artifacts, err := listArtifacts(ctx, client)
+	if err != nil {
+		return CleanupReport{}, err
+	}
+	episodes, err := groupArtifacts(ctx, client, artifacts)
+	if err != nil {
+		return CleanupReport{}, err
+	}
+	report := retention.expired(artifacts, episodes, time.Now())
+	report.DryRun = dryRun
+	if dryRun || len(report.Files) == 0 {
+		return report, nil
+	}
+	if err := deleteArtifacts(ctx, client, report.Files); err != nil {
+		return report, err
+	}
+	log.Printf("cleanup: deleted %d files, %d bytes, with %d episodes", len(report.Files), report.Bytes, len(report.Episodes))
+	return report, nil
+}
+
+// handleCleanup deletes the files past the retention policy, run by Cloud
+// Scheduler; with dry_run=true it only lists them
+func handleCleanup(w http.ResponseWriter, r *http.Request) {
+	if !authorizedPromptAdmin(w, r) {
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	report, err := cleanup(r.Context(), dryRun)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to clean up", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, report)
+}
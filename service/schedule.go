@@ -0,0 +1,396 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// maxFeedBytes bounds the size of a feed document
+const maxFeedBytes = 5 << 20
+
+var (
+	// scheduleConfig is a gs:// URI or local path of the schedule configuration
+	scheduleConfig string
+	// scheduleCollection is the Firestore collection of processed feed items
+	scheduleCollection = "fabulae_processed"
+	firestoreDatabase  = "(default)"
+	// runs are started by Cloud Scheduler with an OIDC token for
+	// schedulerAudience from schedulerServiceAccount, or with the admin token
+	schedulerServiceAccount string
+	schedulerAudience       string
+)
+
+// authorizedScheduler checks a run is from Cloud Scheduler or has the admin
+// bearer token
+func authorizedScheduler(w http.ResponseWriter, r *http.Request) bool {
+	scheduler := schedulerServiceAccount != "" && schedulerAudience != ""
+	if !scheduler && promptAdminToken == "" {
+		writeError(w, http.StatusNotImplemented, errorResponse{Code: codeNotEnabled, Message: "scheduled runs require SCHEDULER_SERVICE_ACCOUNT and SCHEDULER_AUDIENCE, or PROMPT_ADMIN_TOKEN"})
+		return false
+	}
+	if scheduler && verifyOIDC(r.Context(), r, schedulerAudience, schedulerServiceAccount) == nil {
+		return true
+	}
+	if hasAdminToken(r) {
+		return true
+	}
+	writeError(w, http.StatusForbidden, errorResponse{Code: codeForbidden, Message: "scheduled runs need the Cloud Scheduler OIDC token or the admin bearer token"})
+	return false
+}
+
+// ScheduleConfig lists the feeds to check on each scheduled run
+type ScheduleConfig struct {
+	Feeds []FeedConfig `json:"feeds"`
+}
+
+// FeedConfig is an RSS or Atom feed whose new items become podcasts
+type FeedConfig struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Voice1   string `json:"voice1"`
+	Voice2   string `json:"voice2"`
+	MaxItems int    `json:"max_items"` // new items processed per run, default 1
+	// Show is a stored show the items are episodes of, with its settings
+	Show string `json:"show,omitempty"`
+}
+
+// FeedRunResult summarizes a scheduled run of one feed
+type FeedRunResult struct {
+	Name    string   `json:"name"`
+	New     int      `json:"new"`
+	Skipped int      `json:"skipped"`
+	Failed  int      `json:"failed"`
+	JobIDs  []string `json:"job_ids,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// feedItem is a feed entry and the PDF source it links to
+type feedItem struct {
+	ID     string
+	Title  string
+	Source string
+}
+
+// rssFeed and atomFeed cover the parts of RSS 2.0 and Atom documents used
+type rssFeed struct {
+	Items []struct {
+		Title     string `xml:"title"`
+		Link      string `xml:"link"`
+		GUID      string `xml:"guid"`
+		Enclosure struct {
+			URL  string `xml:"url,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"enclosure"`
+	} `xml:"channel>item"`
+}
+
+type atomFeed struct {
+	Entries []struct {
+		Title string `xml:"title"`
+		ID    string `xml:"id"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// pdfLink prefers links to PDFs, and rewrites arXiv abstract pages to their PDF
+func pdfLink(link string) string {
+	if rest, ok := strings.CutPrefix(link, "https://arxiv.org/abs/"); ok {
+		return "https://arxiv.org/pdf/" + rest
+	}
+	if rest, ok := strings.CutPrefix(link, "http://arxiv.org/abs/"); ok {
+		return "https://arxiv.org/pdf/" + rest
+	}
+	return link
+}
+
+// fetchFeed retrieves and parses an RSS or Atom feed, newest items first as published
+func fetchFeed(ctx context.Context, feedURL string) ([]feedItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to retrieve feed %s: %s", feedURL, res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxFeedBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	items := []feedItem{}
+	var rss rssFeed
+	if err := xml.Unmarshal(body, &rss); err == nil && len(rss.Items) > 0 {
+		for _, i := range rss.Items {
+			source := pdfLink(i.Link)
+			if i.Enclosure.Type == "application/pdf" && i.Enclosure.URL != "" {
+				source = i.Enclosure.URL
+			}
+			id := i.GUID
+			if id == "" {
+				id = i.Link
+			}
+			items = append(items, feedItem{id, strings.TrimSpace(i.Title), source})
+		}
+		return items, nil
+	}
+	var atom atomFeed
+	if err := xml.Unmarshal(body, &atom); err != nil {
+		return nil, fmt.Errorf("unable to parse feed %s: %w", feedURL, err)
+	}
+	for _, e := range atom.Entries {
+		source := ""
+		for _, l := range e.Links {
+			if l.Type == "application/pdf" {
+				source = l.Href
+				break
+			}
+			if source == "" && (l.Rel == "" || l.Rel == "alternate") {
+				source = pdfLink(l.Href)
+			}
+		}
+		id := e.ID
+		if id == "" {
+			id = source
+		}
+		items = append(items, feedItem{id, strings.TrimSpace(e.Title), source})
+	}
+	return items, nil
+}
+
+// loadScheduleConfig reads the schedule configuration from Cloud Storage or a local file
+func loadScheduleConfig(ctx context.Context) (ScheduleConfig, error) {
+	var config ScheduleConfig
+	var r io.ReadCloser
+	if bucketObject, ok := strings.CutPrefix(scheduleConfig, "gs://"); ok {
+		client, err := storageClient(ctx)
+		if err != nil {
+			return config, err
+		}
+		bucketName, objectName, _ := strings.Cut(bucketObject, "/")
+		r, err = client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+		if err != nil {
+			return config, err
+		}
+	} else {
+		f, err := os.Open(scheduleConfig)
+		if err != nil {
+			return config, err
+		}
+		r = f
+	}
+	defer r.Close()
+	err := json.NewDecoder(r).Decode(&config)
+	return config, err
+}
+
+// processedItems tracks which feed items have been processed in Firestore
+type processedItems struct {
+	docs   *firestore.ProjectsDatabasesDocumentsService
+	parent string
+}
+
+func newProcessedItems(ctx context.Context) (*processedItems, error) {
+	srv, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &processedItems{
+		docs:   srv.Projects.Databases.Documents,
+		parent: fmt.Sprintf("projects/%s/databases/%s/documents", projectID, firestoreDatabase),
+	}, nil
+}
+
+// itemDocumentID is a stable Firestore document ID for a feed item
+func itemDocumentID(feed string, item feedItem) string {
+	sum := sha256.Sum256([]byte(feed + "\n" + item.ID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func itemFields(feed string, item feedItem, status, jobID string) map[string]firestore.Value {
+	return map[string]firestore.Value{
+		"feed":    {StringValue: feed},
+		"item_id": {StringValue: item.ID},
+		"title":   {StringValue: item.Title, ForceSendFields: []string{"StringValue"}},
+		"source":  {StringValue: item.Source},
+		"status":  {StringValue: status},
+		"job_id":  {StringValue: jobID},
+		"updated": {TimestampValue: time.Now().UTC().Format(time.RFC3339)},
+	}
+}
+
+// claim records an item as being processed, returning false if it has
+// already been processed or is in progress; failed items are claimed again
+func (p *processedItems) claim(ctx context.Context, feed string, item feedItem, jobID string) (bool, error) {
+	docID := itemDocumentID(feed, item)
+	doc := &firestore.Document{Fields: itemFields(feed, item, jobRunning, jobID)}
+	_, err := p.docs.CreateDocument(p.parent, scheduleCollection, doc).DocumentId(docID).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if err == nil {
+		return true, nil
+	}
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusConflict {
+		return false, err
+	}
+	existing, err := p.docs.Get(fmt.Sprintf("%s/%s/%s", p.parent, scheduleCollection, docID)).Context(ctx).Do()
+	if err != nil {
+		return false, err
+	}
+	if existing.Fields["status"].StringValue != jobFailed {
+		return false, nil
+	}
+	return true, p.update(ctx, feed, item, jobRunning, jobID)
+}
+
+// update sets the status of a processed item
+func (p *processedItems) update(ctx context.Context, feed string, item feedItem, status, jobID string) error {
+	name := fmt.Sprintf("%s/%s/%s", p.parent, scheduleCollection, itemDocumentID(feed, item))
+	doc := &firestore.Document{Fields: itemFields(feed, item, status, jobID)}
+	_, err := p.docs.Patch(name, doc).Context(ctx).Do()
+	return err
+}
+
+// handleScheduleRun is called by Cloud Scheduler to create podcasts for new
+// feed items; with a queue the items are queued, otherwise processed in turn
+func handleScheduleRun(w http.ResponseWriter, r *http.Request) {
+	if !authorizedScheduler(w, r) {
+		return
+	}
+	ctx := r.Context()
+	if projectID == "" {
+		writeError(w, http.StatusNotImplemented, errorResponse{Code: codeNotEnabled, Message: "scheduling requires PROJECT_ID, with SCHEDULE_CONFIG or shows with a schedule"})
+		return
+	}
+	var config ScheduleConfig
+	if scheduleConfig != "" {
+		var err error
+		if config, err = loadScheduleConfig(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, errorResponse{Code: codeInternal, Message: "unable to load schedule configuration", Details: err.Error()})
+			return
+		}
+	}
+	shows, err := scheduledShows(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{Code: codeInternal, Message: "unable to load scheduled shows", Details: err.Error()})
+		return
+	}
+	config.Feeds = append(config.Feeds, shows...)
+	processed, err := newProcessedItems(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{Code: codeInternal, Message: "unable to connect to Firestore", Details: err.Error()})
+		return
+	}
+
+	results := []FeedRunResult{}
+	for _, feed := range config.Feeds {
+		results = append(results, runFeed(ctx, processed, feed))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Print(err)
+	}
+}
+
+// runFeed processes up to MaxItems new items of a feed
+func runFeed(ctx context.Context, processed *processedItems, feed FeedConfig) FeedRunResult {
+	result := FeedRunResult{Name: feed.Name}
+	maxItems := feed.MaxItems
+	if maxItems <= 0 {
+		maxItems = 1
+	}
+	items, err := fetchFeed(ctx, feed.URL)
+	if err != nil {
+		log.Printf("schedule %s: %v", feed.Name, err)
+		result.Error = err.Error()
+		return result
+	}
+
+	for _, item := range items {
+		if result.New >= maxItems {
+			break
+		}
+		if item.Source == "" {
+			continue
+		}
+		jobID := newJobID()
+		claimed, err := processed.claim(ctx, feed.Name, item, jobID)
+		if err != nil {
+			log.Printf("schedule %s: unable to record %s: %v", feed.Name, item.ID, err)
+			result.Failed++
+			continue
+		}
+		if !claimed {
+			result.Skipped++
+			continue
+		}
+		result.New++
+		result.JobIDs = append(result.JobIDs, jobID)
+		log.Printf("schedule %s: job %s for %q %s", feed.Name, jobID, item.Title, item.Source)
+
+		req := FabulaeRequest{Voice1Name: feed.Voice1, Voice2Name: feed.Voice2, PDFURL: item.Source, Title: item.Title, Show: feed.Show}
+		status := jobDone
+		if errs := req.prepare(ctx); len(errs) > 0 {
+			log.Printf("schedule %s: job %s invalid: %s", feed.Name, jobID, errs[0].Message)
+			status = jobFailed
+		} else if queue != nil {
+			if err := saveJobStatus(ctx, JobStatus{JobID: jobID, Status: jobQueued}); err != nil {
+				log.Printf("schedule %s: job %s: %v", feed.Name, jobID, err)
+			}
+			if err := queue.Enqueue(ctx, Job{ID: jobID, Request: req}); err != nil {
+				log.Printf("schedule %s: unable to queue job %s: %v", feed.Name, jobID, err)
+				status = jobFailed
+			} else {
+				status = jobQueued
+			}
+		} else if _, jobErr := processSynthesis(ctx, jobID, req); jobErr != nil {
+			log.Printf("schedule %s: job %s failed: %s", feed.Name, jobID, jobErr.Message)
+			status = jobFailed
+		}
+		if status == jobFailed {
+			result.Failed++
+		}
+		if err := processed.update(ctx, feed.Name, item, status, jobID); err != nil {
+			log.Printf("schedule %s: unable to record %s: %v", feed.Name, item.ID, err)
+		}
+	}
+	return result
+}
@@ -0,0 +1,446 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// showCollection is the Firestore collection of recurring shows
+var showCollection = "fabulae_shows"
+
+// errNoShow is a show ID that isn't stored
+var errNoShow = errors.New("no such show")
+
+// updateAttempts bounds retries when another job updates the same show at
+// the same time
+const updateAttempts = 3
+
+// ShowResource is a stored show and the ID requests name it by
+type ShowResource struct {
+	ID string `json:"id"`
+	fabulae.Show
+}
+
+// showStore keeps shows in Firestore, each as JSON in its document's show
+// field so that updates are a single write
+type showStore struct {
+	docs   *firestore.ProjectsDatabasesDocumentsService
+	parent string
+}
+
+func newShowStore(ctx context.Context) (*showStore, error) {
+	if projectID == "" {
+		return nil, errors.New("shows require PROJECT_ID")
+	}
+	srv, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &showStore{
+		docs:   srv.Projects.Databases.Documents,
+		parent: fmt.Sprintf("projects/%s/databases/%s/documents", projectID, firestoreDatabase),
+	}, nil
+}
+
+func (s *showStore) name(id string) string {
+	return fmt.Sprintf("%s/%s/%s", s.parent, showCollection, id)
+}
+
+func showFrom(doc *firestore.Document) (ShowResource, error) {
+	show := ShowResource{ID: doc.Name[strings.LastIndex(doc.Name, "/")+1:]}
+	err := json.Unmarshal([]byte(doc.Fields["show"].StringValue), &show.Show)
+	return show, err
+}
+
+// getDocument returns a show and its document's update time, for a
+// conditional update
+func (s *showStore) getDocument(ctx context.Context, id string) (ShowResource, string, error) {
+	doc, err := s.docs.Get(s.name(id)).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return ShowResource{}, "", fmt.Errorf("%w %q", errNoShow, id)
+	}
+	if err != nil {
+		return ShowResource{}, "", err
+	}
+	show, err := showFrom(doc)
+	return show, doc.UpdateTime, err
+}
+
+// get returns a show, errNoShow if it isn't stored
+func (s *showStore) get(ctx context.Context, id string) (ShowResource, error) {
+	show, _, err := s.getDocument(ctx, id)
+	return show, err
+}
+
+// list returns every show, by ID
+func (s *showStore) list(ctx context.Context) ([]ShowResource, error) {
+	shows := []ShowResource{}
+	err := s.docs.List(s.parent, showCollection).Pages(ctx, func(page *firestore.ListDocumentsResponse) error {
+		for _, doc := range page.Documents {
+			show, err := showFrom(doc)
+			if err != nil {
+				log.Printf("skipping show %s: %v", doc.Name, err)
+				continue
+			}
+			shows = append(shows, show)
+		}
+		return nil
+	})
+	sort.Slice(shows, func(i, j int) bool { return shows[i].ID < shows[j].ID })
+	return shows, err
+}
+
+// put creates or replaces a show, if updated is set only when the document
+// hasn't changed since then
+func (s *showStore) put(ctx context.Context, id string, show fabulae.Show, updated string) error {
+	data, err := json.Marshal(show)
+	if err != nil {
+		return err
+	}
+	doc := &firestore.Document{Fields: map[string]firestore.Value{"show": stringValue(string(data))}}
+	call := s.docs.Patch(s.name(id), doc).Context(ctx)
+	if updated != "" {
+		call = call.CurrentDocumentUpdateTime(updated)
+	}
+	_, err = call.Do()
+	return err
+}
+
+func (s *showStore) remove(ctx context.Context, id string) error {
+	_, err := s.docs.Delete(s.name(id)).Context(ctx).Do()
+	return err
+}
+
+// update changes a show, retrying when another job changes it at the same
+// time; a failed precondition is a 400 from Firestore
+func (s *showStore) update(ctx context.Context, id string, change func(*fabulae.Show)) (fabulae.Show, error) {
+	var err error
+	for range updateAttempts {
+		var show ShowResource
+		var updated string
+		show, updated, err = s.getDocument(ctx, id)
+		if err != nil {
+			return fabulae.Show{}, err
+		}
+		change(&show.Show)
+		if err = s.put(ctx, id, show.Show, updated); err == nil {
+			return show.Show, nil
+		}
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || (apiErr.Code != http.StatusConflict && apiErr.Code != http.StatusPreconditionFailed && apiErr.Code != http.StatusBadRequest) {
+			return fabulae.Show{}, err
+		}
+	}
+	return fabulae.Show{}, fmt.Errorf("unable to update show %s: %w", id, err)
+}
+
+// claimEpisode numbers the show's next episode
+func (s *showStore) claimEpisode(ctx context.Context, id string) (fabulae.Show, int, error) {
+	show, err := s.update(ctx, id, func(show *fabulae.Show) { show.Episodes++ })
+	return show, show.Episodes, err
+}
+
+// applyShow uses the request's show for the settings the request doesn't
+// have, returning the show
+func (req *FabulaeRequest) applyShow(ctx context.Context) (*fabulae.Show, []fieldError) {
+	if req.Show == "" {
+		return nil, nil
+	}
+	if err := fabulae.ValidateShowID(req.Show); err != nil {
+		return nil, []fieldError{{codeInvalidSetting, "show", err.Error()}}
+	}
+	store, err := newShowStore(ctx)
+	if err != nil {
+		return nil, []fieldError{{codeInvalidSetting, "show", err.Error()}}
+	}
+	show, err := store.get(ctx, req.Show)
+	if err != nil {
+		return nil, []fieldError{{codeInvalidSetting, "show", err.Error()}}
+	}
+	for _, v := range []struct {
+		from string
+		to   *string
+	}{
+		{show.HostPersona, &req.HostPersona},
+		{show.ExpertPersona, &req.ExpertPersona},
+		{show.Voice1, &req.Voice1Name},
+		{show.Voice2, &req.Voice2Name},
+		{show.Name, &req.ShowName},
+		{show.Audience, &req.Audience},
+		{show.Tone, &req.Tone},
+		{show.Code, &req.Code},
+		{show.BucketPrefix, &req.BucketPrefix},
+	} {
+		if *v.to == "" {
+			*v.to = v.from
+		}
+	}
+	if req.TargetMinutes == 0 {
+		req.TargetMinutes = show.TargetMinutes
+	}
+	req.SkipReferences = req.SkipReferences || show.SkipReferences
+	return &show.Show, nil
+}
+
+// numberEpisode claims the show's next episode unless the request numbers
+// it or duplicates an earlier one, and titles the episode with the show and
+// its number
+func (req *FabulaeRequest) numberEpisode(ctx context.Context, show *fabulae.Show) error {
+	if show == nil {
+		return nil
+	}
+	if req.Episode == 0 {
+		req.Episode = req.duplicateShowEpisode(ctx)
+	}
+	if req.Episode == 0 {
+		store, err := newShowStore(ctx)
+		if err != nil {
+			return err
+		}
+		var claimed fabulae.Show
+		if claimed, req.Episode, err = store.claimEpisode(ctx, req.Show); err != nil {
+			return err
+		}
+		show = &claimed
+	}
+	req.Title = show.EpisodeTitle(req.Episode, req.Title)
+	return nil
+}
+
+// previousEpisodes are the summaries of the show's episodes before the
+// request's, for the prompt
+func previousEpisodes(ctx context.Context, req FabulaeRequest) []fabulae.EpisodeSummary {
+	if req.Show == "" {
+		return nil
+	}
+	store, err := newShowStore(ctx)
+	if err == nil {
+		var show ShowResource
+		if show, err = store.get(ctx, req.Show); err == nil {
+			return show.PreviousEpisodes(req.Episode)
+		}
+	}
+	log.Printf("unable to read show %s, the episode won't refer to earlier ones: %v", req.Show, err)
+	return nil
+}
+
+// recordShowEpisode adds a finished episode's summary to its show, for later
+// episodes to refer back to; failures are only logged since the episode is done
+func recordShowEpisode(ctx context.Context, jobID string, req FabulaeRequest) {
+	if req.Show == "" || req.Episode == 0 {
+		return
+	}
+	summary, err := fabulae.SummarizeEpisode(ctx, projectID, location, req.model(), req.Conversation)
+	if err != nil {
+		log.Printf("job %s: unable to summarize the episode for show %s: %v", jobID, req.Show, err)
+		return
+	}
+	store, err := newShowStore(ctx)
+	if err == nil {
+		_, err = store.update(ctx, req.Show, func(show *fabulae.Show) {
+			show.AddEpisode(fabulae.EpisodeSummary{Number: req.Episode, Title: req.Title, Summary: summary, Created: time.Now().UTC()})
+		})
+	}
+	if err != nil {
+		log.Printf("job %s: unable to add the episode to show %s: %v", jobID, req.Show, err)
+	}
+}
+
+// scheduledShows are the feeds of the shows with a schedule
+func scheduledShows(ctx context.Context) ([]FeedConfig, error) {
+	store, err := newShowStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shows, err := store.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var feeds []FeedConfig
+	for _, show := range shows {
+		if show.Schedule == nil {
+			continue
+		}
+		feeds = append(feeds, FeedConfig{
+			Name:     path.Join("shows", show.ID),
+			URL:      show.Schedule.FeedURL,
+			MaxItems: show.Schedule.MaxItems,
+			Show:     show.ID,
+		})
+	}
+	return feeds, nil
+}
+
+// prefixFiles names the response's files by where they're stored under the
+// audio bucket, in the request's bucket_prefix
+func prefixFiles(prefix string, response *FabulaeResponse) {
+	if prefix == "" {
+		return
+	}
+	for i, f := range response.OutputFiles {
+		response.OutputFiles[i] = path.Join(prefix, f)
+	}
+	for format, f := range response.Transcripts {
+		response.Transcripts[format] = path.Join(prefix, f)
+	}
+	if response.Page != "" {
+		response.Page = path.Join(prefix, response.Page)
+	}
+	if response.Chapters != "" {
+		response.Chapters = path.Join(prefix, response.Chapters)
+	}
+	for speed, f := range response.SpeedVariants {
+		response.SpeedVariants[speed] = path.Join(prefix, f)
+	}
+	if response.FactCheckReport != "" {
+		response.FactCheckReport = path.Join(prefix, response.FactCheckReport)
+	}
+}
+
+// showFromPath checks the show ID in the path and opens the store, writing
+// the error response if it can't
+func showFromPath(w http.ResponseWriter, r *http.Request) (*showStore, string, bool) {
+	id := r.PathValue("id")
+	if err := fabulae.ValidateShowID(id); err != nil {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: err.Error()})
+		return nil, "", false
+	}
+	store, ok := openShows(w, r)
+	return store, id, ok
+}
+
+func openShows(w http.ResponseWriter, r *http.Request) (*showStore, bool) {
+	if projectID == "" {
+		writeError(w, http.StatusNotImplemented, errorResponse{Code: codeNotEnabled, Message: "shows require PROJECT_ID"})
+		return nil, false
+	}
+	store, err := newShowStore(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read shows", err.Error(), ""})
+		return nil, false
+	}
+	return store, true
+}
+
+// handleListShows lists the stored shows
+func handleListShows(w http.ResponseWriter, r *http.Request) {
+	store, ok := openShows(w, r)
+	if !ok {
+		return
+	}
+	shows, err := store.list(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read shows", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, shows)
+}
+
+// handleGetShow returns a show
+func handleGetShow(w http.ResponseWriter, r *http.Request) {
+	store, id, ok := showFromPath(w, r)
+	if !ok {
+		return
+	}
+	show, err := store.get(r.Context(), id)
+	if errors.Is(err, errNoShow) {
+		writeError(w, http.StatusNotFound, errorResponse{Code: codeNotFound, Message: err.Error()})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read show", err.Error(), ""})
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, show)
+}
+
+// handlePutShow creates or replaces a show; without episodes or previous in
+// the body an existing show keeps its count and episode summaries
+func handlePutShow(w http.ResponseWriter, r *http.Request) {
+	if !authorizedPromptAdmin(w, r) {
+		return
+	}
+	store, id, ok := showFromPath(w, r)
+	if !ok {
+		return
+	}
+	var show fabulae.Show
+	if !decodeRequest(w, r, "", &show) {
+		return
+	}
+	ctx := r.Context()
+	if show.Name == "" {
+		show.Name = id
+	}
+	if err := show.Validate(); err != nil {
+		writeValidationErrors(w, "", fieldError{codeInvalidSetting, "", err.Error()})
+		return
+	}
+	for _, v := range []struct{ field, name string }{{"voice1", show.Voice1}, {"voice2", show.Voice2}} {
+		if v.name != "" && !fabulae.IsCustomVoice(v.name) && !voices.known(ctx, v.name) {
+			writeValidationErrors(w, "", fieldError{codeInvalidVoice, v.field, fmt.Sprintf("unknown voice %q", v.name)})
+			return
+		}
+	}
+	existing, updated, err := store.getDocument(ctx, id)
+	if err != nil && !errors.Is(err, errNoShow) {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to read show", err.Error(), ""})
+		return
+	}
+	if show.Episodes == 0 {
+		show.Episodes = existing.Episodes
+	}
+	if show.Previous == nil {
+		show.Previous = existing.Previous
+	}
+	if err := store.put(ctx, id, show, updated); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to store show", err.Error(), ""})
+		return
+	}
+	log.Printf("show %s: updated", id)
+	writeJSONResponse(w, http.StatusOK, ShowResource{id, show})
+}
+
+// handleDeleteShow removes a show
+func handleDeleteShow(w http.ResponseWriter, r *http.Request) {
+	if !authorizedPromptAdmin(w, r) {
+		return
+	}
+	store, id, ok := showFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := store.remove(r.Context(), id); err != nil {
+		writeError(w, http.StatusInternalServerError, errorResponse{codeStorageFailed, "unable to remove show", err.Error(), ""})
+		return
+	}
+	log.Printf("show %s: removed", id)
+	w.WriteHeader(http.StatusNoContent)
+}
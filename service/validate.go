@@ -0,0 +1,316 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ghchinoy/fabulae"
+)
+
+const (
+	// maxSpeakLength is the Text-to-Speech limit for a single request
+	maxSpeakLength = 5000
+	// maxConversationLength bounds two-voice conversations
+	maxConversationLength = 200000
+	// voiceCatalogTTL is how long the list of voices is reused
+	voiceCatalogTTL = time.Hour
+	// maxTargetMinutes bounds target_minutes
+	maxTargetMinutes = 60
+	// maxPromptSetting bounds prompt settings, e.g. audience
+	maxPromptSetting = 200
+	// maxShowNotes bounds show_notes
+	maxShowNotes = 10000
+	// maxQualityRetries bounds quality_retries, each is another generation
+	maxQualityRetries = 5
+	// maxPersonaItems bounds a persona's catchphrases, expertise and memory
+	maxPersonaItems = 10
+	// maxAds bounds ads, and maxAdScript each ad's script
+	maxAds      = 5
+	maxAdScript = 2000
+	// maxCrossfade bounds crossfade_seconds
+	maxCrossfade = time.Second
+)
+
+// validation error codes
+const (
+	codeInvalidJSON     = "invalid_json"
+	codeEmptyBody       = "empty_body"
+	codeMissingField    = "missing_field"
+	codeInvalidVoice    = "invalid_voice"
+	codeInvalidURL      = "invalid_url"
+	codeTextTooLong     = "text_too_long"
+	codeMissingSource   = "missing_source"
+	codeInvalidSetting  = "invalid_setting"
+	codeInvalidTemplate = "invalid_template"
+	codeInvalidVersion  = "invalid_version"
+	codeInvalidModel    = "invalid_model"
+)
+
+// fieldError describes why a request failed validation
+type fieldError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// writeValidationErrors responds with 400 and the list of problems as details
+func writeValidationErrors(w http.ResponseWriter, jobID string, errs ...fieldError) {
+	writeError(w, http.StatusBadRequest, validationError(jobID, errs))
+}
+
+// validationError is the error for a request that failed validation
+func validationError(jobID string, errs []fieldError) errorResponse {
+	message := "request failed validation"
+	if len(errs) == 1 {
+		message = errs[0].Message
+	}
+	return errorResponse{
+		Code:    codeInvalidRequest,
+		Message: message,
+		Details: errs,
+		JobID:   jobID,
+	}
+}
+
+// voiceCatalog caches the names of available Text-to-Speech voices
+type voiceCatalog struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	fetched time.Time
+}
+
+var voices voiceCatalog
+
+// known reports whether a voice exists; if the catalog can't be retrieved
+// the voice is assumed valid and synthesis reports the failure
+func (c *voiceCatalog) known(ctx context.Context, name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names == nil || time.Since(c.fetched) > voiceCatalogTTL {
+		if err := c.fetch(ctx); err != nil {
+			log.Printf("unable to list voices, skipping voice validation: %v", err)
+			return true
+		}
+	}
+	return c.names[name]
+}
+
+// prefetch fills the catalog, so the first request doesn't wait for it
+func (c *voiceCatalog) prefetch(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetch(ctx)
+}
+
+// fetch lists the voices; the caller holds c.mu
+func (c *voiceCatalog) fetch(ctx context.Context) error {
+	list, err := fabulae.ListVoices(ctx)
+	if err != nil {
+		return err
+	}
+	c.names = make(map[string]bool, len(list))
+	for _, v := range list {
+		c.names[v.Name] = true
+	}
+	c.fetched = time.Now()
+	return nil
+}
+
+// prepare applies the request's show and personas and validates it, then
+// numbers an episode of the show; requests are prepared once, before they're
+// processed or queued
+func (req *FabulaeRequest) prepare(ctx context.Context) []fieldError {
+	show, errs := req.applyShow(ctx)
+	_, personaErrs := req.castPersonas(ctx)
+	errs = append(errs, personaErrs...)
+	if errs = append(errs, req.validate(ctx)...); len(errs) > 0 {
+		return errs
+	}
+	if err := req.numberEpisode(ctx, show); err != nil {
+		return []fieldError{{codeInvalidSetting, "show", err.Error()}}
+	}
+	return nil
+}
+
+// validate checks a FabulaeRequest, returning every problem found
+func (req FabulaeRequest) validate(ctx context.Context) []fieldError {
+	errs := []fieldError{}
+
+	if req.Conversation == "" && req.PDFURL == "" {
+		errs = append(errs, fieldError{codeMissingSource, "conversation", "one of conversation or pdf_url is required"})
+	}
+	if req.Conversation == "" && req.PDFURL != "" {
+		if err := fabulae.ValidateSourceURI(req.PDFURL); err != nil {
+			errs = append(errs, fieldError{codeInvalidURL, "pdf_url", err.Error()})
+		} else if err := fetchPolicy.CheckSource(ctx, req.PDFURL); err != nil {
+			errs = append(errs, fieldError{codeSourceRejected, "pdf_url", err.Error()})
+		}
+		if req.Voice2Name == "" {
+			errs = append(errs, fieldError{codeMissingField, "voice2", "voice2 is required to generate a conversation from pdf_url"})
+		}
+		if err := validateModel(ctx, req.model()); err != nil {
+			errs = append(errs, fieldError{codeInvalidModel, "model", err.Error()})
+		}
+		if fallback := req.SafetyFallback.Model; fallback != "" {
+			if err := validateModel(ctx, fallback); err != nil {
+				errs = append(errs, fieldError{codeInvalidModel, "safety_fallback.model", err.Error()})
+			}
+		}
+	}
+
+	if req.Voice2Name == "" && len(req.Conversation) > maxSpeakLength {
+		errs = append(errs, fieldError{codeTextTooLong, "conversation",
+			fmt.Sprintf("single voice text is %d characters, limit is %d", len(req.Conversation), maxSpeakLength)})
+	}
+	if len(req.Conversation) > maxConversationLength {
+		errs = append(errs, fieldError{codeTextTooLong, "conversation",
+			fmt.Sprintf("conversation is %d characters, limit is %d", len(req.Conversation), maxConversationLength)})
+	}
+
+	if req.TargetMinutes < 0 || req.TargetMinutes > maxTargetMinutes {
+		errs = append(errs, fieldError{codeInvalidSetting, "target_minutes", fmt.Sprintf("target_minutes must be 1 to %d", maxTargetMinutes)})
+	}
+	if len(req.HostNames) > 2 {
+		errs = append(errs, fieldError{codeInvalidSetting, "host_names", "host_names has the host's and expert's names, at most 2"})
+	}
+	if err := fabulae.ValidateTranscriptFormats(req.TranscriptFormats); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "transcript_formats", err.Error()})
+	} else if req.WordTimings && len(req.TranscriptFormats) == 0 {
+		errs = append(errs, fieldError{codeInvalidSetting, "word_timings", "word_timings times the words of transcript_formats"})
+	}
+	if err := fabulae.ValidateCodeMode(req.Code); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "code", err.Error()})
+	}
+	if _, ok := fabulae.DriveFolderID(req.DriveFolder); req.DriveFolder != "" && !ok {
+		errs = append(errs, fieldError{codeInvalidSetting, "drive_folder", "drive_folder is a Drive folder ID or URL"})
+	}
+	if err := fabulae.ValidateFactCheckMode(req.FactCheck); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "fact_check", err.Error()})
+	} else if req.FactCheck != "" && (req.PDFURL == "" || req.Conversation != "") {
+		errs = append(errs, fieldError{codeInvalidSetting, "fact_check", "fact_check checks a conversation generated from pdf_url"})
+	}
+	if req.Episode < 0 || (req.Episode > 0 && req.Show == "") {
+		errs = append(errs, fieldError{codeInvalidSetting, "episode", "episode numbers an episode of a show"})
+	}
+	if err := fabulae.ValidateBucketPrefix(req.BucketPrefix); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "bucket_prefix", err.Error()})
+	}
+	if req.MinQuality < 0 || req.MinQuality > 10 {
+		errs = append(errs, fieldError{codeInvalidSetting, "min_quality", "min_quality is a score from 1 to 10"})
+	}
+	if req.QualityRetries < 0 || req.QualityRetries > maxQualityRetries {
+		errs = append(errs, fieldError{codeInvalidSetting, "quality_retries", fmt.Sprintf("quality_retries is at most %d", maxQualityRetries)})
+	}
+	if len(req.ShowNotes) > maxShowNotes {
+		errs = append(errs, fieldError{codeInvalidSetting, "show_notes", fmt.Sprintf("show_notes is %d characters, limit is %d", len(req.ShowNotes), maxShowNotes)})
+	}
+	errs = append(errs, req.validateAds(ctx)...)
+	if req.CrossfadeSeconds < 0 || req.CrossfadeSeconds > maxCrossfade.Seconds() {
+		errs = append(errs, fieldError{codeInvalidSetting, "crossfade_seconds", fmt.Sprintf("crossfade_seconds is at most %g", maxCrossfade.Seconds())})
+	}
+	if req.Music != "" && !isWavURI(req.Music) {
+		errs = append(errs, fieldError{codeInvalidSetting, "music", "music is a gs://bucket/object wav"})
+	} else if req.Music != "" {
+		if err := fetchPolicy.CheckSource(ctx, req.Music); err != nil {
+			errs = append(errs, fieldError{codeSourceRejected, "music", err.Error()})
+		}
+	}
+	if req.MusicGain < 0 || req.MusicGain > 1 {
+		errs = append(errs, fieldError{codeInvalidSetting, "music_gain", "music_gain is 0 to 1"})
+	}
+	if (req.Music != "" || req.CrossfadeSeconds > 0) && req.Voice2Name == "" {
+		errs = append(errs, fieldError{codeInvalidSetting, "music", "crossfade_seconds and music are mixed into two-voice conversations"})
+	}
+	if err := fabulae.ValidateSpeeds(req.SpeedVariants); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "speed_variants", err.Error()})
+	} else if len(req.SpeedVariants) > 0 && req.Voice2Name == "" {
+		errs = append(errs, fieldError{codeInvalidSetting, "speed_variants", "speed_variants are written for two-voice conversations"})
+	}
+	if req.Mastering != nil {
+		if err := req.Mastering.Validate(); err != nil {
+			errs = append(errs, fieldError{codeInvalidSetting, "mastering", err.Error()})
+		} else if req.Voice2Name == "" {
+			errs = append(errs, fieldError{codeInvalidSetting, "mastering", "mastering is applied to two-voice conversations"})
+		}
+	}
+	if channels, err := fabulae.ParseChannels(req.Channels); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "channels", err.Error()})
+	} else if err := (fabulae.AudioFormat{SampleRate: req.SampleRate, Channels: channels}).Validate(); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "sample_rate", err.Error()})
+	}
+	if _, err := fabulae.LookupOutputProfiles(req.ExportProfiles); err != nil {
+		errs = append(errs, fieldError{codeInvalidSetting, "export_profiles", err.Error()})
+	} else if len(req.ExportProfiles) > 0 && req.Voice2Name == "" {
+		errs = append(errs, fieldError{codeInvalidSetting, "export_profiles", "export_profiles are written for two-voice conversations"})
+	}
+	settings := []struct{ field, value string }{{"title", req.Title}, {"show_name", req.ShowName}, {"audience", req.Audience}, {"tone", req.Tone}}
+	for _, name := range req.HostNames {
+		settings = append(settings, struct{ field, value string }{"host_names", name})
+	}
+	for _, v := range settings {
+		if len(v.value) > maxPromptSetting {
+			errs = append(errs, fieldError{codeInvalidSetting, v.field, fmt.Sprintf("%s is %d characters, limit is %d", v.field, len(v.value), maxPromptSetting)})
+		}
+	}
+
+	if req.Voice1Name == "" {
+		errs = append(errs, fieldError{codeMissingField, "voice1", "voice1 is required"})
+	}
+	for _, v := range []struct{ field, name string }{{"voice1", req.Voice1Name}, {"voice2", req.Voice2Name}} {
+		if v.name != "" && !fabulae.IsCustomVoice(v.name) && !voices.known(ctx, v.name) {
+			errs = append(errs, fieldError{codeInvalidVoice, v.field, fmt.Sprintf("unknown voice %q", v.name)})
+		}
+	}
+
+	return errs
+}
+
+// model is the request's Gemini model, or the service's default
+func (req FabulaeRequest) model() string {
+	if req.Model != "" {
+		return req.Model
+	}
+	return modelName
+}
+
+// audioFormat is the request's sample_rate and channels, validated
+func (req FabulaeRequest) audioFormat() fabulae.AudioFormat {
+	channels, _ := fabulae.ParseChannels(req.Channels)
+	return fabulae.AudioFormat{SampleRate: req.SampleRate, Channels: channels}
+}
+
+// validateModel checks a model can generate from a PDF and is available;
+// if the models can't be listed the model is assumed available
+func validateModel(ctx context.Context, name string) error {
+	needs := fabulae.ModelRequirements{PDFInput: true}
+	if !fabulae.ModelCapabilities(name).PDFInput {
+		return fmt.Errorf("model %s doesn't accept PDF input", name)
+	}
+	if projectID == "" {
+		return nil
+	}
+	list, err := models.get(ctx)
+	if err != nil {
+		log.Printf("unable to list models, skipping model validation: %v", err)
+		return nil
+	}
+	return fabulae.CheckModel(list, name, needs)
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghchinoy/fabulae"
+)
+
+// warmStartTimeout bounds the work done at boot, before requests are served
+const warmStartTimeout = 30 * time.Second
+
+var (
+	storageMu     sync.Mutex
+	sharedStorage *storage.Client
+)
+
+// storageClient returns the Cloud Storage client shared by every request;
+// it's opened without the request's context so it outlives it
+func storageClient(_ context.Context) (*storage.Client, error) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	if sharedStorage == nil {
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		sharedStorage = client
+	}
+	return sharedStorage, nil
+}
+
+// warmStart lists the voices, opens the shared clients and checks the
+// service account can use the audio bucket, so the first request doesn't
+// pay for them; a bucket the service can't write to, or read back from,
+// stops the service
+func warmStart() {
+	ctx, cancel := context.WithTimeout(context.Background(), warmStartTimeout)
+	defer cancel()
+	start := time.Now()
+
+	if err := voices.prefetch(ctx); err != nil {
+		log.Printf("unable to list voices at startup, listing them on the first request: %v", err)
+	}
+	if err := fabulae.WarmUp(projectID, location); err != nil {
+		log.Printf("unable to open clients at startup: %v", err)
+	}
+	client, err := storageClient(ctx)
+	if err != nil {
+		log.Fatalf("unable to open a Cloud Storage client: %v", err)
+	}
+
+	bucketName, _, _ := strings.Cut(audioBucketPath, "/")
+	required := []string{"storage.objects.create", "storage.objects.get"}
+	// listing and deleting are only needed by the admin endpoints and cleanup
+	optional := []string{"storage.objects.list", "storage.objects.delete"}
+	granted, err := client.Bucket(bucketName).IAM().TestPermissions(ctx, append(required, optional...))
+	if err != nil {
+		log.Printf("unable to check permissions on bucket %s: %v", bucketName, err)
+	} else {
+		has := make(map[string]bool, len(granted))
+		for _, p := range granted {
+			has[p] = true
+		}
+		for _, p := range required {
+			if !has[p] {
+				log.Fatalf("the service account lacks %s on bucket %s, grant it roles/storage.objectAdmin on the bucket", p, bucketName)
+			}
+		}
+		for _, p := range optional {
+			if !has[p] {
+				log.Printf("the service account lacks %s on bucket %s, episodes can't be listed or cleaned up", p, bucketName)
+			}
+		}
+	}
+	log.Printf("warm start took %v", time.Since(start).Round(time.Millisecond))
+}
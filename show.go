@@ -0,0 +1,131 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Show is a recurring podcast's settings, so that making its next episode
+// only needs a source
+type Show struct {
+	Name          string `json:"name"` // as the host introduces it
+	HostPersona   string `json:"host_persona,omitempty"`
+	ExpertPersona string `json:"expert_persona,omitempty"`
+	Voice1        string `json:"voice1,omitempty"` // used over the personas' voices
+	Voice2        string `json:"voice2,omitempty"`
+
+	// the built-in prompt's style, see PromptData
+	Audience       string `json:"audience,omitempty"`
+	Tone           string `json:"tone,omitempty"`
+	TargetMinutes  int    `json:"target_minutes,omitempty"`
+	Code           string `json:"code,omitempty"`
+	SkipReferences bool   `json:"skip_references,omitempty"`
+
+	Feed ShowFeed `json:"feed"`
+	// BucketPrefix is the folder under the audio bucket the show's episodes
+	// are stored in, e.g. paper-trail
+	BucketPrefix string `json:"bucket_prefix,omitempty"`
+	// Schedule makes episodes from a source feed's new items
+	Schedule *ShowSchedule `json:"schedule,omitempty"`
+	// Episodes is how many episodes have been made, the next is Episodes+1
+	Episodes int `json:"episodes,omitempty"`
+	// Previous summarizes the latest episodes, for the hosts to refer back to
+	Previous []EpisodeSummary `json:"previous,omitempty"`
+}
+
+// ShowFeed are the show's podcast feed and site settings, see Site
+type ShowFeed struct {
+	Description    string `json:"description,omitempty"`
+	URL            string `json:"url,omitempty"`
+	AudioURL       string `json:"audio_url,omitempty"`
+	TrackingPrefix string `json:"tracking_prefix,omitempty"`
+}
+
+// ShowSchedule is an RSS or Atom feed of sources for a show's episodes
+type ShowSchedule struct {
+	FeedURL  string `json:"feed_url"`
+	MaxItems int    `json:"max_items,omitempty"` // new items per scheduled run, default 1
+}
+
+// ValidateShowID checks the ID a show is stored under
+func ValidateShowID(id string) error {
+	if !resourceIDRe.MatchString(id) {
+		return fmt.Errorf("invalid show %q, use lowercase letters, digits, - and _", id)
+	}
+	return nil
+}
+
+// Validate checks the show's settings
+func (s Show) Validate() error {
+	if s.Name == "" {
+		return errors.New("a show needs a name")
+	}
+	if s.ExpertPersona != "" && s.HostPersona == "" {
+		return errors.New("a show's expert persona needs a host persona")
+	}
+	for _, id := range []string{s.HostPersona, s.ExpertPersona} {
+		if id == "" {
+			continue
+		}
+		if err := ValidatePersonaID(id); err != nil {
+			return err
+		}
+	}
+	if err := ValidateCodeMode(s.Code); err != nil {
+		return err
+	}
+	if s.TargetMinutes < 0 || s.Episodes < 0 {
+		return errors.New("a show's target minutes and episodes can't be negative")
+	}
+	if err := ValidateBucketPrefix(s.BucketPrefix); err != nil {
+		return err
+	}
+	if s.Schedule != nil {
+		u, err := url.Parse(s.Schedule.FeedURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid schedule feed URL %q, use http or https", s.Schedule.FeedURL)
+		}
+		if s.Schedule.MaxItems < 0 {
+			return errors.New("a show's schedule max items can't be negative")
+		}
+	}
+	return nil
+}
+
+// ValidateBucketPrefix checks a folder for episodes is relative and clean,
+// e.g. paper-trail or shows/paper-trail
+func ValidateBucketPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if strings.HasPrefix(prefix, "/") || path.Clean(prefix) != prefix || prefix == "." || strings.HasPrefix(prefix, "../") || prefix == ".." {
+		return fmt.Errorf("invalid bucket prefix %q, use a relative folder like shows/paper-trail", prefix)
+	}
+	return nil
+}
+
+// EpisodeTitle titles an episode with the show and its number, e.g.
+// "Paper Trail, episode 14: AudioLM"
+func (s Show) EpisodeTitle(number int, title string) string {
+	if title == "" {
+		return fmt.Sprintf("%s, episode %d", s.Name, number)
+	}
+	return fmt.Sprintf("%s, episode %d: %s", s.Name, number, title)
+}
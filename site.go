@@ -0,0 +1,164 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Site is a static website for an episode library: an index, a page per
+// episode and an RSS feed
+type Site struct {
+	Title       string
+	Description string
+	URL         string // where the site is hosted, for the feed's links
+	Episodes    []SiteEpisode
+	// TrackingPrefix goes before each episode's audio URL, without its
+	// scheme, for podcast analytics services, e.g.
+	// https://dts.podtrac.com/redirect.mp3/ or https://op3.dev/e/
+	TrackingPrefix string
+	// Analytics is added to the head of every page, e.g. an analytics script
+	Analytics template.HTML
+}
+
+// SiteEpisode is an episode in a Site
+type SiteEpisode struct {
+	EpisodePage
+	Slug      string // the episode page's name, e.g. audiolm_20241014
+	AudioType string // e.g. audio/wav
+	Bytes     int64  // the audio's size, for the feed
+}
+
+// BuildSite writes the site to dir: index.html, episodes/SLUG.html for each
+// episode and feed.xml, newest episodes first
+func BuildSite(dir string, site Site) error {
+	sort.SliceStable(site.Episodes, func(i, j int) bool { return site.Episodes[i].Created.After(site.Episodes[j].Created) })
+	if err := os.MkdirAll(filepath.Join(dir, "episodes"), 0755); err != nil {
+		return err
+	}
+	for _, e := range site.Episodes {
+		page := e.EpisodePage
+		page.Analytics = site.Analytics
+		if u := enclosureURL(site, e); site.TrackingPrefix != "" && strings.Contains(u, "://") {
+			page.Audio = u
+		}
+		if err := WriteEpisodePage(filepath.Join(dir, "episodes", e.Slug+".html"), page); err != nil {
+			return fmt.Errorf("episode %s: %w", e.Slug, err)
+		}
+	}
+
+	funcs := template.FuncMap{
+		"minutes": func(d time.Duration) string {
+			return fmt.Sprintf("%d min", max(1, int(d.Round(time.Minute).Minutes())))
+		},
+	}
+	tmpl, err := template.New("index.html").Funcs(funcs).ParseFS(pageTemplates, "pages/index.html")
+	if err != nil {
+		return err
+	}
+	var index bytes.Buffer
+	if err := tmpl.Execute(&index, site); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), index.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	feed, err := siteFeed(site)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "feed.xml"), feed, 0644)
+}
+
+// rss is the RSS 2.0 document for a site, with an enclosure for each episode
+type rss struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Channel struct {
+		Title       string    `xml:"title"`
+		Link        string    `xml:"link"`
+		Description string    `xml:"description"`
+		Items       []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link,omitempty"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate,omitempty"`
+	Description string `xml:"description,omitempty"`
+	Enclosure   struct {
+		URL    string `xml:"url,attr"`
+		Length int64  `xml:"length,attr"`
+		Type   string `xml:"type,attr"`
+	} `xml:"enclosure"`
+}
+
+// enclosureURL is where the feed finds an episode's audio, through the
+// site's tracking prefix if it has one
+func enclosureURL(site Site, e SiteEpisode) string {
+	u := e.Audio
+	// pages are in episodes/, so relative audio is relative to it
+	if !strings.Contains(u, "://") {
+		u = strings.TrimSuffix(site.URL, "/") + "/" + path.Clean("episodes/"+u)
+	}
+	if site.TrackingPrefix == "" || !strings.Contains(u, "://") {
+		return u
+	}
+	_, rest, _ := strings.Cut(u, "://")
+	return strings.TrimSuffix(site.TrackingPrefix, "/") + "/" + rest
+}
+
+// siteFeed is the site's RSS feed; links are relative without Site.URL
+func siteFeed(site Site) ([]byte, error) {
+	base := strings.TrimSuffix(site.URL, "/")
+	var feed rss
+	feed.Version = "2.0"
+	feed.Channel.Title = site.Title
+	feed.Channel.Link = base + "/"
+	feed.Channel.Description = site.Description
+	if feed.Channel.Description == "" {
+		feed.Channel.Description = site.Title
+	}
+	for _, e := range site.Episodes {
+		item := rssItem{
+			Title:       e.Title,
+			Link:        base + "/episodes/" + e.Slug + ".html",
+			GUID:        e.Slug,
+			Description: strings.Join(strings.Fields(e.ShowNotes), " "),
+		}
+		if !e.Created.IsZero() {
+			item.PubDate = e.Created.Format(time.RFC1123Z)
+		}
+		item.Enclosure.URL, item.Enclosure.Length, item.Enclosure.Type = enclosureURL(site, e), e.Bytes, e.AudioType
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+var (
+	// drivePathRe matches the file ID in Docs and Drive URLs, e.g.
+	// https://docs.google.com/document/d/<id>/edit, https://drive.google.com/file/d/<id>/view
+	drivePathRe = regexp.MustCompile(`/d/([A-Za-z0-9_-]{20,})`)
+	// driveIDRe matches a bare Drive file ID
+	driveIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{25,}$`)
+)
+
+// IsGCSURI returns true if the source is a Cloud Storage gs:// URI
+func IsGCSURI(source string) bool {
+	return strings.HasPrefix(source, "gs://")
+}
+
+// DriveFileID returns the Drive file ID for a source that is a Drive file ID,
+// a Google Docs/Sheets/Slides URL, or a Drive file URL
+func DriveFileID(source string) (string, bool) {
+	if driveIDRe.MatchString(source) {
+		return source, true
+	}
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	if u.Host != "docs.google.com" && u.Host != "drive.google.com" {
+		return "", false
+	}
+	if m := drivePathRe.FindStringSubmatch(u.Path); m != nil {
+		return m[1], true
+	}
+	// https://drive.google.com/open?id=<id>
+	if id := u.Query().Get("id"); driveIDRe.MatchString(id) {
+		return id, true
+	}
+	return "", false
+}
+
+// ValidateSourceURI checks that a PDF source is an http(s) URL, a
+// gs://bucket/object URI, or a Google Drive file
+func ValidateSourceURI(source string) error {
+	if _, ok := DriveFileID(source); ok {
+		return nil
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return fmt.Errorf("invalid source %q: %w", source, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return fmt.Errorf("invalid source %q: missing host", source)
+		}
+	case "gs":
+		if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return fmt.Errorf("invalid source %q: expected gs://bucket/object", source)
+		}
+	default:
+		return fmt.Errorf("invalid source %q: scheme must be http, https or gs, or a Drive file", source)
+	}
+	return nil
+}
+
+// documentPart creates the Gemini part for a PDF source
+// gs:// URIs are handed to Gemini as-is, so documents already in Cloud Storage
+// are read in place rather than downloaded and re-uploaded
+// Drive files are exported as PDF and local file:// documents are sent inline
+func documentPart(ctx context.Context, source string) (genai.Part, error) {
+	if path, ok := strings.CutPrefix(source, "file://"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return genai.Blob{
+			MIMEType: "application/pdf",
+			Data:     data,
+		}, nil
+	}
+	if fileID, ok := DriveFileID(source); ok {
+		data, err := ExportDriveFile(ctx, fileID)
+		if err != nil {
+			return nil, err
+		}
+		return genai.Blob{
+			MIMEType: "application/pdf",
+			Data:     data,
+		}, nil
+	}
+	return genai.FileData{
+		MIMEType: "application/pdf",
+		FileURI:  source,
+	}, nil
+}
+
+// driveService creates a read-only Drive client with application default credentials
+func driveService(ctx context.Context) (*drive.Service, error) {
+	return drive.NewService(ctx, option.WithScopes(drive.DriveReadonlyScope))
+}
+
+// driveFileName returns the name of a Drive file
+func driveFileName(ctx context.Context, fileID string) (string, error) {
+	srv, err := driveService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to create Drive client: %w", err)
+	}
+	f, err := srv.Files.Get(fileID).SupportsAllDrives(true).Fields("name").Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to get Drive file %s: %w", fileID, err)
+	}
+	return f.Name, nil
+}
+
+// driveFileFolders returns the folders a Drive file is in, and its shared
+// drive if it's in one
+func driveFileFolders(ctx context.Context, fileID string) ([]string, error) {
+	srv, err := driveService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Drive client: %w", err)
+	}
+	f, err := srv.Files.Get(fileID).SupportsAllDrives(true).Fields("parents", "driveId").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get Drive file %s: %w", fileID, err)
+	}
+	if f.DriveId != "" {
+		return append(f.Parents, f.DriveId), nil
+	}
+	return f.Parents, nil
+}
+
+// ExportDriveFile returns the PDF contents of a Drive file
+// Google Docs, Sheets and Slides are exported to PDF, PDFs stored in Drive are downloaded,
+// up to DefaultMaxPDFBytes
+func ExportDriveFile(ctx context.Context, fileID string) ([]byte, error) {
+	srv, err := driveService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Drive client: %w", err)
+	}
+	f, err := srv.Files.Get(fileID).SupportsAllDrives(true).Fields("name", "mimeType").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get Drive file %s: %w", fileID, err)
+	}
+	log.Printf("exporting %s (%s) from Drive ...", f.Name, f.MimeType)
+
+	var body io.ReadCloser
+	switch {
+	case f.MimeType == "application/pdf":
+		res, err := srv.Files.Get(fileID).SupportsAllDrives(true).Context(ctx).Download()
+		if err != nil {
+			return nil, fmt.Errorf("unable to download Drive file %s: %w", fileID, err)
+		}
+		body = res.Body
+	case strings.HasPrefix(f.MimeType, "application/vnd.google-apps."):
+		res, err := srv.Files.Export(fileID, "application/pdf").Context(ctx).Download()
+		if err != nil {
+			return nil, fmt.Errorf("unable to export Drive file %s: %w", fileID, err)
+		}
+		body = res.Body
+	default:
+		return nil, fmt.Errorf("unsupported Drive file type %s for %s", f.MimeType, f.Name)
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, DefaultMaxPDFBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > DefaultMaxPDFBytes {
+		return nil, fmt.Errorf("%w: limit %d", ErrTooLarge, DefaultMaxPDFBytes)
+	}
+	return data, nil
+}
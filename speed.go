@@ -0,0 +1,193 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// speeds variants can be rendered at
+const (
+	MinSpeed = 0.5
+	MaxSpeed = 2.0
+)
+
+// time stretching overlaps 30ms Hann windows by half, moving each up to
+// 10ms to where it best continues the last, so pitch is kept without the
+// warble of plain overlap-add
+const (
+	stretchWindow    = 0.030
+	stretchTolerance = 0.010
+	// stretchStride decimates the similarity search, for speed
+	stretchStride = 4
+)
+
+// ParseSpeeds parses a comma-separated list of speeds, e.g. 1.25,1.5
+func ParseSpeeds(s string) ([]float64, error) {
+	var speeds []float64
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSuffix(strings.TrimSpace(v), "x")
+		if v == "" {
+			continue
+		}
+		speed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid speed %q", v)
+		}
+		speeds = append(speeds, speed)
+	}
+	return speeds, ValidateSpeeds(speeds)
+}
+
+// ValidateSpeeds checks speeds are from MinSpeed to MaxSpeed, other than 1
+func ValidateSpeeds(speeds []float64) error {
+	for _, speed := range speeds {
+		if speed < MinSpeed || speed > MaxSpeed || speed == 1 {
+			return fmt.Errorf("speed %g isn't from %g to %g, other than 1", speed, MinSpeed, MaxSpeed)
+		}
+	}
+	return nil
+}
+
+// SpeedVariantFile is where an episode's variant at speed is written, e.g.
+// episode_1.25x.wav
+func SpeedVariantFile(audiofile string, speed float64) string {
+	ext := filepath.Ext(audiofile)
+	return fmt.Sprintf("%s_%gx%s", strings.TrimSuffix(audiofile, ext), speed, ext)
+}
+
+// WriteSpeedVariants writes a wav episode at each speed, time-stretched so
+// voices keep their pitch, for players without speed control. The variants
+// keep the episode's title and disclosure but not its provenance, which
+// is for the original audio
+func WriteSpeedVariants(audiofile string, speeds []float64) ([]string, error) {
+	if !strings.EqualFold(filepath.Ext(audiofile), "."+FormatWAV) {
+		return nil, fmt.Errorf("speed variants are made from wav audio, %s isn't", filepath.Base(audiofile))
+	}
+	if err := ValidateSpeeds(speeds); err != nil {
+		return nil, err
+	}
+	episode, err := readWav16(audiofile, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := ReadTags(audiofile)
+	if err != nil {
+		return nil, err
+	}
+	tags.Provenance = ""
+
+	var files []string
+	for _, speed := range speeds {
+		data := timeStretch(episode.Bytes(), episode.SamplesPerSec(), episode.Channels(), speed)
+		file := pcmAudio{episode.SamplesPerSec(), 16, episode.Channels(), data}.encode()
+		if tags != (Tags{}) {
+			if file, err = wavWithInfo(file, tags); err != nil {
+				return files, err
+			}
+		}
+		variant := SpeedVariantFile(audiofile, speed)
+		if err := os.WriteFile(variant, file, 0644); err != nil {
+			return files, err
+		}
+		log.Printf("%gx variant written to %s", speed, variant)
+		files = append(files, variant)
+	}
+	return files, nil
+}
+
+// timeStretch plays 16-bit audio speed times faster, or slower under 1,
+// with waveform similarity overlap-add (WSOLA), keeping its pitch. Output
+// is written as each hop is complete, so only a window is held as floats
+func timeStretch(data []byte, rate, channels int, speed float64) []byte {
+	frames := len(data) / (2 * channels)
+	sample := func(i, c int) float64 {
+		return float64(int16(binary.LittleEndian.Uint16(data[(i*channels+c)*2:])))
+	}
+	// similarity of the windows at pos and want, on the channels' sum
+	window := int(stretchWindow * float64(rate))
+	window -= window % 2
+	similarity := func(pos, want int) float64 {
+		sum := 0.0
+		for i := 0; i < window; i += stretchStride {
+			a, b := 0.0, 0.0
+			for c := 0; c < channels; c++ {
+				a += sample(pos+i, c)
+				b += sample(want+i, c)
+			}
+			sum += a * b
+		}
+		return sum
+	}
+
+	hop := window / 2
+	tolerance := int(stretchTolerance * float64(rate))
+	hann := make([]float64, window)
+	for i := range hann {
+		hann[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(window))
+	}
+	outFrames := int(float64(frames) / speed)
+	stretched := make([]byte, 0, outFrames*channels*2)
+	// acc is the output from the current hop on, the last window's second
+	// half waiting for the next window's first
+	acc := make([]float64, window*channels)
+	emit := func(n int) {
+		for i := 0; i < n*channels; i++ {
+			v := math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(acc[i])))
+			stretched = binary.LittleEndian.AppendUint16(stretched, uint16(int16(v)))
+		}
+		copy(acc, acc[n*channels:])
+		clear(acc[len(acc)-n*channels:])
+	}
+
+	prev := 0
+	for k := 0; k*hop < outFrames; k++ {
+		nominal := int(float64(k*hop) * speed)
+		pos := nominal
+		if k > 0 {
+			// the window that best continues the last one taken
+			want := prev + hop
+			best := math.Inf(-1)
+			for d := -tolerance; d <= tolerance; d += stretchStride / 2 {
+				p := nominal + d
+				if p < 0 || p+window > frames || want+window > frames {
+					continue
+				}
+				if s := similarity(p, want); s > best {
+					best, pos = s, p
+				}
+			}
+		}
+		if pos+window > frames {
+			break
+		}
+		for i := 0; i < window; i++ {
+			for c := 0; c < channels; c++ {
+				acc[i*channels+c] += sample(pos+i, c) * hann[i]
+			}
+		}
+		emit(hop)
+		prev = pos
+	}
+	emit(hop)
+	return stretched
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// StructuredScripts asks models that support controlled generation for the
+// script as JSON turns, rather than lines with speaker markers
+var StructuredScripts = true
+
+// scriptTurn is one turn of a script generated as JSON
+type scriptTurn struct {
+	Speaker string `json:"speaker"` // host or expert
+	Text    string `json:"text"`
+}
+
+// scriptSchema is the controlled generation schema for a script, its turns
+// in order
+var scriptSchema = &genai.Schema{
+	Type: genai.TypeArray,
+	Items: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"speaker": {Type: genai.TypeString, Enum: []string{"host", "expert"}},
+			"text":    {Type: genai.TypeString},
+		},
+		Required: []string{"speaker", "text"},
+	},
+}
+
+// structuredInstructions replace a prompt's output instructions when the
+// script is generated as JSON
+const structuredInstructions = `
+
+<Structured Output Instructions>
+
+Output the conversation as a JSON array of turns in order, each with the speaker, "host" for the first speaker or "expert" for the second, and the text they say. Don't include speaker markers such as "| [*]" or "| [+]" in the text.`
+
+// structuredScript reports whether to generate modelName's script as JSON
+func structuredScript(modelName string) bool {
+	return StructuredScripts && ModelCapabilities(modelName).ControlledGeneration
+}
+
+// renderScript turns a script generated as JSON into lines with the | [*]
+// and | [+] speaker markers; a response cut off at the output limit keeps
+// the turns it finished
+func renderScript(response string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(response))
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return "", fmt.Errorf("script isn't a JSON array: %.40q", response)
+	}
+	var b strings.Builder
+	for dec.More() {
+		var turn scriptTurn
+		if err := dec.Decode(&turn); err != nil {
+			// a turn cut off at the output limit
+			break
+		}
+		text := strings.Join(strings.Fields(turn.Text), " ")
+		if text == "" {
+			continue
+		}
+		marker := "| [*] "
+		if turn.Speaker == "expert" {
+			marker = "| [+] "
+		}
+		b.WriteString(marker + text + "\n")
+	}
+	if b.Len() == 0 {
+		return "", errors.New("script has no turns")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// prosody is SSML prosody for a speaking style
+type prosody struct {
+	rate, pitch, volume string
+}
+
+// styleProsody maps turn style directives, e.g. [excited], to SSML prosody
+var styleProsody = map[string]prosody{
+	"excited":    {"110%", "+2st", "+2dB"},
+	"happy":      {"105%", "+1st", ""},
+	"laughing":   {"105%", "+2st", ""},
+	"whispering": {"90%", "-1st", "x-soft"},
+	"quiet":      {"95%", "", "soft"},
+	"calm":       {"95%", "-1st", ""},
+	"sad":        {"88%", "-2st", "soft"},
+	"serious":    {"95%", "-1st", ""},
+	"confused":   {"95%", "+1st", ""},
+	"surprised":  {"105%", "+3st", "+2dB"},
+	"loud":       {"", "", "loud"},
+	"shouting":   {"105%", "+2st", "x-loud"},
+	"slow":       {"85%", "", ""},
+	"fast":       {"115%", "", ""},
+}
+
+// styleDirectiveRe matches a style directive at the start of a turn
+var styleDirectiveRe = regexp.MustCompile(`^\[([A-Za-z][A-Za-z -]{0,24})\]\s*`)
+
+// parseStyle removes a leading style directive from a turn, returning the
+// lowercase style and the remaining text
+func parseStyle(turn string) (string, string) {
+	m := styleDirectiveRe.FindStringSubmatch(turn)
+	if m == nil {
+		return "", turn
+	}
+	return strings.ToLower(strings.TrimSpace(m[1])), turn[len(m[0]):]
+}
+
+// supportsSSML reports whether a voice accepts SSML input; Journey and Chirp
+// voices only take text
+func supportsSSML(voicename string) bool {
+	return !strings.Contains(voicename, "Journey") && !strings.Contains(voicename, "Chirp")
+}
+
+// turnSSML creates SSML for a turn's text, with prosody for its style if the
+// style is known, and breaks for natural pacing if enabled
+func turnSSML(style, text string) (string, bool) {
+	content := escapeSSML(text)
+	if naturalPacing {
+		content = pacedSSML(text)
+	}
+	p, ok := styleProsody[style]
+	if !ok {
+		return content, false
+	}
+	attrs := []string{}
+	for _, a := range [][2]string{{"rate", p.rate}, {"pitch", p.pitch}, {"volume", p.volume}} {
+		if a[1] != "" {
+			attrs = append(attrs, fmt.Sprintf("%s=%q", a[0], a[1]))
+		}
+	}
+	return fmt.Sprintf("<prosody %s>%s</prosody>", strings.Join(attrs, " "), content), true
+}
+
+// escapeSSML escapes text for use in SSML
+func escapeSSML(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
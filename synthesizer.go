@@ -0,0 +1,291 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ttspb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+	"github.com/moutend/go-wav"
+)
+
+// audio formats
+const (
+	FormatWAV = "wav"
+	FormatMP3 = "mp3"
+)
+
+// defaultSynthesisParallelism is the number of concurrent synthesis requests
+// for providers that don't set their own
+const defaultSynthesisParallelism = 8
+
+// maxTurnBytes is the most text synthesized at once, under Text-to-Speech's
+// 5000 byte limit with room for SSML markup; longer turns are split
+const maxTurnBytes = 4000
+
+// Audio is synthesized speech
+type Audio struct {
+	Data   []byte
+	Format string // FormatWAV or FormatMP3, also the file extension
+}
+
+// Synthesizer is a text-to-speech provider
+type Synthesizer interface {
+	// Synthesize returns text spoken by a voice, in a style such as excited
+	// if the provider supports it; voice names are provider specific
+	Synthesize(ctx context.Context, voice, style, text string) (Audio, error)
+}
+
+// parallelSynthesizer is implemented by providers with concurrency limits
+type parallelSynthesizer interface {
+	Parallelism() int
+}
+
+// providers create synthesizers by name
+var providers = map[string]func() (Synthesizer, error){
+	"google":     func() (Synthesizer, error) { return &CloudTTS{}, nil },
+	"elevenlabs": newElevenLabsFromEnv,
+	"azure":      newAzureFromEnv,
+	"piper":      newPiperFromEnv,
+}
+
+// Providers returns the names of the text-to-speech providers
+func Providers() []string {
+	names := []string{}
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSynthesizer returns the synthesizer for a provider, configured from the
+// environment
+func NewSynthesizer(provider string) (Synthesizer, error) {
+	newSynthesizer, ok := providers[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, available: %s", provider, strings.Join(Providers(), ", "))
+	}
+	return newSynthesizer()
+}
+
+// CloudTTS synthesizes with Google Cloud Text-to-Speech
+type CloudTTS struct {
+	mu     sync.Mutex
+	voices map[string]*ttspb.VoiceSelectionParams
+}
+
+// Synthesize returns wav audio, styles become SSML prosody for voices that accept SSML
+func (c *CloudTTS) Synthesize(ctx context.Context, voice, style, text string) (Audio, error) {
+	params, err := c.voice(voice)
+	if err != nil {
+		return Audio{}, err
+	}
+	audiobytes, err := synthesizeStyled(ctx, params, style, text)
+	return Audio{audiobytes, FormatWAV}, err
+}
+
+// voice returns selection params for a voice name, looking up each name once
+func (c *CloudTTS) voice(name string) (*ttspb.VoiceSelectionParams, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.voices == nil {
+		c.voices = map[string]*ttspb.VoiceSelectionParams{}
+	}
+	if v, ok := c.voices[name]; ok {
+		return v, nil
+	}
+	v := getSpeechVoicesForName([]string{name})[name]
+	if v == nil {
+		return nil, fmt.Errorf("unknown voice %s", name)
+	}
+	c.voices[name] = v
+	return v, nil
+}
+
+// SynthesizeConversation synthesizes each turn of a conversation with a
+// provider, alternating voice1 and voice2, to files numbered by turn and named
+// for outputfilename; the files are returned in turn order
+func SynthesizeConversation(ctx context.Context, synth Synthesizer, voice1name, voice2name, conversation, outputfilename, tags string) ([]string, error) {
+	p := newProgress(ctx, len(splitTurns(conversation)), false)
+	return synthesizeTurns(ctx, synth, voice1name, voice2name, conversation, outputfilename, tags, nil, p)
+}
+
+// StreamConversation synthesizes a conversation like SynthesizeConversation
+// and merges the turns to w as they're ready, so a very long episode is
+// never held in memory; the provider must return wav. It returns the
+// turns' durations, for timing transcripts
+func StreamConversation(ctx context.Context, synth Synthesizer, voice1name, voice2name, conversation, outputfilename, tags string, w io.Writer) ([]time.Duration, error) {
+	merger := NewWavMerger(w, 0)
+	merger.output = audioFormatOf(ctx)
+	p := newProgress(ctx, len(splitTurns(conversation)), true)
+	ready := func(i int, filename string) error {
+		err := merger.Add(i, filename)
+		p.wrote(merger.bytesWritten())
+		return err
+	}
+	if _, err := synthesizeTurns(ctx, synth, voice1name, voice2name, conversation, outputfilename, tags, ready, p); err != nil {
+		return nil, err
+	}
+	if err := merger.Close(); err != nil {
+		return nil, err
+	}
+	return merger.Durations(), nil
+}
+
+// synthesizeTurns synthesizes each turn to a file, calling ready, if set,
+// with each as it's written, and reporting to p; if a turn fails, those
+// written are removed
+func synthesizeTurns(ctx context.Context, synth Synthesizer, voice1name, voice2name, conversation, outputfilename, tags string, ready func(int, string) error, p *progress) ([]string, error) {
+	turns := splitTurns(conversation)
+	if len(turns) == 0 {
+		return nil, fmt.Errorf("no turns in conversation")
+	}
+	parallelism := defaultSynthesisParallelism
+	if p, ok := synth.(parallelSynthesizer); ok && p.Parallelism() > 0 {
+		parallelism = p.Parallelism()
+	}
+	dir, base := filepath.Split(outputfilename)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	outputfiles := make([]string, len(turns))
+	errs := make([]error, len(turns))
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, parallelism)
+	for i, turn := range turns {
+		voice := voice1name
+		if i%2 == 1 {
+			voice = voice2name
+		}
+		// a leading directive, e.g. [excited], sets the turn's style
+		style, text := parseStyle(strings.TrimSpace(stripParticipantTags(turn, tags)))
+
+		wg.Add(1)
+		go func(i int, voice, style, text string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			p.started(i)
+
+			audio, err := withTurnChecks(i, func() (Audio, error) {
+				return withFallback(ctx, i, voice, func(voice string) (Audio, error) {
+					return withBleeps(text, func(text string) (Audio, error) {
+						text, err := preprocess(ctx, voice, text)
+						if err != nil {
+							return Audio{}, err
+						}
+						return inSentences(text, func(text string) (Audio, error) {
+							return synth.Synthesize(ctx, voice, style, text)
+						})
+					})
+				})
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("turn %d, voice %s: %w", i, voice, err)
+				return
+			}
+			turnfilename := filepath.Join(dir, fmt.Sprintf("%02d_%s.%s", i, base, audio.Format))
+			if err := os.WriteFile(turnfilename, audio.Data, 0644); err != nil {
+				errs[i] = err
+				return
+			}
+			log.Printf("%2d %s Audio content (%7d bytes) written to file: %v", i, voice, len(audio.Data), turnfilename)
+			outputfiles[i] = turnfilename
+			if ready != nil {
+				if errs[i] = ready(i, turnfilename); errs[i] != nil {
+					return
+				}
+			}
+			p.finished(i, len(audio.Data))
+		}(i, voice, style, text)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			RemoveFiles(outputfiles...)
+			return nil, err
+		}
+	}
+	return outputfiles, nil
+}
+
+// inSentences synthesizes text longer than maxTurnBytes in chunks, split at
+// sentence ends, and joins their audio
+func inSentences(text string, synth func(string) (Audio, error)) (Audio, error) {
+	chunks := splitText(text, maxTurnBytes)
+	if len(chunks) == 1 {
+		return synth(text)
+	}
+	log.Printf("splitting a %d byte turn into %d requests", len(text), len(chunks))
+	parts := []Audio{}
+	for _, chunk := range chunks {
+		audio, err := synth(chunk)
+		if err != nil {
+			return Audio{}, err
+		}
+		parts = append(parts, audio)
+	}
+	return joinAudio(parts)
+}
+
+// joinAudio concatenates audio of the same format: wav samples, normalized
+// if their formats differ, or mp3 frames without ID3 tags
+func joinAudio(parts []Audio) (Audio, error) {
+	if parts[0].Format == FormatMP3 {
+		var data bytes.Buffer
+		for _, part := range parts {
+			if part.Format != FormatMP3 {
+				return Audio{}, fmt.Errorf("can't join %s with %s audio", part.Format, FormatMP3)
+			}
+			data.Write(stripID3(part.Data))
+		}
+		return Audio{data.Bytes(), FormatMP3}, nil
+	}
+	wavs := []*wav.File{}
+	for _, part := range parts {
+		w := &wav.File{}
+		if part.Format != FormatWAV {
+			return Audio{}, fmt.Errorf("can't join %s with %s audio", part.Format, FormatWAV)
+		}
+		if err := wav.Unmarshal(part.Data, w); err != nil {
+			return Audio{}, err
+		}
+		wavs = append(wavs, w)
+	}
+	wavs, err := normalizeWavs(wavs)
+	if err != nil {
+		return Audio{}, err
+	}
+	output, err := wav.New(wavs[0].SamplesPerSec(), wavs[0].BitsPerSample(), wavs[0].Channels())
+	if err != nil {
+		return Audio{}, err
+	}
+	for _, w := range wavs {
+		output.Write(w.Bytes())
+	}
+	data, err := wav.Marshal(output)
+	return Audio{data, FormatWAV}, err
+}
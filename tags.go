@@ -0,0 +1,238 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Tags are text metadata written into wav and mp3 files
+type Tags struct {
+	Title      string
+	Comment    string // e.g. a disclosure
+	Software   string
+	Created    time.Time
+	Provenance string // a signed provenance record, as JSON
+}
+
+// wavInfoProvenance is the INFO field for provenance, which has no standard one
+const wavInfoProvenance = "IPRV"
+
+// id3Provenance is the TXXX description for provenance
+const id3Provenance = "provenance"
+
+// WriteTags replaces the metadata in a wav file's INFO chunk or an mp3
+// file's ID3 tag
+func WriteTags(filename string, tags Tags) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".wav":
+		data, err = wavWithInfo(data, tags)
+	case ".mp3":
+		data = append(id3Tag(tags), stripID3(data)...)
+	default:
+		err = fmt.Errorf("can't tag %s files", filepath.Ext(filename))
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// ReadTags reads the metadata written by WriteTags
+func ReadTags(filename string) (Tags, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return Tags{}, err
+	}
+	fields := map[string]string{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".wav":
+		fields = wavInfo(data)
+	case ".mp3":
+		fields = id3Frames(data)
+	default:
+		return Tags{}, fmt.Errorf("can't read tags from %s files", filepath.Ext(filename))
+	}
+	tags := Tags{
+		Title:      fields["INAM"] + fields["TIT2"],
+		Comment:    fields["ICMT"] + fields["COMM"],
+		Software:   fields["ISFT"] + fields["TSSE"],
+		Provenance: fields[wavInfoProvenance] + fields[id3Provenance],
+	}
+	if created := fields["ICRD"] + fields["TDRC"]; created != "" {
+		tags.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	return tags, nil
+}
+
+// wavInfo returns the fields of a wav file's LIST INFO chunk
+func wavInfo(data []byte) map[string]string {
+	fields := map[string]string{}
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := min(pos+8+size+size%2, len(data))
+		if string(data[pos:pos+4]) == "LIST" && pos+12 <= end && string(data[pos+8:pos+12]) == "INFO" {
+			for f := pos + 12; f+8 <= end; {
+				fsize := int(binary.LittleEndian.Uint32(data[f+4:]))
+				fend := min(f+8+fsize, end)
+				fields[string(data[f:f+4])] = strings.TrimRight(string(data[f+8:fend]), "\x00")
+				f = fend + fsize%2
+			}
+		}
+		pos = end
+	}
+	return fields
+}
+
+// id3Frames returns the UTF-8 text frames of an ID3v2.4 tag, with TXXX
+// frames by their description
+func id3Frames(data []byte) map[string]string {
+	fields := map[string]string{}
+	if len(data) < 10 || string(data[:3]) != "ID3" || data[3] != 4 {
+		return fields
+	}
+	end := min(10+unsynchsafe(data[6:10]), len(data))
+	for pos := 10; pos+10 <= end && data[pos] != 0; {
+		id := string(data[pos : pos+4])
+		size := unsynchsafe(data[pos+4 : pos+8])
+		body := data[pos+10 : min(pos+10+size, end)]
+		pos += 10 + size
+		if len(body) == 0 || body[0] != 3 {
+			continue
+		}
+		switch id {
+		case "COMM":
+			if len(body) > 4 {
+				if _, text, ok := strings.Cut(string(body[4:]), "\x00"); ok {
+					fields[id] = text
+				}
+			}
+		case "TXXX":
+			if desc, text, ok := strings.Cut(string(body[1:]), "\x00"); ok {
+				fields[desc] = text
+			}
+		default:
+			fields[id] = string(body[1:])
+		}
+	}
+	return fields
+}
+
+func unsynchsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// wavWithInfo replaces any LIST INFO chunk in wav data with one for tags
+func wavWithInfo(data []byte, tags Tags) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("not a wav file")
+	}
+	var out bytes.Buffer
+	out.Write(data[:12])
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := min(pos+8+size+size%2, len(data))
+		if !(id == "LIST" && pos+12 <= len(data) && string(data[pos+8:pos+12]) == "INFO") {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	var info bytes.Buffer
+	info.WriteString("INFO")
+	for _, field := range [][2]string{
+		{"INAM", tags.Title},
+		{"ICMT", tags.Comment},
+		{"ISFT", tags.Software},
+		{"ICRD", formatCreated(tags.Created)},
+		{wavInfoProvenance, tags.Provenance},
+	} {
+		if field[1] == "" {
+			continue
+		}
+		value := append([]byte(field[1]), 0)
+		info.WriteString(field[0])
+		binary.Write(&info, binary.LittleEndian, uint32(len(value)))
+		info.Write(value)
+		if len(value)%2 == 1 {
+			info.WriteByte(0)
+		}
+	}
+	out.WriteString("LIST")
+	binary.Write(&out, binary.LittleEndian, uint32(info.Len()))
+	out.Write(info.Bytes())
+
+	wavdata := out.Bytes()
+	binary.LittleEndian.PutUint32(wavdata[4:], uint32(len(wavdata)-8))
+	return wavdata, nil
+}
+
+// id3Tag returns an ID3v2.4 tag with UTF-8 text frames for tags
+func id3Tag(tags Tags) []byte {
+	var frames bytes.Buffer
+	frame := func(id string, body []byte) {
+		frames.WriteString(id)
+		frames.Write(synchsafe(len(body)))
+		frames.Write([]byte{0, 0})
+		frames.Write(body)
+	}
+	text := func(id, value string) {
+		if value != "" {
+			frame(id, append([]byte{3}, value...))
+		}
+	}
+	text("TIT2", tags.Title)
+	text("TSSE", tags.Software)
+	text("TDRC", formatCreated(tags.Created))
+	if tags.Comment != "" {
+		// encoding, language, empty description, text
+		frame("COMM", append([]byte{3, 'e', 'n', 'g', 0}, tags.Comment...))
+	}
+	if tags.Provenance != "" {
+		// encoding, description, text
+		frame("TXXX", append(append([]byte{3}, id3Provenance+"\x00"...), tags.Provenance...))
+	}
+
+	var tag bytes.Buffer
+	tag.WriteString("ID3")
+	tag.Write([]byte{4, 0, 0})
+	tag.Write(synchsafe(frames.Len()))
+	tag.Write(frames.Bytes())
+	return tag.Bytes()
+}
+
+// synchsafe encodes n in 4 bytes of 7 bits, as ID3v2.4 sizes are
+func synchsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+func formatCreated(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
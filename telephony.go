@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/moutend/go-wav"
+)
+
+// G.711 encodings, for telephony exports
+const (
+	EncodingMulaw = "mulaw" // North America and Japan
+	EncodingAlaw  = "alaw"  // elsewhere
+)
+
+// wav format tags for G.711 audio
+const (
+	wavFormatAlaw  = 6
+	wavFormatMulaw = 7
+)
+
+// the telephone band, which G.711 exports are limited to
+const (
+	telephoneLow  = 300
+	telephoneHigh = 3400
+)
+
+// readTelephony reads 16-bit audio limited to the telephone band, then
+// converts it to rate and channels, so resampling to 8 kHz doesn't fold
+// the voices' sibilance back into the band as aliasing
+func readTelephony(audiofile string, rate, channels int) (*wav.File, error) {
+	w, err := readWav16(audiofile, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	data := w.Bytes()
+	inRate, inChannels := w.SamplesPerSec(), w.Channels()
+	frames := len(data) / (2 * inChannels)
+	for c := 0; c < inChannels; c++ {
+		// fourth order at the top, where TTS voices have the most energy
+		filters := []biquad{
+			highpass(inRate, telephoneLow, math.Sqrt2/2),
+			lowpass(inRate, telephoneHigh, 0.5411961),
+			lowpass(inRate, telephoneHigh, 1.3065630),
+		}
+		for i := 0; i < frames; i++ {
+			pos := (i*inChannels + c) * 2
+			x := float64(int16(binary.LittleEndian.Uint16(data[pos:])))
+			for f := range filters {
+				x = filters[f].filter(x)
+			}
+			binary.LittleEndian.PutUint16(data[pos:], uint16(int16(max(math.MinInt16, min(math.MaxInt16, math.Round(x))))))
+		}
+	}
+	w, err = pcmAudio{inRate, 16, inChannels, data}.wavFile()
+	if err != nil {
+		return nil, err
+	}
+	return convertWav(w, rate, channels)
+}
+
+// g711Wav encodes 16-bit audio as a G.711 μ-law or A-law wav
+func g711Wav(data []byte, rate, channels int, encoding string) ([]byte, error) {
+	var tag uint16
+	var compand func(int16) byte
+	switch encoding {
+	case EncodingMulaw:
+		tag, compand = wavFormatMulaw, mulaw
+	case EncodingAlaw:
+		tag, compand = wavFormatAlaw, alaw
+	default:
+		return nil, fmt.Errorf("unknown encoding %q, use %s or %s", encoding, EncodingMulaw, EncodingAlaw)
+	}
+	samples := make([]byte, len(data)/2)
+	for i := range samples {
+		samples[i] = compand(int16(binary.LittleEndian.Uint16(data[i*2:])))
+	}
+
+	// non-PCM wavs have an extended fmt chunk and a fact chunk with the
+	// number of frames
+	var out bytes.Buffer
+	size := len(samples) + len(samples)%2
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(4+(8+18)+(8+4)+8+size))
+	out.WriteString("WAVEfmt ")
+	for _, v := range []any{
+		uint32(18),
+		tag,
+		uint16(channels),
+		uint32(rate),
+		uint32(rate * channels),
+		uint16(channels),
+		uint16(8),
+		uint16(0),
+	} {
+		binary.Write(&out, binary.LittleEndian, v)
+	}
+	out.WriteString("fact")
+	binary.Write(&out, binary.LittleEndian, uint32(4))
+	binary.Write(&out, binary.LittleEndian, uint32(len(samples)/channels))
+	out.WriteString("data")
+	binary.Write(&out, binary.LittleEndian, uint32(len(samples)))
+	out.Write(samples)
+	if len(samples)%2 == 1 {
+		out.WriteByte(0)
+	}
+	return out.Bytes(), nil
+}
+
+// segment is the G.711 segment, of 8, that v falls in, with each segment
+// ending at twice the last
+func segment(v, first int) int {
+	seg := 0
+	for end := first; v > end && seg < 8; end = end<<1 | 1 {
+		seg++
+	}
+	return seg
+}
+
+// mulaw is a 16-bit sample in G.711 μ-law, as 14-bit audio
+func mulaw(s int16) byte {
+	const bias, clip = 0x84 >> 2, 8159
+	v, mask := int(s)>>2, 0xFF
+	if v < 0 {
+		v, mask = -v, 0x7F
+	}
+	v = min(v, clip) + bias
+	seg := segment(v, 0x3F)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	return byte((seg<<4 | (v>>(seg+1))&0x0F) ^ mask)
+}
+
+// alaw is a 16-bit sample in G.711 A-law, as 13-bit audio
+func alaw(s int16) byte {
+	v, mask := int(s)>>3, 0xD5
+	if v < 0 {
+		v, mask = -v-1, 0x55
+	}
+	seg := segment(v, 0x1F)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	a := seg << 4
+	if seg < 2 {
+		a |= (v >> 1) & 0x0F
+	} else {
+		a |= (v >> seg) & 0x0F
+	}
+	return byte(a ^ mask)
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	speech "google.golang.org/api/speech/v1p1beta1"
+)
+
+const (
+	// maxInlineAudio is the largest local file sent in the request; longer
+	// recordings must be in Cloud Storage
+	maxInlineAudio = 10 << 20
+	// transcribePoll is how often a long-running recognition is checked
+	transcribePoll = 5 * time.Second
+)
+
+// speechEncodings are Speech-to-Text encodings by file extension; wav and
+// flac headers have the sample rate
+var speechEncodings = map[string]string{
+	".wav":  "",
+	".flac": "FLAC",
+	".mp3":  "MP3",
+	".ogg":  "OGG_OPUS",
+	".opus": "OGG_OPUS",
+	".webm": "WEBM_OPUS",
+}
+
+// TranscribeOptions configures Transcribe, zero values use the defaults
+type TranscribeOptions struct {
+	LanguageCode string   // e.g. en-US
+	Speakers     int      // the number of speakers, at most
+	Labels       []string // turn labels for the speakers, in order of first speaking
+	Model        string   // Speech-to-Text model, e.g. phone_call or video
+	SampleRate   int      // needed for Opus audio
+}
+
+func (o TranscribeOptions) withDefaults() TranscribeOptions {
+	if o.LanguageCode == "" {
+		o.LanguageCode = "en-US"
+	}
+	if o.Speakers <= 0 {
+		o.Speakers = 2
+	}
+	if len(o.Labels) == 0 {
+		o.Labels = []string{"AGENT", "CUSTOMER"}
+	}
+	return o
+}
+
+// Transcribe recognizes speech in a recording, a local file or gs:// URI,
+// with speaker diarization and returns a transcript in fabulae's turn
+// format: a line per turn, labeled with the speaker
+func Transcribe(ctx context.Context, projectID, source string, opts TranscribeOptions) (string, error) {
+	opts = opts.withDefaults()
+	encoding, ok := speechEncodings[strings.ToLower(filepath.Ext(source))]
+	if !ok {
+		return "", fmt.Errorf("unsupported audio %s, use wav, flac, mp3, ogg/opus or webm", filepath.Ext(source))
+	}
+	audio := &speech.RecognitionAudio{}
+	if IsGCSURI(source) {
+		audio.Uri = source
+	} else {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return "", err
+		}
+		if len(data) > maxInlineAudio {
+			return "", fmt.Errorf("%s is larger than %d MB, copy it to Cloud Storage and use its gs:// URI", source, maxInlineAudio>>20)
+		}
+		audio.Content = base64.StdEncoding.EncodeToString(data)
+	}
+
+	config := &speech.RecognitionConfig{
+		Encoding:                   encoding,
+		SampleRateHertz:            int64(opts.SampleRate),
+		LanguageCode:               opts.LanguageCode,
+		Model:                      opts.Model,
+		EnableAutomaticPunctuation: true,
+		DiarizationConfig: &speech.SpeakerDiarizationConfig{
+			EnableSpeakerDiarization: true,
+			MinSpeakerCount:          min(2, int64(opts.Speakers)),
+			MaxSpeakerCount:          int64(opts.Speakers),
+		},
+	}
+	debugf(DebugRequests, "speech: recognizing %s, %s, up to %d speakers", source, opts.LanguageCode, opts.Speakers)
+	start := time.Now()
+	results, err := recognize(ctx, projectID, audio, config)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("transcribed %s in %s", source, time.Since(start).Round(time.Second))
+	return diarizedTurns(results, opts.Labels)
+}
+
+// recognize runs a long-running recognition and waits for its results
+func recognize(ctx context.Context, projectID string, audio *speech.RecognitionAudio, config *speech.RecognitionConfig) ([]*speech.SpeechRecognitionResult, error) {
+	clientopts := []option.ClientOption{}
+	if projectID != "" {
+		clientopts = append(clientopts, option.WithQuotaProject(projectID))
+	}
+	srv, err := speech.NewService(ctx, clientopts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Speech-to-Text client: %w", err)
+	}
+	start := time.Now()
+	op, err := srv.Speech.Longrunningrecognize(&speech.LongRunningRecognizeRequest{Audio: audio, Config: config}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start recognition: %w", err)
+	}
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(transcribePoll):
+		}
+		if op, err = srv.Operations.Get(op.Name).Context(ctx).Do(); err != nil {
+			return nil, err
+		}
+		debugf(DebugRequests, "speech: %s, %s", op.Name, time.Since(start).Round(time.Second))
+	}
+	if op.Error != nil {
+		return nil, fmt.Errorf("recognition failed: %s", op.Error.Message)
+	}
+	var res speech.LongRunningRecognizeResponse
+	if err := json.Unmarshal(op.Response, &res); err != nil {
+		return nil, err
+	}
+	return res.Results, nil
+}
+
+// diarizedTurns groups words into turns by speaker; with diarization the
+// last result has every word with its speaker
+func diarizedTurns(results []*speech.SpeechRecognitionResult, labels []string) (string, error) {
+	var words []*speech.WordInfo
+	for i := len(results) - 1; i >= 0; i-- {
+		if alts := results[i].Alternatives; len(alts) > 0 && len(alts[0].Words) > 0 {
+			words = alts[0].Words
+			break
+		}
+	}
+	if len(words) == 0 {
+		return "", errors.New("no speech recognized")
+	}
+
+	speakers := map[int64]string{}
+	label := func(tag int64) string {
+		if l, ok := speakers[tag]; ok {
+			return l
+		}
+		l := fmt.Sprintf("SPEAKER%d", len(speakers)+1)
+		if len(speakers) < len(labels) {
+			l = labels[len(speakers)]
+		}
+		speakers[tag] = l
+		return l
+	}
+
+	var b strings.Builder
+	current := int64(-1)
+	for _, w := range words {
+		if w.SpeakerTag != current {
+			if current != -1 {
+				b.WriteString("\n")
+			}
+			current = w.SpeakerTag
+			fmt.Fprintf(&b, "%s:", label(current))
+		}
+		b.WriteString(" " + w.Word)
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// transcript formats
+const (
+	TranscriptMarkdown = "md"
+	TranscriptJSON     = "json"
+	TranscriptSRT      = "srt"
+)
+
+// maxCueChars keeps subtitle cues to about two lines
+const maxCueChars = 84
+
+// TranscriptTurn is a turn of a conversation and when it's spoken in the episode
+type TranscriptTurn struct {
+	Speaker string // host or expert
+	Voice   string
+	Text    string
+	Start   time.Duration
+	End     time.Duration
+	Words   []TranscriptWord // once aligned with AlignTranscript
+}
+
+// MarshalJSON writes turn times in seconds
+func (t TranscriptTurn) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Speaker string           `json:"speaker"`
+		Voice   string           `json:"voice,omitempty"`
+		Text    string           `json:"text"`
+		Start   float64          `json:"start"`
+		End     float64          `json:"end"`
+		Words   []TranscriptWord `json:"words,omitempty"`
+	}{t.Speaker, t.Voice, t.Text, t.Start.Seconds(), t.End.Seconds(), t.Words})
+}
+
+// UnmarshalJSON reads turn times in seconds
+func (t *TranscriptTurn) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Speaker string           `json:"speaker"`
+		Voice   string           `json:"voice"`
+		Text    string           `json:"text"`
+		Start   float64          `json:"start"`
+		End     float64          `json:"end"`
+		Words   []TranscriptWord `json:"words"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*t = TranscriptTurn{v.Speaker, v.Voice, v.Text, seconds(v.Start), seconds(v.End), v.Words}
+	return nil
+}
+
+// seconds is a duration from seconds
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ValidateTranscriptFormats checks formats are md, json or srt
+func ValidateTranscriptFormats(formats []string) error {
+	for _, f := range formats {
+		switch f {
+		case TranscriptMarkdown, TranscriptJSON, TranscriptSRT:
+		default:
+			return fmt.Errorf("unknown transcript format %q, use md, json or srt", f)
+		}
+	}
+	return nil
+}
+
+// TranscriptTurns splits a conversation into turns as they're spoken,
+// alternating voices, without speaker markers, tags or style directives;
+// they're timed by their length until TimeTurns
+func TranscriptTurns(conversation, voice1, voice2, tags string) []TranscriptTurn {
+	turns := []TranscriptTurn{}
+	for i, turn := range splitTurns(conversation) {
+		_, text := parseStyle(strings.TrimSpace(stripParticipantTags(turn, tags)))
+		t := TranscriptTurn{Speaker: "host", Voice: voice1, Text: strings.TrimSpace(text)}
+		if i%2 == 1 {
+			t.Speaker, t.Voice = "expert", voice2
+		}
+		turns = append(turns, t)
+	}
+	TimeTurns(turns, nil)
+	return turns
+}
+
+// TimeTurns times turns from the durations of their audio: one per turn,
+// or the whole conversation's spread over the turns by length; without
+// durations turns are estimated from their words
+func TimeTurns(turns []TranscriptTurn, durations []time.Duration) {
+	per := make([]time.Duration, len(turns))
+	switch {
+	case len(durations) == len(turns):
+		copy(per, durations)
+	case len(durations) > 0:
+		var total time.Duration
+		for _, d := range durations {
+			total += d
+		}
+		chars := 0
+		for _, t := range turns {
+			chars += utf8.RuneCountInString(t.Text)
+		}
+		for i, t := range turns {
+			if chars > 0 {
+				per[i] = time.Duration(float64(total) * float64(utf8.RuneCountInString(t.Text)) / float64(chars))
+			}
+		}
+	default:
+		for i, t := range turns {
+			per[i] = time.Duration(len(strings.Fields(t.Text))) * time.Minute / wordsPerMinute
+		}
+	}
+	var start time.Duration
+	for i := range turns {
+		turns[i].Start, turns[i].End = start, start+per[i]
+		start += per[i]
+	}
+}
+
+// ShiftTurns moves turns later by offset, e.g. after an opening disclosure
+func ShiftTurns(turns []TranscriptTurn, offset time.Duration) {
+	for i := range turns {
+		turns[i].Start += offset
+		turns[i].End += offset
+		for j := range turns[i].Words {
+			turns[i].Words[j].Start += offset
+			turns[i].Words[j].End += offset
+		}
+	}
+}
+
+// AudioDurations returns the duration of each wav file
+func AudioDurations(files []string) ([]time.Duration, error) {
+	durations := []time.Duration{}
+	for _, file := range files {
+		p, err := readPCM(file)
+		if err != nil {
+			return nil, err
+		}
+		durations = append(durations, p.duration())
+	}
+	return durations, nil
+}
+
+// MarkdownTranscript formats turns as a readable script
+func MarkdownTranscript(title string, turns []TranscriptTurn) []byte {
+	var b bytes.Buffer
+	if title != "" {
+		fmt.Fprintf(&b, "# %s\n\n", title)
+	}
+	for _, t := range turns {
+		fmt.Fprintf(&b, "**%s%s:** %s\n\n", strings.ToUpper(t.Speaker[:1]), t.Speaker[1:], t.Text)
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
+
+// SRTTranscript formats turns as SubRip subtitles, long turns split into
+// cues at sentence ends and timed by their words if aligned, or their length
+func SRTTranscript(turns []TranscriptTurn) []byte {
+	var b bytes.Buffer
+	n := 0
+	for _, t := range turns {
+		cues := splitText(t.Text, maxCueChars)
+		chars, words := 0, 0
+		for _, c := range cues {
+			chars += utf8.RuneCountInString(c)
+			words += len(strings.Fields(c))
+		}
+		start, word := t.Start, 0
+		for i, c := range cues {
+			end := t.End
+			switch {
+			case i == len(cues)-1:
+			case words == len(t.Words):
+				// the next cue starts with its first word
+				word += len(strings.Fields(c))
+				end = t.Words[word].Start
+			case chars > 0:
+				end = start + time.Duration(float64(t.End-t.Start)*float64(utf8.RuneCountInString(c))/float64(chars))
+			}
+			n++
+			fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", n, srtTime(start), srtTime(end), strings.TrimSpace(c))
+			start = end
+		}
+	}
+	return b.Bytes()
+}
+
+// srtTime formats a subtitle time, e.g. 00:01:02,500
+func srtTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// TranscriptFile is the transcript file for an audio file in a format,
+// e.g. episode.transcript.md
+func TranscriptFile(audiofile, format string) string {
+	base := strings.TrimSuffix(audiofile, ".wav")
+	base = strings.TrimSuffix(base, ".mp3")
+	if format == TranscriptSRT {
+		return base + ".srt"
+	}
+	return base + ".transcript." + format
+}
+
+// WriteTranscripts writes turns in each format next to audiofile, returning
+// the files by format
+func WriteTranscripts(audiofile, title string, turns []TranscriptTurn, formats []string) (map[string]string, error) {
+	files := map[string]string{}
+	for _, format := range formats {
+		var data []byte
+		switch format {
+		case TranscriptMarkdown:
+			data = MarkdownTranscript(title, turns)
+		case TranscriptJSON:
+			var err error
+			if data, err = json.MarshalIndent(turns, "", "  "); err != nil {
+				return files, err
+			}
+			data = append(data, '\n')
+		case TranscriptSRT:
+			data = SRTTranscript(turns)
+		default:
+			return files, fmt.Errorf("unknown transcript format %q", format)
+		}
+		filename := TranscriptFile(audiofile, format)
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			return files, err
+		}
+		files[format] = filename
+	}
+	return files, nil
+}
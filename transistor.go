@@ -0,0 +1,188 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+const transistorBaseURL = "https://api.transistor.fm"
+
+// Transistor publishes to a Transistor.fm show with its API
+type Transistor struct {
+	APIKey  string
+	ShowID  string
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewTransistor returns a Transistor host for a show
+func NewTransistor(apiKey, showID string) *Transistor {
+	return &Transistor{
+		APIKey:  apiKey,
+		ShowID:  showID,
+		BaseURL: transistorBaseURL,
+		Client:  podcastHostClient,
+	}
+}
+
+// newTransistorFromEnv configures Transistor from TRANSISTOR_API_KEY and
+// TRANSISTOR_SHOW_ID, unless show is set
+func newTransistorFromEnv(show string) (PodcastHost, error) {
+	apiKey, err := SecretEnv(context.Background(), "TRANSISTOR_API_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == "" {
+		return nil, errors.New("TRANSISTOR_API_KEY is required for the transistor host")
+	}
+	if show == "" {
+		show = os.Getenv("TRANSISTOR_SHOW_ID")
+	}
+	if show == "" {
+		return nil, errors.New("transistor needs a show ID, from TRANSISTOR_SHOW_ID")
+	}
+	return NewTransistor(apiKey, show), nil
+}
+
+// transistorResource is the JSON:API document Transistor responds with
+type transistorResource struct {
+	Data struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			UploadURL   string `json:"upload_url"`
+			ContentType string `json:"content_type"`
+			AudioURL    string `json:"audio_url"`
+			ShareURL    string `json:"share_url"`
+			Status      string `json:"status"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// do calls the Transistor API, decoding the response into v
+func (t *Transistor) do(ctx context.Context, method, endpoint string, body any, v any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.BaseURL+endpoint, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-api-key", t.APIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	debugf(DebugRequests, "transistor: %s %s", method, endpoint)
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("transistor: %s: %s", res.Status, bytes.TrimSpace(detail))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// upload puts the audio where Transistor authorizes, returning its audio URL
+func (t *Transistor) upload(ctx context.Context, audiofile string) (string, error) {
+	var authorized transistorResource
+	endpoint := "/v1/episodes/authorized_upload_url?filename=" + url.QueryEscape(filepath.Base(audiofile))
+	if err := t.do(ctx, http.MethodGet, endpoint, nil, &authorized); err != nil {
+		return "", err
+	}
+	f, err := os.Open(audiofile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, authorized.Data.Attributes.UploadURL, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", authorized.Data.Attributes.ContentType)
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return "", fmt.Errorf("transistor: audio upload: %s", res.Status)
+	}
+	return authorized.Data.Attributes.AudioURL, nil
+}
+
+// PublishEpisode uploads the audio and creates the episode, published or as
+// a draft; Transistor takes artwork by URL only
+func (t *Transistor) PublishEpisode(ctx context.Context, episode PodcastEpisode) (string, error) {
+	if episode.Artwork != "" && !isURL(episode.Artwork) {
+		return "", errors.New("transistor: artwork must be an http(s) URL")
+	}
+	audioURL, err := t.upload(ctx, episode.Audio)
+	if err != nil {
+		return "", err
+	}
+	attributes := map[string]string{
+		"show_id":     t.ShowID,
+		"title":       episode.Title,
+		"summary":     episode.Summary,
+		"description": episode.Description,
+		"audio_url":   audioURL,
+	}
+	if episode.Artwork != "" {
+		attributes["image_url"] = episode.Artwork
+	}
+	if episode.Transcript != "" {
+		attributes["transcript_text"] = episode.Transcript
+	}
+	var created transistorResource
+	if err := t.do(ctx, http.MethodPost, "/v1/episodes", map[string]any{"episode": attributes}, &created); err != nil {
+		return "", err
+	}
+	if episode.Publish {
+		var published transistorResource
+		endpoint := fmt.Sprintf("/v1/episodes/%s/publish", url.PathEscape(created.Data.ID))
+		if err := t.do(ctx, http.MethodPatch, endpoint, map[string]any{"episode": map[string]string{"status": "published"}}, &published); err != nil {
+			return "", err
+		}
+		created = published
+	}
+	log.Printf("transistor: episode %s, %s", created.Data.ID, created.Data.Attributes.Status)
+	if created.Data.Attributes.ShareURL != "" {
+		return created.Data.Attributes.ShareURL, nil
+	}
+	return "transistor episode " + created.Data.ID, nil
+}
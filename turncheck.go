@@ -0,0 +1,207 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/cmplx"
+	"strings"
+)
+
+// TurnChecks checks each synthesized turn for glitches, synthesizing it
+// again when it has clipping, a DC offset, too much silence or static
+var TurnChecks bool
+
+const (
+	// turnCheckAttempts is how many times a turn is synthesized before the
+	// one with the fewest issues is kept
+	turnCheckAttempts = 3
+
+	// a turn is clipped if more than clipShare of its samples are in runs
+	// of clipRun or more at full scale
+	clipLevel = 0.999
+	clipRun   = 3
+	clipShare = 0.001
+	// maxDCOffset is the most the turn's mean can be off zero, about -34 dBFS
+	maxDCOffset = 0.02
+	// a turn longer than a second is mostly silent if more than
+	// maxSilentShare of its windows are under silenceLevel dBFS
+	silenceLevel   = -50
+	maxSilentShare = 0.75
+	// a turn has static if more than maxStaticShare of its windows with
+	// sound are as flat, spectrally, as noise: speech has its energy in
+	// harmonics and formants, so even fricatives are rarely this flat
+	staticFlatness = 0.45
+	maxStaticShare = 0.25
+	// checkWindow is the frames per analysis window, a power of two
+	checkWindow = 1024
+)
+
+// checkTurn returns what's wrong with a turn's audio, if anything; only wav
+// audio is checked
+func checkTurn(audio Audio) []string {
+	if audio.Format != FormatWAV {
+		return nil
+	}
+	p, err := decodeWav(audio.Data)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	w, err := p.wavFile()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	// the channels are checked together, as one mono signal
+	ints := w.Int32s()
+	samples := make([]float64, len(ints)/p.channels)
+	for i := range samples {
+		for c := 0; c < p.channels; c++ {
+			samples[i] += float64(ints[i*p.channels+c]) / math.MaxInt32
+		}
+		samples[i] /= float64(p.channels)
+	}
+	if len(samples) == 0 {
+		return []string{"no audio"}
+	}
+
+	var issues []string
+	clipped, run, sum := 0, 0, 0.0
+	for _, v := range samples {
+		sum += v
+		if math.Abs(v) >= clipLevel {
+			run++
+			if run == clipRun {
+				clipped += clipRun
+			} else if run > clipRun {
+				clipped++
+			}
+		} else {
+			run = 0
+		}
+	}
+	if share := float64(clipped) / float64(len(samples)); share > clipShare {
+		issues = append(issues, fmt.Sprintf("clipping in %.2f%% of samples", 100*share))
+	}
+	if dc := sum / float64(len(samples)); math.Abs(dc) > maxDCOffset {
+		issues = append(issues, fmt.Sprintf("DC offset of %.3f", dc))
+	}
+
+	windows, silent, static := 0, 0, 0
+	for start := 0; start+checkWindow <= len(samples); start += checkWindow {
+		windows++
+		window := samples[start : start+checkWindow]
+		energy := 0.0
+		for _, v := range window {
+			energy += v * v
+		}
+		if decibels(math.Sqrt(energy/checkWindow)) < silenceLevel {
+			silent++
+			continue
+		}
+		if spectralFlatness(window) > staticFlatness {
+			static++
+		}
+	}
+	switch {
+	case windows > 0 && silent == windows:
+		issues = append(issues, "no speech")
+	case p.duration().Seconds() > 1 && float64(silent) > maxSilentShare*float64(windows):
+		issues = append(issues, fmt.Sprintf("silent for %d%% of the turn", 100*silent/windows))
+	}
+	if sound := windows - silent; sound > 0 && float64(static) > maxStaticShare*float64(sound) {
+		issues = append(issues, fmt.Sprintf("static in %d%% of the turn", 100*static/sound))
+	}
+	return issues
+}
+
+// spectralFlatness is the geometric over the arithmetic mean of a window's
+// power spectrum, Hann windowed: near 0 for tones and voiced speech, about
+// 0.56 for white noise
+func spectralFlatness(window []float64) float64 {
+	n := len(window)
+	x := make([]complex128, n)
+	for i, v := range window {
+		x[i] = complex(v*0.5*(1-math.Cos(2*math.Pi*float64(i)/float64(n-1))), 0)
+	}
+	fft(x)
+	logSum, sum := 0.0, 0.0
+	bins := n/2 - 1
+	for k := 1; k <= bins; k++ {
+		power := real(x[k])*real(x[k]) + imag(x[k])*imag(x[k]) + 1e-20
+		logSum += math.Log(power)
+		sum += power
+	}
+	return math.Exp(logSum/float64(bins)) / (sum / float64(bins))
+}
+
+// fft is an in-place radix-2 fast Fourier transform, len(x) a power of two
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// withTurnChecks synthesizes a turn, again while it fails the checks, with
+// TurnChecks; if every attempt fails, the one with the fewest issues is
+// kept rather than failing the episode
+func withTurnChecks(turn int, synth func() (Audio, error)) (Audio, error) {
+	if !TurnChecks {
+		return synth()
+	}
+	var best Audio
+	var bestIssues []string
+	for attempt := 1; attempt <= turnCheckAttempts; attempt++ {
+		audio, err := synth()
+		if err != nil {
+			return audio, err
+		}
+		issues := checkTurn(audio)
+		if len(issues) == 0 {
+			if attempt > 1 {
+				log.Printf("turn %d passed its checks on attempt %d", turn, attempt)
+			}
+			return audio, nil
+		}
+		if bestIssues == nil || len(issues) < len(bestIssues) {
+			best, bestIssues = audio, issues
+		}
+		if attempt < turnCheckAttempts {
+			log.Printf("turn %d failed its checks, synthesizing it again: %s", turn, strings.Join(issues, ", "))
+		}
+	}
+	log.Printf("turn %d failed its checks %d times, keeping it: %s", turn, turnCheckAttempts, strings.Join(bestIssues, ", "))
+	return best, nil
+}
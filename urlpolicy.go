@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrURLNotAllowed is returned when a URL or the address it resolves to is
+// rejected by a URLPolicy
+var ErrURLNotAllowed = errors.New("url not allowed")
+
+// carrierGradeNAT is 100.64.0.0/10, not covered by net.IP.IsPrivate
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// URLPolicy restricts which URLs may be fetched server-side
+// Host entries match exactly, or match subdomains when they start with a dot,
+// e.g. ".arxiv.org"
+type URLPolicy struct {
+	AllowedHosts []string // if set, only these hosts may be fetched
+	DeniedHosts  []string // never fetched, checked before AllowedHosts
+	AllowedPorts []int    // defaults to 80 and 443
+	AllowPrivate bool     // allow loopback, private, link-local and other internal addresses
+
+	// gs:// and Drive sources are read with the reader's own access rather
+	// than fetched, so CheckSource only accepts them from these buckets,
+	// and Drive folders or shared drives by ID
+	AllowedBuckets      []string
+	AllowedDriveFolders []string
+}
+
+func hostMatches(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if strings.HasPrefix(p, ".") {
+			if host == p[1:] || strings.HasSuffix(host, p) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSource checks a gs:// or Drive source is in an allowed bucket or
+// Drive folder; other sources are checked by CheckURL as they're fetched
+func (p *URLPolicy) CheckSource(ctx context.Context, source string) error {
+	if fileID, ok := DriveFileID(source); ok {
+		if len(p.AllowedDriveFolders) == 0 {
+			return fmt.Errorf("%w: Drive sources aren't allowed", ErrURLNotAllowed)
+		}
+		folders, err := driveFileFolders(ctx, fileID)
+		if err != nil {
+			return err
+		}
+		for _, folder := range folders {
+			if slices.Contains(p.AllowedDriveFolders, folder) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: Drive file %s isn't in an allowed folder", ErrURLNotAllowed, fileID)
+	}
+	if IsGCSURI(source) {
+		bucket, _, _ := strings.Cut(strings.TrimPrefix(source, "gs://"), "/")
+		if !slices.Contains(p.AllowedBuckets, bucket) {
+			return fmt.Errorf("%w: bucket %s isn't allowed", ErrURLNotAllowed, bucket)
+		}
+	}
+	return nil
+}
+
+// CheckURL validates the scheme, host and port of a URL against the policy
+func (p *URLPolicy) CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", ErrURLNotAllowed, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in url", ErrURLNotAllowed)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrURLNotAllowed)
+	}
+	if hostMatches(host, p.DeniedHosts) {
+		return fmt.Errorf("%w: host %s is denied", ErrURLNotAllowed, host)
+	}
+	if len(p.AllowedHosts) > 0 && !hostMatches(host, p.AllowedHosts) {
+		return fmt.Errorf("%w: host %s is not in the allowlist", ErrURLNotAllowed, host)
+	}
+
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if u.Port() != "" {
+		var err error
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return fmt.Errorf("%w: port %q", ErrURLNotAllowed, u.Port())
+		}
+	}
+	if err := p.checkPort(port); err != nil {
+		return err
+	}
+
+	// literal addresses can be rejected before dialing
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+func (p *URLPolicy) checkPort(port int) error {
+	allowed := p.AllowedPorts
+	if len(allowed) == 0 {
+		allowed = []int{80, 443}
+	}
+	if !slices.Contains(allowed, port) {
+		return fmt.Errorf("%w: port %d", ErrURLNotAllowed, port)
+	}
+	return nil
+}
+
+func (p *URLPolicy) checkIP(ip net.IP) error {
+	if p.AllowPrivate {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		carrierGradeNAT.Contains(ip) {
+		return fmt.Errorf("%w: address %s is internal", ErrURLNotAllowed, ip)
+	}
+	return nil
+}
+
+// transport returns an http.Transport that checks every dialed address
+// against the policy, after DNS resolution, so hostnames that resolve to
+// internal addresses are rejected too
+func (p *URLPolicy) transport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("%w: unresolved address %s", ErrURLNotAllowed, host)
+			}
+			if err := p.checkIP(ip); err != nil {
+				return err
+			}
+			portnum, err := strconv.Atoi(port)
+			if err != nil {
+				return err
+			}
+			return p.checkPort(portnum)
+		},
+	}
+	return &http.Transport{
+		// no proxy, so dialed addresses are the real destinations
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verbalizer expands numbers with units, currency, percentages and dates into
+// words, which text-to-speech often misreads in technical papers, e.g. 3.5GHz,
+// $1.2B and 2024-06-01; it's a TextProcessor for English voices, text for
+// other languages is unchanged
+type Verbalizer struct {
+	// Language is the locale, e.g. en-GB, which orders dates; the voice's
+	// language when empty, and en-US if the voice name doesn't have one
+	Language string
+}
+
+var (
+	voiceLanguageRe = regexp.MustCompile(`^(?:[a-z]+:)?([a-z]{2,3}-[A-Z]{2})-`)
+	isoDateRe       = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	currencyRe      = regexp.MustCompile(`([$€£])(\d+(?:,\d{3})*(?:\.\d+)?)(?:\s?(K|M|B|T|k|bn|thousand|million|billion|trillion)\b)?`)
+	percentRe       = regexp.MustCompile(`\b(\d+(?:\.\d+)?)\s?%`)
+	unitRe          = regexp.MustCompile(`\b(\d+(?:,\d{3})*(?:\.\d+)?)\s?(GHz|MHz|kHz|Hz|TB|GB|MB|KB|kB|Tb|Gb|Mb|Gbps|Mbps|ms|µs|us|ns|km|cm|mm|nm|kg|mg|kW|MW|GW|mAh|°C|°F|fps|FLOPs|FLOPS|x)\b`)
+)
+
+// magnitude words, e.g. for $1.2B
+var magnitudes = map[string]string{
+	"K": "thousand", "k": "thousand", "thousand": "thousand",
+	"M": "million", "million": "million",
+	"B": "billion", "bn": "billion", "billion": "billion",
+	"T": "trillion", "trillion": "trillion",
+}
+
+// currencies are the singular and plural names of each symbol's units and cents
+var currencies = map[string][4]string{
+	"$": {"dollar", "dollars", "cent", "cents"},
+	"€": {"euro", "euros", "cent", "cents"},
+	"£": {"pound", "pounds", "penny", "pence"},
+}
+
+// units are spoken unit names
+var units = map[string]string{
+	"GHz": "gigahertz", "MHz": "megahertz", "kHz": "kilohertz", "Hz": "hertz",
+	"TB": "terabytes", "GB": "gigabytes", "MB": "megabytes", "KB": "kilobytes", "kB": "kilobytes",
+	"Tb": "terabits", "Gb": "gigabits", "Mb": "megabits", "Gbps": "gigabits per second", "Mbps": "megabits per second",
+	"ms": "milliseconds", "µs": "microseconds", "us": "microseconds", "ns": "nanoseconds",
+	"km": "kilometers", "cm": "centimeters", "mm": "millimeters", "nm": "nanometers",
+	"kg": "kilograms", "mg": "milligrams",
+	"kW": "kilowatts", "MW": "megawatts", "GW": "gigawatts", "mAh": "milliamp hours",
+	"°C": "degrees Celsius", "°F": "degrees Fahrenheit",
+	"fps": "frames per second", "FLOPs": "flops", "FLOPS": "flops",
+	"x": "times",
+}
+
+// Process verbalizes text for a voice
+func (v Verbalizer) Process(ctx context.Context, voice, text string) (string, error) {
+	language := v.Language
+	if language == "" {
+		language = "en-US"
+		if m := voiceLanguageRe.FindStringSubmatch(voice); m != nil {
+			language = m[1]
+		}
+	}
+	return Verbalize(text, language), nil
+}
+
+// Verbalize expands numbers with units, currency, percentages and ISO dates
+// in English text into words, for a locale such as en-US or en-GB
+func Verbalize(text, language string) string {
+	if !strings.HasPrefix(language, "en") {
+		return text
+	}
+	british := language != "en-US" && language != "en"
+
+	text = isoDateRe.ReplaceAllStringFunc(text, func(s string) string {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return s
+		}
+		if british {
+			return fmt.Sprintf("the %s of %s %s", ordinalWords(d.Day()), d.Month(), yearWords(d.Year()))
+		}
+		return fmt.Sprintf("%s %s, %s", d.Month(), ordinalWords(d.Day()), yearWords(d.Year()))
+	})
+	text = currencyRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := currencyRe.FindStringSubmatch(s)
+		names := currencies[m[1]]
+		amount := strings.ReplaceAll(m[2], ",", "")
+		if magnitude, ok := magnitudes[m[3]]; ok {
+			return numberWords(amount, british) + " " + magnitude + " " + names[1]
+		}
+		whole, cents, _ := strings.Cut(amount, ".")
+		spoken := numberWords(whole, british) + " " + plural(whole, names[0], names[1])
+		if len(cents) == 2 && cents != "00" {
+			cents = strings.TrimPrefix(cents, "0")
+			spoken += " and " + numberWords(cents, british) + " " + plural(cents, names[2], names[3])
+		} else if cents != "" && cents != "00" {
+			return numberWords(amount, british) + " " + names[1]
+		}
+		return spoken
+	})
+	text = percentRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := percentRe.FindStringSubmatch(s)
+		return numberWords(m[1], british) + " percent"
+	})
+	text = unitRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := unitRe.FindStringSubmatch(s)
+		amount := strings.ReplaceAll(m[1], ",", "")
+		unit := units[m[2]]
+		if amount == "1" && m[2] != "x" {
+			unit = singularUnit(unit)
+		}
+		return numberWords(amount, british) + " " + unit
+	})
+	return text
+}
+
+// singularUnit is a unit name for one, e.g. degree Celsius or gigabit per second
+func singularUnit(unit string) string {
+	first, rest, ok := strings.Cut(unit, " ")
+	if ok && (first == "degrees" || strings.HasPrefix(rest, "per ")) {
+		return strings.TrimSuffix(first, "s") + " " + rest
+	}
+	return strings.TrimSuffix(unit, "s")
+}
+
+// plural is the singular name for 1, else the plural
+func plural(amount, singular, plural string) string {
+	if amount == "1" {
+		return singular
+	}
+	return plural
+}
+
+var (
+	smallNumbers = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+		"eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	tens       = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	scales     = []string{"", "thousand", "million", "billion", "trillion"}
+	ordinalEnd = map[string]string{"one": "first", "two": "second", "three": "third", "five": "fifth", "eight": "eighth", "nine": "ninth", "twelve": "twelfth"}
+)
+
+// maxSpokenInteger is a thousand of the largest scale, a quadrillion
+const maxSpokenInteger = 1_000_000_000_000_000
+
+// numberWords speaks a decimal number, reading the digits after the point
+// one by one, e.g. three point one four
+func numberWords(number string, british bool) string {
+	whole, fraction, _ := strings.Cut(number, ".")
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return number
+	}
+	spoken := integerWords(n, british)
+	if fraction != "" {
+		digits := []string{}
+		for _, d := range fraction {
+			digits = append(digits, smallNumbers[d-'0'])
+		}
+		spoken += " point " + strings.Join(digits, " ")
+	}
+	return spoken
+}
+
+// integerWords speaks a whole number, e.g. one hundred twenty, or one hundred
+// and twenty in British English; numbers past the largest scale are left as
+// digits
+func integerWords(n int64, british bool) string {
+	if n >= maxSpokenInteger {
+		return strconv.FormatInt(n, 10)
+	}
+	if n < 20 {
+		return smallNumbers[n]
+	}
+	if n < 100 {
+		if n%10 == 0 {
+			return tens[n/10]
+		}
+		return tens[n/10] + "-" + smallNumbers[n%10]
+	}
+	if n < 1000 {
+		spoken := smallNumbers[n/100] + " hundred"
+		if n%100 != 0 {
+			if british {
+				spoken += " and"
+			}
+			spoken += " " + integerWords(n%100, british)
+		}
+		return spoken
+	}
+	parts := []string{}
+	for scale := 0; n > 0 && scale < len(scales); scale++ {
+		if group := n % 1000; group != 0 {
+			part := integerWords(group, british)
+			if scales[scale] != "" {
+				part += " " + scales[scale]
+			}
+			parts = append([]string{part}, parts...)
+		}
+		n /= 1000
+	}
+	return strings.Join(parts, " ")
+}
+
+// ordinalWords speaks a day of the month, e.g. twenty-first
+func ordinalWords(n int) string {
+	spoken := integerWords(int64(n), false)
+	head, last := "", spoken
+	if i := strings.LastIndexAny(spoken, " -"); i >= 0 {
+		head, last = spoken[:i+1], spoken[i+1:]
+	}
+	if ordinal, ok := ordinalEnd[last]; ok {
+		return head + ordinal
+	}
+	if strings.HasSuffix(last, "y") {
+		return head + strings.TrimSuffix(last, "y") + "ieth"
+	}
+	return head + last + "th"
+}
+
+// yearWords speaks a year the usual way, e.g. twenty twenty-four, two
+// thousand five or nineteen hundred
+func yearWords(year int) string {
+	switch {
+	case year >= 2000 && year < 2010:
+		return integerWords(int64(year), false)
+	case year < 1000 || year%1000 == 0:
+		return integerWords(int64(year), false)
+	case year%100 == 0:
+		return integerWords(int64(year/100), false) + " hundred"
+	case year%100 < 10:
+		return integerWords(int64(year/100), false) + " oh " + smallNumbers[year%10]
+	}
+	return integerWords(int64(year/100), false) + " " + integerWords(int64(year%100), false)
+}
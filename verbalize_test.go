@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIntegerWords(t *testing.T) {
+	tests := []struct {
+		n       int64
+		british bool
+		want    string
+	}{
+		{0, false, "zero"},
+		{21, false, "twenty-one"},
+		{120, false, "one hundred twenty"},
+		{120, true, "one hundred and twenty"},
+		{1_000_000, false, "one million"},
+		{2_000_000_000_001, false, "two trillion one"},
+		// the largest scale is trillion, a thousand of them is left as digits
+		{maxSpokenInteger - 1, false, "nine hundred ninety-nine trillion nine hundred ninety-nine billion nine hundred ninety-nine million nine hundred ninety-nine thousand nine hundred ninety-nine"},
+		{maxSpokenInteger, false, "1000000000000000"},
+		{maxSpokenInteger + 1, false, "1000000000000001"},
+		{maxSpokenInteger + 1, true, "1000000000000001"},
+	}
+	for _, tt := range tests {
+		if got := integerWords(tt.n, tt.british); got != tt.want {
+			t.Errorf("integerWords(%d, %t) = %q, want %q", tt.n, tt.british, got, tt.want)
+		}
+	}
+}
+
+func TestVerbalize(t *testing.T) {
+	tests := []struct {
+		text, language, want string
+	}{
+		{"growth of 12%", "en-US", "growth of twelve percent"},
+		{"a 3.5GHz chip", "en-US", "a three point five gigahertz chip"},
+		{"on 2024-06-01", "en-US", "on June first, twenty twenty-four"},
+		{"on 2024-06-01", "en-GB", "on the first of June twenty twenty-four"},
+		{"999999999999999%", "en-US", "nine hundred ninety-nine trillion nine hundred ninety-nine billion nine hundred ninety-nine million nine hundred ninety-nine thousand nine hundred ninety-nine percent"},
+		{"1000000000000000%", "en-US", "1000000000000000 percent"},
+		{"1000000000000001%", "en-US", "1000000000000001 percent"},
+		{"12%", "fr-FR", "12%"},
+	}
+	for _, tt := range tests {
+		if got := Verbalize(tt.text, tt.language); got != tt.want {
+			t.Errorf("Verbalize(%q, %s) = %q, want %q", tt.text, tt.language, got, tt.want)
+		}
+	}
+}
+
+// verbalize.go's license header has the year the rest of the package has
+func TestVerbalizeHeaderYear(t *testing.T) {
+	data, err := os.ReadFile("verbalize.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := "// Copyright 2024 Google LLC\n"; !strings.HasPrefix(string(data), header) {
+		first, _, _ := strings.Cut(string(data), "\n")
+		t.Errorf("verbalize.go starts %q, want %q", first, strings.TrimSpace(header))
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fabulae
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/moutend/go-wav"
+	"google.golang.org/api/option"
+	"google.golang.org/api/youtube/v3"
+)
+
+const (
+	// YouTube's limits on a video's title and description
+	maxVideoTitle       = 100
+	maxVideoDescription = 5000
+)
+
+var (
+	waveformBackground = color.RGBA{0x1d, 0x23, 0x33, 0xff}
+	waveformBars       = color.RGBA{0xf4, 0xa2, 0x61, 0xff}
+)
+
+// VideoFile is the video rendered for an audio file, e.g. episode.mp4
+func VideoFile(audiofile string) string {
+	return strings.TrimSuffix(audiofile, filepath.Ext(audiofile)) + ".mp4"
+}
+
+// WaveformImage draws a wav file's waveform as a 1280x720 PNG, a still for
+// episodes without cover art
+func WaveformImage(audiofile, outputfilename string) error {
+	data, err := os.ReadFile(audiofile)
+	if err != nil {
+		return err
+	}
+	w := &wav.File{}
+	if err := wav.Unmarshal(data, w); err != nil {
+		return fmt.Errorf("can't read %s: %w", audiofile, err)
+	}
+	const width, height, bars = 1280, 720, 128
+	// the RMS level of each bar's stretch of samples
+	samples := w.Int32s()
+	per := max(1, len(samples)/bars)
+	levels := make([]float64, bars)
+	loudest := 1e-9
+	for i := range levels {
+		from, to := min(len(samples), i*per), min(len(samples), (i+1)*per)
+		sum := 0.0
+		for _, s := range samples[from:to] {
+			v := float64(s) / math.MaxInt32
+			sum += v * v
+		}
+		if to > from {
+			levels[i] = math.Sqrt(sum / float64(to-from))
+		}
+		loudest = max(loudest, levels[i])
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{waveformBackground}, image.Point{}, draw.Src)
+	step := width / bars
+	for i, level := range levels {
+		h := max(4, int(level/loudest*height*0.6))
+		bar := image.Rect(i*step+2, (height-h)/2, (i+1)*step-2, (height+h)/2)
+		draw.Draw(img, bar, &image.Uniform{waveformBars}, image.Point{}, draw.Src)
+	}
+
+	f, err := os.Create(outputfilename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RenderVideo renders audio over a still image, e.g. cover art, as an H.264
+// MP4 for video sites; it uses ffmpeg
+func RenderVideo(ctx context.Context, audiofile, still, outputfilename string) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return ErrNoFFmpeg
+	}
+	args := []string{"-y", "-loglevel", "error",
+		"-loop", "1", "-framerate", "1", "-i", still, "-i", audiofile,
+		"-map", "0:v", "-map", "1:a",
+		"-c:v", "libx264", "-tune", "stillimage", "-pix_fmt", "yuv420p", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"-c:a", "aac", "-b:a", "192k", "-shortest", "-movflags", "+faststart", outputfilename}
+
+	debugf(DebugRequests, "ffmpeg %s", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	log.Printf("video written to %s", outputfilename)
+	return nil
+}
+
+// YouTubeUpload describes a video to upload to YouTube
+type YouTubeUpload struct {
+	Title       string
+	Description string
+	Tags        []string
+	Privacy     string // private, unlisted or public, default private
+	// Credentials are authorized user (OAuth) credentials with the
+	// youtube.upload scope for the channel, default application default credentials
+	Credentials string
+}
+
+// videoText makes text acceptable to YouTube, which refuses angle brackets
+// and text over its limits
+func videoText(s string, limit int) string {
+	s = strings.NewReplacer("<", "‹", ">", "›").Replace(strings.TrimSpace(s))
+	for len(s) > limit {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// UploadToYouTube uploads a video to the credentials' YouTube channel and
+// returns its URL
+func UploadToYouTube(ctx context.Context, videofile string, upload YouTubeUpload) (string, error) {
+	switch upload.Privacy {
+	case "":
+		upload.Privacy = "private"
+	case "private", "unlisted", "public":
+	default:
+		return "", fmt.Errorf("unknown YouTube privacy %q, use private, unlisted or public", upload.Privacy)
+	}
+	opts := []option.ClientOption{option.WithScopes(youtube.YoutubeUploadScope)}
+	if upload.Credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(upload.Credentials))
+	}
+	srv, err := youtube.NewService(ctx, opts...)
+	if err != nil {
+		return "", fmt.Errorf("unable to create YouTube client: %w", err)
+	}
+	f, err := os.Open(videofile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	video := &youtube.Video{
+		Snippet: &youtube.VideoSnippet{
+			Title:       videoText(upload.Title, maxVideoTitle),
+			Description: videoText(upload.Description, maxVideoDescription),
+			Tags:        upload.Tags,
+			CategoryId:  "27", // Education
+		},
+		Status: &youtube.VideoStatus{PrivacyStatus: upload.Privacy, SelfDeclaredMadeForKids: false, ForceSendFields: []string{"SelfDeclaredMadeForKids"}},
+	}
+	created, err := srv.Videos.Insert([]string{"snippet", "status"}, video).Media(f).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to upload %s to YouTube: %w", videofile, err)
+	}
+	link := "https://www.youtube.com/watch?v=" + created.Id
+	log.Printf("uploaded %s to YouTube, %s: %s", videofile, upload.Privacy, link)
+	return link, nil
+}